@@ -11,19 +11,50 @@ import (
 
 	"github.com/makeict/MESSforMakers/controllers"
 	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/payments"
 	"github.com/makeict/MESSforMakers/util"
 )
 
 // database connection, cookie store, etc..
 type application struct {
-	Logger  *util.Logger
-	DB      *sqlx.DB
-	Router  http.Handler
-	Config  *util.Config
-	UserC   controllers.UserController
-	StaticC controllers.StaticController
-	Session *sessions.Session
-	port    int
+	Logger         *util.Logger
+	DB             *sqlx.DB
+	Router         http.Handler
+	Config         *util.Config
+	UserC          controllers.UserController
+	StaticC        controllers.StaticController
+	PaymentC       controllers.PaymentController
+	LedgerC        controllers.LedgerController
+	RefundC        controllers.RefundController
+	DocumentC      controllers.DocumentController
+	ReportC        controllers.ReportController
+	ReminderC      controllers.ReminderController
+	OptionC        controllers.OptionController
+	AddonC         controllers.AddonController
+	RenewalC       controllers.RenewalController
+	LockerC        controllers.LockerController
+	DonationC      controllers.DonationController
+	DiscountC      controllers.DiscountController
+	MembershipC    controllers.MembershipController
+	AccountingC    controllers.AccountingController
+	BankC          controllers.BankController
+	VoucherC       controllers.VoucherController
+	LocationC      controllers.LocationController
+	AreaC          controllers.AreaController
+	EquipmentC     controllers.EquipmentController
+	MaintenanceC   controllers.MaintenanceController
+	ReservationC   controllers.ReservationController
+	CalendarC      controllers.CalendarController
+	HoursC         controllers.HoursController
+	KioskC         controllers.KioskController
+	RegistrationC  controllers.RegistrationController
+	CertificationC controllers.CertificationController
+	ApprovalC      controllers.ApprovalController
+	Session        *sessions.Session
+	Provider       payments.Provider
+	Mailer         util.Mailer
+	Texter         util.Texter
+	port           int
 }
 
 func newApplication(config *util.Config) (*application, error) {
@@ -56,7 +87,7 @@ func newApplication(config *util.Config) (*application, error) {
 	app.DB = db
 	app.port = config.App.Port
 
-	if err := app.UserC.Initialize(app.Config, &models.UserModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+	if err := app.UserC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.MembershipOptionModel{DB: app.DB}, &models.VoucherModel{DB: app.DB}, app.Logger, app.Session); err != nil {
 		app.Logger.Fatalf("Failed to initialize user controller: %v", err)
 	}
 
@@ -64,8 +95,204 @@ func newApplication(config *util.Config) (*application, error) {
 		app.Logger.Fatalf("Failed to initialize controller for static routes: %v", err)
 	}
 
+	//set up the online payment provider. The fake provider marks invoices paid without taking any money, so it has to
+	//be asked for by name rather than being what a missing or misspelled provider falls back to
+	switch config.Payments.Provider {
+	case "stripe":
+		app.Provider = payments.NewStripe(config.Payments.SecretKey, config.Payments.WebhookSecret, config.Payments.Currency)
+	case "fake":
+		app.Provider = payments.NewFake(config.Payments.WebhookSecret, fmt.Sprintf("http://%s:%d/", config.App.Host, config.App.Port))
+	default:
+		return nil, fmt.Errorf("Unknown payment provider %q, expected \"stripe\" or \"fake\"", config.Payments.Provider)
+	}
+
+	app.Mailer = util.NewMailer(config, app.Logger)
+	app.Texter = util.NewTexter(config, app.Logger)
+
+	if err := app.DocumentC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.InvoiceModel{DB: app.DB}, &models.PaymentModel{DB: app.DB}, &models.DonationModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Mailer, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize document controller: %v", err)
+	}
+
+	if err := app.PaymentC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.InvoiceModel{DB: app.DB}, &models.PaymentModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Provider, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize payment controller: %v", err)
+	}
+	app.PaymentC.Receipts = &app.DocumentC
+
+	if err := app.LedgerC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.LedgerModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize ledger controller: %v", err)
+	}
+
+	if err := app.RefundC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.RefundModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Provider, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize refund controller: %v", err)
+	}
+
+	if err := app.ReportC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.ReportModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize report controller: %v", err)
+	}
+
+	if err := app.ReminderC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.ReminderModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Mailer, app.Texter, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize reminder controller: %v", err)
+	}
+
+	if err := app.OptionC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.MembershipOptionModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize membership option controller: %v", err)
+	}
+
+	if err := app.AddonC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.AddonModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, &app.DocumentC, app.Mailer, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize addon controller: %v", err)
+	}
+
+	if err := app.RenewalC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.RenewalModel{DB: app.DB}, &models.MembershipModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, &app.DocumentC, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize renewal controller: %v", err)
+	}
+
+	if err := app.LockerC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.LockerModel{DB: app.DB}, &models.AreaModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Mailer, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize locker controller: %v", err)
+	}
+
+	if err := app.DonationC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.DonationModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, &app.DocumentC, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize donation controller: %v", err)
+	}
+
+	if err := app.DiscountC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.DiscountModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize discount controller: %v", err)
+	}
+
+	if err := app.MembershipC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.MembershipModel{DB: app.DB}, &models.MembershipOptionModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, &app.DocumentC, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize membership controller: %v", err)
+	}
+
+	if err := app.AccountingC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.AccountingModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize accounting controller: %v", err)
+	}
+
+	if err := app.BankC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.BankModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize bank controller: %v", err)
+	}
+
+	if err := app.VoucherC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.VoucherModel{DB: app.DB}, &models.MembershipOptionModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, &app.DocumentC, app.Mailer, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize voucher controller: %v", err)
+	}
+
+	if err := app.LocationC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.LocationModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize location controller: %v", err)
+	}
+
+	if err := app.AreaC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.AreaModel{DB: app.DB}, &models.LocationModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize area controller: %v", err)
+	}
+
+	if err := app.EquipmentC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.EquipmentModel{DB: app.DB}, &models.AreaModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize equipment controller: %v", err)
+	}
+
+	if err := app.MaintenanceC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.MaintenanceModel{DB: app.DB}, &models.EquipmentModel{DB: app.DB}, &models.AreaModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Mailer, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize maintenance controller: %v", err)
+	}
+
+	if err := app.ReservationC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.ReservationModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize reservation controller: %v", err)
+	}
+
+	if err := app.CalendarC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.CalendarModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize calendar controller: %v", err)
+	}
+
+	if err := app.HoursC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.HoursModel{DB: app.DB}, &models.LocationModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize hours controller: %v", err)
+	}
+
+	if err := app.KioskC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.KioskModel{DB: app.DB}, &models.LocationModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize kiosk controller: %v", err)
+	}
+
+	if err := app.RegistrationC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.RegistrationModel{DB: app.DB}, &models.VoucherModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize registration controller: %v", err)
+	}
+
+	if err := app.CertificationC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.CertificationModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize certification controller: %v", err)
+	}
+
+	if err := app.ApprovalC.Initialize(app.Config, &models.UserModel{DB: app.DB}, &models.ApprovalModel{DB: app.DB}, &models.RBACModel{DB: app.DB}, app.Mailer, app.Logger, app.Session); err != nil {
+		app.Logger.Fatalf("Failed to initialize approval controller: %v", err)
+	}
+
 	//initialize all the routes
 	app.appRouter()
 
 	return &app, nil
 }
+
+// sendReminders checks for payment reminders to send every few minutes, as set in the configuration. Runs until the program exits.
+func (app *application) sendReminders() {
+	interval := time.Duration(app.Config.Reminders.IntervalMinutes) * time.Minute
+	for {
+		sent, err := app.ReminderC.Run(time.Now())
+		if err != nil {
+			app.Logger.Printf("Could not send payment reminders: %v", err)
+		} else if sent > 0 {
+			app.Logger.Printf("Sent %d payment reminders", sent)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// invoiceRenewals checks for recurring memberships to invoice every few minutes, as set in the configuration. Runs until the program exits.
+func (app *application) invoiceRenewals() {
+	interval := time.Duration(app.Config.Billing.IntervalMinutes) * time.Minute
+	for {
+		created, err := app.RenewalC.Run(time.Now())
+		if err != nil {
+			app.Logger.Printf("Could not invoice renewals: %v", err)
+		} else if created > 0 {
+			app.Logger.Printf("Created %d renewal invoices", created)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// manageLockers releases lapsed lockers and offers free ones to the waitlist every few minutes, as set in the configuration.
+// Runs until the program exits.
+func (app *application) manageLockers() {
+	interval := time.Duration(app.Config.Lockers.IntervalMinutes) * time.Minute
+	for {
+		released, err := app.LockerC.Run(time.Now())
+		if err != nil {
+			app.Logger.Printf("Could not release lapsed lockers: %v", err)
+		} else if released > 0 {
+			app.Logger.Printf("Released %d lapsed lockers", released)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// remindMaintenance emails stewards about preventive maintenance coming due every few minutes, as set in the
+// configuration. Runs until the program exits.
+func (app *application) remindMaintenance() {
+	interval := time.Duration(app.Config.Maintenance.IntervalMinutes) * time.Minute
+	for {
+		sent, err := app.MaintenanceC.Run(time.Now())
+		if err != nil {
+			app.Logger.Printf("Could not send maintenance reminders: %v", err)
+		} else if sent > 0 {
+			app.Logger.Printf("Sent %d maintenance reminders", sent)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// remindCertifications emails members whose certifications are about to expire every few minutes, as set in the
+// configuration. Runs until the program exits.
+func (app *application) remindCertifications() {
+	interval := time.Duration(app.Config.Certifications.IntervalMinutes) * time.Minute
+	for {
+		sent, err := app.ApprovalC.Run(time.Now())
+		if err != nil {
+			app.Logger.Printf("Could not send certification renewal reminders: %v", err)
+		} else if sent > 0 {
+			app.Logger.Printf("Sent %d certification renewal reminders", sent)
+		}
+		time.Sleep(interval)
+	}
+}
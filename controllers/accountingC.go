@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golangcollege/sessions"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//AccountingController implements the handlers for exporting transactions to the bookkeeper's accounting software
+type AccountingController struct {
+	Controller
+	Accounting     Accounting
+	AccountingView views.View
+}
+
+// accountMapping is how one of our account keys is mapped to the chart of accounts, for checking the configuration
+type accountMapping struct {
+	Key     string
+	Account string
+	Mapped  bool
+}
+
+//Initialize performs the required setup for an accounting controller
+func (ac *AccountingController) Initialize(cfg *util.Config, um Users, am Accounting, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	ac.setup(cfg, um, l, s)
+	ac.Accounting = am
+	ac.Permissions = pm
+
+	ac.AccountingView = views.View{}
+
+	if err := ac.AccountingView.LoadTemplates("accounting"); err != nil {
+		return fmt.Errorf("Error loading accounting templates: %v", err)
+	}
+
+	return nil
+}
+
+// account maps an account key to the chart of accounts in the configuration. Unmapped income categories use the
+// "other" account, and anything still unmapped is exported under its key so that nothing is lost.
+func (ac *AccountingController) account(key string) (string, bool) {
+	cfg := ac.AppConfig.Accounting
+	switch {
+	case key == models.AccountReceivable:
+		if cfg.Receivable != "" {
+			return cfg.Receivable, true
+		}
+	case strings.HasPrefix(key, "deposit:"):
+		if a := cfg.Deposit[strings.TrimPrefix(key, "deposit:")]; a != "" {
+			return a, true
+		}
+	default:
+		if a := cfg.Income[key]; a != "" {
+			return a, true
+		}
+		if a := cfg.Income["other"]; a != "" {
+			return a, false
+		}
+	}
+	return key, false
+}
+
+//Export shows the date range to export, and how the accounts used in it map to the chart of accounts
+func (ac *AccountingController) Export() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "finance.read") {
+			ac.forbidden(w)
+			return
+		}
+
+		from, to := dateRange(r)
+		txns, err := ac.Accounting.Transactions(from, to)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		counts := map[string]int{}
+		keys := map[string]bool{}
+		for _, t := range txns {
+			counts[t.Kind]++
+			for _, s := range t.Splits {
+				keys[s.Account] = true
+			}
+		}
+		mappings := []accountMapping{}
+		for k := range keys {
+			a, ok := ac.account(k)
+			mappings = append(mappings, accountMapping{Key: k, Account: a, Mapped: ok})
+		}
+		sort.Slice(mappings, func(i, j int) bool { return mappings[i].Key < mappings[j].Key })
+
+		td, err := ac.DefaultData(r)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Accounting Export"
+		td.Add("From", from)
+		td.Add("To", to)
+		td.Add("Counts", counts)
+		td.Add("Mappings", mappings)
+
+		if err := ac.AccountingView.Render(w, r, "export.gohtml", td); err != nil {
+			ac.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Download exports the transactions in the date range as a general ledger CSV, or as a QuickBooks IIF file
+//of general journal entries
+func (ac *AccountingController) Download(format string) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "finance.read") {
+			ac.forbidden(w)
+			return
+		}
+
+		from, to := dateRange(r)
+		txns, err := ac.Accounting.Transactions(from, to)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		filename := fmt.Sprintf("transactions-%s-to-%s.%s", from.Format("2006-01-02"), to.Format("2006-01-02"), format)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		if format == "iif" {
+			w.Header().Set("Content-Type", "text/plain")
+			ac.writeIIF(w, txns)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		ac.writeCSV(w, txns)
+	})
+}
+
+// docNum is the reference for a transaction, like INV-12
+func docNum(t *models.GLTransaction) string {
+	prefix := map[string]string{"invoice": "INV", "payment": "PMT", "refund": "REF"}[t.Kind]
+	return fmt.Sprintf("%s-%d", prefix, t.Ref)
+}
+
+func (ac *AccountingController) writeCSV(w http.ResponseWriter, txns []models.GLTransaction) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"Date", "Type", "Reference", "Member", "Account", "Description", "Debit", "Credit"})
+	for i := range txns {
+		t := &txns[i]
+		for _, s := range t.Splits {
+			a, _ := ac.account(s.Account)
+			debit, credit := "", ""
+			if s.Amount >= 0 {
+				debit = s.Amount.Decimal()
+			} else {
+				credit = (-s.Amount).Decimal()
+			}
+			cw.Write([]string{t.Date.Format("2006-01-02"), t.Kind, docNum(t), spreadsheetText(t.Member), spreadsheetText(a), spreadsheetText(t.Memo), debit, credit})
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		ac.Logger.Printf("could not write accounting csv: %v", err)
+	}
+}
+
+// iifField keeps tabs and line breaks out of a tab separated IIF field, and formulas out of the spreadsheet it may
+// be opened in
+func iifField(s string) string {
+	return spreadsheetText(strings.NewReplacer("\t", " ", "\r", " ", "\n", " ", `"`, "'").Replace(s))
+}
+
+func (ac *AccountingController) writeIIF(w http.ResponseWriter, txns []models.GLTransaction) {
+	var b strings.Builder
+	b.WriteString("!TRNS\tTRNSID\tTRNSTYPE\tDATE\tACCNT\tNAME\tAMOUNT\tDOCNUM\tMEMO\r\n")
+	b.WriteString("!SPL\tSPLID\tTRNSTYPE\tDATE\tACCNT\tNAME\tAMOUNT\tDOCNUM\tMEMO\r\n")
+	b.WriteString("!ENDTRNS\r\n")
+	for i := range txns {
+		t := &txns[i]
+		for j, s := range t.Splits {
+			kind := "SPL"
+			if j == 0 {
+				kind = "TRNS"
+			}
+			a, _ := ac.account(s.Account)
+			fields := []string{kind, "", "GENERAL JOURNAL", t.Date.Format("01/02/2006"), iifField(a), iifField(t.Member), s.Amount.Decimal(), docNum(t), iifField(t.Memo)}
+			b.WriteString(strings.Join(fields, "\t"))
+			b.WriteString("\r\n")
+		}
+		b.WriteString("ENDTRNS\r\n")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		ac.Logger.Printf("could not write accounting iif: %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+package controllers
+
+import "testing"
+
+func TestSpreadsheetText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Pat Smith", "Pat Smith"},
+		{"", ""},
+		{"=HYPERLINK(\"http://example.com\")", "'=HYPERLINK(\"http://example.com\")"},
+		{"+1 555 1234", "'+1 555 1234"},
+		{"-2+3", "'-2+3"},
+		{"@SUM(A1:A2)", "'@SUM(A1:A2)"},
+		{"\t=1", "'\t=1"},
+		{"Dues = 40", "Dues = 40"},
+	}
+	for _, tt := range tests {
+		if got := spreadsheetText(tt.in); got != tt.want {
+			t.Errorf("spreadsheetText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if got := iifField("=cmd\t|x"); got != "'=cmd |x" {
+		t.Errorf("iifField() = %q", got)
+	}
+}
@@ -0,0 +1,398 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//AddonController implements the handlers for the addon catalog and for members adding and removing addons
+type AddonController struct {
+	Controller
+	Addons    Addons
+	Invoices  InvoiceSender
+	Mailer    util.Mailer
+	AddonView views.View
+}
+
+//Initialize performs the required setup for an addon controller
+func (ac *AddonController) Initialize(cfg *util.Config, um Users, am Addons, pm Permissions, is InvoiceSender, m util.Mailer, l *util.Logger, s *sessions.Session) error {
+	ac.setup(cfg, um, l, s)
+	ac.Addons = am
+	ac.Permissions = pm
+	ac.Invoices = is
+	ac.Mailer = m
+
+	ac.AddonView = views.View{}
+
+	if err := ac.AddonView.LoadTemplates("addon"); err != nil {
+		return fmt.Errorf("Error loading addon templates: %v", err)
+	}
+
+	return nil
+}
+
+//List shows the whole addon catalog, including retired addons
+func (ac *AddonController) List() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "membership.write") {
+			ac.forbidden(w)
+			return
+		}
+
+		addons, err := ac.Addons.All()
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		td, err := ac.DefaultData(r)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Addons"
+		td.Add("Addons", addons)
+
+		if err := ac.AddonView.Render(w, r, "addons.gohtml", td); err != nil {
+			ac.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Form displays the form for a new addon, or for editing an existing one
+func (ac *AddonController) Form() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "membership.write") {
+			ac.forbidden(w)
+			return
+		}
+
+		form := util.NewForm(url.Values{})
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			id, ok := util.IntOK(idStr, 1, math.MaxInt32)
+			if !ok {
+				ac.clientError(w, http.StatusBadRequest)
+				return
+			}
+			a, err := ac.Addons.Get(id)
+			if err != nil {
+				ac.notFound(w)
+				return
+			}
+			form.Set("id", strconv.Itoa(a.ID))
+			form.Set("name", a.Name)
+			form.Set("monthlycost", a.MonthlyCost.Decimal())
+			if a.Capacity != nil {
+				form.Set("capacity", strconv.Itoa(*a.Capacity))
+			}
+		}
+
+		ac.renderForm(w, r, form)
+	})
+}
+
+func (ac *AddonController) renderForm(w http.ResponseWriter, r *http.Request, form *util.Form) {
+	td, err := ac.DefaultData(r)
+	if err != nil {
+		ac.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Addon"
+	td.Add("Form", form)
+
+	if err := ac.AddonView.Render(w, r, "addon_form.gohtml", td); err != nil {
+		ac.serverError(w, err)
+		return
+	}
+}
+
+//Save validates and saves a new or edited addon
+func (ac *AddonController) Save() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "membership.write") {
+			ac.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("name", "monthlycost")
+		form.MaxLength("name", 255)
+
+		a := &models.Addon{Name: form.Get("name")}
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			a.ID, _ = util.IntOK(idStr, 1, math.MaxInt32)
+			form.Set("id", idStr)
+		}
+		if c := form.Get("monthlycost"); c != "" {
+			cost, err := models.ParseMoney(c)
+			if err != nil || cost < 0 {
+				form.Errors.Add("monthlycost", "Must be an amount of money, like 5.00")
+			}
+			a.MonthlyCost = cost
+		}
+		if c := form.Get("capacity"); c != "" {
+			n, ok := util.IntOK(c, 1, 10000)
+			if !ok {
+				form.Errors.Add("capacity", "Must be a number of members, or empty for no limit")
+			}
+			a.Capacity = &n
+		}
+
+		if !form.Valid() {
+			ac.renderForm(w, r, form)
+			return
+		}
+
+		var err error
+		if a.ID == 0 {
+			err = ac.Addons.Create(a)
+		} else {
+			err = ac.Addons.Update(a)
+		}
+		if err != nil {
+			form.Errors.Add("saveError", err.Error())
+			ac.renderForm(w, r, form)
+			return
+		}
+
+		ac.Session.Put(r, "flash", "Addon saved")
+		http.Redirect(w, r, ac.rootURL()+"addons", http.StatusSeeOther)
+	})
+}
+
+//SetActive retires an addon so that members can no longer add it, or offers it again.
+//Members who already have a retired addon keep it until they remove it.
+func (ac *AddonController) SetActive(active bool) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "membership.write") {
+			ac.forbidden(w)
+			return
+		}
+
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if err := ac.Addons.SetActive(id, active); err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		if active {
+			ac.Session.Put(r, "flash", "Addon is offered again")
+		} else {
+			ac.Session.Put(r, "flash", "Addon retired")
+		}
+		http.Redirect(w, r, ac.rootURL()+"addons", http.StatusSeeOther)
+	})
+}
+
+//ForMember shows the addons a member has, the ones they are waiting for, and the ones they can add
+func (ac *AddonController) ForMember() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !ac.canAccessMember(r, id, "membership.write") {
+			ac.forbidden(w)
+			return
+		}
+
+		current, err := ac.Addons.ForMember(id)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		waiting, err := ac.Addons.Waitlisted(id)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		catalog, err := ac.Addons.All()
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		// only offer addons the member does not already have or wait for
+		taken := map[int]bool{}
+		for _, a := range current {
+			taken[a.AddonID] = true
+		}
+		for _, a := range waiting {
+			taken[a.AddonID] = true
+		}
+		available := []models.Addon{}
+		for _, a := range catalog {
+			if a.Active && !taken[a.ID] {
+				available = append(available, a)
+			}
+		}
+
+		td, err := ac.DefaultData(r)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Addons"
+		td.Add("MemberID", id)
+		td.Add("Current", current)
+		td.Add("Waiting", waiting)
+		td.Add("Available", available)
+
+		if err := ac.AddonView.Render(w, r, "member_addons.gohtml", td); err != nil {
+			ac.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Add gives a member an addon, or puts them on the waitlist if it is full. The prorated charge for the rest of
+//the current dues period is invoiced straight away.
+func (ac *AddonController) Add() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !ac.canAccessMember(r, id, "membership.write") {
+			ac.forbidden(w)
+			return
+		}
+		r.ParseForm()
+		addonID, ok := util.IntOK(r.PostForm.Get("addon"), 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		redirect := fmt.Sprintf("%suser/%d/addons", ac.rootURL(), id)
+
+		change, err := ac.Addons.Add(id, addonID, time.Now())
+		if err == models.ErrAddonUnavailable {
+			ac.Session.Put(r, "flash", err.Error())
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		switch {
+		case change.Waitlisted:
+			ac.Session.Put(r, "flash", "That addon is full, so you have been put on the waitlist. We will let you know when a place comes free.")
+		case change.Invoice != nil:
+			ac.Session.Put(r, "flash", fmt.Sprintf("Addon added. An invoice for %s covers the rest of the current dues period.", change.Invoice.Amount))
+			redirect = fmt.Sprintf("%sinvoice/%d", ac.rootURL(), change.Invoice.ID)
+		default:
+			ac.Session.Put(r, "flash", "Addon added. It will be charged with your next dues.")
+		}
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+	})
+}
+
+//Remove ends a member's addon. The unused part of the current dues period is credited against their next renewal.
+func (ac *AddonController) Remove() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok1 := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		aid, ok2 := util.IntOK(mux.Vars(r)["aid"], 1, math.MaxInt32)
+		if !ok1 || !ok2 {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !ac.canAccessMember(r, id, "membership.write") {
+			ac.forbidden(w)
+			return
+		}
+		redirect := fmt.Sprintf("%suser/%d/addons", ac.rootURL(), id)
+
+		change, err := ac.Addons.Remove(id, aid, time.Now())
+		if err == models.ErrAddonUnavailable {
+			ac.notFound(w)
+			return
+		}
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		if change.Promoted != nil {
+			ac.notifyPromoted(change.Promoted, aid)
+		}
+
+		if change.Credit > 0 {
+			ac.Session.Put(r, "flash", fmt.Sprintf("Addon removed. %s will be taken off your next dues.", change.Credit))
+		} else {
+			ac.Session.Put(r, "flash", "Addon removed")
+		}
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+	})
+}
+
+//LeaveWaitlist takes a member off an addon's waitlist
+func (ac *AddonController) LeaveWaitlist() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok1 := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		aid, ok2 := util.IntOK(mux.Vars(r)["aid"], 1, math.MaxInt32)
+		if !ok1 || !ok2 {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !ac.canAccessMember(r, id, "membership.write") {
+			ac.forbidden(w)
+			return
+		}
+		if err := ac.Addons.LeaveWaitlist(id, aid); err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		ac.Session.Put(r, "flash", "You have left the waitlist")
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/addons", ac.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+// notifyPromoted lets a waitlisted member know they have been given an addon, with the invoice for it if there is one.
+// Failures are only logged because the addon has already been given.
+func (ac *AddonController) notifyPromoted(p *models.AddonPromotion, addonID int) {
+	if p.Invoice != nil {
+		if err := ac.Invoices.SendInvoice(p.Invoice); err != nil {
+			ac.Logger.Printf("could not email invoice %d: %v", p.Invoice.ID, err)
+		}
+	}
+
+	u, err := ac.Users.Get(p.MemberID)
+	if err != nil {
+		ac.Logger.Printf("could not notify member %d about addon %d: %v", p.MemberID, addonID, err)
+		return
+	}
+	a, err := ac.Addons.Get(addonID)
+	if err != nil {
+		ac.Logger.Printf("could not notify member %d about addon %d: %v", p.MemberID, addonID, err)
+		return
+	}
+	err = ac.Mailer.Send(&util.Message{
+		To:      []string{u.Email},
+		Subject: fmt.Sprintf("A %s place is yours", a.Name),
+		Body: fmt.Sprintf("Hi %s,\n\nA place came free and you were next on the waitlist, so %s has been added to your membership. "+
+			"You can see your addons at %suser/%d/addons\n", u.Name, a.Name, ac.rootURL(), u.ID),
+	})
+	if err != nil {
+		ac.Logger.Printf("could not notify member %d about addon %d: %v", p.MemberID, addonID, err)
+	}
+}
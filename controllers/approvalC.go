@@ -0,0 +1,406 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//ApprovalController implements the handlers for members asking to be certified, approvers signing them off,
+//renewing and revoking certifications, and checking whether a member is certified to use an area or piece of equipment
+type ApprovalController struct {
+	Controller
+	Approvals    Approvals
+	Mailer       util.Mailer
+	ApprovalView views.View
+}
+
+//Initialize performs the required setup for an approval controller
+func (ac *ApprovalController) Initialize(cfg *util.Config, um Users, am Approvals, pm Permissions, m util.Mailer, l *util.Logger, s *sessions.Session) error {
+	ac.setup(cfg, um, l, s)
+	ac.Approvals = am
+	ac.Permissions = pm
+	ac.Mailer = m
+
+	ac.ApprovalView = views.View{}
+
+	if err := ac.ApprovalView.LoadTemplates("approval"); err != nil {
+		return fmt.Errorf("Error loading approval templates: %v", err)
+	}
+
+	return nil
+}
+
+//Request asks for a member to be signed off on a certification, or signed off again once it has expired. Members ask
+//for themselves; approvers can start a request for the member number in the "member" field, such as after teaching
+//a class.
+func (ac *ApprovalController) Request() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedBy := ac.authenticatedUserID(r)
+		memberID := requestedBy
+		if memberID == 0 {
+			ac.forbidden(w)
+			return
+		}
+		certificationID, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		r.ParseForm()
+		approver := ac.can(r, "certification.approve")
+		if m := strings.TrimSpace(r.PostForm.Get("member")); m != "" && approver {
+			if memberID, ok = util.IntOK(m, 1, math.MaxInt32); !ok {
+				ac.Session.Put(r, "flash", models.ErrNoSuchMember.Error())
+				http.Redirect(w, r, fmt.Sprintf("%scertification/%d", ac.rootURL(), certificationID), http.StatusSeeOther)
+				return
+			}
+		}
+
+		id, err := ac.Approvals.Request(memberID, certificationID, requestedBy)
+		if err == models.ErrAlreadyRequested || err == models.ErrNoSuchMember {
+			ac.Session.Put(r, "flash", err.Error())
+			http.Redirect(w, r, fmt.Sprintf("%scertification/%d", ac.rootURL(), certificationID), http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		ac.Session.Put(r, "flash", "Sign-off requested")
+		if approver {
+			http.Redirect(w, r, fmt.Sprintf("%sapproval/%d", ac.rootURL(), id), http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/certifications", ac.rootURL(), memberID), http.StatusSeeOther)
+	})
+}
+
+//Pending lists the requests waiting for approval, oldest first, for approvers to work through
+func (ac *ApprovalController) Pending() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "certification.approve") {
+			ac.forbidden(w)
+			return
+		}
+
+		pending, err := ac.Approvals.Pending()
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		td, err := ac.DefaultData(r)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Certification requests"
+		td.Add("Pending", pending)
+
+		if err := ac.ApprovalView.Render(w, r, "pending.gohtml", td); err != nil {
+			ac.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Show displays a member certification with every review of it. The member and approvers can see it, and approvers
+//can review it from here.
+func (ac *ApprovalController) Show() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		mc, err := ac.Approvals.Get(id)
+		if err != nil {
+			ac.notFound(w)
+			return
+		}
+		if !ac.canAccessMember(r, mc.MemberID, "certification.approve") {
+			ac.forbidden(w)
+			return
+		}
+
+		approvals, err := ac.Approvals.Approvals(id)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		missing, err := ac.Approvals.MissingPrerequisites(id)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		td, err := ac.DefaultData(r)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		td.PageTitle = mc.Certification + " for " + mc.Member
+		td.Add("Certification", mc)
+		td.Add("Approvals", approvals)
+		td.Add("Missing", missing)
+		td.Add("CanReview", mc.Status == "pending" && mc.MemberID != ac.authenticatedUserID(r) && ac.can(r, "certification.approve"))
+		td.Add("CanRenew", mc.Status == "approved" && mc.ValidDays != nil && ac.can(r, "certification.approve"))
+		td.Add("CanRevoke", ac.can(r, "certification.write"))
+
+		if err := ac.ApprovalView.Render(w, r, "approval.gohtml", td); err != nil {
+			ac.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Review records the logged in approver signing off ("decision" is approve) or rejecting ("decision" is reject) a
+//member certification. Notes are needed to reject it, so the member knows what to work on.
+func (ac *ApprovalController) Review() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "certification.approve") {
+			ac.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		r.ParseForm()
+		decision := r.PostForm.Get("decision")
+		notes := strings.TrimSpace(r.PostForm.Get("notes"))
+		if decision != "approve" && decision != "reject" {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if decision == "reject" && notes == "" {
+			ac.Session.Put(r, "flash", "Add notes saying why it is rejected")
+			http.Redirect(w, r, fmt.Sprintf("%sapproval/%d", ac.rootURL(), id), http.StatusSeeOther)
+			return
+		}
+
+		status, err := ac.Approvals.Review(id, ac.authenticatedUserID(r), decision == "approve", notes)
+		switch err {
+		case nil:
+		case models.ErrNotPending, models.ErrAlreadyReviewed, models.ErrOwnCertification, models.ErrPrerequisitesMissing:
+			ac.Session.Put(r, "flash", err.Error())
+			http.Redirect(w, r, fmt.Sprintf("%sapproval/%d", ac.rootURL(), id), http.StatusSeeOther)
+			return
+		default:
+			ac.serverError(w, err)
+			return
+		}
+
+		switch status {
+		case "approved":
+			ac.Session.Put(r, "flash", "Certification approved")
+		case "rejected":
+			ac.Session.Put(r, "flash", "Certification rejected")
+		default:
+			ac.Session.Put(r, "flash", "Signed off. It needs another approver to sign off too.")
+		}
+		http.Redirect(w, r, fmt.Sprintf("%sapprovals", ac.rootURL()), http.StatusSeeOther)
+	})
+}
+
+//Renew extends an approved certification by another validity period, such as after the member shows an approver
+//they still use the tool safely. Renewing before it expires does not lose any time.
+func (ac *ApprovalController) Renew() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "certification.approve") {
+			ac.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		r.ParseForm()
+		err := ac.Approvals.Renew(id, ac.authenticatedUserID(r), strings.TrimSpace(r.PostForm.Get("notes")))
+		switch err {
+		case nil:
+			ac.Session.Put(r, "flash", "Certification renewed")
+		case models.ErrNotHeld, models.ErrNeverExpires:
+			ac.Session.Put(r, "flash", err.Error())
+		default:
+			ac.serverError(w, err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("%sapproval/%d", ac.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+//Revoke takes away a member's certification, such as after a safety violation. A reason is needed, and is kept in
+//the member's history.
+func (ac *ApprovalController) Revoke() func(http.ResponseWriter, *http.Request) {
+	return ac.changeStatus(ac.Approvals.Revoke, "Certification revoked")
+}
+
+//Reinstate gives back a revoked certification. A reason is needed, and is kept in the member's history.
+func (ac *ApprovalController) Reinstate() func(http.ResponseWriter, *http.Request) {
+	return ac.changeStatus(ac.Approvals.Reinstate, "Certification reinstated")
+}
+
+// changeStatus handles revoking or reinstating a member certification with the reason in the "reason" field
+func (ac *ApprovalController) changeStatus(change func(int, int, string) error, done string) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "certification.write") {
+			ac.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		r.ParseForm()
+		reason := strings.TrimSpace(r.PostForm.Get("reason"))
+		if reason == "" {
+			ac.Session.Put(r, "flash", "Add a reason, so the member and other approvers know why")
+			http.Redirect(w, r, fmt.Sprintf("%sapproval/%d", ac.rootURL(), id), http.StatusSeeOther)
+			return
+		}
+
+		err := change(id, ac.authenticatedUserID(r), reason)
+		switch err {
+		case nil:
+			ac.Session.Put(r, "flash", done)
+		case models.ErrNotHeld, models.ErrNotRevoked:
+			ac.Session.Put(r, "flash", err.Error())
+		default:
+			ac.serverError(w, err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("%sapproval/%d", ac.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+//ForMember shows the certifications a member holds or has asked for, and everything that has happened to them
+func (ac *ApprovalController) ForMember() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !ac.canAccessMember(r, id, "certification.approve") {
+			ac.forbidden(w)
+			return
+		}
+
+		certifications, err := ac.Approvals.ForMember(id)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		history, err := ac.Approvals.History(id)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		td, err := ac.DefaultData(r)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Certifications"
+		td.Add("MemberID", id)
+		td.Add("Certifications", certifications)
+		td.Add("History", history)
+
+		if err := ac.ApprovalView.Render(w, r, "member_certifications.gohtml", td); err != nil {
+			ac.serverError(w, err)
+			return
+		}
+	})
+}
+
+// access is the answer to whether a member can use an area or piece of equipment
+type access struct {
+	MemberID int      `json:"member_id"`
+	Kind     string   `json:"kind"`
+	ID       int      `json:"id"`
+	Allowed  bool     `json:"allowed"`
+	Missing  []string `json:"missing"` // the certifications the member still needs
+}
+
+//Access writes whether a member is certified to use an area or piece of equipment as JSON, for door and tool
+//controllers. Members can check themselves; space managers can check anyone.
+func (ac *ApprovalController) Access(kind string) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		memberID, ok := util.IntOK(mux.Vars(r)["mid"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !ac.canAccessMember(r, memberID, "space.write") {
+			ac.forbidden(w)
+			return
+		}
+
+		missing, err := ac.Approvals.Missing(memberID, kind, id)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		a := access{MemberID: memberID, Kind: kind, ID: id, Allowed: len(missing) == 0, Missing: missing}
+		if err := json.NewEncoder(w).Encode(a); err != nil {
+			ac.Logger.Printf("could not write access for member %d to %s %d: %v", memberID, kind, id, err)
+		}
+	})
+}
+
+//Run emails members whose certifications expire within the configured number of days, once for each expiry.
+//Returns how many reminders were sent.
+func (ac *ApprovalController) Run(now time.Time) (int, error) {
+	days := ac.AppConfig.Certifications.ReminderDays
+	if days <= 0 {
+		days = 30
+	}
+	due, err := ac.Approvals.DueForRenewal(now.AddDate(0, 0, days))
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, mc := range due {
+		err = ac.Mailer.Send(&util.Message{
+			To:      []string{mc.Email},
+			Subject: fmt.Sprintf("Your %s certification expires soon", mc.Certification),
+			Body: fmt.Sprintf("Your %s certification expires on %s. Ask an approver to renew it before then to keep using the areas and equipment it covers.\n\nSee your certifications at %suser/%d/certifications\n",
+				mc.Certification, mc.ExpiresOn.Format("Monday, Jan 2"), ac.rootURL(), mc.MemberID),
+		})
+		if err != nil {
+			ac.Logger.Printf("could not send renewal reminder for member certification %d: %v", mc.ID, err)
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//AreaController implements the handlers for the public list of areas and for managing them
+type AreaController struct {
+	Controller
+	Areas     Areas
+	Locations Locations
+	AreaView  views.View
+}
+
+//Initialize performs the required setup for an area controller
+func (ac *AreaController) Initialize(cfg *util.Config, um Users, am Areas, lm Locations, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	ac.setup(cfg, um, l, s)
+	ac.Areas = am
+	ac.Locations = lm
+	ac.Permissions = pm
+
+	ac.AreaView = views.View{}
+
+	if err := ac.AreaView.LoadTemplates("area"); err != nil {
+		return fmt.Errorf("Error loading area templates: %v", err)
+	}
+
+	return nil
+}
+
+//List shows every area of the space, by location. Anyone can see it.
+func (ac *AreaController) List() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		areas, err := ac.Areas.All()
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		td, err := ac.DefaultData(r)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Areas"
+		td.Add("Areas", areas)
+		td.Add("CanEdit", ac.can(r, "space.write"))
+
+		if err := ac.AreaView.Render(w, r, "areas.gohtml", td); err != nil {
+			ac.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Show displays one area and the equipment in it. Anyone can see it.
+func (ac *AreaController) Show() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		area, err := ac.Areas.Get(id)
+		if err != nil {
+			ac.notFound(w)
+			return
+		}
+		equipment, err := ac.Areas.Equipment(id)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		stewards, err := ac.Areas.Stewards(id)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		td, err := ac.DefaultData(r)
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+		td.PageTitle = area.Name
+		td.Add("Area", area)
+		td.Add("Equipment", equipment)
+		td.Add("Stewards", stewards)
+		td.Add("CanEdit", ac.can(r, "space.write"))
+		td.Add("LoggedIn", ac.authenticatedUserID(r) != 0)
+
+		if err := ac.AreaView.Render(w, r, "area.gohtml", td); err != nil {
+			ac.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Form displays the form for a new area, or for editing an existing one
+func (ac *AreaController) Form() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "space.write") {
+			ac.forbidden(w)
+			return
+		}
+
+		form := util.NewForm(url.Values{})
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			id, ok := util.IntOK(idStr, 1, math.MaxInt32)
+			if !ok {
+				ac.clientError(w, http.StatusBadRequest)
+				return
+			}
+			a, err := ac.Areas.Get(id)
+			if err != nil {
+				ac.notFound(w)
+				return
+			}
+			form.Set("id", strconv.Itoa(a.ID))
+			form.Set("location", strconv.Itoa(a.LocationID))
+			form.Set("name", a.Name)
+			form.Set("description", a.Description)
+			if a.Capacity != nil {
+				form.Set("capacity", strconv.Itoa(*a.Capacity))
+			}
+			setLimitsForm(form, a.ReservationLimits)
+		}
+
+		ac.renderForm(w, r, form)
+	})
+}
+
+func (ac *AreaController) renderForm(w http.ResponseWriter, r *http.Request, form *util.Form) {
+	locations, err := ac.Locations.All()
+	if err != nil {
+		ac.serverError(w, err)
+		return
+	}
+
+	td, err := ac.DefaultData(r)
+	if err != nil {
+		ac.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Area"
+	td.Add("Form", form)
+	td.Add("Locations", locations)
+
+	if err := ac.AreaView.Render(w, r, "area_form.gohtml", td); err != nil {
+		ac.serverError(w, err)
+		return
+	}
+}
+
+//Save validates and saves a new or edited area
+func (ac *AreaController) Save() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "space.write") {
+			ac.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("name", "location")
+		form.MaxLength("name", 255)
+		form.MaxLength("description", 2000)
+
+		a := &models.Area{
+			Name:        form.Get("name"),
+			Description: form.Get("description"),
+		}
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			a.ID, _ = util.IntOK(idStr, 1, math.MaxInt32)
+			form.Set("id", idStr)
+		}
+		if l := form.Get("location"); l != "" {
+			id, ok := util.IntOK(l, 1, math.MaxInt32)
+			if !ok {
+				form.Errors.Add("location", "Choose a location")
+			}
+			a.LocationID = id
+		}
+		if c := form.Get("capacity"); c != "" {
+			n, ok := util.IntOK(c, 1, 10000)
+			if !ok {
+				form.Errors.Add("capacity", "Must be a number of people, or blank if there is no limit")
+			}
+			a.Capacity = &n
+		}
+		a.ReservationLimits = limitsFromForm(form)
+
+		if !form.Valid() {
+			ac.renderForm(w, r, form)
+			return
+		}
+
+		var err error
+		if a.ID == 0 {
+			err = ac.Areas.Create(a)
+		} else {
+			err = ac.Areas.Update(a)
+		}
+		if err != nil {
+			form.Errors.Add("saveError", err.Error())
+			ac.renderForm(w, r, form)
+			return
+		}
+
+		ac.Session.Put(r, "flash", "Area saved")
+		http.Redirect(w, r, fmt.Sprintf("%sarea/%d", ac.rootURL(), a.ID), http.StatusSeeOther)
+	})
+}
+
+//Delete removes an area that has no equipment, lockers or reservations
+func (ac *AreaController) Delete() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "space.write") {
+			ac.forbidden(w)
+			return
+		}
+
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		err := ac.Areas.Delete(id)
+		if err == models.ErrInUse {
+			ac.Session.Put(r, "flash", "The area still has equipment, lockers or reservations. Move or remove them first.")
+			http.Redirect(w, r, fmt.Sprintf("%sarea/%d", ac.rootURL(), id), http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		ac.Session.Put(r, "flash", "Area deleted")
+		http.Redirect(w, r, ac.rootURL()+"areas", http.StatusSeeOther)
+	})
+}
+
+//AddSteward makes a member a steward of an area, so they are assigned its maintenance tickets
+func (ac *AreaController) AddSteward() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "space.write") {
+			ac.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		back := fmt.Sprintf("%sarea/%d", ac.rootURL(), id)
+		r.ParseForm()
+		memberID, ok := util.IntOK(r.PostForm.Get("member"), 1, math.MaxInt32)
+		if !ok {
+			ac.Session.Put(r, "flash", "Enter the member number of the new steward")
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+
+		switch err := ac.Areas.AddSteward(id, memberID); err {
+		case nil:
+			ac.Session.Put(r, "flash", "Steward added")
+		case models.ErrNoSuchMember:
+			ac.Session.Put(r, "flash", err.Error())
+		default:
+			ac.serverError(w, err)
+			return
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther)
+	})
+}
+
+//RemoveSteward stops a member being a steward of an area
+func (ac *AreaController) RemoveSteward() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ac.can(r, "space.write") {
+			ac.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+		memberID, ok := util.IntOK(mux.Vars(r)["mid"], 1, math.MaxInt32)
+		if !ok {
+			ac.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		if err := ac.Areas.RemoveSteward(id, memberID); err != nil {
+			ac.serverError(w, err)
+			return
+		}
+
+		ac.Session.Put(r, "flash", "Steward removed")
+		http.Redirect(w, r, fmt.Sprintf("%sarea/%d", ac.rootURL(), id), http.StatusSeeOther)
+	})
+}
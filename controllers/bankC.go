@@ -0,0 +1,304 @@
+package controllers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+// maxStatementSize is the largest bank statement file that can be uploaded
+const maxStatementSize = 5 << 20
+
+//BankController implements the handlers for importing bank statements and reconciling deposits with payments
+type BankController struct {
+	Controller
+	Banks    Banks
+	BankView views.View
+}
+
+//Initialize performs the required setup for a bank controller
+func (bc *BankController) Initialize(cfg *util.Config, um Users, bm Banks, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	bc.setup(cfg, um, l, s)
+	bc.Banks = bm
+	bc.Permissions = pm
+
+	bc.BankView = views.View{}
+
+	if err := bc.BankView.LoadTemplates("bank"); err != nil {
+		return fmt.Errorf("Error loading bank templates: %v", err)
+	}
+
+	return nil
+}
+
+// matchDays is how far apart a payment and a deposit can be to be suggested as a match. Defaults to 5 days.
+func (bc *BankController) matchDays() int {
+	if bc.AppConfig.Accounting.MatchDays > 0 {
+		return bc.AppConfig.Accounting.MatchDays
+	}
+	return 5
+}
+
+//Statements lists the imported bank statements, with a form to upload another
+func (bc *BankController) Statements() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bc.can(r, "finance.write") {
+			bc.forbidden(w)
+			return
+		}
+
+		bc.renderStatements(w, r, util.NewForm(url.Values{}))
+	})
+}
+
+func (bc *BankController) renderStatements(w http.ResponseWriter, r *http.Request, form *util.Form) {
+	statements, err := bc.Banks.Statements()
+	if err != nil {
+		bc.serverError(w, err)
+		return
+	}
+
+	td, err := bc.DefaultData(r)
+	if err != nil {
+		bc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Bank Statements"
+	td.Add("Statements", statements)
+	td.Add("Form", form)
+
+	if err := bc.BankView.Render(w, r, "statements.gohtml", td); err != nil {
+		bc.serverError(w, err)
+		return
+	}
+}
+
+//Import reads an uploaded OFX or CSV bank statement, saves its deposits and suggests which payments they match
+func (bc *BankController) Import() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bc.can(r, "finance.write") {
+			bc.forbidden(w)
+			return
+		}
+
+		form := util.NewForm(url.Values{})
+		r.Body = http.MaxBytesReader(w, r.Body, maxStatementSize)
+		if err := r.ParseMultipartForm(maxStatementSize); err != nil {
+			form.Errors.Add("statement", "Choose a statement file smaller than 5MB")
+			bc.renderStatements(w, r, form)
+			return
+		}
+		file, header, err := r.FormFile("statement")
+		if err != nil {
+			form.Errors.Add("statement", "Choose a statement file to upload")
+			bc.renderStatements(w, r, form)
+			return
+		}
+		defer file.Close()
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			bc.serverError(w, err)
+			return
+		}
+
+		format, lines, err := models.ParseStatement(data)
+		if err != nil {
+			form.Errors.Add("statement", err.Error())
+			bc.renderStatements(w, r, form)
+			return
+		}
+		_, imported, err := bc.Banks.Import(filepath.Base(header.Filename), format, lines, bc.authenticatedUserID(r))
+		if err != nil {
+			bc.serverError(w, err)
+			return
+		}
+		if err := bc.Banks.Suggest(bc.matchDays()); err != nil {
+			bc.serverError(w, err)
+			return
+		}
+
+		msg := fmt.Sprintf("Imported %d new deposits", imported)
+		if skipped := len(lines) - imported; skipped > 0 {
+			msg += fmt.Sprintf(", skipping %d that were already imported", skipped)
+		}
+		bc.Session.Put(r, "flash", msg)
+		http.Redirect(w, r, fmt.Sprintf("%sbank/reconcile", bc.rootURL()), http.StatusSeeOther)
+	})
+}
+
+//Statement shows the deposits on one bank statement and the payments they were matched to
+func (bc *BankController) Statement() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bc.can(r, "finance.write") {
+			bc.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			bc.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		statement, err := bc.Banks.Statement(id)
+		if err != nil {
+			bc.notFound(w)
+			return
+		}
+		lines, err := bc.Banks.Lines(id)
+		if err != nil {
+			bc.serverError(w, err)
+			return
+		}
+
+		td, err := bc.DefaultData(r)
+		if err != nil {
+			bc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Bank Statement"
+		td.Add("Statement", statement)
+		td.Add("Lines", lines)
+
+		if err := bc.BankView.Render(w, r, "statement.gohtml", td); err != nil {
+			bc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Reconcile shows the deposits that have not been matched to a payment and the payments that have not been matched
+//to a deposit, with the suggested matches to confirm
+func (bc *BankController) Reconcile() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bc.can(r, "finance.write") {
+			bc.forbidden(w)
+			return
+		}
+
+		lines, err := bc.Banks.Unmatched()
+		if err != nil {
+			bc.serverError(w, err)
+			return
+		}
+		payments, err := bc.Banks.UnreconciledPayments()
+		if err != nil {
+			bc.serverError(w, err)
+			return
+		}
+		suggested := 0
+		for _, l := range lines {
+			if l.SuggestedPaymentID != nil {
+				suggested++
+			}
+		}
+
+		td, err := bc.DefaultData(r)
+		if err != nil {
+			bc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Reconcile Deposits"
+		td.Add("Lines", lines)
+		td.Add("Payments", payments)
+		td.Add("Suggested", suggested)
+		td.Add("MatchDays", bc.matchDays())
+
+		if err := bc.BankView.Render(w, r, "reconcile.gohtml", td); err != nil {
+			bc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Match confirms that a deposit is the payment the treasurer chose, or the suggested one
+func (bc *BankController) Match() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bc.can(r, "finance.write") {
+			bc.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			bc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		r.ParseForm()
+		paymentID, ok := util.IntOK(r.PostForm.Get("payment"), 1, math.MaxInt32)
+		if !ok {
+			bc.Session.Put(r, "flash", "Choose the payment this deposit matches")
+			http.Redirect(w, r, fmt.Sprintf("%sbank/reconcile", bc.rootURL()), http.StatusSeeOther)
+			return
+		}
+
+		err := bc.Banks.Match(id, paymentID, bc.authenticatedUserID(r), time.Now())
+		if err == models.ErrCannotMatch {
+			bc.Session.Put(r, "flash", err.Error())
+			http.Redirect(w, r, fmt.Sprintf("%sbank/reconcile", bc.rootURL()), http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			bc.serverError(w, err)
+			return
+		}
+
+		bc.Session.Put(r, "flash", fmt.Sprintf("Deposit matched to payment #%d", paymentID))
+		http.Redirect(w, r, fmt.Sprintf("%sbank/reconcile", bc.rootURL()), http.StatusSeeOther)
+	})
+}
+
+//ConfirmSuggested matches every unmatched deposit to its suggested payment
+func (bc *BankController) ConfirmSuggested() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bc.can(r, "finance.write") {
+			bc.forbidden(w)
+			return
+		}
+
+		matched, err := bc.Banks.ConfirmSuggested(bc.authenticatedUserID(r), time.Now())
+		if err != nil {
+			bc.serverError(w, err)
+			return
+		}
+
+		bc.Session.Put(r, "flash", fmt.Sprintf("Matched %d deposits", matched))
+		http.Redirect(w, r, fmt.Sprintf("%sbank/reconcile", bc.rootURL()), http.StatusSeeOther)
+	})
+}
+
+//Unmatch undoes a match made by mistake, and suggests matches again for the deposit and the payment
+func (bc *BankController) Unmatch() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bc.can(r, "finance.write") {
+			bc.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			bc.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		if err := bc.Banks.Unmatch(id); err != nil {
+			bc.serverError(w, err)
+			return
+		}
+		if err := bc.Banks.Suggest(bc.matchDays()); err != nil {
+			bc.serverError(w, err)
+			return
+		}
+
+		bc.Session.Put(r, "flash", "The deposit is no longer matched")
+		http.Redirect(w, r, fmt.Sprintf("%sbank/reconcile", bc.rootURL()), http.StatusSeeOther)
+	})
+}
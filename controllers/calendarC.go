@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//CalendarController implements the handlers for the availability calendar of each location
+type CalendarController struct {
+	Controller
+	Calendars    Calendars
+	CalendarView views.View
+}
+
+//Initialize performs the required setup for a calendar controller
+func (cc *CalendarController) Initialize(cfg *util.Config, um Users, cm Calendars, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	cc.setup(cfg, um, l, s)
+	cc.Calendars = cm
+	cc.Permissions = pm
+
+	cc.CalendarView = views.View{}
+
+	if err := cc.CalendarView.LoadTemplates("calendar"); err != nil {
+		return fmt.Errorf("Error loading calendar templates: %v", err)
+	}
+
+	return nil
+}
+
+// calendarFromRequest reads the location from the URL, and the "date" (yyyy-mm-dd, today by default) and "view"
+// ("day" by default, or "week") from the query string, and gets the calendar for that day or the week starting on
+// that date. Writes the error response and returns false if the location does not exist.
+func (cc *CalendarController) calendarFromRequest(w http.ResponseWriter, r *http.Request) (*models.Calendar, string, bool) {
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		cc.clientError(w, http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	from, ok := util.DateOK(r.URL.Query().Get("date"))
+	if !ok {
+		now := time.Now()
+		from = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	}
+	view := r.URL.Query().Get("view")
+	to := from.AddDate(0, 0, 1)
+	if view == "week" {
+		to = from.AddDate(0, 0, 7)
+	} else {
+		view = "day"
+	}
+
+	c, err := cc.Calendars.Calendar(id, from, to)
+	if err != nil {
+		cc.notFound(w)
+		return nil, "", false
+	}
+	return c, view, true
+}
+
+//Show draws the timeline of a location's areas and equipment for a day or a week. Anyone can see it; who made a
+//reservation is not shown.
+func (cc *CalendarController) Show() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, view, ok := cc.calendarFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		// the headings along the top of the timeline, spread evenly across it
+		headings := []string{}
+		step, format := 2*time.Hour, "3pm"
+		if view == "week" {
+			step, format = 24*time.Hour, "Mon Jan 2"
+		}
+		for t := c.From; t.Before(c.To); t = t.Add(step) {
+			headings = append(headings, t.Format(format))
+		}
+
+		days := 1
+		if view == "week" {
+			days = 7
+		}
+
+		td, err := cc.DefaultData(r)
+		if err != nil {
+			cc.serverError(w, err)
+			return
+		}
+		td.PageTitle = c.Location + " calendar"
+		td.Add("Calendar", c)
+		td.Add("View", view)
+		td.Add("Headings", headings)
+		td.Add("HeadingWidth", 100/float64(len(headings)))
+		td.Add("Previous", c.From.AddDate(0, 0, -days))
+		td.Add("Next", c.From.AddDate(0, 0, days))
+
+		if err := cc.CalendarView.Render(w, r, "calendar.gohtml", td); err != nil {
+			cc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//JSON writes the same calendar as Show for client-side calendars to use
+func (cc *CalendarController) JSON() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _, ok := cc.calendarFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c); err != nil {
+			cc.Logger.Printf("could not write calendar for location %d: %v", c.LocationID, err)
+		}
+	})
+}
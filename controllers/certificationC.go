@@ -0,0 +1,347 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//CertificationController implements the handlers for the catalog of certifications and the areas and equipment
+//they grant access to
+type CertificationController struct {
+	Controller
+	Certifications    Certifications
+	CertificationView views.View
+}
+
+//Initialize performs the required setup for a certification controller
+func (cc *CertificationController) Initialize(cfg *util.Config, um Users, cm Certifications, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	cc.setup(cfg, um, l, s)
+	cc.Certifications = cm
+	cc.Permissions = pm
+
+	cc.CertificationView = views.View{}
+
+	if err := cc.CertificationView.LoadTemplates("certification"); err != nil {
+		return fmt.Errorf("Error loading certification templates: %v", err)
+	}
+
+	return nil
+}
+
+//List shows every certification members can earn. Anyone can see it.
+func (cc *CertificationController) List() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		certifications, err := cc.Certifications.All()
+		if err != nil {
+			cc.serverError(w, err)
+			return
+		}
+
+		td, err := cc.DefaultData(r)
+		if err != nil {
+			cc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Certifications"
+		td.Add("Certifications", certifications)
+		td.Add("CanEdit", cc.can(r, "certification.write"))
+
+		if err := cc.CertificationView.Render(w, r, "certifications.gohtml", td); err != nil {
+			cc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Show displays a certification and the areas and equipment it grants access to. Anyone can see it; certification
+//managers can link it to more areas and equipment from here.
+func (cc *CertificationController) Show() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			cc.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		c, err := cc.Certifications.Get(id)
+		if err != nil {
+			cc.notFound(w)
+			return
+		}
+		resources, err := cc.Certifications.Resources(id)
+		if err != nil {
+			cc.serverError(w, err)
+			return
+		}
+
+		td, err := cc.DefaultData(r)
+		if err != nil {
+			cc.serverError(w, err)
+			return
+		}
+		td.PageTitle = c.Name
+		td.Add("Certification", c)
+		td.Add("Resources", resources)
+		td.Add("LoggedIn", cc.authenticatedUserID(r) != 0)
+		td.Add("CanApprove", cc.can(r, "certification.approve"))
+
+		if cc.can(r, "certification.write") {
+			choices, err := cc.Certifications.Choices()
+			if err != nil {
+				cc.serverError(w, err)
+				return
+			}
+			td.Add("CanEdit", true)
+			td.Add("Choices", choices)
+		}
+
+		if err := cc.CertificationView.Render(w, r, "certification.gohtml", td); err != nil {
+			cc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Form displays the form for a new certification, or for editing an existing one
+func (cc *CertificationController) Form() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cc.can(r, "certification.write") {
+			cc.forbidden(w)
+			return
+		}
+
+		form := util.NewForm(url.Values{})
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			id, ok := util.IntOK(idStr, 1, math.MaxInt32)
+			if !ok {
+				cc.clientError(w, http.StatusBadRequest)
+				return
+			}
+			c, err := cc.Certifications.Get(id)
+			if err != nil {
+				cc.notFound(w)
+				return
+			}
+			form.Set("id", strconv.Itoa(c.ID))
+			form.Set("name", c.Name)
+			form.Set("description", c.Description)
+			form.Set("approvals", strconv.Itoa(c.Approvals))
+			if c.ValidDays != nil {
+				form.Set("validdays", strconv.Itoa(*c.ValidDays))
+			}
+			for _, p := range c.PrerequisiteIDs {
+				form.Add("prerequisite", strconv.Itoa(p))
+			}
+		}
+
+		cc.renderForm(w, r, form)
+	})
+}
+
+func (cc *CertificationController) renderForm(w http.ResponseWriter, r *http.Request, form *util.Form) {
+	certifications, err := cc.Certifications.All()
+	if err != nil {
+		cc.serverError(w, err)
+		return
+	}
+	// a certification cannot be its own prerequisite, so it is left out of the choices
+	others := []models.Certification{}
+	for _, c := range certifications {
+		if strconv.Itoa(c.ID) != form.Get("id") {
+			others = append(others, c)
+		}
+	}
+	checked := map[string]bool{}
+	for _, p := range form.Values["prerequisite"] {
+		checked[p] = true
+	}
+
+	td, err := cc.DefaultData(r)
+	if err != nil {
+		cc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Certification"
+	td.Add("Form", form)
+	td.Add("Certifications", others)
+	td.Add("Prerequisites", checked)
+
+	if err := cc.CertificationView.Render(w, r, "certification_form.gohtml", td); err != nil {
+		cc.serverError(w, err)
+		return
+	}
+}
+
+//Save validates and saves a new or edited certification
+func (cc *CertificationController) Save() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cc.can(r, "certification.write") {
+			cc.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("name", "approvals")
+		form.MaxLength("name", 255)
+		form.MaxLength("description", 2000)
+		form.PermittedValues("approvals", "1", "2")
+
+		c := &models.Certification{
+			Name:        strings.TrimSpace(form.Get("name")),
+			Description: form.Get("description"),
+		}
+		c.Approvals, _ = util.IntOK(form.Get("approvals"), 1, 2)
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			c.ID, _ = util.IntOK(idStr, 1, math.MaxInt32)
+			form.Set("id", idStr)
+		}
+		if v := form.Get("validdays"); v != "" {
+			n, ok := util.IntOK(v, 1, 36500)
+			if !ok {
+				form.Errors.Add("validdays", "Must be a number of days, or blank if it never expires")
+			}
+			c.ValidDays = &n
+		}
+		for _, p := range form.Values["prerequisite"] {
+			id, ok := util.IntOK(p, 1, math.MaxInt32)
+			if !ok {
+				form.Errors.Add("prerequisite", "Choose certifications from the list")
+				break
+			}
+			c.PrerequisiteIDs = append(c.PrerequisiteIDs, id)
+		}
+
+		if !form.Valid() {
+			cc.renderForm(w, r, form)
+			return
+		}
+
+		var err error
+		if c.ID == 0 {
+			err = cc.Certifications.Create(c)
+		} else {
+			err = cc.Certifications.Update(c)
+		}
+		if err != nil {
+			form.Errors.Add("saveError", err.Error())
+			cc.renderForm(w, r, form)
+			return
+		}
+
+		cc.Session.Put(r, "flash", "Certification saved")
+		http.Redirect(w, r, fmt.Sprintf("%scertification/%d", cc.rootURL(), c.ID), http.StatusSeeOther)
+	})
+}
+
+//Delete removes a certification that no member holds and no event or other certification needs
+func (cc *CertificationController) Delete() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cc.can(r, "certification.write") {
+			cc.forbidden(w)
+			return
+		}
+
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			cc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		err := cc.Certifications.Delete(id)
+		if err == models.ErrInUse {
+			cc.Session.Put(r, "flash", "Members hold the certification, or events or other certifications need it, so it cannot be deleted.")
+			http.Redirect(w, r, fmt.Sprintf("%scertification/%d", cc.rootURL(), id), http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			cc.serverError(w, err)
+			return
+		}
+
+		cc.Session.Put(r, "flash", "Certification deleted")
+		http.Redirect(w, r, fmt.Sprintf("%scertifications", cc.rootURL()), http.StatusSeeOther)
+	})
+}
+
+//Link makes a certification grant access to the area or piece of equipment chosen in the "resource" field, given as
+//kind:id such as area:3
+func (cc *CertificationController) Link() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cc.can(r, "certification.write") {
+			cc.forbidden(w)
+			return
+		}
+
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			cc.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		r.ParseForm()
+		kind, resource := "", 0
+		if parts := strings.SplitN(r.PostForm.Get("resource"), ":", 2); len(parts) == 2 {
+			kind = parts[0]
+			resource, ok = util.IntOK(parts[1], 1, math.MaxInt32)
+		}
+		if kind == "" || !ok {
+			cc.Session.Put(r, "flash", "Choose an area or piece of equipment")
+			http.Redirect(w, r, fmt.Sprintf("%scertification/%d", cc.rootURL(), id), http.StatusSeeOther)
+			return
+		}
+
+		err := cc.Certifications.Link(id, kind, resource)
+		if err == models.ErrNoSuchResource {
+			cc.Session.Put(r, "flash", err.Error())
+			http.Redirect(w, r, fmt.Sprintf("%scertification/%d", cc.rootURL(), id), http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			cc.serverError(w, err)
+			return
+		}
+
+		cc.Session.Put(r, "flash", "Certification linked")
+		http.Redirect(w, r, fmt.Sprintf("%scertification/%d", cc.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+//Unlink stops a certification granting access to an area or piece of equipment
+func (cc *CertificationController) Unlink() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cc.can(r, "certification.write") {
+			cc.forbidden(w)
+			return
+		}
+
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			cc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		linkID, ok := util.IntOK(mux.Vars(r)["lid"], 1, math.MaxInt32)
+		if !ok {
+			cc.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		if err := cc.Certifications.Unlink(id, linkID); err != nil {
+			cc.serverError(w, err)
+			return
+		}
+
+		cc.Session.Put(r, "flash", "Certification unlinked")
+		http.Redirect(w, r, fmt.Sprintf("%scertification/%d", cc.rootURL(), id), http.StatusSeeOther)
+	})
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net/http"
 	"runtime/debug"
+	"strings"
+	"time"
 
 	"github.com/golangcollege/sessions"
 
@@ -21,14 +23,332 @@ type Users interface {
 	Create(*models.User) error
 	Update(*models.User) error
 	Delete(*models.User) error
+	BillingAddress(int) (*models.Address, error)
+}
+
+// MembershipOptions interface defines the methods that a MembershipOptions model must fulfill.
+type MembershipOptions interface {
+	All() ([]models.MembershipOption, error)
+	Active() ([]models.MembershipOption, error)
+	Get(int) (*models.MembershipOption, error)
+	Create(*models.MembershipOption) error
+	Update(*models.MembershipOption) error
+	SetActive(int, bool) error
+}
+
+// Invoices interface defines the methods that an Invoices model must fulfill.
+type Invoices interface {
+	Get(int) (*models.Invoice, error)
+	GetForMember(int) ([]models.Invoice, error)
+	GetForPayment(int) ([]models.Invoice, error)
+	GetLines(*models.Invoice) error
+	Create(*models.Invoice) error
+}
+
+// Addons interface defines the methods that an Addons model must fulfill.
+type Addons interface {
+	All() ([]models.Addon, error)
+	Get(int) (*models.Addon, error)
+	Create(*models.Addon) error
+	Update(*models.Addon) error
+	SetActive(int, bool) error
+	ForMember(int) ([]models.MemberAddon, error)
+	Waitlisted(int) ([]models.MemberAddon, error)
+	Add(int, int, time.Time) (*models.AddonChange, error)
+	Remove(int, int, time.Time) (*models.AddonChange, error)
+	LeaveWaitlist(int, int) error
+}
+
+// Renewals interface defines the methods that a Renewals model must fulfill.
+type Renewals interface {
+	Due(time.Time) ([]models.Renewal, error)
+	Renew(*models.Renewal) (*models.Invoice, error)
+	Lapse(time.Time) (int, error)
+}
+
+// Accounting interface defines the methods that an Accounting model must fulfill.
+type Accounting interface {
+	Transactions(time.Time, time.Time) ([]models.GLTransaction, error)
+}
+
+// Banks interface defines the methods that a Banks model must fulfill.
+type Banks interface {
+	Import(string, string, []models.StatementLine, int) (int, int, error)
+	Suggest(int) error
+	Statements() ([]models.BankStatement, error)
+	Statement(int) (*models.BankStatement, error)
+	Lines(int) ([]models.BankLine, error)
+	Unmatched() ([]models.BankLine, error)
+	UnreconciledPayments() ([]models.UnreconciledPayment, error)
+	Match(int, int, int, time.Time) error
+	ConfirmSuggested(int, time.Time) (int, error)
+	Unmatch(int) error
+}
+
+// Vouchers interface defines the methods that a Vouchers model must fulfill.
+type Vouchers interface {
+	All() ([]models.Voucher, error)
+	Get(int) (*models.Voucher, error)
+	Find(string) (*models.Voucher, error)
+	ForMember(int) ([]models.Voucher, error)
+	Events(time.Time) ([]models.VoucherEvent, error)
+	Buy(*models.Voucher, time.Time) (*models.Invoice, error)
+	Redeem(int, string, time.Time) (*models.Voucher, error)
+	MarkEmailed(int, time.Time) error
+}
+
+// Memberships interface defines the methods that a Memberships model must fulfill.
+type Memberships interface {
+	Get(int) (*models.Membership, error)
+	History(int) ([]models.MembershipChange, error)
+	Pause(int, time.Time, models.Money, int, time.Time) (*models.Invoice, error)
+	Resume(int, int, time.Time) error
+	ResumeEnded(time.Time) (int, error)
+	ChangePlan(int, int, int, time.Time) (*models.PlanChange, error)
+}
+
+// Lockers interface defines the methods that a Lockers model must fulfill.
+type Lockers interface {
+	All() ([]models.Locker, error)
+	Get(int) (*models.Locker, error)
+	Sizes() ([]string, error)
+	Create(*models.Locker) error
+	Update(*models.Locker) error
+	SetActive(int, bool) error
+	Waitlist() ([]models.LockerWaiter, error)
+	ForMember(int) (*models.MemberLocker, error)
+	Assign(int, int, time.Time) error
+	JoinWaitlist(int) error
+	LeaveWaitlist(int) error
+	Claim(int, time.Time) error
+	Release(int, string, bool, time.Time) error
+	MarkCleared(int) error
+	ReleaseLapsed(time.Time) ([]models.ReleasedLocker, error)
+	OfferFree(time.Time, time.Time) ([]models.LockerOffer, error)
+}
+
+// Areas interface defines the methods that an Areas model must fulfill.
+type Areas interface {
+	All() ([]models.Area, error)
+	Get(int) (*models.Area, error)
+	Equipment(int) ([]models.AreaEquipment, error)
+	Create(*models.Area) error
+	Update(*models.Area) error
+	Delete(int) error
+	Stewards(int) ([]models.Steward, error)
+	IsSteward(int, int) (bool, error)
+	AddSteward(int, int) error
+	RemoveSteward(int, int) error
+}
+
+// Maintenance interface defines the methods that a Maintenance model must fulfill.
+type Maintenance interface {
+	Tickets(models.TicketFilter) ([]models.Ticket, error)
+	Ticket(int) (*models.Ticket, error)
+	Report(*models.Ticket, time.Time) (bool, error)
+	Update(int, string, *int, time.Time) (string, error)
+	Comments(int) ([]models.TicketComment, error)
+	Comment(int, int, string, time.Time) error
+	AffectedEvents(int, time.Time) ([]models.AffectedEvent, error)
+	Schedules(int) ([]models.Schedule, error)
+	Schedule(int) (*models.Schedule, error)
+	AddSchedule(*models.Schedule) error
+	Done(int, time.Time) error
+	DeleteSchedule(int) error
+	DueForReminder(time.Time) ([]models.Schedule, error)
+}
+
+// Equipment interface defines the methods that an Equipment model must fulfill.
+type Equipment interface {
+	List(models.EquipmentFilter) ([]models.Equipment, error)
+	Get(int) (*models.Equipment, error)
+	Create(*models.Equipment) error
+	Update(*models.Equipment) error
+	Move(int, int, int, string, time.Time) error
+	Moves(int) ([]models.EquipmentMove, error)
+	Files(int) ([]models.EquipmentFile, error)
+	File(int, int) (*models.EquipmentFile, error)
+	AddFile(*models.EquipmentFile, int) error
+	DeleteFile(int, int) error
+}
+
+// Reservations interface defines the methods that a Reservations model must fulfill.
+type Reservations interface {
+	Resource(string, int) (*models.Resource, error)
+	Missing(string, int, int) ([]string, error)
+	Reserve(*models.Reservation, bool, time.Time) error
+	Availability(string, int, time.Time, time.Time) (*models.Availability, error)
+	ForMember(int, time.Time) ([]models.Reservation, error)
+	Get(string, int) (*models.Reservation, error)
+	Cancel(string, int) error
+}
+
+// Calendars interface defines the methods that a Calendars model must fulfill.
+type Calendars interface {
+	Calendar(int, time.Time, time.Time) (*models.Calendar, error)
+}
+
+// Certifications interface defines the methods that a Certifications model must fulfill.
+type Certifications interface {
+	All() ([]models.Certification, error)
+	Get(int) (*models.Certification, error)
+	Create(*models.Certification) error
+	Update(*models.Certification) error
+	Delete(int) error
+	Resources(int) ([]models.CertificationResource, error)
+	Choices() ([]models.CertificationResource, error)
+	Link(int, string, int) error
+	Unlink(int, int) error
+}
+
+// Approvals interface defines the methods that an Approvals model must fulfill.
+type Approvals interface {
+	Missing(int, string, int) ([]string, error)
+	IsCertified(int, string, int) (bool, error)
+	Request(int, int, int) (int, error)
+	Pending() ([]models.MemberCertification, error)
+	ForMember(int) ([]models.MemberCertification, error)
+	Get(int) (*models.MemberCertification, error)
+	Approvals(int) ([]models.Approval, error)
+	MissingPrerequisites(int) ([]string, error)
+	Review(int, int, bool, string) (string, error)
+	Renew(int, int, string) error
+	Revoke(int, int, string) error
+	Reinstate(int, int, string) error
+	History(int) ([]models.CertificationEvent, error)
+	DueForRenewal(time.Time) ([]models.MemberCertification, error)
+}
+
+// Hours interface defines the methods that an Hours model must fulfill.
+type Hours interface {
+	Hours(int) ([]models.OpenHours, error)
+	AddHours(*models.OpenHours) error
+	DeleteHours(int, int) error
+	Closures(int, time.Time) ([]models.Closure, error)
+	AddClosure(*models.Closure, int) error
+	DeleteClosure(int, int) error
+}
+
+// Kiosk interface defines the methods that a Kiosk model must fulfill.
+type Kiosk interface {
+	CheckIn(*models.CheckIn, bool, time.Time) error
+	Since(int, time.Time) ([]models.CheckIn, error)
+}
+
+// Registrations interface defines the methods that a Registrations model must fulfill.
+type Registrations interface {
+	Event(int, int) (*models.RegistrationEvent, error)
+	Register(int, int, time.Time) (*models.Invoice, error)
+}
+
+// Locations interface defines the methods that a Locations model must fulfill.
+type Locations interface {
+	All() ([]models.Location, error)
+	Get(int) (*models.Location, error)
+	Create(*models.Location) error
+	Update(*models.Location) error
+	Delete(int) error
+}
+
+// Donations interface defines the methods that a Donations model must fulfill.
+type Donations interface {
+	Recurring(int) (models.Money, error)
+	SetRecurring(int, models.Money) error
+	ForYear(int, int) ([]models.Donation, error)
+	Donors(int) ([]models.Donor, error)
+}
+
+// Discounts interface defines the methods that a Discounts model must fulfill.
+type Discounts interface {
+	All() ([]models.Discount, error)
+	Get(int) (*models.Discount, error)
+	Create(*models.Discount) error
+	Update(*models.Discount) error
+	SetActive(int, bool) error
+	ForMember(int) ([]models.MemberDiscount, error)
+	Grant(int, int, int, string, time.Time) error
+	Redeem(int, string, time.Time) (*models.Discount, error)
+	End(int, int, time.Time) error
+}
+
+// Payments interface defines the methods that a Payments model must fulfill.
+type Payments interface {
+	Get(int) (*models.Payment, error)
+	StartCheckout(int, string) error
+	RecordOnlinePayment(*models.OnlinePayment) (int, error)
+	RecordManualPayment(*models.ManualPayment) (int, error)
+	SavedMethods(int) ([]models.PaymentMethod, error)
+	DefaultMethod(int) (*models.PaymentMethod, error)
+	SetDefaultMethod(int, int) error
+	DeleteMethod(int, int) error
+}
+
+// Ledgers interface defines the methods that a Ledgers model must fulfill.
+type Ledgers interface {
+	ForMember(int, time.Time, time.Time) (*models.Ledger, error)
+}
+
+// Refunds interface defines the methods that a Refunds model must fulfill.
+type Refunds interface {
+	Policies() ([]models.RefundPolicy, error)
+	GetPolicy(int) (*models.RefundPolicy, error)
+	CreatePolicy(*models.RefundPolicy) error
+	UpdatePolicy(*models.RefundPolicy) error
+	Registration(int) (*models.RefundableRegistration, error)
+	RequestRefund(*models.RefundRequest) error
+	GetRequest(int) (*models.RefundRequest, error)
+	Requests(string) ([]models.RefundRequest, error)
+	Reject(int, int, string) error
+	Claim(int, int) error
+	Release(int) error
+	Approve(int, int, string, *models.Refund) error
+	RefundsForPayment(int) ([]models.Refund, error)
+}
+
+// Reports interface defines the methods that a Reports model must fulfill.
+type Reports interface {
+	Revenue(time.Time, time.Time) ([]models.RevenueRow, error)
+	Aging(time.Time) ([]models.AgingInvoice, error)
+	PaymentsByMethod(time.Time, time.Time) ([]models.MethodTotal, error)
+	ActiveMembers(time.Time, time.Time) ([]models.MemberCount, error)
+	Discounts(time.Time, time.Time) ([]models.DiscountTotal, error)
+	DiscountGrants(time.Time, time.Time) ([]models.DiscountGrant, error)
+}
+
+// Reminders interface defines the methods that a Reminders model must fulfill.
+type Reminders interface {
+	Unpaid(time.Time) ([]models.ReminderInvoice, error)
+	Claim(int, string, string) (bool, error)
+	Release(int, string, string) error
+}
+
+// Receipts interface defines how payment receipts are sent to members. Implemented by DocumentController.
+type Receipts interface {
+	SendReceipt(int) error
+}
+
+// InvoiceSender interface defines how new invoices are emailed to members. Implemented by DocumentController.
+type InvoiceSender interface {
+	SendInvoice(*models.Invoice) error
+}
+
+// StatementSender interface defines how year-end donation statements are emailed to donors. Implemented by DocumentController.
+type StatementSender interface {
+	SendDonationStatement(int, int) error
+}
+
+// Permissions interface defines the RBAC lookups required by controllers that restrict access.
+type Permissions interface {
+	HasPermission(int, string) (bool, error)
 }
 
 // Controller is a struct Struct to store pointer to cookiestore, database, and logger and any other things common to many controllers
 type Controller struct {
-	Users     Users
-	Logger    *util.Logger
-	AppConfig *util.Config
-	Session   *sessions.Session
+	Users       Users
+	Permissions Permissions
+	Logger      *util.Logger
+	AppConfig   *util.Config
+	Session     *sessions.Session
 }
 
 // method to create a new struct and store the information from the app, passed as args
@@ -45,12 +365,73 @@ func (c *Controller) setup(cfg *util.Config, um Users, l *util.Logger, s *sessio
 // DefaultData ia the method to generate required default template data and return template object
 func (c *Controller) DefaultData(r *http.Request) (*views.TemplateData, error) {
 	td := &views.TemplateData{}
-	td.Root = fmt.Sprintf("http://%s:%d/", c.AppConfig.App.Host, c.AppConfig.App.Port)
+	td.Root = c.rootURL()
 	c.Logger.Printf("Added root path: %s", td.Root)
 	td.Flash = c.Session.PopString(r, "flash")
 	return td, nil
 }
 
+// rootURL is the base address of the application, with a trailing slash
+func (c *Controller) rootURL() string {
+	return fmt.Sprintf("http://%s:%d/", c.AppConfig.App.Host, c.AppConfig.App.Port)
+}
+
+// authenticatedUserID returns the id of the logged in member, or 0 if nobody is logged in
+func (c *Controller) authenticatedUserID(r *http.Request) int {
+	return c.Session.GetInt(r, "authenticatedUserID")
+}
+
+// can reports whether the logged in member has been granted a permission through their RBAC role
+func (c *Controller) can(r *http.Request, permission string) bool {
+	if c.Permissions == nil {
+		return false
+	}
+	ok, err := c.Permissions.HasPermission(c.authenticatedUserID(r), permission)
+	if err != nil {
+		c.Logger.Printf("permission check failed: %v", err)
+		return false
+	}
+	return ok
+}
+
+// canAccessMember reports whether the logged in member may see another member's records:
+// members can always see their own, otherwise the permission is required.
+func (c *Controller) canAccessMember(r *http.Request, memberID int, permission string) bool {
+	if id := c.authenticatedUserID(r); id != 0 && id == memberID {
+		return true
+	}
+	return c.can(r, permission)
+}
+
+// dateRange reads the "from" and "to" query parameters (yyyy-mm-dd). Missing or invalid dates default to
+// the start of the current year and today, and the dates are swapped if they are given in the wrong order.
+func dateRange(r *http.Request) (time.Time, time.Time) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+
+	from, ok := util.DateOK(r.URL.Query().Get("from"))
+	if !ok {
+		from = time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, time.Local)
+	}
+	to, ok := util.DateOK(r.URL.Query().Get("to"))
+	if !ok {
+		to = today
+	}
+	if to.Before(from) {
+		from, to = to, from
+	}
+	return from, to
+}
+
+// spreadsheetText stops a spreadsheet from running text from a download as a formula, by putting an apostrophe in
+// front of text that starts with =, +, - or @. Use it on names, descriptions and memos, but not on amounts.
+func spreadsheetText(s string) string {
+	if s != "" && strings.ContainsAny(s[:1], "=+-@\t\r") {
+		return "'" + s
+	}
+	return s
+}
+
 func (c *Controller) serverError(w http.ResponseWriter, err error) {
 	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
 	c.Logger.Output(2, trace)
@@ -65,3 +446,7 @@ func (c *Controller) clientError(w http.ResponseWriter, status int) {
 func (c *Controller) notFound(w http.ResponseWriter) {
 	c.clientError(w, http.StatusNotFound)
 }
+
+func (c *Controller) forbidden(w http.ResponseWriter) {
+	c.clientError(w, http.StatusForbidden)
+}
@@ -0,0 +1,419 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//DiscountController implements the handlers for discount codes, scholarships and comped memberships
+type DiscountController struct {
+	Controller
+	Discounts    Discounts
+	DiscountView views.View
+}
+
+//Initialize performs the required setup for a discount controller
+func (dc *DiscountController) Initialize(cfg *util.Config, um Users, dm Discounts, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	dc.setup(cfg, um, l, s)
+	dc.Discounts = dm
+	dc.Permissions = pm
+
+	dc.DiscountView = views.View{}
+
+	if err := dc.DiscountView.LoadTemplates("discount"); err != nil {
+		return fmt.Errorf("Error loading discount templates: %v", err)
+	}
+
+	return nil
+}
+
+//List shows every discount, including retired ones
+func (dc *DiscountController) List() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dc.can(r, "finance.write") {
+			dc.forbidden(w)
+			return
+		}
+
+		discounts, err := dc.Discounts.All()
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+
+		td, err := dc.DefaultData(r)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Discounts"
+		td.Add("Discounts", discounts)
+
+		if err := dc.DiscountView.Render(w, r, "discounts.gohtml", td); err != nil {
+			dc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Form displays the form for a new discount, or for editing an existing one
+func (dc *DiscountController) Form() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dc.can(r, "finance.write") {
+			dc.forbidden(w)
+			return
+		}
+
+		form := util.NewForm(url.Values{})
+		form.Set("kind", "percent")
+		form.Set("dues", "on")
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			id, ok := util.IntOK(idStr, 1, math.MaxInt32)
+			if !ok {
+				dc.clientError(w, http.StatusBadRequest)
+				return
+			}
+			d, err := dc.Discounts.Get(id)
+			if err != nil {
+				dc.notFound(w)
+				return
+			}
+			form.Set("id", strconv.Itoa(d.ID))
+			form.Set("name", d.Name)
+			if d.Code != nil {
+				form.Set("code", *d.Code)
+			}
+			form.Set("kind", d.Kind)
+			if d.Kind == "percent" {
+				form.Set("percentoff", strconv.Itoa(d.PercentOff))
+			}
+			if d.Kind == "fixed" {
+				form.Set("amountoff", d.AmountOff.Decimal())
+			}
+			if d.Periods != nil {
+				form.Set("periods", strconv.Itoa(*d.Periods))
+			}
+			form.Del("dues")
+			if d.AppliesToDues {
+				form.Set("dues", "on")
+			}
+			if d.AppliesToEvents {
+				form.Set("events", "on")
+			}
+			if d.MaxUses != nil {
+				form.Set("maxuses", strconv.Itoa(*d.MaxUses))
+			}
+			if d.ExpiresOn != nil {
+				form.Set("expires", d.ExpiresOn.Format("2006-01-02"))
+			}
+		}
+
+		dc.renderForm(w, r, form)
+	})
+}
+
+func (dc *DiscountController) renderForm(w http.ResponseWriter, r *http.Request, form *util.Form) {
+	td, err := dc.DefaultData(r)
+	if err != nil {
+		dc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Discount"
+	td.Add("Form", form)
+	td.Add("Kinds", []string{"percent", "fixed", "free"})
+
+	if err := dc.DiscountView.Render(w, r, "discount_form.gohtml", td); err != nil {
+		dc.serverError(w, err)
+		return
+	}
+}
+
+//Save validates and saves a new or edited discount
+func (dc *DiscountController) Save() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dc.can(r, "finance.write") {
+			dc.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("name", "kind")
+		form.MaxLength("name", 255)
+		form.MaxLength("code", 64)
+		form.PermittedValues("kind", "percent", "fixed", "free")
+
+		d := &models.Discount{Name: form.Get("name")}
+		d.Kind = form.Get("kind")
+		d.AppliesToDues = form.Get("dues") == "on"
+		d.AppliesToEvents = form.Get("events") == "on"
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			d.ID, _ = util.IntOK(idStr, 1, math.MaxInt32)
+			form.Set("id", idStr)
+		}
+		if c := strings.TrimSpace(form.Get("code")); c != "" {
+			d.Code = &c
+		}
+		switch d.Kind {
+		case "percent":
+			n, ok := util.IntOK(form.Get("percentoff"), 1, 100)
+			if !ok {
+				form.Errors.Add("percentoff", "Must be a percentage from 1 to 100")
+			}
+			d.PercentOff = n
+		case "fixed":
+			amount, err := models.ParseMoney(form.Get("amountoff"))
+			if err != nil || amount <= 0 {
+				form.Errors.Add("amountoff", "Must be an amount of money, like 10.00")
+			}
+			d.AmountOff = amount
+		}
+		if !d.AppliesToDues && !d.AppliesToEvents {
+			form.Errors.Add("dues", "Must apply to dues, event fees, or both")
+		}
+		if p := form.Get("periods"); p != "" {
+			n, ok := util.IntOK(p, 1, 1000)
+			if !ok {
+				form.Errors.Add("periods", "Must be a number of invoices, or empty for no limit")
+			}
+			d.Periods = &n
+		}
+		if m := form.Get("maxuses"); m != "" {
+			n, ok := util.IntOK(m, 1, 100000)
+			if !ok {
+				form.Errors.Add("maxuses", "Must be a number of members, or empty for no limit")
+			}
+			d.MaxUses = &n
+		}
+		if e := form.Get("expires"); e != "" {
+			t, ok := util.DateOK(e)
+			if !ok {
+				form.Errors.Add("expires", "Must be a date, like 2020-12-31")
+			}
+			d.ExpiresOn = &t
+		}
+
+		if !form.Valid() {
+			dc.renderForm(w, r, form)
+			return
+		}
+
+		var err error
+		if d.ID == 0 {
+			err = dc.Discounts.Create(d)
+		} else {
+			err = dc.Discounts.Update(d)
+		}
+		if err != nil {
+			form.Errors.Add("saveError", err.Error())
+			dc.renderForm(w, r, form)
+			return
+		}
+
+		dc.Session.Put(r, "flash", "Discount saved")
+		http.Redirect(w, r, dc.rootURL()+"discounts", http.StatusSeeOther)
+	})
+}
+
+//SetActive retires a discount, which stops it being redeemed and taken off new invoices, or brings it back
+func (dc *DiscountController) SetActive(active bool) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dc.can(r, "finance.write") {
+			dc.forbidden(w)
+			return
+		}
+
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			dc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if err := dc.Discounts.SetActive(id, active); err != nil {
+			dc.serverError(w, err)
+			return
+		}
+
+		if active {
+			dc.Session.Put(r, "flash", "Discount is available again")
+		} else {
+			dc.Session.Put(r, "flash", "Discount retired")
+		}
+		http.Redirect(w, r, dc.rootURL()+"discounts", http.StatusSeeOther)
+	})
+}
+
+//ForMember shows a member's discounts with a form to redeem a code. Admins can also grant and end discounts.
+func (dc *DiscountController) ForMember() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			dc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !dc.canAccessMember(r, id, "finance.write") {
+			dc.forbidden(w)
+			return
+		}
+
+		dc.renderMember(w, r, id, util.NewForm(url.Values{}))
+	})
+}
+
+func (dc *DiscountController) renderMember(w http.ResponseWriter, r *http.Request, id int, form *util.Form) {
+	current, err := dc.Discounts.ForMember(id)
+	if err != nil {
+		dc.serverError(w, err)
+		return
+	}
+
+	td, err := dc.DefaultData(r)
+	if err != nil {
+		dc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Discounts"
+	td.Add("MemberID", id)
+	td.Add("Current", current)
+	td.Add("Form", form)
+
+	if dc.can(r, "finance.write") {
+		all, err := dc.Discounts.All()
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		now := time.Now()
+		available := []models.Discount{}
+		for _, d := range all {
+			if d.Available(now) {
+				available = append(available, d)
+			}
+		}
+		td.Add("Admin", true)
+		td.Add("Available", available)
+	}
+
+	if err := dc.DiscountView.Render(w, r, "member_discounts.gohtml", td); err != nil {
+		dc.serverError(w, err)
+		return
+	}
+}
+
+//Redeem gives a member the discount for the code they entered
+func (dc *DiscountController) Redeem() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			dc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !dc.canAccessMember(r, id, "finance.write") {
+			dc.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("code")
+		if !form.Valid() {
+			dc.renderMember(w, r, id, form)
+			return
+		}
+
+		d, err := dc.Discounts.Redeem(id, strings.TrimSpace(form.Get("code")), time.Now())
+		if err == models.ErrDiscountCode || err == models.ErrDiscountGranted {
+			form.Errors.Add("code", err.Error())
+			dc.renderMember(w, r, id, form)
+			return
+		}
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+
+		dc.Session.Put(r, "flash", fmt.Sprintf("%s applied: %s %s on your next invoices", d.Name, d.Describe(), d.AppliesTo()))
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/discounts", dc.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+//Grant gives a member a discount chosen by an admin, such as a scholarship or a comped membership
+func (dc *DiscountController) Grant() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dc.can(r, "finance.write") {
+			dc.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			dc.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("discount")
+		form.MaxLength("note", 1000)
+		discountID, ok := util.IntOK(form.Get("discount"), 1, math.MaxInt32)
+		if !ok {
+			form.Errors.Add("discount", "Choose a discount")
+		}
+		if !form.Valid() {
+			dc.renderMember(w, r, id, form)
+			return
+		}
+
+		err := dc.Discounts.Grant(id, discountID, dc.authenticatedUserID(r), form.Get("note"), time.Now())
+		if err == models.ErrDiscountCode || err == models.ErrDiscountGranted {
+			form.Errors.Add("discount", err.Error())
+			dc.renderMember(w, r, id, form)
+			return
+		}
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+
+		dc.Session.Put(r, "flash", "Discount granted")
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/discounts", dc.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+//End stops one of a member's discounts being taken off their invoices
+func (dc *DiscountController) End() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dc.can(r, "finance.write") {
+			dc.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			dc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		grantID, ok := util.IntOK(mux.Vars(r)["did"], 1, math.MaxInt32)
+		if !ok {
+			dc.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		if err := dc.Discounts.End(id, grantID, time.Now()); err != nil {
+			dc.serverError(w, err)
+			return
+		}
+
+		dc.Session.Put(r, "flash", "Discount ended")
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/discounts", dc.rootURL(), id), http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,365 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//DocumentController implements the handlers for printable invoices, receipts, donation acknowledgements and
+//year-end donation statements
+type DocumentController struct {
+	Controller
+	Invoices  Invoices
+	Payments  Payments
+	Donations Donations
+	Mailer    util.Mailer
+	PDFView   views.PDFView
+}
+
+// documentData is what the PDF templates are executed with
+type documentData struct {
+	Root          string
+	Org           interface{}
+	Member        *models.User
+	Address       *models.Address
+	Invoice       *models.Invoice
+	Payment       *models.Payment
+	Invoices      []models.Invoice
+	Donations     []models.InvoiceLine
+	DonationTotal models.Money
+	Year          int
+	Statement     []models.Donation
+	Voucher       *models.Voucher
+}
+
+//Initialize performs the required setup for a document controller
+func (dc *DocumentController) Initialize(cfg *util.Config, um Users, im Invoices, pm Payments, dm Donations, perm Permissions, m util.Mailer, l *util.Logger, s *sessions.Session) error {
+	dc.setup(cfg, um, l, s)
+	dc.Invoices = im
+	dc.Payments = pm
+	dc.Donations = dm
+	dc.Permissions = perm
+	dc.Mailer = m
+
+	dc.PDFView = views.PDFView{}
+
+	if err := dc.PDFView.LoadTemplates(); err != nil {
+		return fmt.Errorf("Error loading pdf templates: %v", err)
+	}
+
+	return nil
+}
+
+// newDocument fills in the parts common to every document for a member
+func (dc *DocumentController) newDocument(memberID int) (*documentData, error) {
+	member, err := dc.Users.Get(memberID)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := dc.Users.BillingAddress(memberID)
+	if err != nil {
+		return nil, err
+	}
+	return &documentData{Root: dc.rootURL(), Org: dc.AppConfig.Org, Member: member, Address: addr}, nil
+}
+
+// invoiceDocument gathers everything needed to print an invoice
+func (dc *DocumentController) invoiceDocument(inv *models.Invoice) (*documentData, error) {
+	if err := dc.Invoices.GetLines(inv); err != nil {
+		return nil, err
+	}
+	d, err := dc.newDocument(inv.MemberID)
+	if err != nil {
+		return nil, err
+	}
+	d.Invoice = inv
+	return d, nil
+}
+
+// paymentDocument gathers everything needed to print a receipt or acknowledgement for a payment
+func (dc *DocumentController) paymentDocument(p *models.Payment) (*documentData, error) {
+	invoices, err := dc.Invoices.GetForPayment(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	d, err := dc.newDocument(p.MemberID)
+	if err != nil {
+		return nil, err
+	}
+	d.Payment = p
+	for i := range invoices {
+		if err := dc.Invoices.GetLines(&invoices[i]); err != nil {
+			return nil, err
+		}
+		for _, l := range invoices[i].Lines {
+			if l.Category == "donation" {
+				d.Donations = append(d.Donations, l)
+				d.DonationTotal += l.Total()
+			}
+		}
+	}
+	d.Invoices = invoices
+	return d, nil
+}
+
+// statementDocument gathers everything needed to print a member's donation statement for a year
+func (dc *DocumentController) statementDocument(memberID, year int) (*documentData, error) {
+	donations, err := dc.Donations.ForYear(memberID, year)
+	if err != nil {
+		return nil, err
+	}
+	d, err := dc.newDocument(memberID)
+	if err != nil {
+		return nil, err
+	}
+	d.Year = year
+	d.Statement = donations
+	for _, don := range donations {
+		d.DonationTotal += don.Amount
+	}
+	return d, nil
+}
+
+// invoiceFromRequest looks up the invoice in the {id} route variable and checks the member may see it
+func (dc *DocumentController) invoiceFromRequest(w http.ResponseWriter, r *http.Request) (*models.Invoice, bool) {
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		dc.clientError(w, http.StatusBadRequest)
+		return nil, false
+	}
+	inv, err := dc.Invoices.Get(id)
+	if err != nil {
+		dc.notFound(w)
+		return nil, false
+	}
+	if !dc.canAccessMember(r, inv.MemberID, "finance.read") {
+		dc.forbidden(w)
+		return nil, false
+	}
+	return inv, true
+}
+
+// paymentFromRequest looks up the payment in the {id} route variable and checks the member may see it
+func (dc *DocumentController) paymentFromRequest(w http.ResponseWriter, r *http.Request) (*models.Payment, bool) {
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		dc.clientError(w, http.StatusBadRequest)
+		return nil, false
+	}
+	p, err := dc.Payments.Get(id)
+	if err != nil {
+		dc.notFound(w)
+		return nil, false
+	}
+	if !dc.canAccessMember(r, p.MemberID, "finance.read") {
+		dc.forbidden(w)
+		return nil, false
+	}
+	return p, true
+}
+
+// writePDF sends a finished document as a download
+func (dc *DocumentController) writePDF(w http.ResponseWriter, filename string, pdf []byte) {
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if _, err := w.Write(pdf); err != nil {
+		dc.Logger.Printf("could not write %s: %v", filename, err)
+	}
+}
+
+//InvoicePDF downloads a printable invoice
+func (dc *DocumentController) InvoicePDF() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inv, ok := dc.invoiceFromRequest(w, r)
+		if !ok {
+			return
+		}
+		d, err := dc.invoiceDocument(inv)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		pdf, err := dc.PDFView.Render("invoice.gotmpl", d)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		dc.writePDF(w, fmt.Sprintf("invoice-%d.pdf", inv.ID), pdf)
+	})
+}
+
+//ReceiptPDF downloads a printable receipt for a payment
+func (dc *DocumentController) ReceiptPDF() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := dc.paymentFromRequest(w, r)
+		if !ok {
+			return
+		}
+		d, err := dc.paymentDocument(p)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		pdf, err := dc.PDFView.Render("receipt.gotmpl", d)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		dc.writePDF(w, fmt.Sprintf("receipt-%d.pdf", p.ID), pdf)
+	})
+}
+
+//AcknowledgementPDF downloads the donation acknowledgement for a payment that included a donation
+func (dc *DocumentController) AcknowledgementPDF() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := dc.paymentFromRequest(w, r)
+		if !ok {
+			return
+		}
+		d, err := dc.paymentDocument(p)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		if len(d.Donations) == 0 {
+			dc.notFound(w)
+			return
+		}
+		pdf, err := dc.PDFView.Render("acknowledgement.gotmpl", d)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		dc.writePDF(w, fmt.Sprintf("donation-%d.pdf", p.ID), pdf)
+	})
+}
+
+//StatementPDF downloads a member's year-end donation statement
+func (dc *DocumentController) StatementPDF() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok1 := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		year, ok2 := util.IntOK(mux.Vars(r)["year"], 2000, 9999)
+		if !ok1 || !ok2 {
+			dc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !dc.canAccessMember(r, id, "finance.read") {
+			dc.forbidden(w)
+			return
+		}
+		d, err := dc.statementDocument(id, year)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		if len(d.Statement) == 0 {
+			dc.notFound(w)
+			return
+		}
+		pdf, err := dc.PDFView.Render("statement.gotmpl", d)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		dc.writePDF(w, fmt.Sprintf("donations-%d.pdf", year), pdf)
+	})
+}
+
+//EmailInvoice sends the invoice to the member with the PDF attached
+func (dc *DocumentController) EmailInvoice() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inv, ok := dc.invoiceFromRequest(w, r)
+		if !ok {
+			return
+		}
+		if err := dc.SendInvoice(inv); err != nil {
+			dc.Logger.Printf("could not email invoice %d: %v", inv.ID, err)
+			dc.Session.Put(r, "flash", "The invoice could not be emailed")
+		} else {
+			dc.Session.Put(r, "flash", "The invoice was emailed")
+		}
+		http.Redirect(w, r, fmt.Sprintf("%sinvoice/%d", dc.rootURL(), inv.ID), http.StatusSeeOther)
+	})
+}
+
+// SendInvoice emails an invoice to its member with the PDF attached
+func (dc *DocumentController) SendInvoice(inv *models.Invoice) error {
+	d, err := dc.invoiceDocument(inv)
+	if err != nil {
+		return err
+	}
+	pdf, err := dc.PDFView.Render("invoice.gotmpl", d)
+	if err != nil {
+		return err
+	}
+	return dc.Mailer.Send(&util.Message{
+		To:      []string{d.Member.Email},
+		Subject: fmt.Sprintf("%s invoice #%d", dc.AppConfig.Org.Name, inv.ID),
+		Body: fmt.Sprintf("Hi %s,\n\nYour invoice for %s is attached. You can also view and pay it online at %sinvoice/%d\n",
+			d.Member.Name, inv.Amount, dc.rootURL(), inv.ID),
+		Attachments: []util.Attachment{{Filename: fmt.Sprintf("invoice-%d.pdf", inv.ID), ContentType: "application/pdf", Data: pdf}},
+	})
+}
+
+// SendReceipt emails the receipt for a payment to its member, along with a donation acknowledgement if the payment included a donation
+func (dc *DocumentController) SendReceipt(paymentID int) error {
+	p, err := dc.Payments.Get(paymentID)
+	if err != nil {
+		return err
+	}
+	d, err := dc.paymentDocument(p)
+	if err != nil {
+		return err
+	}
+
+	pdf, err := dc.PDFView.Render("receipt.gotmpl", d)
+	if err != nil {
+		return err
+	}
+	attachments := []util.Attachment{{Filename: fmt.Sprintf("receipt-%d.pdf", p.ID), ContentType: "application/pdf", Data: pdf}}
+
+	if len(d.Donations) > 0 {
+		pdf, err := dc.PDFView.Render("acknowledgement.gotmpl", d)
+		if err != nil {
+			return err
+		}
+		attachments = append(attachments, util.Attachment{Filename: fmt.Sprintf("donation-%d.pdf", p.ID), ContentType: "application/pdf", Data: pdf})
+	}
+
+	return dc.Mailer.Send(&util.Message{
+		To:          []string{d.Member.Email},
+		Subject:     fmt.Sprintf("%s payment receipt #%d", dc.AppConfig.Org.Name, p.ID),
+		Body:        fmt.Sprintf("Hi %s,\n\nThank you, we received your payment of %s. Your receipt is attached.\n", d.Member.Name, p.Amount),
+		Attachments: attachments,
+	})
+}
+
+// SendDonationStatement emails a member their year-end donation statement
+func (dc *DocumentController) SendDonationStatement(memberID, year int) error {
+	d, err := dc.statementDocument(memberID, year)
+	if err != nil {
+		return err
+	}
+	if len(d.Statement) == 0 {
+		return fmt.Errorf("member %d made no donations in %d", memberID, year)
+	}
+	pdf, err := dc.PDFView.Render("statement.gotmpl", d)
+	if err != nil {
+		return err
+	}
+	return dc.Mailer.Send(&util.Message{
+		To:      []string{d.Member.Email},
+		Subject: fmt.Sprintf("%s donation statement for %d", dc.AppConfig.Org.Name, year),
+		Body: fmt.Sprintf("Hi %s,\n\nThank you for your donations to %s in %d, totalling %s. Your statement for your tax records is attached.\n",
+			d.Member.Name, dc.AppConfig.Org.Name, year, d.DonationTotal),
+		Attachments: []util.Attachment{{Filename: fmt.Sprintf("donations-%d.pdf", year), ContentType: "application/pdf", Data: pdf}},
+	})
+}
@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//DonationController implements the handlers for recurring donations and year-end donation statements
+type DonationController struct {
+	Controller
+	Donations    Donations
+	Sender       StatementSender
+	DonationView views.View
+}
+
+// donationYear is a year of a member's donations, for linking to the statement
+type donationYear struct {
+	Year  int
+	Total models.Money
+}
+
+//Initialize performs the required setup for a donation controller
+func (dc *DonationController) Initialize(cfg *util.Config, um Users, dm Donations, pm Permissions, ss StatementSender, l *util.Logger, s *sessions.Session) error {
+	dc.setup(cfg, um, l, s)
+	dc.Donations = dm
+	dc.Permissions = pm
+	dc.Sender = ss
+
+	dc.DonationView = views.View{}
+
+	if err := dc.DonationView.LoadTemplates("donation"); err != nil {
+		return fmt.Errorf("Error loading donation templates: %v", err)
+	}
+
+	return nil
+}
+
+//ForMember shows a member's monthly donation with a form to change it, and their statements for this year and last year
+func (dc *DonationController) ForMember() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			dc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !dc.canAccessMember(r, id, "finance.write") {
+			dc.forbidden(w)
+			return
+		}
+
+		amount, err := dc.Donations.Recurring(id)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		form := util.NewForm(url.Values{})
+		if amount > 0 {
+			form.Set("amount", amount.Decimal())
+		}
+		dc.renderMember(w, r, id, amount, form)
+	})
+}
+
+func (dc *DonationController) renderMember(w http.ResponseWriter, r *http.Request, id int, amount models.Money, form *util.Form) {
+	years := []donationYear{}
+	now := time.Now()
+	for _, y := range []int{now.Year(), now.Year() - 1} {
+		donations, err := dc.Donations.ForYear(id, y)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		if len(donations) == 0 {
+			continue
+		}
+		dy := donationYear{Year: y}
+		for _, d := range donations {
+			dy.Total += d.Amount
+		}
+		years = append(years, dy)
+	}
+
+	td, err := dc.DefaultData(r)
+	if err != nil {
+		dc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Donations"
+	td.Add("MemberID", id)
+	td.Add("Recurring", amount)
+	td.Add("Years", years)
+	td.Add("Form", form)
+
+	if err := dc.DonationView.Render(w, r, "member_donation.gohtml", td); err != nil {
+		dc.serverError(w, err)
+		return
+	}
+}
+
+//SetRecurring sets or changes a member's monthly donation. It is added to their dues invoices from the next renewal.
+func (dc *DonationController) SetRecurring() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			dc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !dc.canAccessMember(r, id, "finance.write") {
+			dc.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("amount")
+		var amount models.Money
+		if a := form.Get("amount"); a != "" {
+			var err error
+			amount, err = models.ParseMoney(a)
+			if err != nil || amount <= 0 {
+				form.Errors.Add("amount", "Must be an amount of money, like 10.00")
+			}
+		}
+		if !form.Valid() {
+			current, err := dc.Donations.Recurring(id)
+			if err != nil {
+				dc.serverError(w, err)
+				return
+			}
+			dc.renderMember(w, r, id, current, form)
+			return
+		}
+
+		if err := dc.Donations.SetRecurring(id, amount); err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		dc.Session.Put(r, "flash", fmt.Sprintf("Thank you! Your monthly donation of %s will be added to your dues from your next renewal.", amount))
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/donation", dc.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+//CancelRecurring stops a member's monthly donation
+func (dc *DonationController) CancelRecurring() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			dc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !dc.canAccessMember(r, id, "finance.write") {
+			dc.forbidden(w)
+			return
+		}
+		if err := dc.Donations.SetRecurring(id, 0); err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		dc.Session.Put(r, "flash", "Your monthly donation has been cancelled")
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/donation", dc.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+// statementYear reads the year from the {year} route variable or the "year" query parameter, defaulting to last year
+func statementYear(r *http.Request) int {
+	y := mux.Vars(r)["year"]
+	if y == "" {
+		y = r.URL.Query().Get("year")
+	}
+	if year, ok := util.IntOK(y, 2000, 9999); ok {
+		return year
+	}
+	return time.Now().Year() - 1
+}
+
+//Statements lists everyone who donated during a year, with their totals and statements
+func (dc *DonationController) Statements() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dc.can(r, "finance.read") {
+			dc.forbidden(w)
+			return
+		}
+
+		year := statementYear(r)
+		donors, err := dc.Donations.Donors(year)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		var total models.Money
+		for _, d := range donors {
+			total += d.Total
+		}
+
+		td, err := dc.DefaultData(r)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		td.PageTitle = fmt.Sprintf("Donation Statements %d", year)
+		td.Add("Year", year)
+		td.Add("PrevYear", year-1)
+		td.Add("NextYear", year+1)
+		td.Add("Donors", donors)
+		td.Add("Total", total)
+
+		if err := dc.DonationView.Render(w, r, "statements.gohtml", td); err != nil {
+			dc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//SendStatements emails every donor their statement for a year. Failures are logged and counted, and the rest are still sent.
+func (dc *DonationController) SendStatements() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dc.can(r, "finance.write") {
+			dc.forbidden(w)
+			return
+		}
+
+		year := statementYear(r)
+		donors, err := dc.Donations.Donors(year)
+		if err != nil {
+			dc.serverError(w, err)
+			return
+		}
+		sent, failed := 0, 0
+		for _, d := range donors {
+			if err := dc.Sender.SendDonationStatement(d.MemberID, year); err != nil {
+				dc.Logger.Printf("could not email %d donation statement to member %d: %v", year, d.MemberID, err)
+				failed++
+				continue
+			}
+			sent++
+		}
+
+		if failed > 0 {
+			dc.Session.Put(r, "flash", fmt.Sprintf("Sent %d donation statements, %d could not be sent", sent, failed))
+		} else {
+			dc.Session.Put(r, "flash", fmt.Sprintf("Sent %d donation statements", sent))
+		}
+		http.Redirect(w, r, fmt.Sprintf("%sdonations/statements?year=%d", dc.rootURL(), year), http.StatusSeeOther)
+	})
+}
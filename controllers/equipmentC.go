@@ -0,0 +1,528 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+// maxEquipmentFileSize is the largest photo or manual that can be uploaded
+const maxEquipmentFileSize = 10 << 20
+
+//EquipmentController implements the handlers for managing the equipment inventory
+type EquipmentController struct {
+	Controller
+	Equipment     Equipment
+	Areas         Areas
+	EquipmentView views.View
+}
+
+//Initialize performs the required setup for an equipment controller
+func (ec *EquipmentController) Initialize(cfg *util.Config, um Users, em Equipment, am Areas, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	ec.setup(cfg, um, l, s)
+	ec.Equipment = em
+	ec.Areas = am
+	ec.Permissions = pm
+
+	ec.EquipmentView = views.View{}
+
+	if err := ec.EquipmentView.LoadTemplates("equipment"); err != nil {
+		return fmt.Errorf("Error loading equipment templates: %v", err)
+	}
+
+	return nil
+}
+
+// equipmentFilter reads the area and status to list equipment for from the query string
+func equipmentFilter(r *http.Request) (models.EquipmentFilter, *util.Form) {
+	form := util.NewForm(r.URL.Query())
+	form.PermittedValues("status", models.EquipmentStatuses...)
+	f := models.EquipmentFilter{Status: form.Get("status")}
+	if !form.Valid() {
+		f.Status = ""
+		form.Set("status", "")
+	}
+	if a := form.Get("area"); a != "" {
+		f.AreaID, _ = util.IntOK(a, 1, math.MaxInt32)
+	}
+	return f, form
+}
+
+//List shows the equipment inventory, filtered by area and status
+func (ec *EquipmentController) List() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ec.can(r, "space.write") {
+			ec.forbidden(w)
+			return
+		}
+
+		filter, form := equipmentFilter(r)
+		equipment, err := ec.Equipment.List(filter)
+		if err != nil {
+			ec.serverError(w, err)
+			return
+		}
+		areas, err := ec.Areas.All()
+		if err != nil {
+			ec.serverError(w, err)
+			return
+		}
+
+		td, err := ec.DefaultData(r)
+		if err != nil {
+			ec.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Equipment"
+		td.Add("Equipment", equipment)
+		td.Add("Areas", areas)
+		td.Add("Statuses", models.EquipmentStatuses)
+		td.Add("Filter", form)
+
+		if err := ec.EquipmentView.Render(w, r, "equipment_list.gohtml", td); err != nil {
+			ec.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Export downloads the equipment inventory, filtered the same way as the list, as a spreadsheet
+func (ec *EquipmentController) Export() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ec.can(r, "space.write") {
+			ec.forbidden(w)
+			return
+		}
+
+		filter, _ := equipmentFilter(r)
+		equipment, err := ec.Equipment.List(filter)
+		if err != nil {
+			ec.serverError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"equipment-%s.csv\"", time.Now().Format("20060102")))
+
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"ID", "Asset tag", "Name", "Area", "Status", "Manufacturer", "Model", "Serial number",
+			"Purchase price", "Purchased on", "In the space since", "Notes"})
+		for _, e := range equipment {
+			var tag, price, purchased, brought string
+			if e.AssetTag != nil {
+				tag = *e.AssetTag
+			}
+			if e.PurchasePrice != nil {
+				price = e.PurchasePrice.Decimal()
+			}
+			if e.PurchasedOn != nil {
+				purchased = e.PurchasedOn.Format("2006-01-02")
+			}
+			if e.BroughtAt != nil {
+				brought = e.BroughtAt.Format("2006-01-02")
+			}
+			cw.Write([]string{
+				strconv.Itoa(e.ID),
+				spreadsheetText(tag),
+				spreadsheetText(e.Name),
+				spreadsheetText(e.Area),
+				e.Status,
+				spreadsheetText(e.Manufacturer),
+				spreadsheetText(e.Model),
+				spreadsheetText(e.SerialNumber),
+				price,
+				purchased,
+				brought,
+				spreadsheetText(e.Notes),
+			})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			ec.Logger.Printf("could not write equipment csv: %v", err)
+		}
+	})
+}
+
+//Show displays one piece of equipment with its photos, manuals and the areas it has been moved between
+func (ec *EquipmentController) Show() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ec.can(r, "space.write") {
+			ec.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ec.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		e, err := ec.Equipment.Get(id)
+		if err != nil {
+			ec.notFound(w)
+			return
+		}
+		moves, err := ec.Equipment.Moves(id)
+		if err != nil {
+			ec.serverError(w, err)
+			return
+		}
+		files, err := ec.Equipment.Files(id)
+		if err != nil {
+			ec.serverError(w, err)
+			return
+		}
+		areas, err := ec.Areas.All()
+		if err != nil {
+			ec.serverError(w, err)
+			return
+		}
+
+		td, err := ec.DefaultData(r)
+		if err != nil {
+			ec.serverError(w, err)
+			return
+		}
+		td.PageTitle = e.Name
+		td.Add("Equipment", e)
+		td.Add("Moves", moves)
+		td.Add("Files", files)
+		td.Add("Areas", areas)
+		td.Add("FileKinds", models.EquipmentFileKinds)
+
+		if err := ec.EquipmentView.Render(w, r, "equipment.gohtml", td); err != nil {
+			ec.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Form displays the form for a new piece of equipment, or for editing an existing one
+func (ec *EquipmentController) Form() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ec.can(r, "space.write") {
+			ec.forbidden(w)
+			return
+		}
+
+		form := util.NewForm(url.Values{})
+		form.Set("status", "available")
+		if a := r.URL.Query().Get("area"); a != "" {
+			form.Set("area", a)
+		}
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			id, ok := util.IntOK(idStr, 1, math.MaxInt32)
+			if !ok {
+				ec.clientError(w, http.StatusBadRequest)
+				return
+			}
+			e, err := ec.Equipment.Get(id)
+			if err != nil {
+				ec.notFound(w)
+				return
+			}
+			form.Set("id", strconv.Itoa(e.ID))
+			form.Set("area", strconv.Itoa(e.AreaID))
+			form.Set("name", e.Name)
+			form.Set("manufacturer", e.Manufacturer)
+			form.Set("model", e.Model)
+			form.Set("serial", e.SerialNumber)
+			form.Set("status", e.Status)
+			form.Set("notes", e.Notes)
+			if e.AssetTag != nil {
+				form.Set("assettag", *e.AssetTag)
+			}
+			if e.PurchasePrice != nil {
+				form.Set("price", e.PurchasePrice.Decimal())
+			}
+			if e.PurchasedOn != nil {
+				form.Set("purchasedon", e.PurchasedOn.Format("2006-01-02"))
+			}
+			if e.BroughtAt != nil {
+				form.Set("broughton", e.BroughtAt.Format("2006-01-02"))
+			}
+			setLimitsForm(form, e.ReservationLimits)
+		}
+
+		ec.renderForm(w, r, form)
+	})
+}
+
+func (ec *EquipmentController) renderForm(w http.ResponseWriter, r *http.Request, form *util.Form) {
+	areas, err := ec.Areas.All()
+	if err != nil {
+		ec.serverError(w, err)
+		return
+	}
+
+	td, err := ec.DefaultData(r)
+	if err != nil {
+		ec.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Equipment"
+	td.Add("Form", form)
+	td.Add("Areas", areas)
+	td.Add("Statuses", models.EquipmentStatuses)
+
+	if err := ec.EquipmentView.Render(w, r, "equipment_form.gohtml", td); err != nil {
+		ec.serverError(w, err)
+		return
+	}
+}
+
+//Save validates and saves a new or edited piece of equipment. The area can only be chosen for new equipment;
+//existing equipment is moved so that the move is recorded.
+func (ec *EquipmentController) Save() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ec.can(r, "space.write") {
+			ec.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("name", "status")
+		form.MaxLength("name", 255)
+		form.MaxLength("manufacturer", 255)
+		form.MaxLength("model", 255)
+		form.MaxLength("serial", 255)
+		form.MaxLength("assettag", 64)
+		form.MaxLength("notes", 2000)
+		form.PermittedValues("status", models.EquipmentStatuses...)
+
+		e := &models.Equipment{
+			Name:         form.Get("name"),
+			Manufacturer: form.Get("manufacturer"),
+			Model:        form.Get("model"),
+			SerialNumber: form.Get("serial"),
+			Status:       form.Get("status"),
+			Notes:        form.Get("notes"),
+		}
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			e.ID, _ = util.IntOK(idStr, 1, math.MaxInt32)
+			form.Set("id", idStr)
+		} else {
+			form.Required("area")
+			if a := form.Get("area"); a != "" {
+				id, ok := util.IntOK(a, 1, math.MaxInt32)
+				if !ok {
+					form.Errors.Add("area", "Choose an area")
+				}
+				e.AreaID = id
+			}
+		}
+		if t := strings.TrimSpace(form.Get("assettag")); t != "" {
+			e.AssetTag = &t
+		}
+		if p := form.Get("price"); p != "" {
+			price, err := models.ParseMoney(p)
+			if err != nil || price < 0 {
+				form.Errors.Add("price", "Must be an amount of money, like 399.00")
+			}
+			e.PurchasePrice = &price
+		}
+		if d := form.Get("purchasedon"); d != "" {
+			t, ok := util.DateOK(d)
+			if !ok {
+				form.Errors.Add("purchasedon", "Must be a date")
+			}
+			e.PurchasedOn = &t
+		}
+		if d := form.Get("broughton"); d != "" {
+			t, ok := util.DateOK(d)
+			if !ok {
+				form.Errors.Add("broughton", "Must be a date")
+			}
+			e.BroughtAt = &t
+		}
+		e.ReservationLimits = limitsFromForm(form)
+
+		if !form.Valid() {
+			ec.renderForm(w, r, form)
+			return
+		}
+
+		var err error
+		if e.ID == 0 {
+			err = ec.Equipment.Create(e)
+		} else {
+			err = ec.Equipment.Update(e)
+		}
+		if err != nil {
+			form.Errors.Add("saveError", err.Error())
+			ec.renderForm(w, r, form)
+			return
+		}
+
+		ec.Session.Put(r, "flash", "Equipment saved")
+		http.Redirect(w, r, fmt.Sprintf("%sequipment/%d", ec.rootURL(), e.ID), http.StatusSeeOther)
+	})
+}
+
+//Move puts a piece of equipment in another area, recording who moved it and why
+func (ec *EquipmentController) Move() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ec.can(r, "space.write") {
+			ec.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ec.clientError(w, http.StatusBadRequest)
+			return
+		}
+		r.ParseForm()
+		areaID, ok := util.IntOK(r.PostForm.Get("area"), 1, math.MaxInt32)
+		if !ok {
+			ec.Session.Put(r, "flash", "Choose the area to move the equipment to")
+			http.Redirect(w, r, fmt.Sprintf("%sequipment/%d", ec.rootURL(), id), http.StatusSeeOther)
+			return
+		}
+		note := strings.TrimSpace(r.PostForm.Get("note"))
+		if len(note) > 2000 {
+			note = note[:2000]
+		}
+
+		if err := ec.Equipment.Move(id, areaID, ec.authenticatedUserID(r), note, time.Now()); err != nil {
+			ec.serverError(w, err)
+			return
+		}
+
+		ec.Session.Put(r, "flash", "Equipment moved")
+		http.Redirect(w, r, fmt.Sprintf("%sequipment/%d", ec.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+//Upload attaches a photo or manual to a piece of equipment
+func (ec *EquipmentController) Upload() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ec.can(r, "space.write") {
+			ec.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ec.clientError(w, http.StatusBadRequest)
+			return
+		}
+		back := fmt.Sprintf("%sequipment/%d", ec.rootURL(), id)
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxEquipmentFileSize)
+		if err := r.ParseMultipartForm(maxEquipmentFileSize); err != nil {
+			ec.Session.Put(r, "flash", "Choose a file smaller than 10MB")
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+		form := util.NewForm(r.PostForm)
+		form.Required("kind")
+		form.PermittedValues("kind", models.EquipmentFileKinds...)
+		file, header, err := r.FormFile("file")
+		if err != nil || !form.Valid() {
+			ec.Session.Put(r, "flash", "Choose a photo or manual to upload")
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+		defer file.Close()
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			ec.serverError(w, err)
+			return
+		}
+
+		f := &models.EquipmentFile{
+			EquipmentID: id,
+			Kind:        form.Get("kind"),
+			Filename:    filepath.Base(header.Filename),
+			ContentType: http.DetectContentType(data),
+			Data:        data,
+		}
+		if f.Kind == "photo" && !strings.HasPrefix(f.ContentType, "image/") {
+			ec.Session.Put(r, "flash", "Photos must be image files")
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+		if err := ec.Equipment.AddFile(f, ec.authenticatedUserID(r)); err != nil {
+			ec.serverError(w, err)
+			return
+		}
+
+		ec.Session.Put(r, "flash", fmt.Sprintf("Uploaded %s", f.Filename))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+	})
+}
+
+//File sends a photo or manual attached to a piece of equipment
+func (ec *EquipmentController) File() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ec.can(r, "space.write") {
+			ec.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ec.clientError(w, http.StatusBadRequest)
+			return
+		}
+		fileID, ok := util.IntOK(mux.Vars(r)["fid"], 1, math.MaxInt32)
+		if !ok {
+			ec.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		f, err := ec.Equipment.File(id, fileID)
+		if err != nil {
+			ec.notFound(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", f.ContentType)
+		disposition := "attachment"
+		if f.Kind == "photo" {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, f.Filename))
+		w.Write(f.Data)
+	})
+}
+
+//DeleteFile removes a photo or manual from a piece of equipment
+func (ec *EquipmentController) DeleteFile() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ec.can(r, "space.write") {
+			ec.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			ec.clientError(w, http.StatusBadRequest)
+			return
+		}
+		fileID, ok := util.IntOK(mux.Vars(r)["fid"], 1, math.MaxInt32)
+		if !ok {
+			ec.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		if err := ec.Equipment.DeleteFile(id, fileID); err != nil {
+			ec.serverError(w, err)
+			return
+		}
+
+		ec.Session.Put(r, "flash", "File removed")
+		http.Redirect(w, r, fmt.Sprintf("%sequipment/%d", ec.rootURL(), id), http.StatusSeeOther)
+	})
+}
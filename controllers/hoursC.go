@@ -0,0 +1,267 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//HoursController implements the handlers for managing the open hours and closures of each location
+type HoursController struct {
+	Controller
+	Hours     Hours
+	Locations Locations
+	HoursView views.View
+}
+
+//Initialize performs the required setup for an hours controller
+func (hc *HoursController) Initialize(cfg *util.Config, um Users, hm Hours, lm Locations, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	hc.setup(cfg, um, l, s)
+	hc.Hours = hm
+	hc.Locations = lm
+	hc.Permissions = pm
+
+	hc.HoursView = views.View{}
+
+	if err := hc.HoursView.LoadTemplates("hours"); err != nil {
+		return fmt.Errorf("Error loading hours templates: %v", err)
+	}
+
+	return nil
+}
+
+// locationFromRequest checks the logged in member can manage the space and gets the location named in the URL.
+// Writes the error response and returns false if not.
+func (hc *HoursController) locationFromRequest(w http.ResponseWriter, r *http.Request) (*models.Location, bool) {
+	if !hc.can(r, "space.write") {
+		hc.forbidden(w)
+		return nil, false
+	}
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		hc.clientError(w, http.StatusBadRequest)
+		return nil, false
+	}
+	l, err := hc.Locations.Get(id)
+	if err != nil {
+		hc.notFound(w)
+		return nil, false
+	}
+	return l, true
+}
+
+//Show lists the weekly open hours and the upcoming closures of a location, with the forms to change them
+func (hc *HoursController) Show() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, ok := hc.locationFromRequest(w, r)
+		if !ok {
+			return
+		}
+		hc.render(w, r, l, util.NewForm(url.Values{}), util.NewForm(url.Values{}))
+	})
+}
+
+func (hc *HoursController) render(w http.ResponseWriter, r *http.Request, l *models.Location, hoursForm, closureForm *util.Form) {
+	hours, err := hc.Hours.Hours(l.ID)
+	if err != nil {
+		hc.serverError(w, err)
+		return
+	}
+	closures, err := hc.Hours.Closures(l.ID, time.Now())
+	if err != nil {
+		hc.serverError(w, err)
+		return
+	}
+	weekdays := []string{}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		weekdays = append(weekdays, d.String())
+	}
+
+	td, err := hc.DefaultData(r)
+	if err != nil {
+		hc.serverError(w, err)
+		return
+	}
+	td.PageTitle = l.Name + " hours"
+	td.Add("Location", l)
+	td.Add("Hours", hours)
+	td.Add("Closures", closures)
+	td.Add("Weekdays", weekdays)
+	td.Add("HoursForm", hoursForm)
+	td.Add("ClosureForm", closureForm)
+
+	if err := hc.HoursView.Render(w, r, "hours.gohtml", td); err != nil {
+		hc.serverError(w, err)
+		return
+	}
+}
+
+// clockOK returns a time of day in the hh:mm format used by time inputs and an OK flag
+func clockOK(val string) (string, bool) {
+	if _, err := time.Parse("15:04", val); err != nil {
+		return "", false
+	}
+	return val, true
+}
+
+//AddHours adds a period the location is open every week. Closing at 00:00 means staying open until midnight.
+func (hc *HoursController) AddHours() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, ok := hc.locationFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("weekday", "opens", "closes")
+
+		h := &models.OpenHours{LocationID: l.ID}
+		if d := form.Get("weekday"); d != "" {
+			if h.Weekday, ok = util.IntOK(d, 0, 6); !ok {
+				form.Errors.Add("weekday", "Choose a day")
+			}
+		}
+		if t := form.Get("opens"); t != "" {
+			if h.Opens, ok = clockOK(t); !ok {
+				form.Errors.Add("opens", "Must be a time")
+			}
+		}
+		if t := form.Get("closes"); t != "" {
+			if h.Closes, ok = clockOK(t); !ok {
+				form.Errors.Add("closes", "Must be a time")
+			}
+			if h.Closes == "00:00" {
+				h.Closes = "24:00"
+			}
+		}
+		if form.Valid() && h.Closes <= h.Opens {
+			form.Errors.Add("closes", "Must be after it opens")
+		}
+
+		if !form.Valid() {
+			hc.render(w, r, l, form, util.NewForm(url.Values{}))
+			return
+		}
+		if err := hc.Hours.AddHours(h); err != nil {
+			form.Errors.Add("saveError", err.Error())
+			hc.render(w, r, l, form, util.NewForm(url.Values{}))
+			return
+		}
+
+		hc.Session.Put(r, "flash", "Open hours added")
+		http.Redirect(w, r, fmt.Sprintf("%slocation/%d/hours", hc.rootURL(), l.ID), http.StatusSeeOther)
+	})
+}
+
+//DeleteHours removes a period the location is open every week
+func (hc *HoursController) DeleteHours() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, ok := hc.locationFromRequest(w, r)
+		if !ok {
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["hid"], 1, math.MaxInt32)
+		if !ok {
+			hc.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		if err := hc.Hours.DeleteHours(l.ID, id); err != nil {
+			hc.serverError(w, err)
+			return
+		}
+
+		hc.Session.Put(r, "flash", "Open hours removed")
+		http.Redirect(w, r, fmt.Sprintf("%slocation/%d/hours", hc.rootURL(), l.ID), http.StatusSeeOther)
+	})
+}
+
+//AddClosure closes the location for a holiday or other reason. Leaving out the times closes it for whole days,
+//and leaving out the last day closes it for one day.
+func (hc *HoursController) AddClosure() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, ok := hc.locationFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("from", "reason")
+		form.MaxLength("reason", 255)
+
+		c := &models.Closure{LocationID: l.ID, Reason: strings.TrimSpace(form.Get("reason"))}
+		if form.Get("from") != "" {
+			until := form.Get("until")
+			if until == "" {
+				until = form.Get("from")
+			}
+			fromTime, untilTime := form.Get("fromtime"), form.Get("untiltime")
+			if fromTime == "" {
+				fromTime = "00:00"
+			}
+			if c.Starts, ok = util.DateTimeOK(form.Get("from"), fromTime); !ok {
+				form.Errors.Add("from", "Must be a date, with a time if it is not closed all day")
+			}
+			if untilTime == "" {
+				if c.Ends, ok = util.DateOK(until); ok {
+					c.Ends = c.Ends.AddDate(0, 0, 1)
+				}
+			} else {
+				c.Ends, ok = util.DateTimeOK(until, untilTime)
+			}
+			if !ok {
+				form.Errors.Add("until", "Must be a date, with a time if it is not closed all day")
+			} else if !c.Ends.After(c.Starts) {
+				form.Errors.Add("until", "Must be after the closure starts")
+			}
+		}
+
+		if !form.Valid() {
+			hc.render(w, r, l, util.NewForm(url.Values{}), form)
+			return
+		}
+		if err := hc.Hours.AddClosure(c, hc.authenticatedUserID(r)); err != nil {
+			form.Errors.Add("saveError", err.Error())
+			hc.render(w, r, l, util.NewForm(url.Values{}), form)
+			return
+		}
+
+		hc.Session.Put(r, "flash", "Closure added")
+		http.Redirect(w, r, fmt.Sprintf("%slocation/%d/hours", hc.rootURL(), l.ID), http.StatusSeeOther)
+	})
+}
+
+//DeleteClosure removes a closure, opening the location again for that time
+func (hc *HoursController) DeleteClosure() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, ok := hc.locationFromRequest(w, r)
+		if !ok {
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["cid"], 1, math.MaxInt32)
+		if !ok {
+			hc.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		if err := hc.Hours.DeleteClosure(l.ID, id); err != nil {
+			hc.serverError(w, err)
+			return
+		}
+
+		hc.Session.Put(r, "flash", "Closure removed")
+		http.Redirect(w, r, fmt.Sprintf("%slocation/%d/hours", hc.rootURL(), l.ID), http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//KioskController implements the handlers for members checking in at the kiosk of a location. Members check
+//themselves in; space managers running the kiosk can check in anyone, and let them in while it is closed.
+type KioskController struct {
+	Controller
+	Kiosk     Kiosk
+	Locations Locations
+	KioskView views.View
+}
+
+//Initialize performs the required setup for a kiosk controller
+func (kc *KioskController) Initialize(cfg *util.Config, um Users, km Kiosk, lm Locations, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	kc.setup(cfg, um, l, s)
+	kc.Kiosk = km
+	kc.Locations = lm
+	kc.Permissions = pm
+
+	kc.KioskView = views.View{}
+
+	if err := kc.KioskView.LoadTemplates("kiosk"); err != nil {
+		return fmt.Errorf("Error loading kiosk templates: %v", err)
+	}
+
+	return nil
+}
+
+// locationFromRequest checks someone is logged in at the kiosk and gets the location named in the URL.
+// Writes the error response and returns false if not.
+func (kc *KioskController) locationFromRequest(w http.ResponseWriter, r *http.Request) (*models.Location, bool) {
+	if kc.authenticatedUserID(r) == 0 {
+		kc.forbidden(w)
+		return nil, false
+	}
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		kc.clientError(w, http.StatusBadRequest)
+		return nil, false
+	}
+	l, err := kc.Locations.Get(id)
+	if err != nil {
+		kc.notFound(w)
+		return nil, false
+	}
+	return l, true
+}
+
+//Show displays the check-in form of a location's kiosk, with today's check-ins for space managers
+func (kc *KioskController) Show() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, ok := kc.locationFromRequest(w, r)
+		if !ok {
+			return
+		}
+		kc.render(w, r, l, util.NewForm(url.Values{}))
+	})
+}
+
+func (kc *KioskController) render(w http.ResponseWriter, r *http.Request, l *models.Location, form *util.Form) {
+	td, err := kc.DefaultData(r)
+	if err != nil {
+		kc.serverError(w, err)
+		return
+	}
+	staff := kc.can(r, "space.write")
+	if staff {
+		now := time.Now()
+		checkIns, err := kc.Kiosk.Since(l.ID, time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()))
+		if err != nil {
+			kc.serverError(w, err)
+			return
+		}
+		td.Add("CheckIns", checkIns)
+	}
+	td.PageTitle = l.Name + " check-in"
+	td.Add("Location", l)
+	td.Add("Form", form)
+	td.Add("Staff", staff)
+
+	if err := kc.KioskView.Render(w, r, "kiosk.gohtml", td); err != nil {
+		kc.serverError(w, err)
+		return
+	}
+}
+
+//CheckIn records a member arriving at the location. It is refused while the location is closed, unless a space
+//manager lets them in anyway.
+func (kc *KioskController) CheckIn() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, ok := kc.locationFromRequest(w, r)
+		if !ok {
+			return
+		}
+		userID := kc.authenticatedUserID(r)
+		staff := kc.can(r, "space.write")
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+
+		c := &models.CheckIn{LocationID: l.ID, MemberID: userID, CheckedInBy: &userID}
+		if m := form.Get("member"); m != "" && m != strconv.Itoa(userID) {
+			if !staff {
+				kc.forbidden(w)
+				return
+			}
+			if c.MemberID, ok = util.IntOK(m, 1, math.MaxInt32); !ok {
+				form.Errors.Add("member", "Must be a member number")
+				kc.render(w, r, l, form)
+				return
+			}
+		}
+
+		// space managers can let members in while the location is closed, for work days or fixing things
+		override := form.Get("outsidehours") == "on" && staff
+		err := kc.Kiosk.CheckIn(c, override, time.Now())
+		if _, closed := err.(*models.ClosedError); closed {
+			form.Errors.Add("saveError", err.Error())
+			kc.render(w, r, l, form)
+			return
+		}
+		if err == models.ErrNoSuchMember {
+			form.Errors.Add("member", err.Error())
+			kc.render(w, r, l, form)
+			return
+		}
+		if err != nil {
+			kc.serverError(w, err)
+			return
+		}
+
+		msg := fmt.Sprintf("%s is checked in", c.Name)
+		if c.Events > 0 {
+			msg += fmt.Sprintf(" and checked in to %d event(s) here", c.Events)
+		}
+		kc.Session.Put(r, "flash", msg)
+		http.Redirect(w, r, fmt.Sprintf("%slocation/%d/kiosk", kc.rootURL(), l.ID), http.StatusSeeOther)
+	})
+}
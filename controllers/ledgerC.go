@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//LedgerController implements the handlers for member account statements
+type LedgerController struct {
+	Controller
+	Ledgers    Ledgers
+	LedgerView views.View
+}
+
+//Initialize performs the required setup for a ledger controller
+func (lc *LedgerController) Initialize(cfg *util.Config, um Users, lm Ledgers, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	lc.setup(cfg, um, l, s)
+	lc.Ledgers = lm
+	lc.Permissions = pm
+
+	lc.LedgerView = views.View{}
+
+	if err := lc.LedgerView.LoadTemplates("ledger"); err != nil {
+		return fmt.Errorf("Error loading ledger templates: %v", err)
+	}
+
+	return nil
+}
+
+// ledgerFromRequest checks access and builds the ledger for the member and date range in the request.
+// Members may see their own ledger; treasurers (finance.read) may see anyone's.
+func (lc *LedgerController) ledgerFromRequest(w http.ResponseWriter, r *http.Request) (*models.User, *models.Ledger, bool) {
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		lc.clientError(w, http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if !lc.canAccessMember(r, id, "finance.read") {
+		lc.forbidden(w)
+		return nil, nil, false
+	}
+
+	member, err := lc.Users.Get(id)
+	if err != nil {
+		lc.notFound(w)
+		return nil, nil, false
+	}
+
+	from, to := dateRange(r)
+	ledger, err := lc.Ledgers.ForMember(id, from, to)
+	if err != nil {
+		lc.serverError(w, err)
+		return nil, nil, false
+	}
+	return member, ledger, true
+}
+
+//Show displays a member's account statement
+func (lc *LedgerController) Show() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		member, ledger, ok := lc.ledgerFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		td, err := lc.DefaultData(r)
+		if err != nil {
+			lc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Account Statement"
+		td.Add("Member", member)
+		td.Add("Ledger", ledger)
+		td.Add("Range", fmt.Sprintf("from=%s&to=%s", ledger.From.Format("2006-01-02"), ledger.To.Format("2006-01-02")))
+
+		if err := lc.LedgerView.Render(w, r, "ledger.gohtml", td); err != nil {
+			lc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//CSV downloads a member's account statement as a spreadsheet
+func (lc *LedgerController) CSV() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		member, ledger, ok := lc.ledgerFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", ledgerFilename(member, ledger, "csv")))
+
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"Date", "Type", "Reference", "Description", "Charge", "Credit", "Balance"})
+		cw.Write([]string{ledger.From.Format("2006-01-02"), "", "", "Opening balance", "", "", ledger.Opening.Decimal()})
+		for _, e := range ledger.Entries {
+			cw.Write([]string{
+				e.Date.Format("2006-01-02"),
+				e.Kind,
+				fmt.Sprintf("%d", e.Ref),
+				spreadsheetText(e.Description),
+				e.Charge.Decimal(),
+				e.Credit.Decimal(),
+				e.Balance.Decimal(),
+			})
+		}
+		cw.Write([]string{ledger.To.Format("2006-01-02"), "", "", "Closing balance", ledger.TotalCharges.Decimal(), ledger.TotalCredits.Decimal(), ledger.Closing.Decimal()})
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			lc.Logger.Printf("could not write ledger csv: %v", err)
+		}
+	})
+}
+
+//PDF downloads a member's account statement as a printable document
+func (lc *LedgerController) PDF() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		member, ledger, ok := lc.ledgerFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		doc := util.NewPDF()
+		doc.Heading("Account Statement")
+		doc.Text(fmt.Sprintf("%s\n%s to %s", member.Name, ledger.From.Format("Jan 2, 2006"), ledger.To.Format("Jan 2, 2006")))
+		doc.Space(6)
+
+		rows := [][]string{{"", "Opening balance", "", "", ledger.Opening.String()}}
+		for _, e := range ledger.Entries {
+			rows = append(rows, []string{e.Date.Format("2006-01-02"), e.Description, blankZero(e.Charge), blankZero(e.Credit), e.Balance.String()})
+		}
+		rows = append(rows, []string{"*", "Closing balance", ledger.TotalCharges.String(), ledger.TotalCredits.String(), ledger.Closing.String()})
+
+		doc.Table([]util.PDFColumn{
+			{Title: "Date", Width: 0.14},
+			{Title: "Description", Width: 0.44},
+			{Title: "Charge", Width: 0.14, Right: true},
+			{Title: "Credit", Width: 0.14, Right: true},
+			{Title: "Balance", Width: 0.14, Right: true},
+		}, rows)
+
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", ledgerFilename(member, ledger, "pdf")))
+		if _, err := doc.WriteTo(w); err != nil {
+			lc.Logger.Printf("could not write ledger pdf: %v", err)
+		}
+	})
+}
+
+func ledgerFilename(m *models.User, l *models.Ledger, ext string) string {
+	return fmt.Sprintf("statement-%d-%s-%s.%s", m.ID, l.From.Format("20060102"), l.To.Format("20060102"), ext)
+}
+
+// blankZero shows an amount, or nothing at all if it is zero. Keeps charge and credit columns readable.
+func blankZero(m models.Money) string {
+	if m == 0 {
+		return ""
+	}
+	return m.String()
+}
@@ -0,0 +1,197 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//LocationController implements the handlers for managing the locations the organization runs
+type LocationController struct {
+	Controller
+	Locations    Locations
+	LocationView views.View
+}
+
+//Initialize performs the required setup for a location controller
+func (lc *LocationController) Initialize(cfg *util.Config, um Users, lm Locations, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	lc.setup(cfg, um, l, s)
+	lc.Locations = lm
+	lc.Permissions = pm
+
+	lc.LocationView = views.View{}
+
+	if err := lc.LocationView.LoadTemplates("location"); err != nil {
+		return fmt.Errorf("Error loading location templates: %v", err)
+	}
+
+	return nil
+}
+
+//List shows every location and how many areas it has
+func (lc *LocationController) List() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lc.can(r, "space.write") {
+			lc.forbidden(w)
+			return
+		}
+
+		locations, err := lc.Locations.All()
+		if err != nil {
+			lc.serverError(w, err)
+			return
+		}
+
+		td, err := lc.DefaultData(r)
+		if err != nil {
+			lc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Locations"
+		td.Add("Locations", locations)
+
+		if err := lc.LocationView.Render(w, r, "locations.gohtml", td); err != nil {
+			lc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Form displays the form for a new location, or for editing an existing one
+func (lc *LocationController) Form() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lc.can(r, "space.write") {
+			lc.forbidden(w)
+			return
+		}
+
+		form := util.NewForm(url.Values{})
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			id, ok := util.IntOK(idStr, 1, math.MaxInt32)
+			if !ok {
+				lc.clientError(w, http.StatusBadRequest)
+				return
+			}
+			l, err := lc.Locations.Get(id)
+			if err != nil {
+				lc.notFound(w)
+				return
+			}
+			form.Set("id", strconv.Itoa(l.ID))
+			form.Set("name", l.Name)
+			form.Set("address1", l.Address1)
+			form.Set("address2", l.Address2)
+			form.Set("city", l.City)
+			form.Set("state", l.State)
+			form.Set("zip", l.Zip)
+		}
+
+		lc.renderForm(w, r, form)
+	})
+}
+
+func (lc *LocationController) renderForm(w http.ResponseWriter, r *http.Request, form *util.Form) {
+	td, err := lc.DefaultData(r)
+	if err != nil {
+		lc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Location"
+	td.Add("Form", form)
+
+	if err := lc.LocationView.Render(w, r, "location_form.gohtml", td); err != nil {
+		lc.serverError(w, err)
+		return
+	}
+}
+
+//Save validates and saves a new or edited location
+func (lc *LocationController) Save() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lc.can(r, "space.write") {
+			lc.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("name", "address1", "city", "state", "zip")
+		form.MaxLength("name", 255)
+		form.MaxLength("address1", 255)
+		form.MaxLength("address2", 255)
+		form.MaxLength("city", 255)
+		form.MaxLength("state", 2)
+		form.MaxLength("zip", 10)
+
+		l := &models.Location{
+			Name:     form.Get("name"),
+			Address1: form.Get("address1"),
+			Address2: form.Get("address2"),
+			City:     form.Get("city"),
+			State:    form.Get("state"),
+			Zip:      form.Get("zip"),
+		}
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			l.ID, _ = util.IntOK(idStr, 1, math.MaxInt32)
+			form.Set("id", idStr)
+		}
+
+		if !form.Valid() {
+			lc.renderForm(w, r, form)
+			return
+		}
+
+		var err error
+		if l.ID == 0 {
+			err = lc.Locations.Create(l)
+		} else {
+			err = lc.Locations.Update(l)
+		}
+		if err != nil {
+			form.Errors.Add("saveError", err.Error())
+			lc.renderForm(w, r, form)
+			return
+		}
+
+		lc.Session.Put(r, "flash", "Location saved")
+		http.Redirect(w, r, lc.rootURL()+"locations", http.StatusSeeOther)
+	})
+}
+
+//Delete removes a location that no longer has any areas
+func (lc *LocationController) Delete() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lc.can(r, "space.write") {
+			lc.forbidden(w)
+			return
+		}
+
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			lc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		err := lc.Locations.Delete(id)
+		if err == models.ErrInUse {
+			lc.Session.Put(r, "flash", "The location still has areas. Move or delete them first.")
+			http.Redirect(w, r, lc.rootURL()+"locations", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			lc.serverError(w, err)
+			return
+		}
+
+		lc.Session.Put(r, "flash", "Location deleted")
+		http.Redirect(w, r, lc.rootURL()+"locations", http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,480 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//LockerController implements the handlers for the locker inventory, locker assignment and the locker waitlist
+type LockerController struct {
+	Controller
+	Lockers    Lockers
+	Areas      Areas
+	Mailer     util.Mailer
+	LockerView views.View
+}
+
+//Initialize performs the required setup for a locker controller
+func (lc *LockerController) Initialize(cfg *util.Config, um Users, lm Lockers, am Areas, pm Permissions, m util.Mailer, l *util.Logger, s *sessions.Session) error {
+	lc.setup(cfg, um, l, s)
+	lc.Lockers = lm
+	lc.Areas = am
+	lc.Permissions = pm
+	lc.Mailer = m
+
+	lc.LockerView = views.View{}
+
+	if err := lc.LockerView.LoadTemplates("locker"); err != nil {
+		return fmt.Errorf("Error loading locker templates: %v", err)
+	}
+
+	return nil
+}
+
+//List shows every locker with who has it, and the waitlist
+func (lc *LockerController) List() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lc.can(r, "membership.write") {
+			lc.forbidden(w)
+			return
+		}
+
+		lockers, err := lc.Lockers.All()
+		if err != nil {
+			lc.serverError(w, err)
+			return
+		}
+		waitlist, err := lc.Lockers.Waitlist()
+		if err != nil {
+			lc.serverError(w, err)
+			return
+		}
+
+		td, err := lc.DefaultData(r)
+		if err != nil {
+			lc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Lockers"
+		td.Add("Lockers", lockers)
+		td.Add("Waitlist", waitlist)
+
+		if err := lc.LockerView.Render(w, r, "lockers.gohtml", td); err != nil {
+			lc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Form displays the form for a new locker, or for editing an existing one
+func (lc *LockerController) Form() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lc.can(r, "membership.write") {
+			lc.forbidden(w)
+			return
+		}
+
+		form := util.NewForm(url.Values{})
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			id, ok := util.IntOK(idStr, 1, math.MaxInt32)
+			if !ok {
+				lc.clientError(w, http.StatusBadRequest)
+				return
+			}
+			l, err := lc.Lockers.Get(id)
+			if err != nil {
+				lc.notFound(w)
+				return
+			}
+			form.Set("id", strconv.Itoa(l.ID))
+			form.Set("label", l.Label)
+			form.Set("size", l.Size)
+			if l.AreaID != nil {
+				form.Set("area", strconv.Itoa(*l.AreaID))
+			}
+		}
+
+		lc.renderForm(w, r, form)
+	})
+}
+
+func (lc *LockerController) renderForm(w http.ResponseWriter, r *http.Request, form *util.Form) {
+	sizes, err := lc.Lockers.Sizes()
+	if err != nil {
+		lc.serverError(w, err)
+		return
+	}
+	areas, err := lc.Areas.All()
+	if err != nil {
+		lc.serverError(w, err)
+		return
+	}
+
+	td, err := lc.DefaultData(r)
+	if err != nil {
+		lc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Locker"
+	td.Add("Form", form)
+	td.Add("Sizes", sizes)
+	td.Add("Areas", areas)
+
+	if err := lc.LockerView.Render(w, r, "locker_form.gohtml", td); err != nil {
+		lc.serverError(w, err)
+		return
+	}
+}
+
+//Save validates and saves a new or edited locker
+func (lc *LockerController) Save() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lc.can(r, "membership.write") {
+			lc.forbidden(w)
+			return
+		}
+
+		sizes, err := lc.Lockers.Sizes()
+		if err != nil {
+			lc.serverError(w, err)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("label", "size")
+		form.MaxLength("label", 50)
+		form.PermittedValues("size", sizes...)
+
+		l := &models.Locker{Label: form.Get("label"), Size: form.Get("size")}
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			l.ID, _ = util.IntOK(idStr, 1, math.MaxInt32)
+			form.Set("id", idStr)
+		}
+		if a := form.Get("area"); a != "" {
+			id, ok := util.IntOK(a, 1, math.MaxInt32)
+			if !ok {
+				form.Errors.Add("area", "Choose an area from the list")
+			}
+			l.AreaID = &id
+		}
+
+		if !form.Valid() {
+			lc.renderForm(w, r, form)
+			return
+		}
+
+		if l.ID == 0 {
+			err = lc.Lockers.Create(l)
+		} else {
+			err = lc.Lockers.Update(l)
+		}
+		if err != nil {
+			form.Errors.Add("saveError", err.Error())
+			lc.renderForm(w, r, form)
+			return
+		}
+
+		// a new locker may be offered straight away
+		lc.offer(time.Now())
+		lc.Session.Put(r, "flash", "Locker saved")
+		http.Redirect(w, r, lc.rootURL()+"lockers", http.StatusSeeOther)
+	})
+}
+
+//SetActive retires a locker, or brings it back into use
+func (lc *LockerController) SetActive(active bool) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lc.can(r, "membership.write") {
+			lc.forbidden(w)
+			return
+		}
+
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			lc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		err := lc.Lockers.SetActive(id, active)
+		if err == models.ErrLockerUnavailable {
+			lc.Session.Put(r, "flash", "A locker can only be retired once it has been released")
+			http.Redirect(w, r, lc.rootURL()+"lockers", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			lc.serverError(w, err)
+			return
+		}
+
+		lc.offer(time.Now())
+		if active {
+			lc.Session.Put(r, "flash", "Locker is back in use")
+		} else {
+			lc.Session.Put(r, "flash", "Locker retired")
+		}
+		http.Redirect(w, r, lc.rootURL()+"lockers", http.StatusSeeOther)
+	})
+}
+
+//Assign gives a locker to a member chosen by an admin
+func (lc *LockerController) Assign() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lc.can(r, "membership.write") {
+			lc.forbidden(w)
+			return
+		}
+
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			lc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		r.ParseForm()
+		memberID, ok := util.IntOK(r.PostForm.Get("member"), 1, math.MaxInt32)
+		if !ok {
+			lc.Session.Put(r, "flash", "Enter the member number to assign the locker to")
+			http.Redirect(w, r, lc.rootURL()+"lockers", http.StatusSeeOther)
+			return
+		}
+
+		switch err := lc.Lockers.Assign(id, memberID, time.Now()); err {
+		case nil:
+			lc.Session.Put(r, "flash", "Locker assigned")
+		case models.ErrNoLockerAddon, models.ErrLockerUnavailable, models.ErrHasLocker:
+			lc.Session.Put(r, "flash", err.Error())
+		default:
+			lc.serverError(w, err)
+			return
+		}
+		http.Redirect(w, r, lc.rootURL()+"lockers", http.StatusSeeOther)
+	})
+}
+
+//Release takes a locker back from its member. An admin can flag it as needing clearing if it was not left empty.
+func (lc *LockerController) Release() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lc.can(r, "membership.write") {
+			lc.forbidden(w)
+			return
+		}
+
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			lc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		r.ParseForm()
+		err := lc.Lockers.Release(id, "released by admin", r.PostForm.Get("needsclearing") == "on", time.Now())
+		if err == models.ErrLockerUnavailable {
+			lc.notFound(w)
+			return
+		}
+		if err != nil {
+			lc.serverError(w, err)
+			return
+		}
+
+		lc.offer(time.Now())
+		lc.Session.Put(r, "flash", "Locker released")
+		http.Redirect(w, r, lc.rootURL()+"lockers", http.StatusSeeOther)
+	})
+}
+
+//Cleared records that a released locker has been emptied, so that it can be offered to the waitlist
+func (lc *LockerController) Cleared() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lc.can(r, "membership.write") {
+			lc.forbidden(w)
+			return
+		}
+
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			lc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if err := lc.Lockers.MarkCleared(id); err != nil {
+			lc.serverError(w, err)
+			return
+		}
+
+		lc.offer(time.Now())
+		lc.Session.Put(r, "flash", "Locker marked as cleared")
+		http.Redirect(w, r, lc.rootURL()+"lockers", http.StatusSeeOther)
+	})
+}
+
+//ForMember shows a member their locker, or their place on the waitlist and any locker offered to them
+func (lc *LockerController) ForMember() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			lc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !lc.canAccessMember(r, id, "membership.write") {
+			lc.forbidden(w)
+			return
+		}
+
+		ml, err := lc.Lockers.ForMember(id)
+		if err != nil {
+			lc.serverError(w, err)
+			return
+		}
+
+		td, err := lc.DefaultData(r)
+		if err != nil {
+			lc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Locker"
+		td.Add("MemberID", id)
+		td.Add("Locker", ml)
+
+		if err := lc.LockerView.Render(w, r, "member_locker.gohtml", td); err != nil {
+			lc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//JoinWaitlist puts a member on the locker waitlist
+func (lc *LockerController) JoinWaitlist() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			lc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !lc.canAccessMember(r, id, "membership.write") {
+			lc.forbidden(w)
+			return
+		}
+		if err := lc.Lockers.JoinWaitlist(id); err != nil {
+			lc.serverError(w, err)
+			return
+		}
+
+		// there may be a free locker already
+		lc.offer(time.Now())
+		lc.Session.Put(r, "flash", "You are on the locker waitlist. We will email you when a locker is offered to you.")
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/locker", lc.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+//LeaveWaitlist takes a member off the locker waitlist, turning down any locker offered to them
+func (lc *LockerController) LeaveWaitlist() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			lc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !lc.canAccessMember(r, id, "membership.write") {
+			lc.forbidden(w)
+			return
+		}
+		if err := lc.Lockers.LeaveWaitlist(id); err != nil {
+			lc.serverError(w, err)
+			return
+		}
+
+		// a locker that was offered to the member goes to the next in line
+		lc.offer(time.Now())
+		lc.Session.Put(r, "flash", "You have left the locker waitlist")
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/locker", lc.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+//Claim gives a member the locker offered to them
+func (lc *LockerController) Claim() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			lc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !lc.canAccessMember(r, id, "membership.write") {
+			lc.forbidden(w)
+			return
+		}
+
+		switch err := lc.Lockers.Claim(id, time.Now()); err {
+		case nil:
+			lc.Session.Put(r, "flash", "The locker is yours")
+		case models.ErrNoLockerAddon:
+			lc.Session.Put(r, "flash", "Add the Locker addon to your membership first, then claim your locker")
+		case models.ErrNoLockerOffer, models.ErrLockerUnavailable, models.ErrHasLocker:
+			lc.Session.Put(r, "flash", err.Error())
+		default:
+			lc.serverError(w, err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/locker", lc.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+// Run takes lockers back from members who have quit or dropped the Locker addon, lets the organization know which
+// lockers need clearing out, and offers free lockers to the waitlist. Returns how many lockers were released.
+func (lc *LockerController) Run(now time.Time) (int, error) {
+	released, err := lc.Lockers.ReleaseLapsed(now)
+	if err != nil {
+		return 0, err
+	}
+	if len(released) > 0 {
+		lines := []string{}
+		for _, l := range released {
+			lines = append(lines, fmt.Sprintf("Locker %s, taken back from %s (member %d): %s", l.Label, l.MemberName, l.MemberID, l.Reason))
+		}
+		err := lc.Mailer.Send(&util.Message{
+			To:      []string{lc.AppConfig.Org.Email},
+			Subject: "Lockers need clearing",
+			Body: "These lockers were released automatically and need to be cleared out before they can be offered again:\n\n" +
+				strings.Join(lines, "\n") + fmt.Sprintf("\n\nMark them as cleared at %slockers\n", lc.rootURL()),
+		})
+		if err != nil {
+			lc.Logger.Printf("could not send locker clearing notice: %v", err)
+		}
+	}
+	lc.offer(now)
+	return len(released), nil
+}
+
+// offer offers free lockers to the waitlist and emails the members they are offered to.
+// Failures are only logged, because offers are retried on the next run.
+func (lc *LockerController) offer(now time.Time) {
+	hours := lc.AppConfig.Lockers.ClaimHours
+	if hours <= 0 {
+		hours = 72
+	}
+	offers, err := lc.Lockers.OfferFree(now, now.Add(time.Duration(hours)*time.Hour))
+	if err != nil {
+		lc.Logger.Printf("could not offer lockers: %v", err)
+		return
+	}
+	for _, o := range offers {
+		err := lc.Mailer.Send(&util.Message{
+			To:      []string{o.Email},
+			Subject: fmt.Sprintf("Locker %s is available for you", o.Label),
+			Body: fmt.Sprintf("Hi %s,\n\nYou are next on the locker waitlist, and locker %s is being held for you until %s. "+
+				"Claim it at %suser/%d/locker\n\nIf you do not claim it by then it will be offered to the next member in line.\n",
+				o.MemberName, o.Label, o.Expires.Format("Jan 2 at 3:04pm"), lc.rootURL(), o.MemberID),
+		})
+		if err != nil {
+			lc.Logger.Printf("could not email locker offer to member %d: %v", o.MemberID, err)
+		}
+	}
+}
@@ -0,0 +1,646 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//MaintenanceController implements the handlers for equipment maintenance tickets and preventive maintenance
+type MaintenanceController struct {
+	Controller
+	Maintenance     Maintenance
+	Equipment       Equipment
+	Areas           Areas
+	Mailer          util.Mailer
+	MaintenanceView views.View
+}
+
+//Initialize performs the required setup for a maintenance controller
+func (mc *MaintenanceController) Initialize(cfg *util.Config, um Users, mm Maintenance, em Equipment, am Areas, pm Permissions, m util.Mailer, l *util.Logger, s *sessions.Session) error {
+	mc.setup(cfg, um, l, s)
+	mc.Maintenance = mm
+	mc.Equipment = em
+	mc.Areas = am
+	mc.Permissions = pm
+	mc.Mailer = m
+
+	mc.MaintenanceView = views.View{}
+
+	if err := mc.MaintenanceView.LoadTemplates("maintenance"); err != nil {
+		return fmt.Errorf("Error loading maintenance templates: %v", err)
+	}
+
+	return nil
+}
+
+// canMaintain reports whether the logged in member can manage maintenance in an area: anyone who
+// manages the space, and the area's stewards
+func (mc *MaintenanceController) canMaintain(r *http.Request, areaID int) bool {
+	if mc.can(r, "space.write") {
+		return true
+	}
+	id := mc.authenticatedUserID(r)
+	if id == 0 {
+		return false
+	}
+	steward, err := mc.Areas.IsSteward(areaID, id)
+	if err != nil {
+		mc.Logger.Printf("could not check area steward: %v", err)
+		return false
+	}
+	return steward
+}
+
+// canSeeTicket reports whether the logged in member can see and comment on a ticket: the member who reported it,
+// and anyone who can maintain its area
+func (mc *MaintenanceController) canSeeTicket(r *http.Request, t *models.Ticket) bool {
+	if id := mc.authenticatedUserID(r); id != 0 && t.ReportedByID != nil && *t.ReportedByID == id {
+		return true
+	}
+	return mc.canMaintain(r, t.AreaID)
+}
+
+//ReportForm displays the form for any member to report a problem with a piece of equipment
+func (mc *MaintenanceController) ReportForm() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mc.authenticatedUserID(r) == 0 {
+			mc.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			mc.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		e, err := mc.Equipment.Get(id)
+		if err != nil || e.Status == "retired" {
+			mc.notFound(w)
+			return
+		}
+
+		mc.renderReport(w, r, e, util.NewForm(url.Values{}))
+	})
+}
+
+func (mc *MaintenanceController) renderReport(w http.ResponseWriter, r *http.Request, e *models.Equipment, form *util.Form) {
+	td, err := mc.DefaultData(r)
+	if err != nil {
+		mc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Report a Problem"
+	td.Add("Equipment", e)
+	td.Add("Form", form)
+
+	if err := mc.MaintenanceView.Render(w, r, "report_form.gohtml", td); err != nil {
+		mc.serverError(w, err)
+		return
+	}
+}
+
+//Report saves a problem a member reported, tells the area steward, and if the member says the equipment cannot be
+//used, takes it out of service and warns the hosts of upcoming events that need it
+func (mc *MaintenanceController) Report() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		memberID := mc.authenticatedUserID(r)
+		if memberID == 0 {
+			mc.forbidden(w)
+			return
+		}
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			mc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		e, err := mc.Equipment.Get(id)
+		if err != nil || e.Status == "retired" {
+			mc.notFound(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("title")
+		form.MaxLength("title", 255)
+		form.MaxLength("description", 5000)
+		if !form.Valid() {
+			mc.renderReport(w, r, e, form)
+			return
+		}
+
+		t := &models.Ticket{
+			EquipmentID:  e.ID,
+			Title:        form.Get("title"),
+			Description:  form.Get("description"),
+			OutOfService: form.Get("outofservice") == "on",
+			ReportedByID: &memberID,
+		}
+		now := time.Now()
+		flagged, err := mc.Maintenance.Report(t, now)
+		if err != nil {
+			mc.serverError(w, err)
+			return
+		}
+		t, err = mc.Maintenance.Ticket(t.ID)
+		if err != nil {
+			mc.serverError(w, err)
+			return
+		}
+
+		mc.notifyReported(t)
+		if flagged {
+			mc.warnHosts(t, now)
+		}
+
+		msg := "Thanks, the problem has been reported"
+		if flagged {
+			msg += " and the equipment is marked out of service"
+		}
+		mc.Session.Put(r, "flash", msg)
+		http.Redirect(w, r, fmt.Sprintf("%sticket/%d", mc.rootURL(), t.ID), http.StatusSeeOther)
+	})
+}
+
+// notifyReported emails a new ticket to the steward it was assigned to, or to the organization if the area has no
+// steward. Failures are only logged, because the ticket has been saved.
+func (mc *MaintenanceController) notifyReported(t *models.Ticket) {
+	to := mc.AppConfig.Org.Email
+	if t.AssignedToID != nil {
+		u, err := mc.Users.Get(*t.AssignedToID)
+		if err != nil {
+			mc.Logger.Printf("could not find steward %d for ticket %d: %v", *t.AssignedToID, t.ID, err)
+		} else {
+			to = u.Email
+		}
+	}
+	reporter := "A member"
+	if t.ReportedBy != nil {
+		reporter = *t.ReportedBy
+	}
+	body := fmt.Sprintf("%s reported a problem with %s in %s:\n\n%s\n\n%s\n\n", reporter, t.Equipment, t.Area, t.Title, t.Description)
+	if t.OutOfService {
+		body += "They said it cannot be used, so it has been marked out of service until the ticket is resolved.\n\n"
+	}
+	body += fmt.Sprintf("See the ticket at %sticket/%d\n", mc.rootURL(), t.ID)
+	err := mc.Mailer.Send(&util.Message{
+		To:      []string{to},
+		Subject: fmt.Sprintf("Maintenance ticket #%d: %s", t.ID, t.Title),
+		Body:    body,
+	})
+	if err != nil {
+		mc.Logger.Printf("could not email maintenance ticket %d: %v", t.ID, err)
+	}
+}
+
+// warnHosts emails the people running upcoming events that use a piece of equipment that has just gone out of
+// service. Failures are only logged.
+func (mc *MaintenanceController) warnHosts(t *models.Ticket, now time.Time) {
+	events, err := mc.Maintenance.AffectedEvents(t.EquipmentID, now)
+	if err != nil {
+		mc.Logger.Printf("could not find events using equipment %d: %v", t.EquipmentID, err)
+		return
+	}
+	for _, ev := range events {
+		err := mc.Mailer.Send(&util.Message{
+			To:      []string{ev.Email},
+			Subject: fmt.Sprintf("%s is out of service", t.Equipment),
+			Body: fmt.Sprintf("Hi %s,\n\n%s in %s has been taken out of service (%s). Your event %s on %s uses it, "+
+				"so you may need to change your plans. The area steward will update the ticket at %sticket/%d when it is fixed.\n",
+				ev.HostName, t.Equipment, t.Area, t.Title, ev.Event, ev.Starts.Format("Jan 2 at 3:04pm"), mc.rootURL(), t.ID),
+		})
+		if err != nil {
+			mc.Logger.Printf("could not warn host of event %d about equipment %d: %v", ev.EventID, t.EquipmentID, err)
+		}
+	}
+}
+
+//List shows maintenance tickets. Members who manage the space see every ticket; everyone else sees the tickets
+//they reported, were assigned, or that are in an area they look after.
+func (mc *MaintenanceController) List() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		memberID := mc.authenticatedUserID(r)
+		if memberID == 0 {
+			mc.forbidden(w)
+			return
+		}
+
+		form := util.NewForm(r.URL.Query())
+		status := form.Get("status")
+		form.PermittedValues("status", append([]string{"unresolved"}, models.TicketStatuses...)...)
+		if status == "" || !form.Valid() {
+			status = "unresolved"
+		}
+		filter := models.TicketFilter{Status: status}
+		if !mc.can(r, "space.write") {
+			filter.MemberID = memberID
+		}
+
+		tickets, err := mc.Maintenance.Tickets(filter)
+		if err != nil {
+			mc.serverError(w, err)
+			return
+		}
+
+		td, err := mc.DefaultData(r)
+		if err != nil {
+			mc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Maintenance Tickets"
+		td.Add("Status", status)
+		td.Add("Tickets", tickets)
+
+		if err := mc.MaintenanceView.Render(w, r, "tickets.gohtml", td); err != nil {
+			mc.serverError(w, err)
+			return
+		}
+	})
+}
+
+// ticketFromRequest gets the ticket named in the URL, and checks that the logged in member can see it.
+// Writes the error response and returns false if not.
+func (mc *MaintenanceController) ticketFromRequest(w http.ResponseWriter, r *http.Request) (*models.Ticket, bool) {
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		mc.clientError(w, http.StatusBadRequest)
+		return nil, false
+	}
+	t, err := mc.Maintenance.Ticket(id)
+	if err != nil {
+		mc.notFound(w)
+		return nil, false
+	}
+	if !mc.canSeeTicket(r, t) {
+		mc.forbidden(w)
+		return nil, false
+	}
+	return t, true
+}
+
+//Show displays a ticket and its comments, with the forms to comment on it and, for stewards, to update it
+func (mc *MaintenanceController) Show() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := mc.ticketFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		comments, err := mc.Maintenance.Comments(t.ID)
+		if err != nil {
+			mc.serverError(w, err)
+			return
+		}
+		stewards, err := mc.Areas.Stewards(t.AreaID)
+		if err != nil {
+			mc.serverError(w, err)
+			return
+		}
+
+		assignedTo := 0
+		if t.AssignedToID != nil {
+			assignedTo = *t.AssignedToID
+		}
+
+		td, err := mc.DefaultData(r)
+		if err != nil {
+			mc.serverError(w, err)
+			return
+		}
+		td.PageTitle = fmt.Sprintf("Ticket #%d", t.ID)
+		td.Add("Ticket", t)
+		td.Add("Comments", comments)
+		td.Add("Stewards", stewards)
+		td.Add("AssignedTo", assignedTo)
+		td.Add("Statuses", models.TicketStatuses)
+		td.Add("CanManage", mc.canMaintain(r, t.AreaID))
+
+		if err := mc.MaintenanceView.Render(w, r, "ticket.gohtml", td); err != nil {
+			mc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Comment adds a comment to a ticket
+func (mc *MaintenanceController) Comment() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := mc.ticketFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		r.ParseForm()
+		body := strings.TrimSpace(r.PostForm.Get("body"))
+		if body == "" || len(body) > 5000 {
+			mc.Session.Put(r, "flash", "Write a comment of up to 5000 characters")
+			http.Redirect(w, r, fmt.Sprintf("%sticket/%d", mc.rootURL(), t.ID), http.StatusSeeOther)
+			return
+		}
+		if err := mc.Maintenance.Comment(t.ID, mc.authenticatedUserID(r), body, time.Now()); err != nil {
+			mc.serverError(w, err)
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("%sticket/%d", mc.rootURL(), t.ID), http.StatusSeeOther)
+	})
+}
+
+//Update changes the status of a ticket and the steward it is assigned to. Resolving the last ticket keeping
+//equipment out of service makes it available again.
+func (mc *MaintenanceController) Update() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := mc.ticketFromRequest(w, r)
+		if !ok {
+			return
+		}
+		if !mc.canMaintain(r, t.AreaID) {
+			mc.forbidden(w)
+			return
+		}
+		back := fmt.Sprintf("%sticket/%d", mc.rootURL(), t.ID)
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("status")
+		form.PermittedValues("status", models.TicketStatuses...)
+		if !form.Valid() {
+			mc.Session.Put(r, "flash", "Choose a status for the ticket")
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+		var assignedTo *int
+		if a := form.Get("assignedto"); a != "" {
+			stewardID, ok := util.IntOK(a, 1, math.MaxInt32)
+			if !ok {
+				mc.clientError(w, http.StatusBadRequest)
+				return
+			}
+			steward, err := mc.Areas.IsSteward(t.AreaID, stewardID)
+			if err != nil {
+				mc.serverError(w, err)
+				return
+			}
+			if !steward {
+				mc.Session.Put(r, "flash", "Tickets can only be assigned to a steward of the area")
+				http.Redirect(w, r, back, http.StatusSeeOther)
+				return
+			}
+			assignedTo = &stewardID
+		}
+
+		now := time.Now()
+		changed, err := mc.Maintenance.Update(t.ID, form.Get("status"), assignedTo, now)
+		if err != nil {
+			mc.serverError(w, err)
+			return
+		}
+
+		msg := "Ticket updated"
+		switch changed {
+		case "available":
+			msg += fmt.Sprintf(" and %s is back in service", t.Equipment)
+		case "out_of_service":
+			msg += fmt.Sprintf(" and %s is out of service again", t.Equipment)
+			mc.warnHosts(t, now)
+		}
+		if form.Get("status") == "resolved" && t.Status != "resolved" && t.ReportedByID != nil {
+			mc.notifyResolved(t)
+		}
+		mc.Session.Put(r, "flash", msg)
+		http.Redirect(w, r, back, http.StatusSeeOther)
+	})
+}
+
+// notifyResolved lets the member who reported a problem know that it has been fixed. Failures are only logged.
+func (mc *MaintenanceController) notifyResolved(t *models.Ticket) {
+	u, err := mc.Users.Get(*t.ReportedByID)
+	if err != nil {
+		mc.Logger.Printf("could not find reporter %d of ticket %d: %v", *t.ReportedByID, t.ID, err)
+		return
+	}
+	err = mc.Mailer.Send(&util.Message{
+		To:      []string{u.Email},
+		Subject: fmt.Sprintf("Fixed: %s", t.Title),
+		Body: fmt.Sprintf("Hi %s,\n\nThe problem you reported with %s (%s) has been resolved. Thank you for letting us know.\n\n"+
+			"See the ticket at %sticket/%d\n", u.Name, t.Equipment, t.Title, mc.rootURL(), t.ID),
+	})
+	if err != nil {
+		mc.Logger.Printf("could not email reporter of ticket %d: %v", t.ID, err)
+	}
+}
+
+// equipmentFromRequest gets the equipment named in the URL, and checks that the logged in member can maintain it.
+// Writes the error response and returns false if not.
+func (mc *MaintenanceController) equipmentFromRequest(w http.ResponseWriter, r *http.Request) (*models.Equipment, bool) {
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		mc.clientError(w, http.StatusBadRequest)
+		return nil, false
+	}
+	e, err := mc.Equipment.Get(id)
+	if err != nil {
+		mc.notFound(w)
+		return nil, false
+	}
+	if !mc.canMaintain(r, e.AreaID) {
+		mc.forbidden(w)
+		return nil, false
+	}
+	return e, true
+}
+
+//Schedules shows the tickets and the preventive maintenance schedule for a piece of equipment
+func (mc *MaintenanceController) Schedules() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, ok := mc.equipmentFromRequest(w, r)
+		if !ok {
+			return
+		}
+		mc.renderSchedules(w, r, e, util.NewForm(url.Values{}))
+	})
+}
+
+func (mc *MaintenanceController) renderSchedules(w http.ResponseWriter, r *http.Request, e *models.Equipment, form *util.Form) {
+	schedules, err := mc.Maintenance.Schedules(e.ID)
+	if err != nil {
+		mc.serverError(w, err)
+		return
+	}
+	tickets, err := mc.Maintenance.Tickets(models.TicketFilter{EquipmentID: e.ID})
+	if err != nil {
+		mc.serverError(w, err)
+		return
+	}
+
+	td, err := mc.DefaultData(r)
+	if err != nil {
+		mc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Maintenance"
+	td.Add("Equipment", e)
+	td.Add("Schedules", schedules)
+	td.Add("Tickets", tickets)
+	td.Add("Form", form)
+	td.Add("Now", time.Now())
+
+	if err := mc.MaintenanceView.Render(w, r, "schedules.gohtml", td); err != nil {
+		mc.serverError(w, err)
+		return
+	}
+}
+
+//AddSchedule saves new preventive maintenance for a piece of equipment
+func (mc *MaintenanceController) AddSchedule() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, ok := mc.equipmentFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("task", "intervaldays", "firstdue")
+		form.MaxLength("task", 255)
+		s := &models.Schedule{EquipmentID: e.ID, Task: form.Get("task")}
+		if d := form.Get("intervaldays"); d != "" {
+			n, ok := util.IntOK(d, 1, 3650)
+			if !ok {
+				form.Errors.Add("intervaldays", "Must be a number of days between 1 and 3650")
+			}
+			s.IntervalDays = n
+		}
+		if d := form.Get("firstdue"); d != "" {
+			t, ok := util.DateOK(d)
+			if !ok {
+				form.Errors.Add("firstdue", "Must be a date")
+			}
+			s.NextDueOn = t
+		}
+		if !form.Valid() {
+			mc.renderSchedules(w, r, e, form)
+			return
+		}
+
+		if err := mc.Maintenance.AddSchedule(s); err != nil {
+			mc.serverError(w, err)
+			return
+		}
+
+		mc.Session.Put(r, "flash", "Preventive maintenance scheduled")
+		http.Redirect(w, r, fmt.Sprintf("%sequipment/%d/maintenance", mc.rootURL(), e.ID), http.StatusSeeOther)
+	})
+}
+
+// scheduleFromRequest gets the preventive maintenance named in the URL, and checks that the logged in member can
+// maintain its equipment. Writes the error response and returns false if not.
+func (mc *MaintenanceController) scheduleFromRequest(w http.ResponseWriter, r *http.Request) (*models.Schedule, bool) {
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		mc.clientError(w, http.StatusBadRequest)
+		return nil, false
+	}
+	s, err := mc.Maintenance.Schedule(id)
+	if err != nil {
+		mc.notFound(w)
+		return nil, false
+	}
+	if !mc.canMaintain(r, s.AreaID) {
+		mc.forbidden(w)
+		return nil, false
+	}
+	return s, true
+}
+
+//Done records that preventive maintenance was done today, and schedules the next time
+func (mc *MaintenanceController) Done() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, ok := mc.scheduleFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if err := mc.Maintenance.Done(s.ID, time.Now()); err != nil {
+			mc.serverError(w, err)
+			return
+		}
+
+		mc.Session.Put(r, "flash", fmt.Sprintf("Marked done. It is due again in %d days.", s.IntervalDays))
+		http.Redirect(w, r, fmt.Sprintf("%sequipment/%d/maintenance", mc.rootURL(), s.EquipmentID), http.StatusSeeOther)
+	})
+}
+
+//DeleteSchedule stops scheduling preventive maintenance
+func (mc *MaintenanceController) DeleteSchedule() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, ok := mc.scheduleFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if err := mc.Maintenance.DeleteSchedule(s.ID); err != nil {
+			mc.serverError(w, err)
+			return
+		}
+
+		mc.Session.Put(r, "flash", "Preventive maintenance removed")
+		http.Redirect(w, r, fmt.Sprintf("%sequipment/%d/maintenance", mc.rootURL(), s.EquipmentID), http.StatusSeeOther)
+	})
+}
+
+//Run reminds area stewards of preventive maintenance coming due in the next few days, as set in the configuration.
+//Areas without stewards are reminded to the organization. Returns how many reminders were sent.
+func (mc *MaintenanceController) Run(now time.Time) (int, error) {
+	days := mc.AppConfig.Maintenance.ReminderDays
+	if days <= 0 {
+		days = 7
+	}
+	due, err := mc.Maintenance.DueForReminder(now.AddDate(0, 0, days))
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, s := range due {
+		to := []string{}
+		stewards, err := mc.Areas.Stewards(s.AreaID)
+		if err != nil {
+			mc.Logger.Printf("could not find stewards for area %d: %v", s.AreaID, err)
+		}
+		for _, st := range stewards {
+			to = append(to, st.Email)
+		}
+		if len(to) == 0 {
+			to = append(to, mc.AppConfig.Org.Email)
+		}
+
+		when := "is due on " + s.NextDueOn.Format("Monday, Jan 2")
+		if s.Overdue(now) {
+			when = "was due on " + s.NextDueOn.Format("Monday, Jan 2") + " and is overdue"
+		}
+		err = mc.Mailer.Send(&util.Message{
+			To:      to,
+			Subject: fmt.Sprintf("Maintenance due: %s", s.Equipment),
+			Body: fmt.Sprintf("Preventive maintenance on %s %s:\n\n%s\n\nMark it done at %sequipment/%d/maintenance\n",
+				s.Equipment, when, s.Task, mc.rootURL(), s.EquipmentID),
+		})
+		if err != nil {
+			mc.Logger.Printf("could not send maintenance reminder for schedule %d: %v", s.ID, err)
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
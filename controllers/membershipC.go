@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//MembershipController implements the handlers for members pausing, resuming and changing their membership
+type MembershipController struct {
+	Controller
+	Memberships    Memberships
+	Options        MembershipOptions
+	Invoices       InvoiceSender
+	MembershipView views.View
+}
+
+//Initialize performs the required setup for a membership controller
+func (mc *MembershipController) Initialize(cfg *util.Config, um Users, mm Memberships, om MembershipOptions, pm Permissions, is InvoiceSender, l *util.Logger, s *sessions.Session) error {
+	mc.setup(cfg, um, l, s)
+	mc.Memberships = mm
+	mc.Options = om
+	mc.Permissions = pm
+	mc.Invoices = is
+
+	mc.MembershipView = views.View{}
+
+	if err := mc.MembershipView.LoadTemplates("membership"); err != nil {
+		return fmt.Errorf("Error loading membership templates: %v", err)
+	}
+
+	return nil
+}
+
+// pauseFee is the configured fee for pausing a membership, 0 if there is none or it cannot be read
+func (mc *MembershipController) pauseFee() models.Money {
+	if mc.AppConfig.Billing.PauseFee == "" {
+		return 0
+	}
+	fee, err := models.ParseMoney(mc.AppConfig.Billing.PauseFee)
+	if err != nil {
+		mc.Logger.Printf("could not read pause fee %q: %v", mc.AppConfig.Billing.PauseFee, err)
+		return 0
+	}
+	return fee
+}
+
+// pauseLimits are the shortest and longest pauses allowed, in days. The longest defaults to a year.
+func (mc *MembershipController) pauseLimits() (int, int) {
+	min, max := mc.AppConfig.Billing.PauseMinDays, mc.AppConfig.Billing.PauseMaxDays
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = 365
+	}
+	return min, max
+}
+
+//Show displays a member's membership with forms to pause or resume it and to change plan, and its history
+func (mc *MembershipController) Show() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			mc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !mc.canAccessMember(r, id, "membership.write") {
+			mc.forbidden(w)
+			return
+		}
+
+		mc.render(w, r, id, util.NewForm(url.Values{}))
+	})
+}
+
+func (mc *MembershipController) render(w http.ResponseWriter, r *http.Request, id int, form *util.Form) {
+	m, err := mc.Memberships.Get(id)
+	if err != nil {
+		mc.notFound(w)
+		return
+	}
+	history, err := mc.Memberships.History(id)
+	if err != nil {
+		mc.serverError(w, err)
+		return
+	}
+	active, err := mc.Options.Active()
+	if err != nil {
+		mc.serverError(w, err)
+		return
+	}
+	options := []models.MembershipOption{}
+	for _, o := range active {
+		if m.OptionID == nil || o.ID != *m.OptionID {
+			options = append(options, o)
+		}
+	}
+
+	td, err := mc.DefaultData(r)
+	if err != nil {
+		mc.serverError(w, err)
+		return
+	}
+	min, max := mc.pauseLimits()
+	td.PageTitle = "Membership"
+	td.Add("MemberID", id)
+	td.Add("Membership", m)
+	td.Add("History", history)
+	td.Add("Options", options)
+	td.Add("PauseMinDays", min)
+	td.Add("PauseMaxDays", max)
+	td.Add("PauseFee", mc.pauseFee())
+	td.Add("Form", form)
+
+	if err := mc.MembershipView.Render(w, r, "membership.gohtml", td); err != nil {
+		mc.serverError(w, err)
+		return
+	}
+}
+
+//Pause freezes a member's membership until the date they chose, within the configured limits
+func (mc *MembershipController) Pause() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			mc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !mc.canAccessMember(r, id, "membership.write") {
+			mc.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("until")
+		now := time.Now()
+		until, ok := util.DateOK(form.Get("until"))
+		if form.Get("until") != "" {
+			min, max := mc.pauseLimits()
+			today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+			if !ok {
+				form.Errors.Add("until", "Must be a date, like 2020-12-31")
+			} else if days := int(until.Sub(today).Hours()/24 + 0.5); days < min || days > max {
+				form.Errors.Add("until", fmt.Sprintf("A pause must last between %d and %d days", min, max))
+			}
+		}
+		if !form.Valid() {
+			mc.render(w, r, id, form)
+			return
+		}
+
+		inv, err := mc.Memberships.Pause(id, until, mc.pauseFee(), mc.authenticatedUserID(r), now)
+		if err == models.ErrCannotPause {
+			form.Errors.Add("until", err.Error())
+			mc.render(w, r, id, form)
+			return
+		}
+		if err != nil {
+			mc.serverError(w, err)
+			return
+		}
+		if inv != nil {
+			if err := mc.Invoices.SendInvoice(inv); err != nil {
+				mc.Logger.Printf("could not email invoice %d: %v", inv.ID, err)
+			}
+		}
+
+		mc.Session.Put(r, "flash", fmt.Sprintf("Your membership is paused until %s", until.Format("January 2, 2006")))
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/membership", mc.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+//Resume ends a member's pause early
+func (mc *MembershipController) Resume() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			mc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !mc.canAccessMember(r, id, "membership.write") {
+			mc.forbidden(w)
+			return
+		}
+
+		err := mc.Memberships.Resume(id, mc.authenticatedUserID(r), time.Now())
+		if err == models.ErrNotPaused {
+			mc.Session.Put(r, "flash", err.Error())
+			http.Redirect(w, r, fmt.Sprintf("%suser/%d/membership", mc.rootURL(), id), http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			mc.serverError(w, err)
+			return
+		}
+
+		mc.Session.Put(r, "flash", "Welcome back! Your membership has been resumed")
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/membership", mc.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+//ChangePlan switches a member to another membership option, crediting what is left of the current one
+func (mc *MembershipController) ChangePlan() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			mc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !mc.canAccessMember(r, id, "membership.write") {
+			mc.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("option")
+		optionID, ok := util.IntOK(form.Get("option"), 1, math.MaxInt32)
+		if !ok {
+			form.Errors.Add("option", "Choose a membership option")
+		}
+		if !form.Valid() {
+			mc.render(w, r, id, form)
+			return
+		}
+
+		change, err := mc.Memberships.ChangePlan(id, optionID, mc.authenticatedUserID(r), time.Now())
+		if err == models.ErrCannotChangePlan || err == models.ErrDuesUnpaid {
+			form.Errors.Add("option", err.Error())
+			mc.render(w, r, id, form)
+			return
+		}
+		if err != nil {
+			mc.serverError(w, err)
+			return
+		}
+		if err := mc.Invoices.SendInvoice(change.Invoice); err != nil {
+			mc.Logger.Printf("could not email invoice %d: %v", change.Invoice.ID, err)
+		}
+
+		msg := fmt.Sprintf("Your membership has been changed and now runs until %s.", change.Expires.Format("January 2, 2006"))
+		if !change.Invoice.Paid() {
+			msg = fmt.Sprintf("Your membership has been changed. It runs until %s once this invoice is paid.", change.Expires.Format("January 2, 2006"))
+		}
+		if change.Credit > 0 {
+			msg += fmt.Sprintf(" You were credited %s for the rest of your old plan.", change.Credit)
+		}
+		mc.Session.Put(r, "flash", msg)
+		http.Redirect(w, r, fmt.Sprintf("%sinvoice/%d", mc.rootURL(), change.Invoice.ID), http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//OptionController implements the handlers for managing the membership options offered at signup
+type OptionController struct {
+	Controller
+	Options    MembershipOptions
+	OptionView views.View
+}
+
+//Initialize performs the required setup for a membership option controller
+func (oc *OptionController) Initialize(cfg *util.Config, um Users, om MembershipOptions, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	oc.setup(cfg, um, l, s)
+	oc.Options = om
+	oc.Permissions = pm
+
+	oc.OptionView = views.View{}
+
+	if err := oc.OptionView.LoadTemplates("option"); err != nil {
+		return fmt.Errorf("Error loading membership option templates: %v", err)
+	}
+
+	return nil
+}
+
+//List shows every membership option, including retired ones
+func (oc *OptionController) List() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !oc.can(r, "membership.write") {
+			oc.forbidden(w)
+			return
+		}
+
+		options, err := oc.Options.All()
+		if err != nil {
+			oc.serverError(w, err)
+			return
+		}
+
+		td, err := oc.DefaultData(r)
+		if err != nil {
+			oc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Membership Options"
+		td.Add("Options", options)
+
+		if err := oc.OptionView.Render(w, r, "options.gohtml", td); err != nil {
+			oc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Form displays the form for a new membership option, or for editing an existing one
+func (oc *OptionController) Form() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !oc.can(r, "membership.write") {
+			oc.forbidden(w)
+			return
+		}
+
+		form := util.NewForm(url.Values{})
+		form.Set("periodmonths", "1")
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			id, ok := util.IntOK(idStr, 1, math.MaxInt32)
+			if !ok {
+				oc.clientError(w, http.StatusBadRequest)
+				return
+			}
+			o, err := oc.Options.Get(id)
+			if err != nil {
+				oc.notFound(w)
+				return
+			}
+			form.Set("id", strconv.Itoa(o.ID))
+			form.Set("name", o.Name)
+			form.Set("price", o.Price.Decimal())
+			form.Set("periodmonths", strconv.Itoa(o.PeriodMonths))
+			if o.Recurring {
+				form.Set("recurring", "on")
+			}
+		}
+
+		oc.renderForm(w, r, form)
+	})
+}
+
+func (oc *OptionController) renderForm(w http.ResponseWriter, r *http.Request, form *util.Form) {
+	td, err := oc.DefaultData(r)
+	if err != nil {
+		oc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Membership Option"
+	td.Add("Form", form)
+
+	if err := oc.OptionView.Render(w, r, "option_form.gohtml", td); err != nil {
+		oc.serverError(w, err)
+		return
+	}
+}
+
+//Save validates and saves a new or edited membership option
+func (oc *OptionController) Save() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !oc.can(r, "membership.write") {
+			oc.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("name", "price", "periodmonths")
+		form.MaxLength("name", 255)
+
+		o := &models.MembershipOption{
+			Name:      form.Get("name"),
+			Recurring: form.Get("recurring") == "on",
+		}
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			o.ID, _ = util.IntOK(idStr, 1, math.MaxInt32)
+			form.Set("id", idStr)
+		}
+		if p := form.Get("price"); p != "" {
+			price, err := models.ParseMoney(p)
+			if err != nil || price < 0 {
+				form.Errors.Add("price", "Must be an amount of money, like 40.00")
+			}
+			o.Price = price
+		}
+		if m := form.Get("periodmonths"); m != "" {
+			n, ok := util.IntOK(m, 1, 120)
+			if !ok {
+				form.Errors.Add("periodmonths", "Must be a number of months between 1 and 120")
+			}
+			o.PeriodMonths = n
+		}
+
+		if !form.Valid() {
+			oc.renderForm(w, r, form)
+			return
+		}
+
+		var err error
+		if o.ID == 0 {
+			err = oc.Options.Create(o)
+		} else {
+			err = oc.Options.Update(o)
+		}
+		if err != nil {
+			form.Errors.Add("saveError", err.Error())
+			oc.renderForm(w, r, form)
+			return
+		}
+
+		oc.Session.Put(r, "flash", "Membership option saved")
+		http.Redirect(w, r, oc.rootURL()+"membershipoptions", http.StatusSeeOther)
+	})
+}
+
+//SetActive retires a membership option so that it is no longer offered, or offers it again.
+//Options are never deleted because existing members may still be on them.
+func (oc *OptionController) SetActive(active bool) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !oc.can(r, "membership.write") {
+			oc.forbidden(w)
+			return
+		}
+
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			oc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if err := oc.Options.SetActive(id, active); err != nil {
+			oc.serverError(w, err)
+			return
+		}
+
+		if active {
+			oc.Session.Put(r, "flash", "Membership option is offered again")
+		} else {
+			oc.Session.Put(r, "flash", "Membership option retired")
+		}
+		http.Redirect(w, r, oc.rootURL()+"membershipoptions", http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,489 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/payments"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+// maximum size of a webhook body that will be read
+const maxWebhookBytes = 1 << 16
+
+//PaymentController implements the handlers for paying invoices online and receiving provider webhooks
+type PaymentController struct {
+	Controller
+	Invoices    Invoices
+	Payments    Payments
+	Provider    payments.Provider
+	Receipts    Receipts // optional, receipts are emailed when set
+	PaymentView views.View
+}
+
+//Initialize performs the required setup for a payment controller
+func (pc *PaymentController) Initialize(cfg *util.Config, um Users, im Invoices, pm Payments, perm Permissions, p payments.Provider, l *util.Logger, s *sessions.Session) error {
+	pc.setup(cfg, um, l, s)
+	pc.Invoices = im
+	pc.Payments = pm
+	pc.Permissions = perm
+	pc.Provider = p
+
+	pc.PaymentView = views.View{}
+
+	if err := pc.PaymentView.LoadTemplates("payment"); err != nil {
+		return fmt.Errorf("Error loading payment templates: %v", err)
+	}
+
+	return nil
+}
+
+// invoiceFromRequest looks up the invoice in the {id} route variable, writing an error response if it can't be found
+// or the logged in member is neither its owner nor has the permission
+func (pc *PaymentController) invoiceFromRequest(w http.ResponseWriter, r *http.Request, permission string) (*models.Invoice, bool) {
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		pc.clientError(w, http.StatusBadRequest)
+		return nil, false
+	}
+	inv, err := pc.Invoices.Get(id)
+	if err != nil {
+		pc.notFound(w)
+		return nil, false
+	}
+	if !pc.canAccessMember(r, inv.MemberID, permission) {
+		pc.forbidden(w)
+		return nil, false
+	}
+	return inv, true
+}
+
+//ShowInvoice displays an invoice with the options for paying it online
+func (pc *PaymentController) ShowInvoice() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inv, ok := pc.invoiceFromRequest(w, r, "finance.read")
+		if !ok {
+			return
+		}
+		form := util.NewForm(url.Values{})
+		form.Set("received", time.Now().Format("2006-01-02"))
+		pc.renderInvoice(w, r, inv, form)
+	})
+}
+
+// renderInvoice shows an invoice. Treasurers also get the form for recording a cash or check payment.
+func (pc *PaymentController) renderInvoice(w http.ResponseWriter, r *http.Request, inv *models.Invoice, form *util.Form) {
+	method, err := pc.Payments.DefaultMethod(inv.MemberID)
+	if err != nil {
+		pc.serverError(w, err)
+		return
+	}
+
+	td, err := pc.DefaultData(r)
+	if err != nil {
+		pc.serverError(w, err)
+		return
+	}
+	td.PageTitle = fmt.Sprintf("Invoice #%d", inv.ID)
+	td.Add("Invoice", inv)
+	td.Add("SavedMethod", method)
+	td.Add("CanRecord", pc.can(r, "finance.write"))
+	td.Add("Form", form)
+
+	if err := pc.PaymentView.Render(w, r, "invoice.gohtml", td); err != nil {
+		pc.serverError(w, err)
+		return
+	}
+}
+
+//RecordPayment records a cash or check payment against an invoice. Only treasurers can record them, and a receipt
+//is emailed to the member as for an online payment.
+func (pc *PaymentController) RecordPayment() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inv, ok := pc.invoiceFromRequest(w, r, "finance.write")
+		if !ok {
+			return
+		}
+		if !pc.can(r, "finance.write") {
+			pc.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("method", "amount", "received")
+		form.PermittedValues("method", "cash", "check")
+		form.RequiredIf("checknumber", form.Get("method") == "check")
+		var amount models.Money
+		if a := form.Get("amount"); a != "" {
+			var err error
+			amount, err = models.ParseMoney(a)
+			if err != nil || amount <= 0 {
+				form.Errors.Add("amount", "Must be an amount of money, like 10.00")
+			}
+		}
+		received, ok := util.DateOK(form.Get("received"))
+		if form.Get("received") != "" && !ok {
+			form.Errors.Add("received", "Must be a date")
+		}
+		if !form.Valid() {
+			pc.renderInvoice(w, r, inv, form)
+			return
+		}
+
+		paymentID, err := pc.Payments.RecordManualPayment(&models.ManualPayment{
+			InvoiceID:   inv.ID,
+			Method:      form.Get("method"),
+			Amount:      amount,
+			CheckNumber: form.Get("checknumber"),
+			ReceivedOn:  received,
+			RecordedBy:  pc.authenticatedUserID(r),
+		})
+		if err != nil {
+			pc.serverError(w, err)
+			return
+		}
+		pc.sendReceipt(paymentID)
+
+		pc.Session.Put(r, "flash", fmt.Sprintf("Recorded %s payment #%d of %s", form.Get("method"), paymentID, amount))
+		http.Redirect(w, r, fmt.Sprintf("%sinvoice/%d", pc.rootURL(), inv.ID), http.StatusSeeOther)
+	})
+}
+
+//Pay starts a checkout session with the provider and sends the member to it
+func (pc *PaymentController) Pay() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inv, ok := pc.invoiceFromRequest(w, r, "finance.write")
+		if !ok {
+			return
+		}
+		if !inv.Payable() {
+			pc.Session.Put(r, "flash", "This invoice does not need to be paid")
+			http.Redirect(w, r, fmt.Sprintf("%sinvoice/%d", pc.rootURL(), inv.ID), http.StatusSeeOther)
+			return
+		}
+
+		member, err := pc.Users.Get(inv.MemberID)
+		if err != nil {
+			pc.serverError(w, err)
+			return
+		}
+
+		cr := &payments.CheckoutRequest{
+			InvoiceID:   inv.ID,
+			MemberEmail: member.Email,
+			Description: inv.Description,
+			Amount:      int64(inv.Balance()),
+			SaveMethod:  r.FormValue("savemethod") == "on",
+			SuccessURL:  fmt.Sprintf("%spayments/success?invoice=%d", pc.rootURL(), inv.ID),
+			CancelURL:   fmt.Sprintf("%spayments/cancel?invoice=%d", pc.rootURL(), inv.ID),
+		}
+		if m, err := pc.Payments.DefaultMethod(inv.MemberID); err == nil && m != nil {
+			cr.CustomerID = m.CustomerID
+		}
+
+		cs, err := pc.Provider.CreateCheckoutSession(cr)
+		if err != nil {
+			pc.serverError(w, err)
+			return
+		}
+		if err := pc.Payments.StartCheckout(inv.ID, cs.ID); err != nil {
+			pc.serverError(w, err)
+			return
+		}
+
+		http.Redirect(w, r, cs.URL, http.StatusSeeOther)
+	})
+}
+
+//AutoPay charges an invoice to the member's default saved payment method. Used for recurring dues.
+func (pc *PaymentController) AutoPay() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inv, ok := pc.invoiceFromRequest(w, r, "finance.write")
+		if !ok {
+			return
+		}
+		redirect := fmt.Sprintf("%sinvoice/%d", pc.rootURL(), inv.ID)
+
+		if !inv.Payable() {
+			pc.Session.Put(r, "flash", "This invoice does not need to be paid")
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+			return
+		}
+
+		if err := pc.ChargeSavedMethod(inv); err != nil {
+			pc.Logger.Printf("automatic payment for invoice %d failed: %v", inv.ID, err)
+			pc.Session.Put(r, "flash", fmt.Sprintf("Could not charge the saved payment method: %v", err))
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+			return
+		}
+
+		pc.Session.Put(r, "flash", "Payment received, thank you!")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+	})
+}
+
+// ChargeSavedMethod charges what is left to pay on an invoice to the member's default payment method and records the
+// payment. The invoice, payment method and amount make up the idempotency key, so retrying a failed request never
+// charges twice but a retry after the member saves a different card, or pays part of the invoice some other way, is
+// a new charge rather than a replay of the old one.
+func (pc *PaymentController) ChargeSavedMethod(inv *models.Invoice) error {
+	method, err := pc.Payments.DefaultMethod(inv.MemberID)
+	if err != nil {
+		return err
+	}
+	if method == nil {
+		return fmt.Errorf("no saved payment method")
+	}
+
+	charge, err := pc.Provider.Charge(&payments.ChargeRequest{
+		InvoiceID:      inv.ID,
+		CustomerID:     method.CustomerID,
+		MethodID:       method.MethodID,
+		Description:    inv.Description,
+		Amount:         int64(inv.Balance()),
+		IdempotencyKey: fmt.Sprintf("invoice-%d-%s-%d", inv.ID, method.MethodID, int64(inv.Balance())),
+	})
+	if err != nil {
+		return err
+	}
+
+	paymentID, err := pc.Payments.RecordOnlinePayment(&models.OnlinePayment{
+		InvoiceID: inv.ID,
+		ChargeRef: charge.Ref,
+		Amount:    models.Money(charge.Amount),
+	})
+	if err != nil {
+		return err
+	}
+	pc.sendReceipt(paymentID)
+	return nil
+}
+
+// sendReceipt emails the receipt for a newly recorded payment. A failure is only logged, the payment itself has been recorded.
+func (pc *PaymentController) sendReceipt(paymentID int) {
+	if pc.Receipts == nil || paymentID == 0 {
+		return
+	}
+	if err := pc.Receipts.SendReceipt(paymentID); err != nil {
+		pc.Logger.Printf("could not send receipt for payment %d: %v", paymentID, err)
+	}
+}
+
+//Webhook receives event notifications from the payment provider.
+//Events are recorded idempotently, so the provider may safely redeliver them.
+func (pc *PaymentController) Webhook() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookBytes))
+		if err != nil {
+			pc.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		status, err := pc.handleWebhook(payload, r.Header.Get("Stripe-Signature"))
+		if err != nil {
+			pc.Logger.Printf("webhook rejected: %v", err)
+		}
+		w.WriteHeader(status)
+	})
+}
+
+// handleWebhook verifies and records a webhook payload, returning the HTTP status that should be sent to the provider
+func (pc *PaymentController) handleWebhook(payload []byte, signature string) (int, error) {
+	e, err := pc.Provider.VerifyWebhook(payload, signature)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if e.Type != payments.EventCheckoutCompleted {
+		return http.StatusOK, nil
+	}
+
+	paymentID, err := pc.Payments.RecordOnlinePayment(&models.OnlinePayment{
+		EventID:    e.ID,
+		EventType:  e.Type,
+		SessionID:  e.SessionID,
+		InvoiceID:  e.InvoiceID,
+		ChargeRef:  e.ChargeRef,
+		Amount:     models.Money(e.Amount),
+		CustomerID: e.CustomerID,
+		MethodID:   e.MethodID,
+		Brand:      e.Brand,
+		Last4:      e.Last4,
+	})
+	if err != nil {
+		// a server error tells the provider to retry later
+		return http.StatusInternalServerError, err
+	}
+	if paymentID == 0 {
+		pc.Logger.Printf("webhook event %s was already recorded", e.ID)
+	}
+	pc.sendReceipt(paymentID)
+	return http.StatusOK, nil
+}
+
+//CheckoutResult is where the provider sends the member back to after checkout. The payment itself is recorded by the webhook.
+func (pc *PaymentController) CheckoutResult(success bool) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(r.URL.Query().Get("invoice"), 1, math.MaxInt32)
+		if !ok {
+			pc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if success {
+			pc.Session.Put(r, "flash", "Payment received, thank you! It may take a moment to show on your invoice.")
+		} else {
+			pc.Session.Put(r, "flash", "Payment was cancelled")
+		}
+		http.Redirect(w, r, fmt.Sprintf("%sinvoice/%d", pc.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+//FakeCheckoutForm shows the checkout page of the fake provider. Only routed when the fake provider is configured.
+func (pc *PaymentController) FakeCheckoutForm() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake, ok := pc.Provider.(*payments.Fake)
+		if !ok {
+			pc.notFound(w)
+			return
+		}
+		cr, ok := fake.Session(mux.Vars(r)["session"])
+		if !ok {
+			pc.notFound(w)
+			return
+		}
+
+		td, err := pc.DefaultData(r)
+		if err != nil {
+			pc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Test Checkout"
+		td.Add("SessionID", mux.Vars(r)["session"])
+		td.Add("Checkout", cr)
+		td.Add("Amount", models.Money(cr.Amount))
+
+		if err := pc.PaymentView.Render(w, r, "fake_checkout.gohtml", td); err != nil {
+			pc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//FakeCheckoutComplete completes a fake checkout and delivers its webhook, as the real provider would
+func (pc *PaymentController) FakeCheckoutComplete() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake, ok := pc.Provider.(*payments.Fake)
+		if !ok {
+			pc.notFound(w)
+			return
+		}
+		session := mux.Vars(r)["session"]
+		cr, ok := fake.Session(session)
+		if !ok {
+			pc.notFound(w)
+			return
+		}
+
+		payload, sig, err := fake.Complete(session)
+		if err != nil {
+			pc.serverError(w, err)
+			return
+		}
+		if _, err := pc.handleWebhook(payload, sig); err != nil {
+			pc.serverError(w, err)
+			return
+		}
+
+		http.Redirect(w, r, cr.SuccessURL, http.StatusSeeOther)
+	})
+}
+
+//Methods lists the payment methods a member has saved
+func (pc *PaymentController) Methods() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			pc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !pc.canAccessMember(r, id, "finance.write") {
+			pc.forbidden(w)
+			return
+		}
+
+		methods, err := pc.Payments.SavedMethods(id)
+		if err != nil {
+			pc.serverError(w, err)
+			return
+		}
+
+		td, err := pc.DefaultData(r)
+		if err != nil {
+			pc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Saved Payment Methods"
+		td.Add("MemberID", id)
+		td.Add("Methods", methods)
+
+		if err := pc.PaymentView.Render(w, r, "methods.gohtml", td); err != nil {
+			pc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//DefaultMethod makes a saved method the one used for recurring dues
+func (pc *PaymentController) DefaultMethod() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok1 := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		mid, ok2 := util.IntOK(mux.Vars(r)["mid"], 1, math.MaxInt32)
+		if !ok1 || !ok2 {
+			pc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !pc.canAccessMember(r, id, "finance.write") {
+			pc.forbidden(w)
+			return
+		}
+		if err := pc.Payments.SetDefaultMethod(id, mid); err != nil {
+			pc.serverError(w, err)
+			return
+		}
+		pc.Session.Put(r, "flash", "Default payment method updated")
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/paymentmethods", pc.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+//DeleteMethod forgets a saved payment method
+func (pc *PaymentController) DeleteMethod() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok1 := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		mid, ok2 := util.IntOK(mux.Vars(r)["mid"], 1, math.MaxInt32)
+		if !ok1 || !ok2 {
+			pc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !pc.canAccessMember(r, id, "finance.write") {
+			pc.forbidden(w)
+			return
+		}
+		if err := pc.Payments.DeleteMethod(id, mid); err != nil {
+			pc.serverError(w, err)
+			return
+		}
+		pc.Session.Put(r, "flash", "Payment method removed")
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/paymentmethods", pc.rootURL(), id), http.StatusSeeOther)
+	})
+}
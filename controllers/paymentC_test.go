@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/payments"
+	"github.com/makeict/MESSforMakers/util"
+)
+
+// stubPayments records online payments once per webhook event, like PaymentModel does with its
+// payment_webhook_event table. The other methods are not used by the webhook.
+type stubPayments struct {
+	Payments
+	events   map[string]bool
+	recorded []models.OnlinePayment
+}
+
+func (sp *stubPayments) RecordOnlinePayment(op *models.OnlinePayment) (int, error) {
+	if sp.events[op.EventID] {
+		return 0, nil
+	}
+	sp.events[op.EventID] = true
+	sp.recorded = append(sp.recorded, *op)
+	return len(sp.recorded), nil
+}
+
+type stubReceipts struct {
+	sent []int
+}
+
+func (sr *stubReceipts) SendReceipt(paymentID int) error {
+	sr.sent = append(sr.sent, paymentID)
+	return nil
+}
+
+func TestWebhookRecordsFakeCheckoutOnce(t *testing.T) {
+	fake := payments.NewFake("whsec_test", "http://localhost/")
+	sp := &stubPayments{events: map[string]bool{}}
+	sr := &stubReceipts{}
+	pc := &PaymentController{Payments: sp, Provider: fake, Receipts: sr}
+	pc.Logger = &util.Logger{Logger: log.New(ioutil.Discard, "", 0)}
+
+	cs, err := fake.CreateCheckoutSession(&payments.CheckoutRequest{InvoiceID: 7, Amount: 2500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, err := fake.Complete(cs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, err := pc.handleWebhook(payload, sig); status != http.StatusOK || err != nil {
+		t.Fatalf("handleWebhook() = %d, %v; want 200", status, err)
+	}
+	if len(sp.recorded) != 1 {
+		t.Fatalf("recorded %d payments, want 1", len(sp.recorded))
+	}
+	if p := sp.recorded[0]; p.InvoiceID != 7 || p.Amount != 2500 || p.SessionID != cs.ID || p.ChargeRef == "" {
+		t.Errorf("recorded %+v, want 2500 paid on invoice 7", p)
+	}
+
+	// the provider redelivers the same event, which must change nothing
+	if status, err := pc.handleWebhook(payload, sig); status != http.StatusOK || err != nil {
+		t.Fatalf("redelivered handleWebhook() = %d, %v; want 200", status, err)
+	}
+	if len(sp.recorded) != 1 {
+		t.Errorf("recorded %d payments after redelivery, want 1", len(sp.recorded))
+	}
+	if len(sr.sent) != 1 {
+		t.Errorf("sent %d receipts after redelivery, want 1", len(sr.sent))
+	}
+}
+
+func TestWebhookRejectsTamperedPayload(t *testing.T) {
+	fake := payments.NewFake("whsec_test", "http://localhost/")
+	sp := &stubPayments{events: map[string]bool{}}
+	pc := &PaymentController{Payments: sp, Provider: fake}
+	pc.Logger = &util.Logger{Logger: log.New(ioutil.Discard, "", 0)}
+
+	cs, err := fake.CreateCheckoutSession(&payments.CheckoutRequest{InvoiceID: 7, Amount: 2500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, err := fake.Complete(cs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload = []byte(string(payload[:len(payload)-1]) + `,"Amount":1}`)
+
+	if status, _ := pc.handleWebhook(payload, sig); status != http.StatusBadRequest {
+		t.Errorf("handleWebhook() = %d, want 400", status)
+	}
+	if len(sp.recorded) != 0 {
+		t.Errorf("recorded %d payments from a tampered payload, want none", len(sp.recorded))
+	}
+}
@@ -0,0 +1,456 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/payments"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//RefundController implements the handlers for refund policies and the refund request and approval flow
+type RefundController struct {
+	Controller
+	Refunds    Refunds
+	Provider   payments.Provider
+	RefundView views.View
+}
+
+//Initialize performs the required setup for a refund controller
+func (rc *RefundController) Initialize(cfg *util.Config, um Users, rm Refunds, pm Permissions, p payments.Provider, l *util.Logger, s *sessions.Session) error {
+	rc.setup(cfg, um, l, s)
+	rc.Refunds = rm
+	rc.Permissions = pm
+	rc.Provider = p
+
+	rc.RefundView = views.View{}
+
+	if err := rc.RefundView.LoadTemplates("refund"); err != nil {
+		return fmt.Errorf("Error loading refund templates: %v", err)
+	}
+
+	return nil
+}
+
+//Policies lists the refund policies that can be chosen for an event
+func (rc *RefundController) Policies() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policies, err := rc.Refunds.Policies()
+		if err != nil {
+			rc.serverError(w, err)
+			return
+		}
+
+		td, err := rc.DefaultData(r)
+		if err != nil {
+			rc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Refund Policies"
+		td.Add("Policies", policies)
+		td.Add("CanEdit", rc.can(r, "finance.write"))
+
+		if err := rc.RefundView.Render(w, r, "policies.gohtml", td); err != nil {
+			rc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//PolicyForm displays the form for a new refund policy, or for editing an existing one
+func (rc *RefundController) PolicyForm() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rc.can(r, "finance.write") {
+			rc.forbidden(w)
+			return
+		}
+
+		form := util.NewForm(url.Values{})
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			id, ok := util.IntOK(idStr, 1, math.MaxInt32)
+			if !ok {
+				rc.clientError(w, http.StatusBadRequest)
+				return
+			}
+			p, err := rc.Refunds.GetPolicy(id)
+			if err != nil {
+				rc.notFound(w)
+				return
+			}
+			form.Set("id", strconv.Itoa(p.ID))
+			form.Set("name", p.Name)
+			form.Set("description", p.Description)
+			if p.FullRefundDays != nil {
+				form.Set("fullrefunddays", strconv.Itoa(*p.FullRefundDays))
+			}
+			form.Set("partialpercent", strconv.Itoa(p.PartialPercent))
+		}
+
+		rc.renderPolicyForm(w, r, form)
+	})
+}
+
+func (rc *RefundController) renderPolicyForm(w http.ResponseWriter, r *http.Request, form *util.Form) {
+	td, err := rc.DefaultData(r)
+	if err != nil {
+		rc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Refund Policy"
+	td.Add("Form", form)
+
+	if err := rc.RefundView.Render(w, r, "policy_form.gohtml", td); err != nil {
+		rc.serverError(w, err)
+		return
+	}
+}
+
+//SavePolicy validates and saves a new or edited refund policy
+func (rc *RefundController) SavePolicy() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rc.can(r, "finance.write") {
+			rc.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("name", "description", "partialpercent")
+		form.MaxLength("name", 255)
+
+		p := &models.RefundPolicy{
+			Name:        form.Get("name"),
+			Description: form.Get("description"),
+		}
+		if idStr, ok := mux.Vars(r)["id"]; ok {
+			p.ID, _ = util.IntOK(idStr, 1, math.MaxInt32)
+			form.Set("id", idStr)
+		}
+		if d := form.Get("fullrefunddays"); d != "" {
+			n, ok := util.IntOK(d, 0, 365)
+			if !ok {
+				form.Errors.Add("fullrefunddays", "Must be a number of days between 0 and 365")
+			}
+			p.FullRefundDays = &n
+		}
+		if pct := form.Get("partialpercent"); pct != "" {
+			n, ok := util.IntOK(pct, 0, 100)
+			if !ok {
+				form.Errors.Add("partialpercent", "Must be a percentage between 0 and 100")
+			}
+			p.PartialPercent = n
+		}
+
+		if !form.Valid() {
+			rc.renderPolicyForm(w, r, form)
+			return
+		}
+
+		var err error
+		if p.ID == 0 {
+			err = rc.Refunds.CreatePolicy(p)
+		} else {
+			err = rc.Refunds.UpdatePolicy(p)
+		}
+		if err != nil {
+			form.Errors.Add("saveError", err.Error())
+			rc.renderPolicyForm(w, r, form)
+			return
+		}
+
+		rc.Session.Put(r, "flash", "Refund policy saved")
+		http.Redirect(w, r, rc.rootURL()+"refundpolicies", http.StatusSeeOther)
+	})
+}
+
+// registrationFromRequest loads the registration in the {id} route variable and checks that the logged in member may request its refund
+func (rc *RefundController) registrationFromRequest(w http.ResponseWriter, r *http.Request) (*models.RefundableRegistration, bool) {
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		rc.clientError(w, http.StatusBadRequest)
+		return nil, false
+	}
+	reg, err := rc.Refunds.Registration(id)
+	if err != nil {
+		rc.notFound(w)
+		return nil, false
+	}
+	if !rc.canAccessMember(r, reg.MemberID, "finance.write") {
+		rc.forbidden(w)
+		return nil, false
+	}
+	return reg, true
+}
+
+//RequestForm shows what the refund policy allows for a registration and asks for a reason
+func (rc *RefundController) RequestForm() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reg, ok := rc.registrationFromRequest(w, r)
+		if !ok {
+			return
+		}
+		rc.renderRequestForm(w, r, reg, util.NewForm(nil))
+	})
+}
+
+func (rc *RefundController) renderRequestForm(w http.ResponseWriter, r *http.Request, reg *models.RefundableRegistration, form *util.Form) {
+	td, err := rc.DefaultData(r)
+	if err != nil {
+		rc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Request a Refund"
+	td.Add("Registration", reg)
+	td.Add("Amount", reg.Refund(time.Now()))
+	td.Add("Form", form)
+
+	if err := rc.RefundView.Render(w, r, "request_form.gohtml", td); err != nil {
+		rc.serverError(w, err)
+		return
+	}
+}
+
+//Request saves a refund request for an admin to approve. The amount is fixed by the policy at the time of the request.
+func (rc *RefundController) Request() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reg, ok := rc.registrationFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.MaxLength("reason", 1000)
+
+		amount := reg.Refund(time.Now())
+		if reg.PaymentID == nil {
+			form.Errors.Add("saveError", "There is no payment on this registration to refund")
+		} else if amount == 0 {
+			form.Errors.Add("saveError", "The refund policy for this event does not allow a refund at this time")
+		}
+		if !form.Valid() {
+			rc.renderRequestForm(w, r, reg, form)
+			return
+		}
+
+		rr := &models.RefundRequest{
+			RegistrationID: reg.ID,
+			PaymentID:      *reg.PaymentID,
+			Amount:         amount,
+			Reason:         form.Get("reason"),
+			RequestedBy:    rc.authenticatedUserID(r),
+		}
+		if err := rc.Refunds.RequestRefund(rr); err != nil {
+			if err != models.ErrDuplicateRefund {
+				rc.Logger.Printf("could not save refund request: %v", err)
+			}
+			form.Errors.Add("saveError", err.Error())
+			rc.renderRequestForm(w, r, reg, form)
+			return
+		}
+
+		rc.Session.Put(r, "flash", fmt.Sprintf("Your request for a refund of %s has been sent for approval", amount))
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d", rc.rootURL(), reg.MemberID), http.StatusSeeOther)
+	})
+}
+
+//Queue lists refund requests for admins, pending requests by default
+func (rc *RefundController) Queue() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rc.can(r, "finance.write") {
+			rc.forbidden(w)
+			return
+		}
+
+		form := util.NewForm(r.URL.Query())
+		status := form.Get("status")
+		form.PermittedValues("status", "pending", "processing", "refunded", "rejected")
+		if status == "" || !form.Valid() {
+			status = "pending"
+		}
+
+		requests, err := rc.Refunds.Requests(status)
+		if err != nil {
+			rc.serverError(w, err)
+			return
+		}
+
+		td, err := rc.DefaultData(r)
+		if err != nil {
+			rc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Refund Requests"
+		td.Add("Status", status)
+		td.Add("Requests", requests)
+
+		if err := rc.RefundView.Render(w, r, "requests.gohtml", td); err != nil {
+			rc.serverError(w, err)
+			return
+		}
+	})
+}
+
+// requestFromRequest loads the refund request in the {id} route variable for an admin decision
+func (rc *RefundController) requestFromRequest(w http.ResponseWriter, r *http.Request) (*models.RefundRequest, bool) {
+	if !rc.can(r, "finance.write") {
+		rc.forbidden(w)
+		return nil, false
+	}
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		rc.clientError(w, http.StatusBadRequest)
+		return nil, false
+	}
+	rr, err := rc.Refunds.GetRequest(id)
+	if err != nil {
+		rc.notFound(w)
+		return nil, false
+	}
+	if rr.Status == "processing" {
+		rc.Session.Put(r, "flash", fmt.Sprintf("Refund request %d is already being refunded", rr.ID))
+		http.Redirect(w, r, rc.rootURL()+"refunds", http.StatusSeeOther)
+		return nil, false
+	}
+	if rr.Status != "pending" {
+		rc.Session.Put(r, "flash", fmt.Sprintf("Refund request %d has already been %s", rr.ID, rr.Status))
+		http.Redirect(w, r, rc.rootURL()+"refunds", http.StatusSeeOther)
+		return nil, false
+	}
+	return rr, true
+}
+
+//Approve issues the refund. Online payments are refunded through the payment provider,
+//anything else is recorded as a cash or check refund handed over by the treasurer.
+//The request is claimed before any money moves, so a double submit or two admins approving at once refund it once.
+func (rc *RefundController) Approve() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rr, ok := rc.requestFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.PermittedValues("method", "cash", "check")
+		form.MaxLength("note", 1000)
+		if !form.Valid() {
+			rc.clientError(w, http.StatusBadRequest)
+			return
+		}
+
+		refund := &models.Refund{
+			PaymentID: rr.PaymentID,
+			Amount:    rr.Amount,
+			Note:      form.Get("note"),
+		}
+
+		err := rc.Refunds.Claim(rr.ID, rc.authenticatedUserID(r))
+		if err == models.ErrRefundNotPending {
+			rc.Session.Put(r, "flash", fmt.Sprintf("Refund request %d is already being refunded or has been decided", rr.ID))
+			http.Redirect(w, r, rc.rootURL()+"refunds", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			rc.serverError(w, err)
+			return
+		}
+
+		// other refunds may have been made from the same payment since this one was requested
+		earlier, err := rc.Refunds.RefundsForPayment(rr.PaymentID)
+		if err != nil {
+			rc.release(rr.ID)
+			rc.serverError(w, err)
+			return
+		}
+		left := rr.PaymentAmount
+		for _, e := range earlier {
+			left -= e.Amount
+		}
+		if rr.Amount > left {
+			rc.release(rr.ID)
+			rc.Session.Put(r, "flash", fmt.Sprintf("Refund request %d is for %s, but only %s of the payment has not been refunded", rr.ID, rr.Amount, left))
+			http.Redirect(w, r, rc.rootURL()+"refunds", http.StatusSeeOther)
+			return
+		}
+
+		if rr.PaymentMethod == "online" {
+			if rr.ProviderRef == nil {
+				rc.release(rr.ID)
+				rc.serverError(w, fmt.Errorf("online payment %d has no provider reference", rr.PaymentID))
+				return
+			}
+			// the key makes the provider hand back the same refund if this request is ever sent again
+			pr, err := rc.Provider.Refund(*rr.ProviderRef, int64(rr.Amount), fmt.Sprintf("refund-request-%d", rr.ID))
+			if err != nil {
+				rc.release(rr.ID)
+				rc.Session.Put(r, "flash", fmt.Sprintf("The payment provider could not refund request %d: %v", rr.ID, err))
+				http.Redirect(w, r, rc.rootURL()+"refunds", http.StatusSeeOther)
+				return
+			}
+			refund.Method = "online"
+			refund.ProviderRef = &pr.Ref
+		} else {
+			refund.Method = form.Get("method")
+			if refund.Method == "" {
+				refund.Method = rr.PaymentMethod
+			}
+		}
+
+		if err := rc.Refunds.Approve(rr.ID, rc.authenticatedUserID(r), form.Get("note"), refund); err != nil {
+			if refund.ProviderRef != nil {
+				// the money has already gone back to the member, so this must be fixed by hand. The request stays
+				// processing so nobody refunds it again.
+				rc.Logger.Printf("refund %s for request %d was issued but could not be recorded, record it by hand: %v", *refund.ProviderRef, rr.ID, err)
+			} else {
+				rc.release(rr.ID)
+			}
+			rc.serverError(w, err)
+			return
+		}
+
+		rc.Session.Put(r, "flash", fmt.Sprintf("Refunded %s to %s", rr.Amount, rr.MemberName))
+		http.Redirect(w, r, rc.rootURL()+"refunds", http.StatusSeeOther)
+	})
+}
+
+// release puts a claimed request back in the queue after its refund failed, so it can be tried again
+func (rc *RefundController) release(id int) {
+	if err := rc.Refunds.Release(id); err != nil {
+		rc.Logger.Printf("could not release refund request %d: %v", id, err)
+	}
+}
+
+//Reject closes a refund request without refunding anything
+func (rc *RefundController) Reject() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rr, ok := rc.requestFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		r.ParseForm()
+		err := rc.Refunds.Reject(rr.ID, rc.authenticatedUserID(r), r.PostForm.Get("note"))
+		if err == models.ErrRefundNotPending {
+			rc.Session.Put(r, "flash", fmt.Sprintf("Refund request %d is already being refunded or has been decided", rr.ID))
+			http.Redirect(w, r, rc.rootURL()+"refunds", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			rc.serverError(w, err)
+			return
+		}
+
+		rc.Session.Put(r, "flash", fmt.Sprintf("Rejected refund request %d", rr.ID))
+		http.Redirect(w, r, rc.rootURL()+"refunds", http.StatusSeeOther)
+	})
+}
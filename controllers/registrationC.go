@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//RegistrationController implements the handlers for members registering for events
+type RegistrationController struct {
+	Controller
+	Registrations    Registrations
+	Vouchers         Vouchers
+	RegistrationView views.View
+}
+
+//Initialize performs the required setup for a registration controller
+func (rc *RegistrationController) Initialize(cfg *util.Config, um Users, rm Registrations, vm Vouchers, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	rc.setup(cfg, um, l, s)
+	rc.Registrations = rm
+	rc.Vouchers = vm
+	rc.Permissions = pm
+
+	rc.RegistrationView = views.View{}
+
+	if err := rc.RegistrationView.LoadTemplates("registration"); err != nil {
+		return fmt.Errorf("Error loading registration templates: %v", err)
+	}
+
+	return nil
+}
+
+// eventFromRequest checks a member is logged in and gets the event named in the URL, with the fees they would pay.
+// Writes the error response and returns false if not.
+func (rc *RegistrationController) eventFromRequest(w http.ResponseWriter, r *http.Request) (*models.RegistrationEvent, bool) {
+	memberID := rc.authenticatedUserID(r)
+	if memberID == 0 {
+		rc.forbidden(w)
+		return nil, false
+	}
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		rc.clientError(w, http.StatusBadRequest)
+		return nil, false
+	}
+	e, err := rc.Registrations.Event(id, memberID)
+	if err != nil {
+		rc.notFound(w)
+		return nil, false
+	}
+	return e, true
+}
+
+//Form shows an event with what the logged in member would pay to register for it
+func (rc *RegistrationController) Form() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, ok := rc.eventFromRequest(w, r)
+		if !ok {
+			return
+		}
+		rc.render(w, r, e, util.NewForm(url.Values{}))
+	})
+}
+
+func (rc *RegistrationController) render(w http.ResponseWriter, r *http.Request, e *models.RegistrationEvent, form *util.Form) {
+	td, err := rc.DefaultData(r)
+	if err != nil {
+		rc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Register for " + e.Name
+	td.Add("Event", e)
+	td.Add("Open", e.RequiresRegistration && e.Starts.After(time.Now()))
+	td.Add("Form", form)
+
+	if err := rc.RegistrationView.Render(w, r, "register.gohtml", td); err != nil {
+		rc.serverError(w, err)
+		return
+	}
+}
+
+//Register signs the logged in member up for an event. A gift voucher code entered with it is redeemed first, so
+//that the voucher comes off the invoice for the fees.
+func (rc *RegistrationController) Register() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, ok := rc.eventFromRequest(w, r)
+		if !ok {
+			return
+		}
+		memberID := rc.authenticatedUserID(r)
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+
+		if code := form.Get("code"); code != "" {
+			_, err := rc.Vouchers.Redeem(memberID, code, time.Now())
+			if err == models.ErrVoucherCode || err == models.ErrVoucherRedeemed {
+				form.Errors.Add("code", err.Error())
+				rc.render(w, r, e, form)
+				return
+			}
+			if err != nil {
+				rc.serverError(w, err)
+				return
+			}
+		}
+
+		inv, err := rc.Registrations.Register(memberID, e.ID, time.Now())
+		switch err {
+		case nil:
+		case models.ErrNoRegistration, models.ErrEventStarted, models.ErrAlreadyRegistered, models.ErrMissingPrerequisites:
+			form.Errors.Add("saveError", err.Error())
+			rc.render(w, r, e, form)
+			return
+		default:
+			rc.serverError(w, err)
+			return
+		}
+
+		if inv == nil || inv.Paid() {
+			rc.Session.Put(r, "flash", fmt.Sprintf("You are registered for %s", e.Name))
+			http.Redirect(w, r, fmt.Sprintf("%slocation/%d/calendar", rc.rootURL(), e.LocationID), http.StatusSeeOther)
+			return
+		}
+		rc.Session.Put(r, "flash", fmt.Sprintf("You are registered for %s. Please pay the invoice for its fees.", e.Name))
+		http.Redirect(w, r, fmt.Sprintf("%sinvoice/%d", rc.rootURL(), inv.ID), http.StatusSeeOther)
+	})
+}
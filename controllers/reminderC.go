@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golangcollege/sessions"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//ReminderController sends payment reminders for unpaid invoices on the schedule in the configuration
+type ReminderController struct {
+	Controller
+	Reminders    Reminders
+	Mailer       util.Mailer
+	Texter       util.Texter
+	ReminderView views.TextView
+}
+
+// reminderStep is one step of the configured schedule
+type reminderStep struct {
+	Name string
+	Days int
+	SMS  bool
+}
+
+// reminderData is what the reminder templates are executed with
+type reminderData struct {
+	Org     interface{}
+	Invoice models.ReminderInvoice
+	Overdue int // days past the due date, 0 or less if not yet due
+	Until   int // days until the due date
+	PayURL  string
+}
+
+//Initialize performs the required setup for a reminder controller. Every step in the schedule must have a template.
+func (rc *ReminderController) Initialize(cfg *util.Config, um Users, rm Reminders, pm Permissions, m util.Mailer, t util.Texter, l *util.Logger, s *sessions.Session) error {
+	rc.setup(cfg, um, l, s)
+	rc.Reminders = rm
+	rc.Permissions = pm
+	rc.Mailer = m
+	rc.Texter = t
+
+	rc.ReminderView = views.TextView{}
+
+	if err := rc.ReminderView.LoadTemplates("reminder"); err != nil {
+		return fmt.Errorf("Error loading reminder templates: %v", err)
+	}
+	for _, step := range rc.steps() {
+		if !rc.ReminderView.Has(step.Name + ".gotmpl") {
+			return fmt.Errorf("No template for reminder step %q", step.Name)
+		}
+	}
+
+	return nil
+}
+
+// steps returns the configured schedule, earliest step first
+func (rc *ReminderController) steps() []reminderStep {
+	steps := []reminderStep{}
+	for _, s := range rc.AppConfig.Reminders.Steps {
+		steps = append(steps, reminderStep{Name: s.Name, Days: s.Days, SMS: s.SMS})
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i].Days < steps[j].Days })
+	return steps
+}
+
+// Run sends every reminder that is due and returns how many were sent. Only the latest step an invoice has
+// reached is sent, so an invoice that is already well overdue does not get the earlier reminders all at once.
+// Failures are logged and retried on the next run.
+func (rc *ReminderController) Run(now time.Time) (int, error) {
+	steps := rc.steps()
+	if len(steps) == 0 {
+		return 0, nil
+	}
+
+	// invoice due dates are plain dates, so compare whole days
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	invoices, err := rc.Reminders.Unpaid(today.AddDate(0, 0, -steps[0].Days))
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, inv := range invoices {
+		due := time.Date(inv.DueDate.Year(), inv.DueDate.Month(), inv.DueDate.Day(), 0, 0, 0, 0, time.UTC)
+		overdue := int(today.Sub(due).Hours() / 24)
+
+		var step *reminderStep
+		for i := range steps {
+			if steps[i].Days <= overdue {
+				step = &steps[i]
+			}
+		}
+		if step == nil {
+			continue
+		}
+
+		data := &reminderData{
+			Org:     rc.AppConfig.Org,
+			Invoice: inv,
+			Overdue: overdue,
+			Until:   -overdue,
+			PayURL:  fmt.Sprintf("%sinvoice/%d", rc.rootURL(), inv.InvoiceID),
+		}
+
+		if rc.send(inv.InvoiceID, step.Name, "email", func() error { return rc.sendEmail(step.Name, data) }) {
+			sent++
+		}
+		if step.SMS && inv.TextOK && inv.Phone != "" {
+			if to, ok := util.NormalizePhone(inv.Phone, rc.AppConfig.SMS.CountryCode); !ok {
+				rc.Logger.Printf("skipping %s sms reminder for invoice %d: %q is not a phone number", step.Name, inv.InvoiceID, inv.Phone)
+			} else if rc.send(inv.InvoiceID, step.Name, "sms", func() error { return rc.sendText(step.Name, to, data) }) {
+				sent++
+			}
+		}
+	}
+	return sent, nil
+}
+
+// send claims a reminder and sends it, releasing the claim if sending fails. Returns whether it was sent.
+func (rc *ReminderController) send(invoiceID int, step, channel string, deliver func() error) bool {
+	ok, err := rc.Reminders.Claim(invoiceID, step, channel)
+	if err != nil {
+		rc.Logger.Printf("could not claim %s %s reminder for invoice %d: %v", step, channel, invoiceID, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if err := deliver(); err != nil {
+		rc.Logger.Printf("could not send %s %s reminder for invoice %d: %v", step, channel, invoiceID, err)
+		if err := rc.Reminders.Release(invoiceID, step, channel); err != nil {
+			rc.Logger.Printf("%v", err)
+		}
+		return false
+	}
+	return true
+}
+
+func (rc *ReminderController) sendEmail(step string, data *reminderData) error {
+	subject, err := rc.ReminderView.Render(step+".gotmpl", "subject", data)
+	if err != nil {
+		return err
+	}
+	body, err := rc.ReminderView.Render(step+".gotmpl", "body", data)
+	if err != nil {
+		return err
+	}
+	return rc.Mailer.Send(&util.Message{To: []string{data.Invoice.Email}, Subject: subject, Body: body + "\n"})
+}
+
+func (rc *ReminderController) sendText(step, to string, data *reminderData) error {
+	body, err := rc.ReminderView.Render(step+".gotmpl", "sms", data)
+	if err != nil {
+		return err
+	}
+	return rc.Texter.SendText(to, body)
+}
+
+//RunNow sends any reminders that are due without waiting for the next scheduled run
+func (rc *ReminderController) RunNow() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rc.can(r, "finance.write") {
+			rc.forbidden(w)
+			return
+		}
+
+		sent, err := rc.Run(time.Now())
+		if err != nil {
+			rc.serverError(w, err)
+			return
+		}
+		rc.Session.Put(r, "flash", fmt.Sprintf("Sent %d payment reminders", sent))
+		http.Redirect(w, r, fmt.Sprintf("%sreports/aging", rc.rootURL()), http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+)
+
+// stubReminders lets every reminder be claimed
+type stubReminders struct {
+	invoices []models.ReminderInvoice
+}
+
+func (sr *stubReminders) Unpaid(time.Time) ([]models.ReminderInvoice, error) { return sr.invoices, nil }
+func (sr *stubReminders) Claim(int, string, string) (bool, error)            { return true, nil }
+func (sr *stubReminders) Release(int, string, string) error                  { return nil }
+
+type stubMailer struct{}
+
+func (stubMailer) Send(*util.Message) error { return nil }
+
+type stubTexter struct {
+	to []string
+}
+
+func (st *stubTexter) SendText(to, body string) error {
+	st.to = append(st.to, to)
+	return nil
+}
+
+func TestRemindersTextNormalizedNumbers(t *testing.T) {
+	// templates are loaded relative to the repository root
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir("controllers")
+
+	cfg := &util.Config{}
+	if err := json.Unmarshal([]byte(`{"reminder_settings": {"steps": [{"name": "due", "days": 0, "sms": true}]}}`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	today := time.Date(2026, time.March, 10, 0, 0, 0, 0, time.UTC)
+	reminders := &stubReminders{invoices: []models.ReminderInvoice{
+		{InvoiceID: 1, DueDate: today, Phone: "(316) 555-1234", TextOK: true},
+		{InvoiceID: 2, DueDate: today, Phone: "555-1234", TextOK: true},
+		{InvoiceID: 3, DueDate: today, Phone: "316.555.9876", TextOK: false},
+	}}
+	texter := &stubTexter{}
+
+	rc := &ReminderController{}
+	logger := &util.Logger{Logger: log.New(ioutil.Discard, "", 0)}
+	if err := rc.Initialize(cfg, nil, reminders, nil, stubMailer{}, texter, logger, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.Run(today); err != nil {
+		t.Fatal(err)
+	}
+	if len(texter.to) != 1 || texter.to[0] != "+13165551234" {
+		t.Errorf("texts sent to %q, want only +13165551234", texter.to)
+	}
+}
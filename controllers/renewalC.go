@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golangcollege/sessions"
+
+	"github.com/makeict/MESSforMakers/util"
+)
+
+//RenewalController invoices recurring memberships, with their addons, ahead of each new dues period
+type RenewalController struct {
+	Controller
+	Renewals    Renewals
+	Memberships Memberships
+	Invoices    InvoiceSender
+}
+
+//Initialize performs the required setup for a renewal controller
+func (rc *RenewalController) Initialize(cfg *util.Config, um Users, rm Renewals, mm Memberships, pm Permissions, is InvoiceSender, l *util.Logger, s *sessions.Session) error {
+	rc.setup(cfg, um, l, s)
+	rc.Renewals = rm
+	rc.Memberships = mm
+	rc.Permissions = pm
+	rc.Invoices = is
+	return nil
+}
+
+// Run invoices every membership whose period ends within the configured number of days and returns how many
+// invoices were created. Each new invoice is emailed to the member; failures to email are only logged.
+// Memberships whose pause has ended are resumed first, so that they are invoiced as usual, and members whose
+// period has ended without the invoice for the next one being paid are moved to past_due.
+func (rc *RenewalController) Run(now time.Time) (int, error) {
+	resumed, err := rc.Memberships.ResumeEnded(now)
+	if err != nil {
+		rc.Logger.Printf("could not resume paused memberships: %v", err)
+	} else if resumed > 0 {
+		rc.Logger.Printf("Resumed %d paused memberships", resumed)
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	lapsed, err := rc.Renewals.Lapse(today)
+	if err != nil {
+		rc.Logger.Printf("could not mark lapsed memberships past due: %v", err)
+	} else if lapsed > 0 {
+		rc.Logger.Printf("Moved %d lapsed memberships to past due", lapsed)
+	}
+
+	due, err := rc.Renewals.Due(today.AddDate(0, 0, rc.AppConfig.Billing.RenewalDays))
+	if err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for i := range due {
+		inv, err := rc.Renewals.Renew(&due[i])
+		if err != nil {
+			rc.Logger.Printf("could not renew membership for member %d: %v", due[i].MemberID, err)
+			continue
+		}
+		if inv == nil {
+			continue
+		}
+		created++
+		if err := rc.Invoices.SendInvoice(inv); err != nil {
+			rc.Logger.Printf("could not email invoice %d: %v", inv.ID, err)
+		}
+	}
+	return created, nil
+}
+
+//RunNow invoices any renewals that are due without waiting for the next scheduled run
+func (rc *RenewalController) RunNow() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rc.can(r, "finance.write") {
+			rc.forbidden(w)
+			return
+		}
+
+		created, err := rc.Run(time.Now())
+		if err != nil {
+			rc.serverError(w, err)
+			return
+		}
+		rc.Session.Put(r, "flash", fmt.Sprintf("Created %d renewal invoices", created))
+		http.Redirect(w, r, fmt.Sprintf("%sreports/aging", rc.rootURL()), http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,336 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//ReportController implements the handlers for the treasurer's financial reports
+type ReportController struct {
+	Controller
+	Reports    Reports
+	ReportView views.View
+}
+
+// report is a finished report: one or more tables that can be shown as HTML or downloaded as CSV
+type report struct {
+	Name     string
+	Title    string
+	Note     string
+	Sections []reportTable
+}
+
+// reportTable is one table in a report. Totals is optional.
+type reportTable struct {
+	Title   string
+	Columns []string
+	Right   []bool // columns to align right, usually numbers
+	Rows    [][]string
+	Totals  []string
+}
+
+// reportTypes lists the available reports in the order they are offered
+var reportTypes = []struct {
+	Name  string
+	Title string
+	build func(*ReportController, time.Time, time.Time) (*report, error)
+}{
+	{"revenue", "Revenue by category", (*ReportController).revenue},
+	{"aging", "Accounts receivable aging", (*ReportController).aging},
+	{"payments", "Payments by method", (*ReportController).payments},
+	{"members", "Active members", (*ReportController).members},
+	{"discounts", "Discounts granted", (*ReportController).discounts},
+}
+
+//Initialize performs the required setup for a report controller
+func (rc *ReportController) Initialize(cfg *util.Config, um Users, rm Reports, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	rc.setup(cfg, um, l, s)
+	rc.Reports = rm
+	rc.Permissions = pm
+
+	rc.ReportView = views.View{}
+
+	if err := rc.ReportView.LoadTemplates("report"); err != nil {
+		return fmt.Errorf("Error loading report templates: %v", err)
+	}
+
+	return nil
+}
+
+//Index lists the available reports
+func (rc *ReportController) Index() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rc.can(r, "finance.read") {
+			rc.forbidden(w)
+			return
+		}
+
+		td, err := rc.DefaultData(r)
+		if err != nil {
+			rc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Financial Reports"
+		td.Add("Reports", reportTypes)
+
+		if err := rc.ReportView.Render(w, r, "index.gohtml", td); err != nil {
+			rc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Show displays a report for the date range in the request, or downloads it as CSV
+func (rc *ReportController) Show(asCSV bool) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rc.can(r, "finance.read") {
+			rc.forbidden(w)
+			return
+		}
+
+		name := mux.Vars(r)["name"]
+		from, to := dateRange(r)
+		var rep *report
+		var err error
+		found := false
+		for _, rt := range reportTypes {
+			if rt.Name == name {
+				found = true
+				rep, err = rt.build(rc, from, to)
+				break
+			}
+		}
+		if !found {
+			rc.notFound(w)
+			return
+		}
+		if err != nil {
+			rc.serverError(w, err)
+			return
+		}
+
+		if asCSV {
+			rc.writeCSV(w, rep, from, to)
+			return
+		}
+
+		td, err := rc.DefaultData(r)
+		if err != nil {
+			rc.serverError(w, err)
+			return
+		}
+		td.PageTitle = rep.Title
+		td.Add("Report", rep)
+		td.Add("From", from)
+		td.Add("To", to)
+		td.Add("Range", fmt.Sprintf("from=%s&to=%s", from.Format("2006-01-02"), to.Format("2006-01-02")))
+
+		if err := rc.ReportView.Render(w, r, "report.gohtml", td); err != nil {
+			rc.serverError(w, err)
+			return
+		}
+	})
+}
+
+// writeCSV downloads every table of a report, one after the other with a blank line between them
+func (rc *ReportController) writeCSV(w http.ResponseWriter, rep *report, from, to time.Time) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s-%s.csv\"", rep.Name, from.Format("20060102"), to.Format("20060102")))
+
+	cw := csv.NewWriter(w)
+	for i, t := range rep.Sections {
+		if i > 0 {
+			cw.Write([]string{})
+		}
+		if t.Title != "" {
+			cw.Write([]string{t.Title})
+		}
+		cw.Write(t.Columns)
+		for _, row := range t.Rows {
+			// text columns hold member names and descriptions; the right aligned ones are numbers
+			safe := make([]string, len(row))
+			for j, v := range row {
+				if j < len(t.Right) && t.Right[j] {
+					safe[j] = v
+				} else {
+					safe[j] = spreadsheetText(v)
+				}
+			}
+			cw.Write(safe)
+		}
+		if t.Totals != nil {
+			cw.Write(t.Totals)
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		rc.Logger.Printf("could not write %s report csv: %v", rep.Name, err)
+	}
+}
+
+func (rc *ReportController) revenue(from, to time.Time) (*report, error) {
+	rows, err := rc.Reports.Revenue(from, to)
+	if err != nil {
+		return nil, err
+	}
+	t := reportTable{Columns: []string{"Category", "Lines", "Amount"}, Right: []bool{false, true, true}}
+	var lines int
+	var total models.Money
+	for _, row := range rows {
+		t.Rows = append(t.Rows, []string{row.Category, strconv.Itoa(row.Lines), row.Amount.Decimal()})
+		lines += row.Lines
+		total += row.Amount
+	}
+	t.Totals = []string{"Total", strconv.Itoa(lines), total.Decimal()}
+	return &report{
+		Name:     "revenue",
+		Title:    "Revenue by category",
+		Note:     "Amounts invoiced in the period, excluding cancelled invoices. Dues are shown by the member's current membership option.",
+		Sections: []reportTable{t},
+	}, nil
+}
+
+func (rc *ReportController) aging(from, to time.Time) (*report, error) {
+	invoices, err := rc.Reports.Aging(to)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := reportTable{Title: "Summary", Columns: []string{"Age", "Invoices", "Amount"}, Right: []bool{false, true, true}}
+	detail := reportTable{
+		Title:   "Unpaid invoices",
+		Columns: []string{"Invoice", "Member", "Description", "Issued", "Days", "Age", "Amount"},
+		Right:   []bool{false, false, false, false, true, false, true},
+	}
+	counts := make([]int, len(models.AgingBuckets))
+	amounts := make([]models.Money, len(models.AgingBuckets))
+	var total models.Money
+	for _, inv := range invoices {
+		b := inv.Bucket()
+		counts[b]++
+		amounts[b] += inv.Amount
+		total += inv.Amount
+		detail.Rows = append(detail.Rows, []string{
+			strconv.Itoa(inv.ID),
+			inv.MemberName,
+			inv.Description,
+			inv.CreatedAt.Format("2006-01-02"),
+			strconv.Itoa(inv.Days),
+			models.AgingBuckets[b].Name,
+			inv.Amount.Decimal(),
+		})
+	}
+	for i, b := range models.AgingBuckets {
+		summary.Rows = append(summary.Rows, []string{b.Name, strconv.Itoa(counts[i]), amounts[i].Decimal()})
+	}
+	summary.Totals = []string{"Total", strconv.Itoa(len(invoices)), total.Decimal()}
+
+	return &report{
+		Name:     "aging",
+		Title:    "Accounts receivable aging",
+		Note:     fmt.Sprintf("Invoices unpaid as of %s. Only the end of the date range is used.", to.Format("January 2, 2006")),
+		Sections: []reportTable{summary, detail},
+	}, nil
+}
+
+func (rc *ReportController) payments(from, to time.Time) (*report, error) {
+	totals, err := rc.Reports.PaymentsByMethod(from, to)
+	if err != nil {
+		return nil, err
+	}
+	t := reportTable{
+		Columns: []string{"Method", "Payments", "Received", "Refunds", "Refunded", "Net"},
+		Right:   []bool{false, true, true, true, true, true},
+	}
+	var sum models.MethodTotal
+	for _, m := range totals {
+		t.Rows = append(t.Rows, []string{m.Method, strconv.Itoa(m.Payments), m.Received.Decimal(), strconv.Itoa(m.Refunds), m.Refunded.Decimal(), m.Net().Decimal()})
+		sum.Payments += m.Payments
+		sum.Received += m.Received
+		sum.Refunds += m.Refunds
+		sum.Refunded += m.Refunded
+	}
+	t.Totals = []string{"Total", strconv.Itoa(sum.Payments), sum.Received.Decimal(), strconv.Itoa(sum.Refunds), sum.Refunded.Decimal(), sum.Net().Decimal()}
+	return &report{
+		Name:     "payments",
+		Title:    "Payments by method",
+		Note:     "Money received and refunded in the period.",
+		Sections: []reportTable{t},
+	}, nil
+}
+
+func (rc *ReportController) members(from, to time.Time) (*report, error) {
+	counts, err := rc.Reports.ActiveMembers(from, to)
+	if err != nil {
+		return nil, err
+	}
+	t := reportTable{
+		Columns: []string{"Month", "Active", "New", "With addons", "Addons"},
+		Right:   []bool{false, true, true, true, true},
+	}
+	for _, c := range counts {
+		t.Rows = append(t.Rows, []string{c.Month.Format("2006-01"), strconv.Itoa(c.Active), strconv.Itoa(c.New), strconv.Itoa(c.WithAddons), strconv.Itoa(c.AddonsTotal)})
+	}
+	return &report{
+		Name:     "members",
+		Title:    "Active members",
+		Note:     "Members who were active at any time in each month, by join date and membership expiry. Guests and members who quit are not counted.",
+		Sections: []reportTable{t},
+	}, nil
+}
+
+func (rc *ReportController) discounts(from, to time.Time) (*report, error) {
+	totals, err := rc.Reports.Discounts(from, to)
+	if err != nil {
+		return nil, err
+	}
+	grants, err := rc.Reports.DiscountGrants(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := reportTable{
+		Title:   "By discount",
+		Columns: []string{"Discount", "Code", "Granted", "Invoices", "Amount"},
+		Right:   []bool{false, false, true, true, true},
+	}
+	var granted, uses int
+	var amount models.Money
+	for _, d := range totals {
+		code := ""
+		if d.Code != nil {
+			code = *d.Code
+		}
+		summary.Rows = append(summary.Rows, []string{d.Name, code, strconv.Itoa(d.Granted), strconv.Itoa(d.Uses), d.Amount.Decimal()})
+		granted += d.Granted
+		uses += d.Uses
+		amount += d.Amount
+	}
+	summary.Totals = []string{"Total", "", strconv.Itoa(granted), strconv.Itoa(uses), amount.Decimal()}
+
+	detail := reportTable{Title: "Granted", Columns: []string{"Date", "Member", "Discount", "Granted by", "Note"}, Right: make([]bool, 5)}
+	for _, g := range grants {
+		by := "Redeemed code"
+		if g.GrantedBy != nil {
+			by = *g.GrantedBy
+		}
+		detail.Rows = append(detail.Rows, []string{g.CreatedAt.Format("2006-01-02"), g.MemberName, g.Discount, by, g.Note})
+	}
+
+	return &report{
+		Name:     "discounts",
+		Title:    "Discounts granted",
+		Note:     "Discounts given to members in the period, and the amounts taken off invoices issued in the period, excluding cancelled invoices.",
+		Sections: []reportTable{summary, detail},
+	}, nil
+}
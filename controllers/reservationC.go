@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+//ReservationController implements the handlers for members reserving areas and equipment for themselves
+type ReservationController struct {
+	Controller
+	Reservations    Reservations
+	ReservationView views.View
+}
+
+//Initialize performs the required setup for a reservation controller
+func (rc *ReservationController) Initialize(cfg *util.Config, um Users, rm Reservations, pm Permissions, l *util.Logger, s *sessions.Session) error {
+	rc.setup(cfg, um, l, s)
+	rc.Reservations = rm
+	rc.Permissions = pm
+
+	rc.ReservationView = views.View{}
+
+	if err := rc.ReservationView.LoadTemplates("reservation"); err != nil {
+		return fmt.Errorf("Error loading reservation templates: %v", err)
+	}
+
+	return nil
+}
+
+// setLimitsForm fills in the reservation limit fields of an area or equipment form
+func setLimitsForm(form *util.Form, l models.ReservationLimits) {
+	for field, v := range map[string]*int{"maxminutes": l.MaxMinutes, "advancedays": l.AdvanceDays, "quota": l.MemberQuota} {
+		if v != nil {
+			form.Set(field, strconv.Itoa(*v))
+		}
+	}
+}
+
+// limitsFromForm reads the reservation limit fields of an area or equipment form, adding errors to the form for
+// any that are not valid. Blank fields are no limit.
+func limitsFromForm(form *util.Form) models.ReservationLimits {
+	limit := func(field, msg string) *int {
+		v := form.Get(field)
+		if v == "" {
+			return nil
+		}
+		n, ok := util.IntOK(v, 1, 100000)
+		if !ok {
+			form.Errors.Add(field, msg)
+		}
+		return &n
+	}
+	return models.ReservationLimits{
+		MaxMinutes:  limit("maxminutes", "Must be a number of minutes, or blank for no limit"),
+		AdvanceDays: limit("advancedays", "Must be a number of days, or blank for no limit"),
+		MemberQuota: limit("quota", "Must be a number of reservations, or blank for no limit"),
+	}
+}
+
+// resourceFromRequest gets the area or equipment named in the URL. Writes the error response and returns false if
+// there is no such resource.
+func (rc *ReservationController) resourceFromRequest(w http.ResponseWriter, r *http.Request, kind string) (*models.Resource, bool) {
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		rc.clientError(w, http.StatusBadRequest)
+		return nil, false
+	}
+	res, err := rc.Reservations.Resource(kind, id)
+	if err != nil {
+		rc.notFound(w)
+		return nil, false
+	}
+	return res, true
+}
+
+//Form shows a logged in member the form to reserve an area or piece of equipment, with its limits, the
+//certifications it needs, and when it is booked over a week starting from the "from" date (today by default)
+func (rc *ReservationController) Form(kind string) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rc.authenticatedUserID(r) == 0 {
+			rc.forbidden(w)
+			return
+		}
+		res, ok := rc.resourceFromRequest(w, r, kind)
+		if !ok {
+			return
+		}
+		rc.renderForm(w, r, res, util.NewForm(url.Values{}), nil)
+	})
+}
+
+// availabilityDays is how many days of bookings are shown on the reservation form
+const availabilityDays = 7
+
+// renderForm shows the reservation form. conflict is the bookings in the way of the reservation asked for, if any.
+func (rc *ReservationController) renderForm(w http.ResponseWriter, r *http.Request, res *models.Resource, form *util.Form, conflict *models.ConflictError) {
+	missing, err := rc.Reservations.Missing(res.Kind, res.ID, rc.authenticatedUserID(r))
+	if err != nil {
+		rc.serverError(w, err)
+		return
+	}
+
+	from, ok := util.DateOK(r.URL.Query().Get("from"))
+	if !ok {
+		if from, ok = util.DateOK(form.Get("date")); !ok {
+			now := time.Now()
+			from = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		}
+	}
+	availability, err := rc.Reservations.Availability(res.Kind, res.ID, from, from.AddDate(0, 0, availabilityDays))
+	if err != nil {
+		rc.serverError(w, err)
+		return
+	}
+
+	td, err := rc.DefaultData(r)
+	if err != nil {
+		rc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Reserve " + res.Name
+	td.Add("Resource", res)
+	td.Add("Missing", missing)
+	td.Add("MemberID", rc.authenticatedUserID(r))
+	td.Add("Form", form)
+	td.Add("Availability", availability)
+	td.Add("Previous", from.AddDate(0, 0, -availabilityDays))
+	td.Add("Next", from.AddDate(0, 0, availabilityDays))
+	td.Add("Conflict", conflict)
+	td.Add("CanOverride", rc.can(r, "space.write"))
+
+	if err := rc.ReservationView.Render(w, r, "reservation_form.gohtml", td); err != nil {
+		rc.serverError(w, err)
+		return
+	}
+}
+
+//Reserve books an area or piece of equipment for the logged in member
+func (rc *ReservationController) Reserve(kind string) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		memberID := rc.authenticatedUserID(r)
+		if memberID == 0 {
+			rc.forbidden(w)
+			return
+		}
+		res, ok := rc.resourceFromRequest(w, r, kind)
+		if !ok {
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("date", "from", "until")
+
+		reservation := &models.Reservation{Kind: kind, ResourceID: res.ID, MemberID: &memberID}
+		if form.Valid() {
+			var fromOK, untilOK bool
+			reservation.Starts, fromOK = util.DateTimeOK(form.Get("date"), form.Get("from"))
+			reservation.Ends, untilOK = util.DateTimeOK(form.Get("date"), form.Get("until"))
+			switch {
+			case !fromOK:
+				form.Errors.Add("from", "Must be a date and a time")
+			case !untilOK:
+				form.Errors.Add("until", "Must be a time")
+			case !reservation.Ends.After(reservation.Starts):
+				form.Errors.Add("until", "Must be after the start")
+			}
+		}
+
+		if !form.Valid() {
+			rc.renderForm(w, r, res, form, nil)
+			return
+		}
+
+		// space managers can book while the location is closed, for setting up or fixing things
+		override := form.Get("outsidehours") == "on" && rc.can(r, "space.write")
+		if err := rc.Reservations.Reserve(reservation, override, time.Now()); err != nil {
+			form.Errors.Add("saveError", err.Error())
+			conflict, _ := err.(*models.ConflictError)
+			rc.renderForm(w, r, res, form, conflict)
+			return
+		}
+
+		rc.Session.Put(r, "flash", fmt.Sprintf("%s is reserved for you %s", res.Name, reservation.Starts.Format("Mon Jan 2 at 3:04pm")))
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/reservations", rc.rootURL(), memberID), http.StatusSeeOther)
+	})
+}
+
+//ForMember shows a member the areas and equipment they have reserved that have not ended yet
+func (rc *ReservationController) ForMember() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			rc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !rc.canAccessMember(r, id, "space.write") {
+			rc.forbidden(w)
+			return
+		}
+
+		reservations, err := rc.Reservations.ForMember(id, time.Now())
+		if err != nil {
+			rc.serverError(w, err)
+			return
+		}
+
+		td, err := rc.DefaultData(r)
+		if err != nil {
+			rc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Reservations"
+		td.Add("MemberID", id)
+		td.Add("Reservations", reservations)
+
+		if err := rc.ReservationView.Render(w, r, "member_reservations.gohtml", td); err != nil {
+			rc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//Cancel removes a reservation a member made for themselves. Members can cancel their own; space managers can
+//cancel anyone's.
+func (rc *ReservationController) Cancel(kind string) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			rc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		reservation, err := rc.Reservations.Get(kind, id)
+		if err != nil {
+			rc.notFound(w)
+			return
+		}
+		if reservation.MemberID == nil || !rc.canAccessMember(r, *reservation.MemberID, "space.write") {
+			rc.forbidden(w)
+			return
+		}
+
+		if err := rc.Reservations.Cancel(kind, id); err != nil {
+			rc.serverError(w, err)
+			return
+		}
+
+		rc.Session.Put(r, "flash", "Reservation cancelled")
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/reservations", rc.rootURL(), *reservation.MemberID), http.StatusSeeOther)
+	})
+}
@@ -18,12 +18,16 @@ import (
 //UserController implements the handlers required for user management
 type UserController struct {
 	Controller
+	Options  MembershipOptions
+	Vouchers Vouchers
 	UserView views.View
 }
 
 //Initialize performs the required setup for a user controller
-func (uc *UserController) Initialize(cfg *util.Config, um Users, l *util.Logger, s *sessions.Session) error {
+func (uc *UserController) Initialize(cfg *util.Config, um Users, om MembershipOptions, vm Vouchers, l *util.Logger, s *sessions.Session) error {
 	uc.setup(cfg, um, l, s)
+	uc.Options = om
+	uc.Vouchers = vm
 
 	uc.UserView = views.View{}
 
@@ -37,12 +41,19 @@ func (uc *UserController) Initialize(cfg *util.Config, um Users, l *util.Logger,
 //SignupForm displays the signup form
 func (uc *UserController) SignupForm() func(http.ResponseWriter, *http.Request) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		options, err := uc.Options.Active()
+		if err != nil {
+			uc.serverError(w, err)
+			return
+		}
+
 		td, err := uc.DefaultData(r)
 		if err != nil {
 			http.Error(w, "could not generate default data", http.StatusInternalServerError)
 			return
 		}
 		td.Add("Form", util.NewForm(nil))
+		td.Add("Options", options)
 
 		if err := uc.UserView.Render(w, r, "signup.gohtml", td); err != nil {
 			uc.serverError(w, err)
@@ -127,12 +138,22 @@ func (uc *UserController) Show() func(http.ResponseWriter, *http.Request) {
 func (uc *UserController) New() func(http.ResponseWriter, *http.Request) {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
+		options, err := uc.Options.Active()
+		if err != nil {
+			uc.serverError(w, err)
+			return
+		}
+		optionIDs := make([]string, len(options))
+		for i, o := range options {
+			optionIDs[i] = strconv.Itoa(o.ID)
+		}
+
 		r.ParseForm()
 		form := util.NewForm(r.PostForm)
 
 		form.Required("name", "email", "email2", "password", "password2", "dob.mm", "dob.dd", "dob.yyyy", "phone")
 		form.RequiredIf("membershipoption", r.FormValue("membersignup") == "on")
-		form.PermittedValues("membershipoption", "1", "2", "3", "4", "5", "6")
+		form.PermittedValues("membershipoption", optionIDs...)
 		form.MatchField("email", "email2")
 		form.MatchField("password", "password2")
 		form.MinLength("password", 4)
@@ -152,11 +173,33 @@ func (uc *UserController) New() func(http.ResponseWriter, *http.Request) {
 		var ms, mo int
 		ms = 1
 		if r.FormValue("membersignup") == "on" {
-			//The error from Atoi is ignored because the value has already been confirmed to be the string 1, 2, 3, 4, 5, or 6
+			//The error from Atoi is ignored because the value has already been confirmed to be the id of an active option
 			mo, _ = strconv.Atoi(r.FormValue("membershipoption"))
 			ms = 1
 		}
 
+		//A gift voucher is checked before the account is created, and redeemed once it has been
+		var voucher *models.Voucher
+		if code := form.Get("giftcode"); code != "" {
+			v, err := uc.Vouchers.Find(code)
+			if err != nil && err != models.ErrVoucherCode {
+				uc.serverError(w, err)
+				return
+			}
+			switch {
+			case err == models.ErrVoucherCode || !v.Usable(time.Now()):
+				form.Errors.Add("giftcode", models.ErrVoucherCode.Error())
+			case v.RedeemedByID != nil:
+				form.Errors.Add("giftcode", models.ErrVoucherRedeemed.Error())
+			default:
+				voucher = v
+			}
+		}
+		if voucher != nil && voucher.OptionID != nil && mo == 0 {
+			//A gift membership signs the recipient up for the membership it was bought for
+			mo = *voucher.OptionID
+		}
+
 		if !form.Valid() {
 			td, err := uc.DefaultData(r)
 			if err != nil {
@@ -171,6 +214,7 @@ func (uc *UserController) New() func(http.ResponseWriter, *http.Request) {
 			form.Set("password2", "")
 
 			td.Add("Form", form)
+			td.Add("Options", options)
 			uc.UserView.Render(w, r, "signup.gohtml", td)
 			return
 		}
@@ -201,10 +245,17 @@ func (uc *UserController) New() func(http.ResponseWriter, *http.Request) {
 			td.Flash = fmt.Sprintf("Could not save user: %s", err.Error())
 
 			td.Add("Form", form)
+			td.Add("Options", options)
 			uc.UserView.Render(w, r, "signup.gohtml", td)
 			return
 		}
 
+		if voucher != nil {
+			if _, err := uc.Vouchers.Redeem(u.ID, voucher.Code, time.Now()); err != nil {
+				uc.Logger.Printf("could not redeem voucher %d for new member %d: %v", voucher.ID, u.ID, err)
+			}
+		}
+
 		uc.Session.Put(r, "flash", "Successfully saved user!")
 
 		http.Redirect(w, r, fmt.Sprintf("http://%s:%d/user/%d", uc.AppConfig.App.Host, uc.AppConfig.App.Port, u.ID), http.StatusSeeOther)
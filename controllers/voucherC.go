@@ -0,0 +1,394 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golangcollege/sessions"
+	"github.com/gorilla/mux"
+
+	"github.com/makeict/MESSforMakers/models"
+	"github.com/makeict/MESSforMakers/util"
+	"github.com/makeict/MESSforMakers/views"
+)
+
+// maxVoucherValue is the most a value voucher can be bought for
+const maxVoucherValue = models.Money(100000)
+
+//VoucherController implements the handlers for buying, redeeming and sending gift memberships and prepaid vouchers
+type VoucherController struct {
+	Controller
+	Vouchers    Vouchers
+	Options     MembershipOptions
+	Invoices    InvoiceSender
+	Mailer      util.Mailer
+	VoucherView views.View
+	PDFView     views.PDFView
+}
+
+//Initialize performs the required setup for a voucher controller
+func (vc *VoucherController) Initialize(cfg *util.Config, um Users, vm Vouchers, om MembershipOptions, pm Permissions, is InvoiceSender, m util.Mailer, l *util.Logger, s *sessions.Session) error {
+	vc.setup(cfg, um, l, s)
+	vc.Vouchers = vm
+	vc.Options = om
+	vc.Permissions = pm
+	vc.Invoices = is
+	vc.Mailer = m
+
+	vc.VoucherView = views.View{}
+	vc.PDFView = views.PDFView{}
+
+	if err := vc.VoucherView.LoadTemplates("voucher"); err != nil {
+		return fmt.Errorf("Error loading voucher templates: %v", err)
+	}
+	if err := vc.PDFView.LoadTemplates(); err != nil {
+		return fmt.Errorf("Error loading pdf templates: %v", err)
+	}
+
+	return nil
+}
+
+//List shows every voucher sold, with what is left on each
+func (vc *VoucherController) List() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !vc.can(r, "finance.write") {
+			vc.forbidden(w)
+			return
+		}
+
+		vouchers, err := vc.Vouchers.All()
+		if err != nil {
+			vc.serverError(w, err)
+			return
+		}
+		var outstanding models.Money
+		for _, v := range vouchers {
+			if v.Paid && !v.Expired(time.Now()) {
+				outstanding += v.Balance
+			}
+		}
+
+		td, err := vc.DefaultData(r)
+		if err != nil {
+			vc.serverError(w, err)
+			return
+		}
+		td.PageTitle = "Gift Vouchers"
+		td.Add("Vouchers", vouchers)
+		td.Add("Outstanding", outstanding)
+
+		if err := vc.VoucherView.Render(w, r, "vouchers.gohtml", td); err != nil {
+			vc.serverError(w, err)
+			return
+		}
+	})
+}
+
+//BuyForm displays the form for buying a gift voucher for someone else
+func (vc *VoucherController) BuyForm() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if vc.authenticatedUserID(r) == 0 {
+			vc.forbidden(w)
+			return
+		}
+
+		form := util.NewForm(url.Values{})
+		form.Set("kind", "value")
+		vc.renderBuy(w, r, form)
+	})
+}
+
+func (vc *VoucherController) renderBuy(w http.ResponseWriter, r *http.Request, form *util.Form) {
+	options, err := vc.Options.Active()
+	if err != nil {
+		vc.serverError(w, err)
+		return
+	}
+	events, err := vc.Vouchers.Events(time.Now())
+	if err != nil {
+		vc.serverError(w, err)
+		return
+	}
+
+	td, err := vc.DefaultData(r)
+	if err != nil {
+		vc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Buy a Gift Voucher"
+	td.Add("Form", form)
+	td.Add("Options", options)
+	td.Add("Events", events)
+	td.Add("Months", vc.AppConfig.Billing.VoucherMonths)
+
+	if err := vc.VoucherView.Render(w, r, "buy.gohtml", td); err != nil {
+		vc.serverError(w, err)
+		return
+	}
+}
+
+//Buy invoices the logged in member for a gift voucher. The voucher can be redeemed once the invoice is paid.
+func (vc *VoucherController) Buy() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		memberID := vc.authenticatedUserID(r)
+		if memberID == 0 {
+			vc.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("kind", "recipient")
+		form.PermittedValues("kind", "value", "membership", "event")
+		form.MaxLength("recipient", 255)
+		form.MaxLength("email", 255)
+		form.MaxLength("message", 500)
+		if form.Get("email") != "" {
+			form.MatchPattern("email", util.EmailRegEx)
+		}
+
+		now := time.Now()
+		v := &models.Voucher{
+			Kind:           form.Get("kind"),
+			PurchaserID:    memberID,
+			RecipientName:  form.Get("recipient"),
+			RecipientEmail: form.Get("email"),
+			Message:        form.Get("message"),
+		}
+		switch v.Kind {
+		case "value":
+			amount, err := models.ParseMoney(form.Get("amount"))
+			if err != nil || amount < 100 || amount > maxVoucherValue {
+				form.Errors.Add("amount", fmt.Sprintf("Must be an amount between $1.00 and %s", maxVoucherValue))
+			}
+			v.Amount = amount
+		case "membership":
+			id, ok := util.IntOK(form.Get("option"), 1, math.MaxInt32)
+			if !ok {
+				form.Errors.Add("option", "Choose a membership option")
+			} else if o, err := vc.Options.Get(id); err != nil || !o.Active {
+				form.Errors.Add("option", "Choose a membership option")
+			}
+			v.OptionID = &id
+		case "event":
+			id, ok := util.IntOK(form.Get("event"), 1, math.MaxInt32)
+			events, err := vc.Vouchers.Events(now)
+			if err != nil {
+				vc.serverError(w, err)
+				return
+			}
+			found := false
+			for _, e := range events {
+				if e.ID == id {
+					found = true
+				}
+			}
+			if !ok || !found {
+				form.Errors.Add("event", "Choose an upcoming class or event")
+			}
+			v.EventID = &id
+		}
+		if !form.Valid() {
+			vc.renderBuy(w, r, form)
+			return
+		}
+		if months := vc.AppConfig.Billing.VoucherMonths; months > 0 {
+			expires := now.AddDate(0, months, 0)
+			v.ExpiresOn = &expires
+		}
+
+		inv, err := vc.Vouchers.Buy(v, now)
+		if err != nil {
+			vc.serverError(w, err)
+			return
+		}
+		if err := vc.Invoices.SendInvoice(inv); err != nil {
+			vc.Logger.Printf("could not email invoice %d: %v", inv.ID, err)
+		}
+
+		vc.Session.Put(r, "flash", fmt.Sprintf("Thank you! Once this invoice is paid you can print or email the gift certificate for %s", v.RecipientName))
+		http.Redirect(w, r, fmt.Sprintf("%sinvoice/%d", vc.rootURL(), inv.ID), http.StatusSeeOther)
+	})
+}
+
+//ForMember shows the vouchers a member has bought and redeemed, with a form to redeem a code
+func (vc *VoucherController) ForMember() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			vc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !vc.canAccessMember(r, id, "finance.write") {
+			vc.forbidden(w)
+			return
+		}
+
+		vc.renderMember(w, r, id, util.NewForm(url.Values{}))
+	})
+}
+
+func (vc *VoucherController) renderMember(w http.ResponseWriter, r *http.Request, id int, form *util.Form) {
+	vouchers, err := vc.Vouchers.ForMember(id)
+	if err != nil {
+		vc.serverError(w, err)
+		return
+	}
+	bought, redeemed := []models.Voucher{}, []models.Voucher{}
+	for _, v := range vouchers {
+		if v.RedeemedByID != nil && *v.RedeemedByID == id {
+			redeemed = append(redeemed, v)
+		}
+		if v.PurchaserID == id {
+			bought = append(bought, v)
+		}
+	}
+
+	td, err := vc.DefaultData(r)
+	if err != nil {
+		vc.serverError(w, err)
+		return
+	}
+	td.PageTitle = "Gift Vouchers"
+	td.Add("MemberID", id)
+	td.Add("Bought", bought)
+	td.Add("Redeemed", redeemed)
+	td.Add("Now", time.Now())
+	td.Add("Form", form)
+
+	if err := vc.VoucherView.Render(w, r, "member_vouchers.gohtml", td); err != nil {
+		vc.serverError(w, err)
+		return
+	}
+}
+
+//Redeem gives a member the voucher with the code they entered
+func (vc *VoucherController) Redeem() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+		if !ok {
+			vc.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if !vc.canAccessMember(r, id, "finance.write") {
+			vc.forbidden(w)
+			return
+		}
+
+		r.ParseForm()
+		form := util.NewForm(r.PostForm)
+		form.Required("code")
+		if !form.Valid() {
+			vc.renderMember(w, r, id, form)
+			return
+		}
+
+		v, err := vc.Vouchers.Redeem(id, form.Get("code"), time.Now())
+		if err == models.ErrVoucherCode || err == models.ErrVoucherRedeemed {
+			form.Errors.Add("code", err.Error())
+			vc.renderMember(w, r, id, form)
+			return
+		}
+		if err != nil {
+			vc.serverError(w, err)
+			return
+		}
+
+		vc.Session.Put(r, "flash", fmt.Sprintf("%s has been added to your account, with %s to spend on %s", v.Describe(), v.Balance, v.SpentOn()))
+		http.Redirect(w, r, fmt.Sprintf("%suser/%d/vouchers", vc.rootURL(), id), http.StatusSeeOther)
+	})
+}
+
+// voucherFromRequest looks up the voucher in the {id} route variable and checks that the logged in member bought
+// it or has the permission. Gift certificates are only available once the voucher has been paid for.
+func (vc *VoucherController) voucherFromRequest(w http.ResponseWriter, r *http.Request, permission string) (*models.Voucher, bool) {
+	id, ok := util.IntOK(mux.Vars(r)["id"], 1, math.MaxInt32)
+	if !ok {
+		vc.clientError(w, http.StatusBadRequest)
+		return nil, false
+	}
+	v, err := vc.Vouchers.Get(id)
+	if err != nil {
+		vc.notFound(w)
+		return nil, false
+	}
+	if !vc.canAccessMember(r, v.PurchaserID, permission) {
+		vc.forbidden(w)
+		return nil, false
+	}
+	if !v.Paid {
+		vc.clientError(w, http.StatusConflict)
+		return nil, false
+	}
+	return v, true
+}
+
+// certificate renders the printable gift certificate for a voucher
+func (vc *VoucherController) certificate(v *models.Voucher) ([]byte, error) {
+	return vc.PDFView.Render("voucher.gotmpl", &documentData{Root: vc.rootURL(), Org: vc.AppConfig.Org, Voucher: v})
+}
+
+//Certificate downloads the printable gift certificate for a voucher
+func (vc *VoucherController) Certificate() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := vc.voucherFromRequest(w, r, "finance.read")
+		if !ok {
+			return
+		}
+		pdf, err := vc.certificate(v)
+		if err != nil {
+			vc.serverError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("gift-certificate-%d.pdf", v.ID)))
+		if _, err := w.Write(pdf); err != nil {
+			vc.Logger.Printf("could not write gift certificate %d: %v", v.ID, err)
+		}
+	})
+}
+
+//Email sends the gift certificate to the recipient
+func (vc *VoucherController) Email() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := vc.voucherFromRequest(w, r, "finance.write")
+		if !ok {
+			return
+		}
+		back := fmt.Sprintf("%suser/%d/vouchers", vc.rootURL(), v.PurchaserID)
+		if v.RecipientEmail == "" {
+			vc.Session.Put(r, "flash", "There is no email address for the recipient. Print the gift certificate instead")
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+
+		pdf, err := vc.certificate(v)
+		if err != nil {
+			vc.serverError(w, err)
+			return
+		}
+		err = vc.Mailer.Send(&util.Message{
+			To:      []string{v.RecipientEmail},
+			Subject: fmt.Sprintf("A gift from %s: %s", v.Purchaser, v.Describe()),
+			Body: fmt.Sprintf("Hi %s,\n\n%s has sent you a gift from %s. Your gift certificate is attached, with the code to redeem it at %ssignup\n",
+				v.RecipientName, v.Purchaser, vc.AppConfig.Org.Name, vc.rootURL()),
+			Attachments: []util.Attachment{{Filename: fmt.Sprintf("gift-certificate-%d.pdf", v.ID), ContentType: "application/pdf", Data: pdf}},
+		})
+		if err != nil {
+			vc.Logger.Printf("could not email gift certificate %d: %v", v.ID, err)
+			vc.Session.Put(r, "flash", "The gift certificate could not be emailed")
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+		if err := vc.Vouchers.MarkEmailed(v.ID, time.Now()); err != nil {
+			vc.serverError(w, err)
+			return
+		}
+
+		vc.Session.Put(r, "flash", fmt.Sprintf("The gift certificate was emailed to %s", v.RecipientEmail))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+	})
+}
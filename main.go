@@ -37,6 +37,22 @@ func main() {
 		Handler:      app.Router,
 	}
 
+	if config.Reminders.IntervalMinutes > 0 {
+		go app.sendReminders()
+	}
+	if config.Billing.IntervalMinutes > 0 {
+		go app.invoiceRenewals()
+	}
+	if config.Lockers.IntervalMinutes > 0 {
+		go app.manageLockers()
+	}
+	if config.Maintenance.IntervalMinutes > 0 {
+		go app.remindMaintenance()
+	}
+	if config.Certifications.IntervalMinutes > 0 {
+		go app.remindCertifications()
+	}
+
 	app.Logger.Println("Starting Application on :" + strconv.Itoa(app.port))
 	app.Logger.Fatal(srv.ListenAndServe())
 
@@ -0,0 +1,134 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// AccountingModel stores the database handle for exporting transactions to the bookkeeper's accounting software
+type AccountingModel struct {
+	DB *sqlx.DB
+}
+
+// AccountReceivable is the account key for money owed by members. Other account keys are line item categories for
+// income, and "deposit:" followed by a payment method for where money is received.
+const AccountReceivable = "receivable"
+
+// GLTransaction is one balanced general ledger transaction: an invoice, a payment or a refund
+type GLTransaction struct {
+	Date   time.Time
+	Kind   string // invoice, payment or refund
+	Ref    int    // the id of the invoice, payment or refund
+	Member string
+	Memo   string
+	Splits []GLSplit
+}
+
+// GLSplit is the amount a transaction posts to one account. Debits are positive and credits negative,
+// so the splits of a transaction add up to zero.
+type GLSplit struct {
+	Account string // an account key, mapped to the chart of accounts by the caller
+	Amount  Money
+}
+
+// glRow is a row of any of the transaction queries, before it is grouped into a transaction
+type glRow struct {
+	Date    time.Time `db:"date"`
+	Ref     int       `db:"ref"`
+	Member  string    `db:"member"`
+	Memo    string    `db:"memo"`
+	Account string    `db:"account"`
+	Amount  Money     `db:"amount"`
+}
+
+//Transactions returns the invoices issued, payments received and refunds paid between two dates, inclusive, as
+//general ledger transactions in date order. Invoices credit income by line item category and debit receivables,
+//leaving out cancelled invoices; payments debit the account for their payment method and credit receivables; and
+//refunds are charged back to receivables, the same as on member account statements.
+func (am *AccountingModel) Transactions(from, to time.Time) ([]GLTransaction, error) {
+	end := to.AddDate(0, 0, 1)
+
+	lines := []glRow{}
+	q := am.DB.Rebind(`
+		SELECT invoice.created_at AS date, invoice.id AS ref, member.name AS member, invoice.description AS memo,
+			line_item_category.name AS account, invoice_line_item.quantity * invoice_line_item.unit_amount AS amount
+		FROM invoice_line_item
+			JOIN line_item_category ON line_item_category.id = invoice_line_item.category_id
+			JOIN invoice ON invoice.id = invoice_line_item.invoice_id
+			JOIN member ON member.id = invoice.member_id
+		WHERE invoice.created_at >= ? AND invoice.created_at < ? AND ` + ledgerInvoiceFilter + `
+	UNION ALL
+		SELECT invoice.created_at, invoice.id, member.name, invoice.description, 'other', invoice.amount
+		FROM invoice JOIN member ON member.id = invoice.member_id
+		WHERE invoice.created_at >= ? AND invoice.created_at < ? AND ` + ledgerInvoiceFilter + `
+			AND NOT EXISTS (SELECT 1 FROM invoice_line_item WHERE invoice_line_item.invoice_id = invoice.id)
+	ORDER BY date, ref`)
+	if err := am.DB.Select(&lines, q, from, end, from, end); err != nil {
+		return nil, fmt.Errorf("Could not retrieve invoices: %v", err)
+	}
+
+	txns := []GLTransaction{}
+	for _, l := range lines {
+		if l.Amount == 0 {
+			continue
+		}
+		if n := len(txns); n == 0 || txns[n-1].Kind != "invoice" || txns[n-1].Ref != l.Ref {
+			txns = append(txns, GLTransaction{Date: l.Date, Kind: "invoice", Ref: l.Ref, Member: l.Member, Memo: l.Memo})
+		}
+		t := &txns[len(txns)-1]
+		t.Splits = append(t.Splits, GLSplit{Account: l.Account, Amount: -l.Amount})
+	}
+	for i := range txns {
+		var total Money
+		for _, s := range txns[i].Splits {
+			total -= s.Amount
+		}
+		txns[i].Splits = append([]GLSplit{{Account: AccountReceivable, Amount: total}}, txns[i].Splits...)
+	}
+
+	payments := []glRow{}
+	q = am.DB.Rebind(`
+		SELECT payment.created_at AS date, payment.id AS ref, member.name AS member,
+			'Payment (' || payment_method.name || ')' AS memo, 'deposit:' || payment_method.name AS account, payment.amount
+		FROM payment
+			JOIN payment_method ON payment_method.id = payment.payment_method_id
+			JOIN member ON member.id = payment.member_id
+		WHERE payment.created_at >= ? AND payment.created_at < ?
+		ORDER BY payment.created_at, payment.id`)
+	if err := am.DB.Select(&payments, q, from, end); err != nil {
+		return nil, fmt.Errorf("Could not retrieve payments: %v", err)
+	}
+	for _, p := range payments {
+		txns = append(txns, GLTransaction{
+			Date: p.Date, Kind: "payment", Ref: p.Ref, Member: p.Member, Memo: p.Memo,
+			Splits: []GLSplit{{Account: p.Account, Amount: p.Amount}, {Account: AccountReceivable, Amount: -p.Amount}},
+		})
+	}
+
+	refunds := []glRow{}
+	q = am.DB.Rebind(`
+		SELECT refund.created_at AS date, refund.id AS ref, member.name AS member,
+			'Refund (' || payment_method.name || ') of payment #' || refund.payment_id AS memo,
+			'deposit:' || payment_method.name AS account, refund.amount
+		FROM refund
+			JOIN payment ON payment.id = refund.payment_id
+			JOIN payment_method ON payment_method.id = refund.payment_method_id
+			JOIN member ON member.id = payment.member_id
+		WHERE refund.created_at >= ? AND refund.created_at < ?
+		ORDER BY refund.created_at, refund.id`)
+	if err := am.DB.Select(&refunds, q, from, end); err != nil {
+		return nil, fmt.Errorf("Could not retrieve refunds: %v", err)
+	}
+	for _, r := range refunds {
+		txns = append(txns, GLTransaction{
+			Date: r.Date, Kind: "refund", Ref: r.Ref, Member: r.Member, Memo: r.Memo,
+			Splits: []GLSplit{{Account: AccountReceivable, Amount: r.Amount}, {Account: r.Account, Amount: -r.Amount}},
+		})
+	}
+
+	sort.SliceStable(txns, func(i, j int) bool { return txns[i].Date.Before(txns[j].Date) })
+	return txns, nil
+}
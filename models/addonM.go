@@ -0,0 +1,343 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// AddonModel stores the database handle for the addon catalog and member addon subscriptions
+type AddonModel struct {
+	DB *sqlx.DB
+}
+
+// ErrAddonUnavailable is returned when a member tries to add an addon that is retired or that they already have
+var ErrAddonUnavailable = errors.New("That addon is not available")
+
+// Addon is an additional service that members can pay for along with their dues
+type Addon struct {
+	ID          int    `db:"id"`
+	Name        string `db:"name"`
+	MonthlyCost Money  `db:"monthly_cost"`
+	Capacity    *int   `db:"capacity"` // nil for no limit
+	Active      bool   `db:"active"`
+	Holders     int    `db:"holders"` // members who have the addon now
+	Waiting     int    `db:"waiting"` // members on the waitlist
+}
+
+// Full reports whether every place on the addon is taken
+func (a *Addon) Full() bool {
+	return a.Capacity != nil && a.Holders >= *a.Capacity
+}
+
+// MemberAddon is an addon a member has, or is waiting for
+type MemberAddon struct {
+	AddonID     int       `db:"addon_id"`
+	Name        string    `db:"name"`
+	MonthlyCost Money     `db:"monthly_cost"`
+	Since       time.Time `db:"since"`
+}
+
+// AddonChange describes the result of adding or removing an addon
+type AddonChange struct {
+	Waitlisted bool     // the addon was full and the member was put on the waitlist instead
+	Invoice    *Invoice // the prorated charge for the rest of the dues period, if any
+	Credit     Money    // the prorated credit for the unused part of the dues period, if any
+	Promoted   *AddonPromotion
+}
+
+// AddonPromotion is a waitlisted member who was given a place that came free
+type AddonPromotion struct {
+	MemberID int
+	Invoice  *Invoice
+}
+
+const addonColumns = `addon_types.id, addon_types.name, addon_types.monthly_cost, addon_types.capacity, addon_types.active,
+	(SELECT COUNT(*) FROM member_addon_rel WHERE member_addon_rel.addon_id = addon_types.id AND member_addon_rel.ended_at IS NULL) AS holders,
+	(SELECT COUNT(*) FROM addon_waitlist WHERE addon_waitlist.addon_id = addon_types.id) AS waiting`
+
+// Prorate works out the share of an addon's cost for what is left of a dues period.
+// The period runs for periodMonths months and ends on periodEnd; nothing is charged once it has ended.
+// A member whose next period has already been invoiced has a periodEnd more than one period away, and is
+// charged for the rest of the current period as well as the next one.
+func Prorate(monthly Money, periodMonths int, periodEnd, now time.Time) Money {
+	return ProratePeriod(monthly*Money(periodMonths), periodMonths, periodEnd, now)
+}
+
+// ProratePeriod works out the share of the price of a whole dues period for what is left of it, in the same way as Prorate
+func ProratePeriod(price Money, periodMonths int, periodEnd, now time.Time) Money {
+	start := periodEnd.AddDate(0, -periodMonths, 0)
+	total := periodEnd.Sub(start)
+	left := periodEnd.Sub(now)
+	if total <= 0 || left <= 0 {
+		return 0
+	}
+	// whole days, so that the amount does not depend on the time of day
+	days := int64(left.Hours()/24 + 0.5)
+	totalDays := int64(total.Hours()/24 + 0.5)
+	return Money((int64(price)*days + totalDays/2) / totalDays)
+}
+
+//All returns the whole catalog, including retired addons, with the active ones first
+func (am *AddonModel) All() ([]Addon, error) {
+	addons := []Addon{}
+	if err := am.DB.Select(&addons, `SELECT `+addonColumns+` FROM addon_types ORDER BY active DESC, name`); err != nil {
+		return nil, fmt.Errorf("Could not retrieve addons: %v", err)
+	}
+	return addons, nil
+}
+
+//Get one addon
+func (am *AddonModel) Get(id int) (*Addon, error) {
+	a := &Addon{}
+	if err := am.DB.Get(a, am.DB.Rebind(`SELECT `+addonColumns+` FROM addon_types WHERE id = ?`), id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve addon: %v", err)
+	}
+	return a, nil
+}
+
+//Create saves a new addon
+func (am *AddonModel) Create(a *Addon) error {
+	q := am.DB.Rebind(`INSERT INTO addon_types (name, monthly_cost, capacity) VALUES (?, ?, ?) RETURNING id`)
+	if err := am.DB.Get(&a.ID, q, a.Name, a.MonthlyCost, a.Capacity); err != nil {
+		return fmt.Errorf("Could not create addon: %v", err)
+	}
+	a.Active = true
+	return nil
+}
+
+//Update saves changes to an addon. Lowering the capacity does not remove anyone who already has the addon.
+func (am *AddonModel) Update(a *Addon) error {
+	q := am.DB.Rebind(`UPDATE addon_types SET name = ?, monthly_cost = ?, capacity = ? WHERE id = ?`)
+	if _, err := am.DB.Exec(q, a.Name, a.MonthlyCost, a.Capacity, a.ID); err != nil {
+		return fmt.Errorf("Could not update addon: %v", err)
+	}
+	return nil
+}
+
+//SetActive retires an addon so that it can no longer be added, or offers it again
+func (am *AddonModel) SetActive(id int, active bool) error {
+	if _, err := am.DB.Exec(am.DB.Rebind(`UPDATE addon_types SET active = ? WHERE id = ?`), active, id); err != nil {
+		return fmt.Errorf("Could not update addon: %v", err)
+	}
+	return nil
+}
+
+//ForMember returns the addons a member has now
+func (am *AddonModel) ForMember(memberID int) ([]MemberAddon, error) {
+	q := am.DB.Rebind(`
+	SELECT addon_types.id AS addon_id, addon_types.name, addon_types.monthly_cost, member_addon_rel.created_at AS since
+	FROM member_addon_rel JOIN addon_types ON addon_types.id = member_addon_rel.addon_id
+	WHERE member_addon_rel.member_id = ? AND member_addon_rel.ended_at IS NULL
+	ORDER BY addon_types.name`)
+	addons := []MemberAddon{}
+	if err := am.DB.Select(&addons, q, memberID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve member addons: %v", err)
+	}
+	return addons, nil
+}
+
+//Waitlisted returns the addons a member is waiting for
+func (am *AddonModel) Waitlisted(memberID int) ([]MemberAddon, error) {
+	q := am.DB.Rebind(`
+	SELECT addon_types.id AS addon_id, addon_types.name, addon_types.monthly_cost, addon_waitlist.created_at AS since
+	FROM addon_waitlist JOIN addon_types ON addon_types.id = addon_waitlist.addon_id
+	WHERE addon_waitlist.member_id = ?
+	ORDER BY addon_types.name`)
+	addons := []MemberAddon{}
+	if err := am.DB.Select(&addons, q, memberID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve waitlist: %v", err)
+	}
+	return addons, nil
+}
+
+//Add gives a member an addon and invoices them for the rest of their current dues period.
+//If the addon is full the member is put on its waitlist instead.
+func (am *AddonModel) Add(memberID, addonID int, now time.Time) (*AddonChange, error) {
+	tx, err := am.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// locking the addon serializes changes to it, so two members can never take the last place
+	a := &Addon{}
+	if err := tx.Get(a, tx.Rebind(`SELECT `+addonColumns+` FROM addon_types WHERE id = ? FOR UPDATE`), addonID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve addon: %v", err)
+	}
+	if !a.Active {
+		return nil, ErrAddonUnavailable
+	}
+	var n int
+	if err := tx.Get(&n, tx.Rebind(`
+		SELECT (SELECT COUNT(*) FROM member_addon_rel WHERE member_id = ? AND addon_id = ? AND ended_at IS NULL)
+			+ (SELECT COUNT(*) FROM addon_waitlist WHERE member_id = ? AND addon_id = ?)`),
+		memberID, addonID, memberID, addonID); err != nil {
+		return nil, fmt.Errorf("Could not check member addons: %v", err)
+	}
+	if n > 0 {
+		return nil, ErrAddonUnavailable
+	}
+
+	change := &AddonChange{}
+	if a.Full() {
+		if _, err := tx.Exec(tx.Rebind(`INSERT INTO addon_waitlist (member_id, addon_id) VALUES (?, ?)`), memberID, addonID); err != nil {
+			return nil, fmt.Errorf("Could not join waitlist: %v", err)
+		}
+		change.Waitlisted = true
+	} else {
+		if change.Invoice, err = startAddon(tx, memberID, a, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+//Remove ends a member's addon and credits them for the unused part of their dues period.
+//The credit is taken off their next renewal. If the place that came free was wanted, the first member
+//on the waitlist is given it.
+func (am *AddonModel) Remove(memberID, addonID int, now time.Time) (*AddonChange, error) {
+	tx, err := am.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	a := &Addon{}
+	if err := tx.Get(a, tx.Rebind(`SELECT `+addonColumns+` FROM addon_types WHERE id = ? FOR UPDATE`), addonID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve addon: %v", err)
+	}
+
+	res, err := tx.Exec(tx.Rebind(`UPDATE member_addon_rel SET ended_at = ? WHERE member_id = ? AND addon_id = ? AND ended_at IS NULL`), now, memberID, addonID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not remove addon: %v", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return nil, ErrAddonUnavailable
+	}
+	a.Holders--
+
+	change := &AddonChange{}
+	period, err := duesPeriod(tx, memberID)
+	if err != nil {
+		return nil, err
+	}
+	if period != nil {
+		change.Credit = Prorate(a.MonthlyCost, period.Months, *period.End, now)
+	}
+	if change.Credit > 0 {
+		_, err := tx.Exec(tx.Rebind(`INSERT INTO member_credit (member_id, amount, description) VALUES (?, ?, ?)`),
+			memberID, change.Credit, fmt.Sprintf("Unused %s until %s", a.Name, period.End.Format("Jan 2, 2006")))
+		if err != nil {
+			return nil, fmt.Errorf("Could not record credit: %v", err)
+		}
+	}
+
+	if a.Active && !a.Full() {
+		var next int
+		err := tx.Get(&next, tx.Rebind(`
+			DELETE FROM addon_waitlist WHERE id = (
+				SELECT id FROM addon_waitlist WHERE addon_id = ? ORDER BY created_at, id LIMIT 1
+			) RETURNING member_id`), addonID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("Could not check waitlist: %v", err)
+		}
+		if err == nil {
+			inv, err := startAddon(tx, next, a, now)
+			if err != nil {
+				return nil, err
+			}
+			change.Promoted = &AddonPromotion{MemberID: next, Invoice: inv}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+//LeaveWaitlist takes a member off an addon's waitlist
+func (am *AddonModel) LeaveWaitlist(memberID, addonID int) error {
+	q := am.DB.Rebind(`DELETE FROM addon_waitlist WHERE member_id = ? AND addon_id = ?`)
+	if _, err := am.DB.Exec(q, memberID, addonID); err != nil {
+		return fmt.Errorf("Could not leave waitlist: %v", err)
+	}
+	return nil
+}
+
+// startAddon gives a member an addon and invoices the prorated cost for the rest of their dues period.
+// Returns nil if nothing is owed, e.g. when the member has no current period; the addon is billed from their next renewal.
+func startAddon(tx *sqlx.Tx, memberID int, a *Addon, now time.Time) (*Invoice, error) {
+	if _, err := tx.Exec(tx.Rebind(`INSERT INTO member_addon_rel (member_id, addon_id, created_at) VALUES (?, ?, ?)`), memberID, a.ID, now); err != nil {
+		return nil, fmt.Errorf("Could not add addon: %v", err)
+	}
+
+	period, err := duesPeriod(tx, memberID)
+	if err != nil || period == nil {
+		return nil, err
+	}
+	amount := Prorate(a.MonthlyCost, period.Months, *period.End, now)
+	if amount <= 0 {
+		return nil, nil
+	}
+
+	inv := &Invoice{
+		MemberID:    memberID,
+		Description: fmt.Sprintf("%s until %s", a.Name, period.End.Format("Jan 2, 2006")),
+		Lines: []InvoiceLine{{
+			Category:    "addon",
+			Description: fmt.Sprintf("%s from %s to %s (prorated)", a.Name, now.Format("Jan 2"), period.End.Format("Jan 2, 2006")),
+			Quantity:    1,
+			UnitAmount:  amount,
+		}},
+	}
+	if err := createInvoice(tx, inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// currentAddons returns the addons a member has now as part of a larger transaction
+func currentAddons(tx *sqlx.Tx, memberID int) ([]MemberAddon, error) {
+	addons := []MemberAddon{}
+	err := tx.Select(&addons, tx.Rebind(`
+		SELECT addon_types.id AS addon_id, addon_types.name, addon_types.monthly_cost, member_addon_rel.created_at AS since
+		FROM member_addon_rel JOIN addon_types ON addon_types.id = member_addon_rel.addon_id
+		WHERE member_addon_rel.member_id = ? AND member_addon_rel.ended_at IS NULL
+		ORDER BY addon_types.name`), memberID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve member addons: %v", err)
+	}
+	return addons, nil
+}
+
+// duesPeriodInfo is the length and end of a member's current dues period
+type duesPeriodInfo struct {
+	End    *time.Time `db:"membership_expires"`
+	Months int        `db:"period_months"`
+}
+
+// duesPeriod returns the member's current dues period, or nil if they do not have one
+func duesPeriod(tx *sqlx.Tx, memberID int) (*duesPeriodInfo, error) {
+	p := &duesPeriodInfo{}
+	err := tx.Get(p, tx.Rebind(`
+		SELECT member.membership_expires,
+			COALESCE((EXTRACT(YEAR FROM membership_options.period) * 12 + EXTRACT(MONTH FROM membership_options.period))::integer, 0) AS period_months
+		FROM member LEFT JOIN membership_options ON membership_options.id = member.membership_option
+		WHERE member.id = ?`), memberID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve dues period: %v", err)
+	}
+	if p.End == nil || p.Months <= 0 {
+		return nil, nil
+	}
+	return p, nil
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProrate(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name         string
+		monthly      Money
+		periodMonths int
+		periodEnd    time.Time
+		now          time.Time
+		want         Money
+	}{
+		{"start of the period", 3000, 1, date(2026, time.February, 1), date(2026, time.January, 1), 3000},
+		{"half way, rounded", 3000, 1, date(2026, time.February, 1), date(2026, time.January, 16), 1548},
+		{"last day", 3100, 1, date(2026, time.February, 1), date(2026, time.January, 31), 100},
+		{"time of day does not matter", 3100, 1, date(2026, time.February, 1), date(2026, time.January, 31).Add(5 * time.Hour), 100},
+		{"three month period", 3000, 3, date(2026, time.April, 1), date(2026, time.February, 15), 4500},
+		{"period has ended", 3000, 1, date(2026, time.February, 1), date(2026, time.February, 1), 0},
+		{"after the period", 3000, 1, date(2026, time.February, 1), date(2026, time.March, 1), 0},
+		{"next period already invoiced", 2800, 1, date(2026, time.March, 1), date(2026, time.January, 31), 2900},
+		{"no period", 3000, 0, date(2026, time.February, 1), date(2026, time.January, 1), 0},
+	}
+	for _, tt := range tests {
+		if got := Prorate(tt.monthly, tt.periodMonths, tt.periodEnd, tt.now); got != tt.want {
+			t.Errorf("%s: Prorate() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProratePeriod(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name         string
+		price        Money
+		periodMonths int
+		periodEnd    time.Time
+		now          time.Time
+		want         Money
+	}{
+		{"start of the period", 3000, 1, date(2026, time.February, 1), date(2026, time.January, 1), 3000},
+		{"half way, rounded", 3000, 1, date(2026, time.February, 1), date(2026, time.January, 16), 1548},
+		{"three month price", 9000, 3, date(2026, time.April, 1), date(2026, time.February, 15), 4500},
+		{"year price, one month left", 36500, 12, date(2027, time.January, 1), date(2026, time.December, 1), 3100},
+		{"period has ended", 3000, 1, date(2026, time.February, 1), date(2026, time.February, 1), 0},
+		{"no period", 3000, 0, date(2026, time.February, 1), date(2026, time.January, 1), 0},
+	}
+	for _, tt := range tests {
+		if got := ProratePeriod(tt.price, tt.periodMonths, tt.periodEnd, tt.now); got != tt.want {
+			t.Errorf("%s: ProratePeriod() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Errors returned when a request for a certification, or a review of one, breaks the rules of the approval workflow
+var (
+	ErrAlreadyRequested     = errors.New("That certification has already been asked for or given")
+	ErrNotPending           = errors.New("That certification is not waiting for approval")
+	ErrAlreadyReviewed      = errors.New("You have already reviewed that request")
+	ErrOwnCertification     = errors.New("You cannot approve your own certification")
+	ErrPrerequisitesMissing = errors.New("The member does not hold all the certifications needed first")
+	ErrNotHeld              = errors.New("That certification is not held, so it cannot be renewed or revoked")
+	ErrNotRevoked           = errors.New("That certification has not been revoked")
+	ErrNeverExpires         = errors.New("That certification never expires, so it does not need renewing")
+)
+
+// ApprovalModel stores the database handle for members' certifications and their approval
+type ApprovalModel struct {
+	DB *sqlx.DB
+}
+
+// MemberCertification is a certification a member holds or has asked to be signed off on
+type MemberCertification struct {
+	ID                int        `db:"id"`
+	MemberID          int        `db:"member_id"`
+	Member            string     `db:"member"`
+	CertificationID   int        `db:"certification_id"`
+	Certification     string     `db:"certification"`
+	Email             string     `db:"email"`
+	Status            string     `db:"status"` // "pending", "approved", "rejected" or "revoked"
+	RequestedAt       time.Time  `db:"requested_at"`
+	DecidedAt         *time.Time `db:"decided_at"`
+	ExpiresOn         *time.Time `db:"expires_on"` // the last day it is valid, nil if it never expires
+	Expired           bool       `db:"expired"`    // approved, but past its expiry
+	ValidDays         *int       `db:"valid_days"` // how long the certification lasts when approved or renewed
+	ApprovalsRequired int        `db:"approvals_required"`
+	Approvals         int        `db:"approvals"` // sign-offs since it was last asked for
+}
+
+// CertificationEvent is something that happened to a member certification, for its history
+type CertificationEvent struct {
+	MemberCertificationID int        `db:"member_certification_id"`
+	Certification         string     `db:"certification"`
+	Action                string     `db:"action"` // "requested", "approved", "rejected", "renewed", "revoked" or "reinstated"
+	Reason                string     `db:"reason"`
+	By                    *string    `db:"by"` // who did it, nil if they are no longer a member
+	ExpiresOn             *time.Time `db:"expires_on"`
+	CreatedAt             time.Time  `db:"created_at"`
+}
+
+// Approval is one approver's sign-off or rejection of a member certification
+type Approval struct {
+	ID         int       `db:"id"`
+	ApproverID int       `db:"approver_id"`
+	Approver   string    `db:"approver"`
+	Approved   bool      `db:"approved"` // false if the approver rejected it
+	Notes      string    `db:"notes"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+const memberCertificationColumns = `member_certification.id, member_certification.member_id, member.name AS member,
+	member.username AS email, member_certification.certification_id, certification.name AS certification,
+	member_certification.status, member_certification.requested_at, member_certification.decided_at,
+	member_certification.expires_on,
+	COALESCE(member_certification.status = 'approved' AND member_certification.expires_on < CURRENT_DATE, 'f') AS expired,
+	certification.valid_days, certification.approvals_required,
+	(SELECT COUNT(*) FROM certification_approval
+		WHERE member_certification_id = member_certification.id AND approved
+		AND created_at >= member_certification.requested_at) AS approvals`
+
+const memberCertificationFrom = ` FROM member_certification
+	JOIN member ON member.id = member_certification.member_id
+	JOIN certification ON certification.id = member_certification.certification_id`
+
+//Missing returns the names of the certifications needed to use an area or piece of equipment that a member does
+//not hold. Equipment needs the certifications for its area too.
+func (am *ApprovalModel) Missing(memberID int, kind string, id int) ([]string, error) {
+	required, ok := requiredCertifications[kind]
+	if !ok {
+		return nil, ErrNoSuchResource
+	}
+	q := am.DB.Rebind(`
+	SELECT certification.name
+	FROM certification
+	WHERE certification.id IN (` + required + `)
+	AND NOT member_certified(?, certification.id)
+	ORDER BY certification.name`)
+	missing := []string{}
+	if err := am.DB.Select(&missing, q, id, memberID); err != nil {
+		return nil, fmt.Errorf("Could not check certifications: %v", err)
+	}
+	return missing, nil
+}
+
+//IsCertified reports whether a member holds every certification needed to use an area or piece of equipment.
+//It and Missing are the only checks of a member's certifications; both go through the member_certified SQL
+//function, which also stops members registering for events without their prerequisites.
+func (am *ApprovalModel) IsCertified(memberID int, kind string, id int) (bool, error) {
+	missing, err := am.Missing(memberID, kind, id)
+	if err != nil {
+		return false, err
+	}
+	return len(missing) == 0, nil
+}
+
+//Request asks for a member to be signed off on a certification. A rejected or expired certification can be asked
+//for again, and reviews from before then no longer count. Returns the ID of the member certification.
+func (am *ApprovalModel) Request(memberID, certificationID, requestedBy int) (int, error) {
+	tx, err := am.DB.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	q := tx.Rebind(`
+	INSERT INTO member_certification
+		(member_id, certification_id)
+	VALUES
+		(?, ?)
+	ON CONFLICT (member_id, certification_id) DO UPDATE
+		SET status = 'pending', requested_at = now(), decided_at = NULL, expires_on = NULL
+		WHERE member_certification.status = 'rejected'
+		OR (member_certification.status = 'approved' AND member_certification.expires_on < CURRENT_DATE)
+	RETURNING id`)
+	var id int
+	if err := tx.Get(&id, q, memberID, certificationID); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrAlreadyRequested
+		}
+		if isForeignKeyViolation(err) {
+			return 0, ErrNoSuchMember
+		}
+		return 0, fmt.Errorf("Could not request certification: %v", err)
+	}
+	if err := addHistory(tx, id, "requested", "", requestedBy); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("Could not request certification: %v", err)
+	}
+	return id, nil
+}
+
+// addHistory records something that happened to a member certification, along with its expiry afterwards
+func addHistory(tx *sqlx.Tx, id int, action, reason string, byID int) error {
+	q := tx.Rebind(`
+	INSERT INTO member_certification_history
+		(member_certification_id, action, reason, by_id, expires_on)
+	SELECT id, ?, ?, ?, expires_on FROM member_certification WHERE id = ?`)
+	if _, err := tx.Exec(q, action, reason, byID, id); err != nil {
+		return fmt.Errorf("Could not save certification history: %v", err)
+	}
+	return nil
+}
+
+//Pending returns the requests waiting for approval, oldest first
+func (am *ApprovalModel) Pending() ([]MemberCertification, error) {
+	q := `SELECT ` + memberCertificationColumns + memberCertificationFrom + `
+	WHERE member_certification.status = 'pending'
+	ORDER BY member_certification.requested_at`
+	pending := []MemberCertification{}
+	if err := am.DB.Select(&pending, q); err != nil {
+		return nil, fmt.Errorf("Could not retrieve certification requests: %v", err)
+	}
+	return pending, nil
+}
+
+//ForMember returns the certifications a member holds or has asked for, by certification
+func (am *ApprovalModel) ForMember(memberID int) ([]MemberCertification, error) {
+	q := am.DB.Rebind(`SELECT ` + memberCertificationColumns + memberCertificationFrom + `
+	WHERE member_certification.member_id = ?
+	ORDER BY certification.name`)
+	certifications := []MemberCertification{}
+	if err := am.DB.Select(&certifications, q, memberID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve certifications for member: %v", err)
+	}
+	return certifications, nil
+}
+
+//Get one member certification
+func (am *ApprovalModel) Get(id int) (*MemberCertification, error) {
+	q := am.DB.Rebind(`SELECT ` + memberCertificationColumns + memberCertificationFrom + ` WHERE member_certification.id = ?`)
+	mc := &MemberCertification{}
+	if err := am.DB.Get(mc, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve member certification: %v", err)
+	}
+	return mc, nil
+}
+
+//Approvals returns every review of a member certification, including those from before it was last asked for,
+//oldest first
+func (am *ApprovalModel) Approvals(id int) ([]Approval, error) {
+	q := am.DB.Rebind(`
+	SELECT certification_approval.id, approver_id, member.name AS approver, approved, notes,
+		certification_approval.created_at
+	FROM certification_approval
+		JOIN member ON member.id = certification_approval.approver_id
+	WHERE member_certification_id = ?
+	ORDER BY certification_approval.created_at`)
+	approvals := []Approval{}
+	if err := am.DB.Select(&approvals, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve approvals: %v", err)
+	}
+	return approvals, nil
+}
+
+//MissingPrerequisites returns the names of the certifications a member needs before they can be signed off on a
+//member certification
+func (am *ApprovalModel) MissingPrerequisites(id int) ([]string, error) {
+	return missingPrerequisites(am.DB, id)
+}
+
+func missingPrerequisites(q sqlx.Ext, id int) ([]string, error) {
+	missing := []string{}
+	err := sqlx.Select(q, &missing, q.Rebind(`
+	SELECT certification.name
+	FROM member_certification
+		JOIN certification_prerequisite ON certification_prerequisite.certification_id = member_certification.certification_id
+		JOIN certification ON certification.id = certification_prerequisite.prerequisite_id
+	WHERE member_certification.id = ?
+	AND NOT member_certified(member_certification.member_id, certification.id)
+	ORDER BY certification.name`), id)
+	if err != nil {
+		return nil, fmt.Errorf("Could not check prerequisites: %v", err)
+	}
+	return missing, nil
+}
+
+//Review records an approver signing off or rejecting a member certification waiting for approval. A rejection
+//decides it straight away; a sign-off approves it once enough approvers have signed off. Approvers cannot review
+//their own certifications or review the same request twice, and cannot sign off a member who does not hold the
+//prerequisites. Approved certifications expire after the certification's validity period. Returns the status of
+//the member certification afterwards.
+//
+//Times come from the database clock, the same one that set when the member certification was asked for.
+func (am *ApprovalModel) Review(id, approverID int, approve bool, notes string) (string, error) {
+	tx, err := am.DB.Beginx()
+	if err != nil {
+		return "", fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// locking the request makes approvers reviewing it at the same time take turns, so it is counted once
+	mc := &MemberCertification{}
+	q := tx.Rebind(`SELECT ` + memberCertificationColumns + memberCertificationFrom + `
+	WHERE member_certification.id = ?
+	FOR UPDATE OF member_certification`)
+	if err := tx.Get(mc, q, id); err != nil {
+		return "", fmt.Errorf("Could not retrieve member certification: %v", err)
+	}
+	if mc.Status != "pending" {
+		return "", ErrNotPending
+	}
+	if mc.MemberID == approverID {
+		return "", ErrOwnCertification
+	}
+
+	var reviewed bool
+	q = tx.Rebind(`
+	SELECT EXISTS (
+		SELECT 1 FROM certification_approval
+		WHERE member_certification_id = ? AND approver_id = ? AND created_at >= ?)`)
+	if err := tx.Get(&reviewed, q, id, approverID, mc.RequestedAt); err != nil {
+		return "", fmt.Errorf("Could not check approvals: %v", err)
+	}
+	if reviewed {
+		return "", ErrAlreadyReviewed
+	}
+
+	if approve {
+		missing, err := missingPrerequisites(tx, id)
+		if err != nil {
+			return "", err
+		}
+		if len(missing) > 0 {
+			return "", ErrPrerequisitesMissing
+		}
+	}
+
+	q = tx.Rebind(`
+	INSERT INTO certification_approval
+		(member_certification_id, approver_id, approved, notes)
+	VALUES
+		(?, ?, ?, ?)`)
+	if _, err := tx.Exec(q, id, approverID, approve, notes); err != nil {
+		return "", fmt.Errorf("Could not save approval: %v", err)
+	}
+
+	switch {
+	case !approve:
+		mc.Status = "rejected"
+	case mc.Approvals+1 >= mc.ApprovalsRequired:
+		mc.Status = "approved"
+	}
+	if mc.Status != "pending" {
+		// an approved certification lasts for the certification's validity period from today
+		q = tx.Rebind(`
+		UPDATE member_certification
+		SET status = ?, decided_at = now(),
+			expires_on = CASE WHEN ? THEN CURRENT_DATE + (SELECT valid_days FROM certification WHERE id = certification_id) END
+		WHERE id = ?`)
+		if _, err := tx.Exec(q, mc.Status, mc.Status == "approved", id); err != nil {
+			return "", fmt.Errorf("Could not update member certification: %v", err)
+		}
+		if err := addHistory(tx, id, mc.Status, notes, approverID); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("Could not save approval: %v", err)
+	}
+	return mc.Status, nil
+}
+
+// lockHeld gets a member certification for changing, locked so changes made at the same time take turns
+func lockHeld(tx *sqlx.Tx, id int) (*MemberCertification, error) {
+	mc := &MemberCertification{}
+	q := tx.Rebind(`SELECT ` + memberCertificationColumns + memberCertificationFrom + `
+	WHERE member_certification.id = ?
+	FOR UPDATE OF member_certification`)
+	if err := tx.Get(mc, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve member certification: %v", err)
+	}
+	return mc, nil
+}
+
+//Renew extends an approved certification by the certification's validity period, from its current expiry or from
+//today if it has already expired
+func (am *ApprovalModel) Renew(id, byID int, notes string) error {
+	tx, err := am.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	mc, err := lockHeld(tx, id)
+	if err != nil {
+		return err
+	}
+	if mc.Status != "approved" {
+		return ErrNotHeld
+	}
+	if mc.ValidDays == nil {
+		return ErrNeverExpires
+	}
+
+	q := tx.Rebind(`UPDATE member_certification SET expires_on = GREATEST(expires_on, CURRENT_DATE) + ? WHERE id = ?`)
+	if _, err := tx.Exec(q, *mc.ValidDays, id); err != nil {
+		return fmt.Errorf("Could not renew certification: %v", err)
+	}
+	if err := addHistory(tx, id, "renewed", notes, byID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Could not renew certification: %v", err)
+	}
+	return nil
+}
+
+//Revoke takes away a member's certification, such as after a safety violation. The reason is kept in its history.
+func (am *ApprovalModel) Revoke(id, byID int, reason string) error {
+	return am.changeStatus(id, byID, "approved", "revoked", reason, ErrNotHeld)
+}
+
+//Reinstate gives back a revoked certification, with the expiry it had before
+func (am *ApprovalModel) Reinstate(id, byID int, reason string) error {
+	return am.changeStatus(id, byID, "revoked", "approved", reason, ErrNotRevoked)
+}
+
+// changeStatus moves a member certification from one status to another and records why in its history. Returns
+// wrongStatus if it does not have the from status.
+func (am *ApprovalModel) changeStatus(id, byID int, from, to, reason string, wrongStatus error) error {
+	tx, err := am.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	mc, err := lockHeld(tx, id)
+	if err != nil {
+		return err
+	}
+	if mc.Status != from {
+		return wrongStatus
+	}
+
+	if _, err := tx.Exec(tx.Rebind(`UPDATE member_certification SET status = ? WHERE id = ?`), to, id); err != nil {
+		return fmt.Errorf("Could not update member certification: %v", err)
+	}
+	action := to
+	if to == "approved" {
+		action = "reinstated"
+	}
+	if err := addHistory(tx, id, action, reason, byID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Could not update member certification: %v", err)
+	}
+	return nil
+}
+
+//History returns everything that happened to a member's certifications, newest first
+func (am *ApprovalModel) History(memberID int) ([]CertificationEvent, error) {
+	q := am.DB.Rebind(`
+	SELECT member_certification_history.member_certification_id, certification.name AS certification, action, reason,
+		member.name AS by, member_certification_history.expires_on, member_certification_history.created_at
+	FROM member_certification_history
+		JOIN member_certification ON member_certification.id = member_certification_history.member_certification_id
+		JOIN certification ON certification.id = member_certification.certification_id
+		LEFT JOIN member ON member.id = member_certification_history.by_id
+	WHERE member_certification.member_id = ?
+	ORDER BY member_certification_history.created_at DESC, member_certification_history.id DESC`)
+	history := []CertificationEvent{}
+	if err := am.DB.Select(&history, q, memberID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve certification history: %v", err)
+	}
+	return history, nil
+}
+
+//DueForRenewal returns the certifications that expire by the given date and whose members have not been reminded
+//to renew them for that expiry, and marks them as reminded. Certifications that have already expired are skipped.
+func (am *ApprovalModel) DueForRenewal(by time.Time) ([]MemberCertification, error) {
+	q := am.DB.Rebind(`
+	WITH due AS (
+		UPDATE member_certification
+		SET reminded_for = expires_on
+		WHERE status = 'approved'
+		AND expires_on BETWEEN CURRENT_DATE AND ?::date
+		AND reminded_for IS DISTINCT FROM expires_on
+		RETURNING id
+	)
+	SELECT ` + memberCertificationColumns + memberCertificationFrom + `
+	WHERE member_certification.id IN (SELECT id FROM due)
+	ORDER BY member_certification.expires_on`)
+	due := []MemberCertification{}
+	if err := am.DB.Select(&due, q, by); err != nil {
+		return nil, fmt.Errorf("Could not retrieve certifications due for renewal: %v", err)
+	}
+	return due, nil
+}
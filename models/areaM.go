@@ -0,0 +1,173 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrNoSuchMember is returned when making someone a steward using a member number that does not exist
+var ErrNoSuchMember = errors.New("There is no member with that number")
+
+// AreaModel stores the database handle for the areas of the space
+type AreaModel struct {
+	DB *sqlx.DB
+}
+
+// Area is a room or part of the space that members can use
+type Area struct {
+	ID          int    `db:"id"`
+	LocationID  int    `db:"location_id"`
+	Location    string `db:"location"` // the name of the location
+	Name        string `db:"name"`
+	Capacity    *int   `db:"capacity"` // nil if there is no limit on how many people can use the area
+	Description string `db:"description"`
+	Equipment   int    `db:"equipment"` // the number of pieces of equipment in the area, not counting retired equipment
+	ReservationLimits
+}
+
+// AreaEquipment is a piece of equipment that lives in an area
+type AreaEquipment struct {
+	ID        int        `db:"id"`
+	Name      string     `db:"name"`
+	Status    string     `db:"status"`
+	BroughtAt *time.Time `db:"brought_at"`
+}
+
+// Steward is a member who looks after an area and is assigned its maintenance tickets
+type Steward struct {
+	MemberID int    `db:"member_id"`
+	Name     string `db:"name"`
+	Email    string `db:"email"`
+}
+
+const areaColumns = `area.id, area.location_id, location.name AS location, area.name, area.capacity, area.description,
+	area.max_reservation_minutes, area.advance_days, area.member_quota,
+	(SELECT COUNT(*) FROM equipment
+		WHERE equipment.area_id = area.id
+		AND status_id <> (SELECT id FROM equipment_status WHERE name = 'retired')) AS equipment`
+
+const areaFrom = ` FROM area JOIN location ON location.id = area.location_id`
+
+//All returns every area, by location and then by name
+func (am *AreaModel) All() ([]Area, error) {
+	areas := []Area{}
+	if err := am.DB.Select(&areas, `SELECT `+areaColumns+areaFrom+` ORDER BY location.name, area.name`); err != nil {
+		return nil, fmt.Errorf("Could not retrieve areas: %v", err)
+	}
+	return areas, nil
+}
+
+//Get one area
+func (am *AreaModel) Get(id int) (*Area, error) {
+	q := am.DB.Rebind(`SELECT ` + areaColumns + areaFrom + ` WHERE area.id = ?`)
+	a := &Area{}
+	if err := am.DB.Get(a, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve area: %v", err)
+	}
+	return a, nil
+}
+
+//Equipment returns the equipment that lives in an area, by name. Retired equipment is left out.
+func (am *AreaModel) Equipment(id int) ([]AreaEquipment, error) {
+	q := am.DB.Rebind(`
+	SELECT equipment.id, equipment.name, equipment_status.name AS status, brought_at
+	FROM equipment
+		JOIN equipment_status ON equipment_status.id = equipment.status_id
+	WHERE area_id = ? AND equipment_status.name <> 'retired'
+	ORDER BY equipment.name`)
+	equipment := []AreaEquipment{}
+	if err := am.DB.Select(&equipment, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve equipment for area: %v", err)
+	}
+	return equipment, nil
+}
+
+//Create saves a new area
+func (am *AreaModel) Create(a *Area) error {
+	q := am.DB.Rebind(`
+	INSERT INTO area
+		(location_id, name, capacity, description, max_reservation_minutes, advance_days, member_quota)
+	VALUES
+		(?, ?, ?, ?, ?, ?, ?)
+	RETURNING id`)
+	if err := am.DB.Get(&a.ID, q, a.LocationID, a.Name, a.Capacity, a.Description, a.MaxMinutes, a.AdvanceDays,
+		a.MemberQuota); err != nil {
+		return fmt.Errorf("Could not create area: %v", err)
+	}
+	return nil
+}
+
+//Update saves changes to an area, including moving it to another location
+func (am *AreaModel) Update(a *Area) error {
+	q := am.DB.Rebind(`
+	UPDATE area
+	SET location_id = ?, name = ?, capacity = ?, description = ?, max_reservation_minutes = ?, advance_days = ?,
+		member_quota = ?
+	WHERE id = ?`)
+	if _, err := am.DB.Exec(q, a.LocationID, a.Name, a.Capacity, a.Description, a.MaxMinutes, a.AdvanceDays,
+		a.MemberQuota, a.ID); err != nil {
+		return fmt.Errorf("Could not update area: %v", err)
+	}
+	return nil
+}
+
+//Delete removes an area. Returns ErrInUse if equipment, lockers or reservations still refer to it.
+func (am *AreaModel) Delete(id int) error {
+	q := am.DB.Rebind(`DELETE FROM area WHERE id = ?`)
+	if _, err := am.DB.Exec(q, id); err != nil {
+		if isForeignKeyViolation(err) {
+			return ErrInUse
+		}
+		return fmt.Errorf("Could not delete area: %v", err)
+	}
+	return nil
+}
+
+//Stewards returns the members who look after an area, in the order they became stewards
+func (am *AreaModel) Stewards(id int) ([]Steward, error) {
+	q := am.DB.Rebind(`
+	SELECT member.id AS member_id, member.name, member.username AS email
+	FROM area_steward
+		JOIN member ON member.id = area_steward.member_id
+	WHERE area_id = ?
+	ORDER BY area_steward.id`)
+	stewards := []Steward{}
+	if err := am.DB.Select(&stewards, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve stewards for area: %v", err)
+	}
+	return stewards, nil
+}
+
+//IsSteward reports whether a member looks after an area
+func (am *AreaModel) IsSteward(id, memberID int) (bool, error) {
+	q := am.DB.Rebind(`SELECT EXISTS (SELECT 1 FROM area_steward WHERE area_id = ? AND member_id = ?)`)
+	var steward bool
+	if err := am.DB.Get(&steward, q, id, memberID); err != nil {
+		return false, fmt.Errorf("Could not check area steward: %v", err)
+	}
+	return steward, nil
+}
+
+//AddSteward makes a member a steward of an area. Adding a member who is already a steward does nothing.
+func (am *AreaModel) AddSteward(id, memberID int) error {
+	q := am.DB.Rebind(`INSERT INTO area_steward (area_id, member_id) VALUES (?, ?) ON CONFLICT DO NOTHING`)
+	if _, err := am.DB.Exec(q, id, memberID); err != nil {
+		if isForeignKeyViolation(err) {
+			return ErrNoSuchMember
+		}
+		return fmt.Errorf("Could not add area steward: %v", err)
+	}
+	return nil
+}
+
+//RemoveSteward stops a member being a steward of an area. Tickets already assigned to them stay assigned.
+func (am *AreaModel) RemoveSteward(id, memberID int) error {
+	q := am.DB.Rebind(`DELETE FROM area_steward WHERE area_id = ? AND member_id = ?`)
+	if _, err := am.DB.Exec(q, id, memberID); err != nil {
+		return fmt.Errorf("Could not remove area steward: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,537 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// BankModel stores the database handle for importing bank statements and reconciling their deposits with payments
+type BankModel struct {
+	DB *sqlx.DB
+}
+
+// ErrStatementFormat is returned when an uploaded file is not an OFX or CSV bank statement that can be read
+var ErrStatementFormat = errors.New("Could not read the file as an OFX or CSV bank statement")
+
+// ErrCannotMatch is returned when a deposit or payment has already been matched, or their amounts differ
+var ErrCannotMatch = errors.New("That deposit and payment cannot be matched")
+
+// StatementLine is a deposit read from a bank statement file, before it is imported
+type StatementLine struct {
+	PostedOn    time.Time
+	Amount      Money
+	Description string
+	CheckNumber string
+	BankRef     string // the bank's id for the transaction, or one made from its details
+}
+
+// BankStatement is an imported bank statement
+type BankStatement struct {
+	ID         int       `db:"id"`
+	Filename   string    `db:"filename"`
+	Format     string    `db:"format"`
+	ImportedBy *string   `db:"imported_by"`
+	CreatedAt  time.Time `db:"created_at"`
+	Deposits   int       `db:"deposits"`
+	Matched    int       `db:"matched"`
+}
+
+// BankLine is a deposit on an imported bank statement, with the payment it was matched to or is likely to match
+type BankLine struct {
+	ID                 int        `db:"id"`
+	StatementID        int        `db:"statement_id"`
+	PostedOn           time.Time  `db:"posted_on"`
+	Amount             Money      `db:"amount"`
+	Description        string     `db:"description"`
+	CheckNumber        *string    `db:"check_number"`
+	SuggestedPaymentID *int       `db:"suggested_payment_id"`
+	Suggested          *string    `db:"suggested"` // who made the suggested payment, and when
+	PaymentID          *int       `db:"payment_id"`
+	Paid               *string    `db:"paid"` // who made the matched payment, and when
+	MatchedBy          *string    `db:"matched_by"`
+	MatchedAt          *time.Time `db:"matched_at"`
+}
+
+// Suggests says whether a payment is the suggested match for the deposit
+func (l BankLine) Suggests(paymentID int) bool {
+	return l.SuggestedPaymentID != nil && *l.SuggestedPaymentID == paymentID
+}
+
+// UnreconciledPayment is a payment that has not been matched to a deposit yet
+type UnreconciledPayment struct {
+	ID          int       `db:"id"`
+	Amount      Money     `db:"amount"`
+	Member      string    `db:"member"`
+	Method      string    `db:"method"`
+	CheckNumber *string   `db:"check_number"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+var ofxTransaction = regexp.MustCompile(`(?is)<STMTTRN>(.*?)(?:</STMTTRN>|<STMTTRN>|</BANKTRANLIST>)`)
+var ofxField = regexp.MustCompile(`(?i)<([A-Z0-9.]+)>([^<\r\n]*)`)
+
+// ParseStatement reads the deposits from an OFX or CSV bank statement, and says which format it was.
+// Withdrawals are left out, since only money received is reconciled with payments.
+func ParseStatement(data []byte) (string, []StatementLine, error) {
+	head := data
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	upper := strings.ToUpper(string(head))
+	if strings.Contains(upper, "OFXHEADER") || strings.Contains(upper, "<OFX>") {
+		lines, err := parseOFX(data)
+		return "ofx", lines, err
+	}
+	lines, err := parseCSV(data)
+	return "csv", lines, err
+}
+
+// parseAmount reads an amount as banks write them, which can have more than two decimal places
+func parseAmount(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if m, err := ParseMoney(s); err == nil {
+		return m, nil
+	}
+	f, err := strconv.ParseFloat(strings.NewReplacer("$", "", ",", "").Replace(s), 64)
+	if err != nil {
+		return 0, fmt.Errorf("Could not recognize amount %q", s)
+	}
+	return Money(math.Round(f * 100)), nil
+}
+
+func parseOFX(data []byte) ([]StatementLine, error) {
+	blocks := ofxTransaction.FindAllSubmatch(data, -1)
+	if blocks == nil {
+		return nil, ErrStatementFormat
+	}
+	lines := []StatementLine{}
+	for _, b := range blocks {
+		fields := map[string]string{}
+		for _, f := range ofxField.FindAllSubmatch(b[1], -1) {
+			fields[strings.ToUpper(string(f[1]))] = strings.TrimSpace(string(f[2]))
+		}
+		amount, err := parseAmount(fields["TRNAMT"])
+		if err != nil {
+			return nil, err
+		}
+		if amount <= 0 {
+			continue
+		}
+		posted := fields["DTPOSTED"]
+		if len(posted) < 8 {
+			return nil, fmt.Errorf("Could not recognize date %q", posted)
+		}
+		date, err := time.Parse("20060102", posted[:8])
+		if err != nil {
+			return nil, fmt.Errorf("Could not recognize date %q", posted)
+		}
+		if fields["FITID"] == "" {
+			return nil, fmt.Errorf("Transaction on %s has no FITID", date.Format("2006-01-02"))
+		}
+		desc := fields["NAME"]
+		if memo := fields["MEMO"]; memo != "" && memo != desc {
+			desc = strings.TrimSpace(desc + " " + memo)
+		}
+		lines = append(lines, StatementLine{
+			PostedOn:    date,
+			Amount:      amount,
+			Description: desc,
+			CheckNumber: fields["CHECKNUM"],
+			BankRef:     "ofx:" + fields["FITID"],
+		})
+	}
+	return lines, nil
+}
+
+var csvDateFormats = []string{"2006-01-02", "01/02/2006", "1/2/2006", "01/02/06", "1/2/06", "01-02-2006"}
+
+// csvColumn finds the first header that contains any of the names
+func csvColumn(header []string, names ...string) int {
+	for _, n := range names {
+		for i, h := range header {
+			if strings.Contains(strings.ToLower(strings.TrimSpace(h)), n) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func parseCSV(data []byte) ([]StatementLine, error) {
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil || len(records) < 1 {
+		return nil, ErrStatementFormat
+	}
+
+	header := records[0]
+	date := csvColumn(header, "posted", "date")
+	amount := csvColumn(header, "amount")
+	credit := csvColumn(header, "credit", "deposit")
+	desc := csvColumn(header, "description", "memo", "payee", "name")
+	check := csvColumn(header, "check", "cheque")
+	if date < 0 || (amount < 0 && credit < 0) {
+		return nil, ErrStatementFormat
+	}
+	field := func(rec []string, i int) string {
+		if i < 0 || i >= len(rec) {
+			return ""
+		}
+		return strings.TrimSpace(rec[i])
+	}
+
+	lines := []StatementLine{}
+	seen := map[string]int{}
+	for n, rec := range records[1:] {
+		if field(rec, date) == "" {
+			continue
+		}
+		var posted time.Time
+		var err error
+		for _, f := range csvDateFormats {
+			if posted, err = time.Parse(f, field(rec, date)); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: could not recognize date %q", n+2, field(rec, date))
+		}
+		col := amount
+		if credit >= 0 {
+			col = credit
+		}
+		if field(rec, col) == "" {
+			continue
+		}
+		m, err := parseAmount(field(rec, col))
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", n+2, err)
+		}
+		if m <= 0 {
+			continue
+		}
+
+		l := StatementLine{PostedOn: posted, Amount: m, Description: field(rec, desc), CheckNumber: field(rec, check)}
+		// CSV exports have no transaction ids, so one is made from the details. Counting repeats keeps two identical
+		// deposits on the same day apart, while the same deposit on an overlapping statement gets the same id.
+		key := fmt.Sprintf("%s|%s|%s|%s", l.PostedOn.Format("2006-01-02"), l.Amount.Decimal(), l.Description, l.CheckNumber)
+		seen[key]++
+		sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d", key, seen[key])))
+		l.BankRef = "csv:" + hex.EncodeToString(sum[:])
+		lines = append(lines, l)
+	}
+	return lines, nil
+}
+
+//Import saves a statement's deposits, skipping any that were already imported from another statement.
+//It returns the id of the statement and how many deposits were new.
+func (bm *BankModel) Import(filename, format string, lines []StatementLine, importedBy int) (int, int, error) {
+	tx, err := bm.DB.Beginx()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.Get(&id, tx.Rebind(`INSERT INTO bank_statement (filename, format, imported_by) VALUES (?, ?, ?) RETURNING id`),
+		filename, format, importedBy)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not save bank statement: %v", err)
+	}
+
+	imported := 0
+	q := tx.Rebind(`
+		INSERT INTO bank_statement_line (statement_id, posted_on, amount, description, check_number, bank_ref)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), ?)
+		ON CONFLICT (bank_ref) DO NOTHING`)
+	for _, l := range lines {
+		res, err := tx.Exec(q, id, l.PostedOn, l.Amount, l.Description, l.CheckNumber, l.BankRef)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Could not save deposit: %v", err)
+		}
+		n, _ := res.RowsAffected()
+		imported += int(n)
+	}
+	return id, imported, tx.Commit()
+}
+
+//Suggest works out the likely payment for each deposit that has not been matched yet. A payment with the same
+//check number and amount is the best match; otherwise the payment of the same amount received closest to the date
+//of the deposit, within windowDays of it. Each payment is only suggested for one deposit.
+func (bm *BankModel) Suggest(windowDays int) error {
+	tx, err := bm.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	lines := []BankLine{}
+	q := `SELECT id, statement_id, posted_on, amount, description, check_number FROM bank_statement_line
+		WHERE payment_id IS NULL ORDER BY posted_on, id FOR UPDATE`
+	if err := tx.Select(&lines, q); err != nil {
+		return fmt.Errorf("Could not retrieve deposits: %v", err)
+	}
+	payments := []UnreconciledPayment{}
+	if err := tx.Select(&payments, `SELECT `+unreconciledColumns+unreconciledFrom); err != nil {
+		return fmt.Errorf("Could not retrieve payments: %v", err)
+	}
+
+	used := map[int]bool{}
+	suggest := map[int]int{}
+	// check numbers first, so that a check is not taken by another deposit of the same amount
+	for _, l := range lines {
+		if l.CheckNumber == nil {
+			continue
+		}
+		for _, p := range payments {
+			if !used[p.ID] && p.CheckNumber != nil && *p.CheckNumber == *l.CheckNumber && p.Amount == l.Amount {
+				used[p.ID] = true
+				suggest[l.ID] = p.ID
+				break
+			}
+		}
+	}
+	for _, l := range lines {
+		if _, ok := suggest[l.ID]; ok {
+			continue
+		}
+		best, bestDays := 0, windowDays+1
+		for _, p := range payments {
+			if used[p.ID] || p.Amount != l.Amount {
+				continue
+			}
+			received := time.Date(p.CreatedAt.Year(), p.CreatedAt.Month(), p.CreatedAt.Day(), 0, 0, 0, 0, time.UTC)
+			posted := time.Date(l.PostedOn.Year(), l.PostedOn.Month(), l.PostedOn.Day(), 0, 0, 0, 0, time.UTC)
+			days := int(math.Abs(posted.Sub(received).Hours() / 24))
+			if days < bestDays {
+				best, bestDays = p.ID, days
+			}
+		}
+		if best != 0 {
+			used[best] = true
+			suggest[l.ID] = best
+		}
+	}
+
+	update := tx.Rebind(`UPDATE bank_statement_line SET suggested_payment_id = ? WHERE id = ?`)
+	for _, l := range lines {
+		var p *int
+		if id, ok := suggest[l.ID]; ok {
+			p = &id
+		}
+		if _, err := tx.Exec(update, p, l.ID); err != nil {
+			return fmt.Errorf("Could not save suggested match: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+const bankStatementSelect = `
+	SELECT bank_statement.id, bank_statement.filename, bank_statement.format, member.name AS imported_by,
+		bank_statement.created_at,
+		(SELECT COUNT(*) FROM bank_statement_line WHERE statement_id = bank_statement.id) AS deposits,
+		(SELECT COUNT(*) FROM bank_statement_line WHERE statement_id = bank_statement.id AND payment_id IS NOT NULL) AS matched
+	FROM bank_statement LEFT JOIN member ON member.id = bank_statement.imported_by`
+
+//Statements returns the imported bank statements, newest first, with how many of their deposits are matched
+func (bm *BankModel) Statements() ([]BankStatement, error) {
+	statements := []BankStatement{}
+	q := bankStatementSelect + `
+		ORDER BY bank_statement.created_at DESC, bank_statement.id DESC`
+	if err := bm.DB.Select(&statements, q); err != nil {
+		return nil, fmt.Errorf("Could not retrieve bank statements: %v", err)
+	}
+	return statements, nil
+}
+
+//Statement returns one imported bank statement
+func (bm *BankModel) Statement(id int) (*BankStatement, error) {
+	s := &BankStatement{}
+	q := bm.DB.Rebind(bankStatementSelect + ` WHERE bank_statement.id = ?`)
+	if err := bm.DB.Get(s, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve bank statement: %v", err)
+	}
+	return s, nil
+}
+
+const bankLineColumns = `
+	bank_statement_line.id, bank_statement_line.statement_id, bank_statement_line.posted_on, bank_statement_line.amount,
+	bank_statement_line.description, bank_statement_line.check_number, bank_statement_line.suggested_payment_id,
+	suggested_member.name || ' on ' || to_char(suggested.created_at, 'Mon DD, YYYY') AS suggested,
+	bank_statement_line.payment_id,
+	paid_member.name || ' on ' || to_char(paid.created_at, 'Mon DD, YYYY') AS paid,
+	matcher.name AS matched_by, bank_statement_line.matched_at`
+
+const bankLineFrom = `
+	FROM bank_statement_line
+		LEFT JOIN payment suggested ON suggested.id = bank_statement_line.suggested_payment_id
+		LEFT JOIN member suggested_member ON suggested_member.id = suggested.member_id
+		LEFT JOIN payment paid ON paid.id = bank_statement_line.payment_id
+		LEFT JOIN member paid_member ON paid_member.id = paid.member_id
+		LEFT JOIN member matcher ON matcher.id = bank_statement_line.matched_by`
+
+//Lines returns the deposits on a bank statement
+func (bm *BankModel) Lines(statementID int) ([]BankLine, error) {
+	lines := []BankLine{}
+	q := bm.DB.Rebind(`SELECT ` + bankLineColumns + bankLineFrom + `
+		WHERE bank_statement_line.statement_id = ?
+		ORDER BY bank_statement_line.posted_on, bank_statement_line.id`)
+	if err := bm.DB.Select(&lines, q, statementID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve deposits: %v", err)
+	}
+	return lines, nil
+}
+
+//Unmatched returns the deposits on all statements that have not been matched to a payment
+func (bm *BankModel) Unmatched() ([]BankLine, error) {
+	lines := []BankLine{}
+	q := `SELECT ` + bankLineColumns + bankLineFrom + `
+		WHERE bank_statement_line.payment_id IS NULL
+		ORDER BY bank_statement_line.posted_on, bank_statement_line.id`
+	if err := bm.DB.Select(&lines, q); err != nil {
+		return nil, fmt.Errorf("Could not retrieve deposits: %v", err)
+	}
+	return lines, nil
+}
+
+const unreconciledColumns = `
+	payment.id, payment.amount, member.name AS member, payment_method.name AS method, payment.check_number, payment.created_at`
+
+// Online payments are paid out by the payment provider in batches, so they are not matched to deposits one by one
+const unreconciledFrom = `
+	FROM payment
+		JOIN payment_method ON payment_method.id = payment.payment_method_id
+		JOIN member ON member.id = payment.member_id
+	WHERE payment.reconciled_at IS NULL AND payment_method.name <> 'online'
+	ORDER BY payment.created_at, payment.id`
+
+//UnreconciledPayments returns the cash and check payments that have not been matched to a deposit
+func (bm *BankModel) UnreconciledPayments() ([]UnreconciledPayment, error) {
+	payments := []UnreconciledPayment{}
+	if err := bm.DB.Select(&payments, `SELECT `+unreconciledColumns+unreconciledFrom); err != nil {
+		return nil, fmt.Errorf("Could not retrieve payments: %v", err)
+	}
+	return payments, nil
+}
+
+//Match confirms that a deposit is a payment, and marks the payment reconciled
+func (bm *BankModel) Match(lineID, paymentID, matchedBy int, now time.Time) error {
+	tx, err := bm.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := match(tx, lineID, paymentID, matchedBy, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//ConfirmSuggested matches every unmatched deposit to its suggested payment, and returns how many were matched
+func (bm *BankModel) ConfirmSuggested(matchedBy int, now time.Time) (int, error) {
+	tx, err := bm.DB.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	suggested := []struct {
+		ID        int `db:"id"`
+		PaymentID int `db:"suggested_payment_id"`
+	}{}
+	q := `SELECT id, suggested_payment_id FROM bank_statement_line
+		WHERE payment_id IS NULL AND suggested_payment_id IS NOT NULL ORDER BY id`
+	if err := tx.Select(&suggested, q); err != nil {
+		return 0, fmt.Errorf("Could not retrieve suggested matches: %v", err)
+	}
+	matched := 0
+	for _, s := range suggested {
+		err := match(tx, s.ID, s.PaymentID, matchedBy, now)
+		if err == ErrCannotMatch {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		matched++
+	}
+	return matched, tx.Commit()
+}
+
+func match(tx *sqlx.Tx, lineID, paymentID, matchedBy int, now time.Time) error {
+	var deposit Money
+	err := tx.Get(&deposit, tx.Rebind(`SELECT amount FROM bank_statement_line WHERE id = ? AND payment_id IS NULL FOR UPDATE`), lineID)
+	if err == sql.ErrNoRows {
+		return ErrCannotMatch
+	}
+	if err != nil {
+		return fmt.Errorf("Could not retrieve deposit: %v", err)
+	}
+	var payment Money
+	err = tx.Get(&payment, tx.Rebind(`SELECT amount FROM payment WHERE id = ? AND reconciled_at IS NULL FOR UPDATE`), paymentID)
+	if err == sql.ErrNoRows {
+		return ErrCannotMatch
+	}
+	if err != nil {
+		return fmt.Errorf("Could not retrieve payment: %v", err)
+	}
+	if deposit != payment {
+		return ErrCannotMatch
+	}
+
+	_, err = tx.Exec(tx.Rebind(`
+		UPDATE bank_statement_line SET payment_id = ?, suggested_payment_id = NULL, matched_by = ?, matched_at = ?
+		WHERE id = ?`), paymentID, matchedBy, now, lineID)
+	if err != nil {
+		return fmt.Errorf("Could not match deposit: %v", err)
+	}
+	_, err = tx.Exec(tx.Rebind(`UPDATE bank_statement_line SET suggested_payment_id = NULL WHERE suggested_payment_id = ?`), paymentID)
+	if err != nil {
+		return fmt.Errorf("Could not clear suggested matches: %v", err)
+	}
+	if _, err := tx.Exec(tx.Rebind(`UPDATE payment SET reconciled_at = ? WHERE id = ?`), now, paymentID); err != nil {
+		return fmt.Errorf("Could not mark payment reconciled: %v", err)
+	}
+	return nil
+}
+
+//Unmatch undoes a match made by mistake, so the deposit and payment can be matched again
+func (bm *BankModel) Unmatch(lineID int) error {
+	tx, err := bm.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var paymentID *int
+	err = tx.Get(&paymentID, tx.Rebind(`SELECT payment_id FROM bank_statement_line WHERE id = ? FOR UPDATE`), lineID)
+	if err != nil {
+		return fmt.Errorf("Could not retrieve deposit: %v", err)
+	}
+	if paymentID == nil {
+		return nil
+	}
+	_, err = tx.Exec(tx.Rebind(`UPDATE bank_statement_line SET payment_id = NULL, matched_by = NULL, matched_at = NULL WHERE id = ?`), lineID)
+	if err != nil {
+		return fmt.Errorf("Could not unmatch deposit: %v", err)
+	}
+	if _, err := tx.Exec(tx.Rebind(`UPDATE payment SET reconciled_at = NULL WHERE id = ?`), *paymentID); err != nil {
+		return fmt.Errorf("Could not unmark payment: %v", err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,26 @@
+package models
+
+import "testing"
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+		ok   bool
+	}{
+		{"100.10", 10010, true},
+		{"-25.00", -2500, true},
+		{"$1,000.00", 100000, true},
+		{"12.3456", 1235, true},
+		{"12.3412", 1234, true},
+		{"$1,000.999", 100100, true},
+		{"", 0, false},
+		{"twelve", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseAmount(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseAmount(%q) = %v, %v; want %v, ok %v", tt.in, int64(got), err, int64(tt.want), tt.ok)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// CalendarModel stores the database handle for the availability calendar of each location
+type CalendarModel struct {
+	DB *sqlx.DB
+}
+
+// CalendarBlock is an event or reservation taking up an area or piece of equipment on the calendar
+type CalendarBlock struct {
+	Kind       string    `db:"kind" json:"-"`
+	ResourceID int       `db:"resource_id" json:"-"`
+	EventID    *int      `db:"event_id" json:"event_id"` // nil for reservations members made for themselves
+	Title      string    `db:"title" json:"title"`
+	Starts     time.Time `db:"starts" json:"starts"`
+	Ends       time.Time `db:"ends" json:"ends"`
+	Left       float64   `db:"-" json:"-"` // where the block starts and how long it is, as percentages of the calendar period
+	Width      float64   `db:"-" json:"-"`
+}
+
+// CalendarRow is an area or piece of equipment on the calendar, or the events at the location that do not use any
+// particular area, with what is booked during the calendar period
+type CalendarRow struct {
+	Kind   string          `db:"kind" json:"kind"` // "events", "area" or "equipment"
+	ID     int             `db:"id" json:"id"`
+	Name   string          `db:"name" json:"name"`
+	Blocks []CalendarBlock `db:"-" json:"blocks"`
+}
+
+// Calendar is what is booked at a location over a period, one row for each area and piece of equipment
+type Calendar struct {
+	LocationID int             `json:"location_id"`
+	Location   string          `json:"location"`
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	Rows       []CalendarRow   `json:"rows"`
+	Hours      []OpenHours     `json:"hours"`
+	Closed     []CalendarBlock `json:"closed"` // the times outside the open hours and during closures
+}
+
+// place works out where a block is drawn on the calendar, cutting off the parts outside the calendar period
+func (c *Calendar) place(b *CalendarBlock) {
+	period := c.To.Sub(c.From)
+	starts, ends := b.Starts, b.Ends
+	if starts.Before(c.From) {
+		starts = c.From
+	}
+	if ends.After(c.To) {
+		ends = c.To
+	}
+	b.Left = 100 * float64(starts.Sub(c.From)) / float64(period)
+	b.Width = 100 * float64(ends.Sub(starts)) / float64(period)
+}
+
+// clockOn returns the time of day in the hh:mm format on a day, with 24:00 being midnight at the end of the day
+func clockOn(day time.Time, clock string) time.Time {
+	var h, m int
+	fmt.Sscanf(clock, "%d:%d", &h, &m)
+	return time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, day.Location())
+}
+
+// closed works out when the location is closed during the calendar period from its open hours and closures. A
+// location with no open hours is open all the time except for its closures.
+func (c *Calendar) closed(closures []Closure) {
+	c.Closed = []CalendarBlock{}
+	if len(c.Hours) > 0 {
+		for day := c.From; day.Before(c.To); day = day.AddDate(0, 0, 1) {
+			// the hours are in order, so the gaps between them are when it is closed
+			closedFrom := day
+			for _, h := range c.Hours {
+				if h.Weekday != int(day.Weekday()) {
+					continue
+				}
+				if opens := clockOn(day, h.Opens); opens.After(closedFrom) {
+					c.Closed = append(c.Closed, CalendarBlock{Title: "Closed", Starts: closedFrom, Ends: opens})
+				}
+				if closes := clockOn(day, h.Closes); closes.After(closedFrom) {
+					closedFrom = closes
+				}
+			}
+			if next := day.AddDate(0, 0, 1); next.After(closedFrom) {
+				c.Closed = append(c.Closed, CalendarBlock{Title: "Closed", Starts: closedFrom, Ends: next})
+			}
+		}
+	}
+	for _, cl := range closures {
+		c.Closed = append(c.Closed, CalendarBlock{Title: cl.Reason, Starts: cl.Starts, Ends: cl.Ends})
+	}
+	for i := range c.Closed {
+		c.place(&c.Closed[i])
+	}
+}
+
+//Calendar returns the events and reservations at a location between two times. Areas come first with their
+//equipment after them, and retired equipment is left out. The open hours and closures of the location are included
+//so the calendar can show when it is closed.
+func (cm *CalendarModel) Calendar(locationID int, from, to time.Time) (*Calendar, error) {
+	c := &Calendar{LocationID: locationID, From: from, To: to}
+	if err := cm.DB.Get(&c.Location, cm.DB.Rebind(`SELECT name FROM location WHERE id = ?`), locationID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve location: %v", err)
+	}
+
+	q := cm.DB.Rebind(`
+	SELECT kind, id, name FROM (
+		SELECT 'area' AS kind, area.id, area.name, area.name AS area, 0 AS position
+		FROM area
+		WHERE area.location_id = ?
+		UNION ALL
+		SELECT 'equipment', equipment.id, equipment.name, area.name, 1
+		FROM equipment
+			JOIN area ON area.id = equipment.area_id
+			JOIN equipment_status ON equipment_status.id = equipment.status_id
+		WHERE area.location_id = ? AND equipment_status.name <> 'retired'
+	) AS resource
+	ORDER BY area, position, name`)
+	rows := []CalendarRow{}
+	if err := cm.DB.Select(&rows, q, locationID, locationID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve areas and equipment for calendar: %v", err)
+	}
+	c.Rows = append([]CalendarRow{{Kind: "events", Name: "Events"}}, rows...)
+
+	// events show on the areas and equipment they use or have reserved, and on the events row if they use none
+	q = cm.DB.Rebind(`
+	SELECT 'area' AS kind, area_reservation.area_id AS resource_id, event_id,
+		COALESCE(event.name, 'Reserved') AS title, lower(area_reservation.during) AS starts,
+		upper(area_reservation.during) AS ends
+	FROM area_reservation
+		JOIN area ON area.id = area_reservation.area_id
+		LEFT JOIN event ON event.id = area_reservation.event_id
+	WHERE area.location_id = ? AND area_reservation.during && tsrange(?, ?)
+	UNION
+	SELECT 'equipment', equipment_reservation.equipment_id, event_id, COALESCE(event.name, 'Reserved'),
+		lower(equipment_reservation.during), upper(equipment_reservation.during)
+	FROM equipment_reservation
+		JOIN equipment ON equipment.id = equipment_reservation.equipment_id
+		JOIN area ON area.id = equipment.area_id
+		LEFT JOIN event ON event.id = equipment_reservation.event_id
+	WHERE area.location_id = ? AND equipment_reservation.during && tsrange(?, ?)
+	UNION
+	SELECT 'area', event_area_rel.area_id, event.id, event.name, lower(event.during), upper(event.during)
+	FROM event
+		JOIN event_area_rel ON event_area_rel.event_id = event.id
+	WHERE event.location_id = ? AND event.during && tsrange(?, ?)
+	UNION
+	SELECT 'equipment', event_equipment_rel.equipment_id, event.id, event.name, lower(event.during), upper(event.during)
+	FROM event
+		JOIN event_equipment_rel ON event_equipment_rel.event_id = event.id
+	WHERE event.location_id = ? AND event.during && tsrange(?, ?)
+	UNION
+	SELECT 'events', 0, event.id, event.name, lower(event.during), upper(event.during)
+	FROM event
+	WHERE event.location_id = ? AND event.during && tsrange(?, ?)
+	AND NOT EXISTS (SELECT 1 FROM event_area_rel WHERE event_id = event.id)
+	AND NOT EXISTS (SELECT 1 FROM event_equipment_rel WHERE event_id = event.id)
+	AND NOT EXISTS (SELECT 1 FROM area_reservation WHERE event_id = event.id)
+	AND NOT EXISTS (SELECT 1 FROM equipment_reservation WHERE event_id = event.id)
+	ORDER BY starts`)
+	blocks := []CalendarBlock{}
+	err := cm.DB.Select(&blocks, q, locationID, from, to, locationID, from, to, locationID, from, to,
+		locationID, from, to, locationID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve bookings for calendar: %v", err)
+	}
+
+	hm := &HoursModel{DB: cm.DB}
+	if c.Hours, err = hm.Hours(locationID); err != nil {
+		return nil, err
+	}
+	closures, err := hm.Closures(locationID, from)
+	if err != nil {
+		return nil, err
+	}
+	during := closures[:0]
+	for _, cl := range closures {
+		if cl.Starts.Before(to) {
+			during = append(during, cl)
+		}
+	}
+	c.closed(during)
+
+	for i := range c.Rows {
+		c.Rows[i].Blocks = []CalendarBlock{}
+	}
+	for _, b := range blocks {
+		c.place(&b)
+		for i := range c.Rows {
+			if c.Rows[i].Kind == b.Kind && c.Rows[i].ID == b.ResourceID {
+				c.Rows[i].Blocks = append(c.Rows[i].Blocks, b)
+				break
+			}
+		}
+	}
+	return c, nil
+}
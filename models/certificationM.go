@@ -0,0 +1,252 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Errors returned when saving a certification that breaks the rules for the catalog
+var (
+	ErrCertificationExists = errors.New("There is already a certification with that name")
+	ErrPrerequisiteCycle   = errors.New("A certification cannot need itself, even through its prerequisites")
+)
+
+// CertificationModel stores the database handle for the catalog of certifications
+type CertificationModel struct {
+	DB *sqlx.DB
+}
+
+// Certification is a kind of certification that members can earn, such as being allowed to use the table saw
+type Certification struct {
+	ID              int    `db:"id"`
+	Name            string `db:"name"`
+	Description     string `db:"description"`
+	ValidDays       *int   `db:"valid_days"`         // how long a member's certification lasts, nil if it never expires
+	Approvals       int    `db:"approvals_required"` // how many approvers sign a member off, 2 for dangerous tools
+	Prerequisites   string `db:"prerequisites"`      // the names of the certifications needed first, for lists
+	Resources       int    `db:"resources"`          // how many areas and pieces of equipment it covers
+	PrerequisiteIDs []int  `db:"-"`
+}
+
+// CertificationResource is an area or piece of equipment that a certification grants access to
+type CertificationResource struct {
+	ID         int    `db:"id"`   // of the link between them, 0 for a resource that is not linked
+	Kind       string `db:"kind"` // "area" or "equipment"
+	ResourceID int    `db:"resource_id"`
+	Name       string `db:"name"`
+	Area       string `db:"area"` // the area the equipment is in, or the area itself
+}
+
+// requiredCertifications selects the IDs of the certifications needed to use an area or piece of equipment, given
+// its ID. Equipment needs the certifications covering the area it is in as well as its own.
+var requiredCertifications = map[string]string{
+	"area": `SELECT certification_id FROM certification_resource_rel WHERE area_id = ?`,
+	"equipment": `
+		SELECT certification_id
+		FROM certification_resource_rel, equipment
+		WHERE equipment.id = ?
+		AND (certification_resource_rel.equipment_id = equipment.id OR certification_resource_rel.area_id = equipment.area_id)`,
+}
+
+const certificationColumns = `certification.id, certification.name, certification.description, certification.valid_days,
+	certification.approvals_required,
+	COALESCE((SELECT string_agg(prerequisite.name, ', ' ORDER BY prerequisite.name)
+		FROM certification_prerequisite
+			JOIN certification AS prerequisite ON prerequisite.id = certification_prerequisite.prerequisite_id
+		WHERE certification_prerequisite.certification_id = certification.id), '') AS prerequisites,
+	(SELECT COUNT(*) FROM certification_resource_rel WHERE certification_id = certification.id) AS resources`
+
+//All returns every certification, by name
+func (cm *CertificationModel) All() ([]Certification, error) {
+	certifications := []Certification{}
+	if err := cm.DB.Select(&certifications, `SELECT `+certificationColumns+` FROM certification ORDER BY name`); err != nil {
+		return nil, fmt.Errorf("Could not retrieve certifications: %v", err)
+	}
+	return certifications, nil
+}
+
+//Get one certification, with the IDs of its prerequisites
+func (cm *CertificationModel) Get(id int) (*Certification, error) {
+	c := &Certification{}
+	if err := cm.DB.Get(c, cm.DB.Rebind(`SELECT `+certificationColumns+` FROM certification WHERE id = ?`), id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve certification: %v", err)
+	}
+	q := cm.DB.Rebind(`SELECT prerequisite_id FROM certification_prerequisite WHERE certification_id = ?`)
+	if err := cm.DB.Select(&c.PrerequisiteIDs, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve prerequisites: %v", err)
+	}
+	return c, nil
+}
+
+//Create saves a new certification and its prerequisites
+func (cm *CertificationModel) Create(c *Certification) error {
+	tx, err := cm.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	q := tx.Rebind(`
+	INSERT INTO certification (name, description, valid_days, approvals_required) VALUES (?, ?, ?, ?) RETURNING id`)
+	if err := tx.Get(&c.ID, q, c.Name, c.Description, c.ValidDays, c.Approvals); err != nil {
+		if isUniqueViolation(err) {
+			return ErrCertificationExists
+		}
+		return fmt.Errorf("Could not create certification: %v", err)
+	}
+	if err := setPrerequisites(tx, c); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Could not create certification: %v", err)
+	}
+	return nil
+}
+
+//Update saves changes to a certification and replaces its prerequisites. Members who already hold it keep it.
+func (cm *CertificationModel) Update(c *Certification) error {
+	tx, err := cm.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	q := tx.Rebind(`
+	UPDATE certification SET name = ?, description = ?, valid_days = ?, approvals_required = ? WHERE id = ?`)
+	if _, err := tx.Exec(q, c.Name, c.Description, c.ValidDays, c.Approvals, c.ID); err != nil {
+		if isUniqueViolation(err) {
+			return ErrCertificationExists
+		}
+		return fmt.Errorf("Could not update certification: %v", err)
+	}
+	if err := setPrerequisites(tx, c); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Could not update certification: %v", err)
+	}
+	return nil
+}
+
+// setPrerequisites replaces the prerequisites of a certification, making sure none of them need it in turn
+func setPrerequisites(tx *sqlx.Tx, c *Certification) error {
+	if _, err := tx.Exec(tx.Rebind(`DELETE FROM certification_prerequisite WHERE certification_id = ?`), c.ID); err != nil {
+		return fmt.Errorf("Could not update prerequisites: %v", err)
+	}
+	q := tx.Rebind(`INSERT INTO certification_prerequisite (certification_id, prerequisite_id) VALUES (?, ?) ON CONFLICT DO NOTHING`)
+	for _, p := range c.PrerequisiteIDs {
+		if _, err := tx.Exec(q, c.ID, p); err != nil {
+			if isCheckViolation(err) {
+				return ErrPrerequisiteCycle
+			}
+			return fmt.Errorf("Could not update prerequisites: %v", err)
+		}
+	}
+
+	q = tx.Rebind(`
+	WITH RECURSIVE needed (id) AS (
+		SELECT prerequisite_id FROM certification_prerequisite WHERE certification_id = ?
+		UNION
+		SELECT certification_prerequisite.prerequisite_id
+		FROM certification_prerequisite
+			JOIN needed ON needed.id = certification_prerequisite.certification_id
+	)
+	SELECT EXISTS (SELECT 1 FROM needed WHERE id = ?)`)
+	var cycle bool
+	if err := tx.Get(&cycle, q, c.ID, c.ID); err != nil {
+		return fmt.Errorf("Could not check prerequisites: %v", err)
+	}
+	if cycle {
+		return ErrPrerequisiteCycle
+	}
+	return nil
+}
+
+//Delete removes a certification. Returns ErrInUse if members hold it, events need or grant it, or it is a
+//prerequisite of another certification.
+func (cm *CertificationModel) Delete(id int) error {
+	if _, err := cm.DB.Exec(cm.DB.Rebind(`DELETE FROM certification WHERE id = ?`), id); err != nil {
+		if isForeignKeyViolation(err) {
+			return ErrInUse
+		}
+		return fmt.Errorf("Could not delete certification: %v", err)
+	}
+	return nil
+}
+
+//Resources returns the areas and equipment a certification grants access to, by area
+func (cm *CertificationModel) Resources(id int) ([]CertificationResource, error) {
+	q := cm.DB.Rebind(`
+	SELECT certification_resource_rel.id, 'area' AS kind, area.id AS resource_id, area.name, area.name AS area
+	FROM certification_resource_rel
+		JOIN area ON area.id = certification_resource_rel.area_id
+	WHERE certification_id = ?
+	UNION ALL
+	SELECT certification_resource_rel.id, 'equipment', equipment.id, equipment.name, area.name
+	FROM certification_resource_rel
+		JOIN equipment ON equipment.id = certification_resource_rel.equipment_id
+		JOIN area ON area.id = equipment.area_id
+	WHERE certification_id = ?
+	ORDER BY area, kind, name`)
+	resources := []CertificationResource{}
+	if err := cm.DB.Select(&resources, q, id, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve resources for certification: %v", err)
+	}
+	return resources, nil
+}
+
+//Choices returns every area and piece of equipment a certification could be linked to, by area. Retired equipment
+//is left out.
+func (cm *CertificationModel) Choices() ([]CertificationResource, error) {
+	q := `
+	SELECT 0 AS id, 'area' AS kind, area.id AS resource_id, area.name, area.name AS area
+	FROM area
+	UNION ALL
+	SELECT 0, 'equipment', equipment.id, equipment.name, area.name
+	FROM equipment
+		JOIN area ON area.id = equipment.area_id
+		JOIN equipment_status ON equipment_status.id = equipment.status_id
+	WHERE equipment_status.name <> 'retired'
+	ORDER BY area, kind, name`
+	resources := []CertificationResource{}
+	if err := cm.DB.Select(&resources, q); err != nil {
+		return nil, fmt.Errorf("Could not retrieve areas and equipment: %v", err)
+	}
+	return resources, nil
+}
+
+//Link makes a certification grant access to an area and all its equipment, or to a single piece of equipment.
+//Linking a resource that is already linked does nothing.
+func (cm *CertificationModel) Link(id int, kind string, resourceID int) error {
+	if _, ok := requiredCertifications[kind]; !ok {
+		return ErrNoSuchResource
+	}
+	q := cm.DB.Rebind(`INSERT INTO certification_resource_rel (certification_id, ` + kind + `_id) VALUES (?, ?) ON CONFLICT DO NOTHING`)
+	if _, err := cm.DB.Exec(q, id, resourceID); err != nil {
+		if isForeignKeyViolation(err) {
+			return ErrNoSuchResource
+		}
+		return fmt.Errorf("Could not link certification: %v", err)
+	}
+	return nil
+}
+
+//Unlink stops a certification granting access to an area or piece of equipment
+func (cm *CertificationModel) Unlink(id, linkID int) error {
+	q := cm.DB.Rebind(`DELETE FROM certification_resource_rel WHERE certification_id = ? AND id = ?`)
+	if _, err := cm.DB.Exec(q, id, linkID); err != nil {
+		return fmt.Errorf("Could not unlink certification: %v", err)
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether a statement failed because it would have duplicated a unique value
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
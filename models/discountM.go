@@ -0,0 +1,374 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DiscountModel stores the database handle for discount codes, scholarships and comped memberships
+type DiscountModel struct {
+	DB *sqlx.DB
+}
+
+// ErrDiscountCode is returned when a code does not exist, has expired, is retired, or has been used up
+var ErrDiscountCode = errors.New("That discount code is not valid")
+
+// ErrDiscountGranted is returned when a member already has a discount, or has already redeemed its code
+var ErrDiscountGranted = errors.New("That discount has already been given")
+
+// DiscountTerms is how a discount reduces a charge, and which charges it reduces
+type DiscountTerms struct {
+	Kind            string `db:"kind"` // percent, fixed or free
+	PercentOff      int    `db:"percent_off"`
+	AmountOff       Money  `db:"amount_off"`
+	AppliesToDues   bool   `db:"applies_to_dues"`
+	AppliesToEvents bool   `db:"applies_to_events"`
+}
+
+// Discount is a discount that can be redeemed with a code, or granted to a member by an admin
+type Discount struct {
+	DiscountTerms
+	ID        int        `db:"id"`
+	Name      string     `db:"name"`
+	Code      *string    `db:"code"`       // nil if only an admin can grant it
+	Periods   *int       `db:"periods"`    // how many invoices it is applied to for each member, nil for no limit
+	MaxUses   *int       `db:"max_uses"`   // how many members can be given it, nil for no limit
+	ExpiresOn *time.Time `db:"expires_on"` // nil if it does not expire
+	Active    bool       `db:"active"`
+	Granted   int        `db:"granted"` // members who have been given it
+}
+
+// MemberDiscount is a discount a member has been given
+type MemberDiscount struct {
+	DiscountTerms
+	ID          int       `db:"id"`
+	DiscountID  int       `db:"discount_id"`
+	Name        string    `db:"name"`
+	PeriodsLeft *int      `db:"periods_left"` // nil for no limit
+	GrantedBy   *string   `db:"granted_by"`   // the admin's name, nil if the member redeemed a code
+	Note        string    `db:"note"`
+	CreatedAt   time.Time `db:"created_at"`
+	Saved       Money     `db:"saved"` // taken off the member's invoices so far
+}
+
+// Describe says how much the discount takes off, e.g. "50% off"
+func (t DiscountTerms) Describe() string {
+	switch t.Kind {
+	case "percent":
+		return fmt.Sprintf("%d%% off", t.PercentOff)
+	case "fixed":
+		return fmt.Sprintf("%s off", t.AmountOff)
+	}
+	return "free"
+}
+
+// AppliesTo says which charges the discount reduces, e.g. "dues and event fees"
+func (t DiscountTerms) AppliesTo() string {
+	switch {
+	case t.AppliesToDues && t.AppliesToEvents:
+		return "dues and event fees"
+	case t.AppliesToEvents:
+		return "event fees"
+	case t.AppliesToDues:
+		return "dues"
+	}
+	return "nothing"
+}
+
+// applies reports whether the discount reduces an invoice line in a category
+func (t DiscountTerms) applies(category string) bool {
+	switch category {
+	case "dues":
+		return t.AppliesToDues
+	case "event_fee", "material_fee":
+		return t.AppliesToEvents
+	}
+	return false
+}
+
+// off is how much the discount takes off charges that it applies to, which total the given amount
+func (t DiscountTerms) off(amount Money) Money {
+	var off Money
+	switch t.Kind {
+	case "percent":
+		off = (amount*Money(t.PercentOff) + 50) / 100
+	case "fixed":
+		off = t.AmountOff
+	default:
+		off = amount
+	}
+	if off > amount {
+		off = amount
+	}
+	return off
+}
+
+// Expired reports whether the discount has passed its expiry date
+func (d *Discount) Expired(now time.Time) bool {
+	return d.ExpiresOn != nil && d.ExpiresOn.Before(now.Truncate(24*time.Hour))
+}
+
+// Available reports whether the discount can still be given to another member
+func (d *Discount) Available(now time.Time) bool {
+	return d.Active && !d.Expired(now) && (d.MaxUses == nil || d.Granted < *d.MaxUses)
+}
+
+const discountColumns = `discount.id, discount.name, discount.code, discount_kind.name AS kind, discount.percent_off, discount.amount_off,
+	discount.periods, discount.applies_to_dues, discount.applies_to_events, discount.max_uses, discount.expires_on, discount.active,
+	(SELECT COUNT(*) FROM member_discount WHERE member_discount.discount_id = discount.id) AS granted`
+
+const discountFrom = ` FROM discount JOIN discount_kind ON discount_kind.id = discount.kind_id`
+
+//All returns every discount, including retired ones, with the active ones first
+func (dm *DiscountModel) All() ([]Discount, error) {
+	discounts := []Discount{}
+	if err := dm.DB.Select(&discounts, `SELECT `+discountColumns+discountFrom+` ORDER BY discount.active DESC, discount.name`); err != nil {
+		return nil, fmt.Errorf("Could not retrieve discounts: %v", err)
+	}
+	return discounts, nil
+}
+
+//Get one discount
+func (dm *DiscountModel) Get(id int) (*Discount, error) {
+	d := &Discount{}
+	if err := dm.DB.Get(d, dm.DB.Rebind(`SELECT `+discountColumns+discountFrom+` WHERE discount.id = ?`), id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve discount: %v", err)
+	}
+	return d, nil
+}
+
+//Create saves a new discount
+func (dm *DiscountModel) Create(d *Discount) error {
+	q := dm.DB.Rebind(`
+	INSERT INTO discount
+		(name, code, kind_id, percent_off, amount_off, periods, applies_to_dues, applies_to_events, max_uses, expires_on)
+	VALUES
+		(?, ?, (SELECT id FROM discount_kind WHERE name = ?), ?, ?, ?, ?, ?, ?, ?)
+	RETURNING id`)
+	err := dm.DB.Get(&d.ID, q, d.Name, d.Code, d.Kind, d.PercentOff, d.AmountOff, d.Periods,
+		d.AppliesToDues, d.AppliesToEvents, d.MaxUses, d.ExpiresOn)
+	if err != nil {
+		return fmt.Errorf("Could not create discount: %v", err)
+	}
+	d.Active = true
+	return nil
+}
+
+//Update saves changes to a discount. Members who already have it keep the number of periods they were given.
+func (dm *DiscountModel) Update(d *Discount) error {
+	q := dm.DB.Rebind(`
+	UPDATE discount SET
+		name = ?, code = ?, kind_id = (SELECT id FROM discount_kind WHERE name = ?), percent_off = ?, amount_off = ?, periods = ?,
+		applies_to_dues = ?, applies_to_events = ?, max_uses = ?, expires_on = ?
+	WHERE id = ?`)
+	_, err := dm.DB.Exec(q, d.Name, d.Code, d.Kind, d.PercentOff, d.AmountOff, d.Periods,
+		d.AppliesToDues, d.AppliesToEvents, d.MaxUses, d.ExpiresOn, d.ID)
+	if err != nil {
+		return fmt.Errorf("Could not update discount: %v", err)
+	}
+	return nil
+}
+
+//SetActive retires a discount, which stops it being redeemed or applied to new invoices, or brings it back
+func (dm *DiscountModel) SetActive(id int, active bool) error {
+	if _, err := dm.DB.Exec(dm.DB.Rebind(`UPDATE discount SET active = ? WHERE id = ?`), active, id); err != nil {
+		return fmt.Errorf("Could not update discount: %v", err)
+	}
+	return nil
+}
+
+//ForMember returns the discounts a member has now, with how much each has saved them
+func (dm *DiscountModel) ForMember(memberID int) ([]MemberDiscount, error) {
+	q := dm.DB.Rebind(`
+	SELECT member_discount.id, discount.id AS discount_id, discount.name, discount_kind.name AS kind, discount.percent_off,
+		discount.amount_off, discount.applies_to_dues, discount.applies_to_events, member_discount.periods_left,
+		admin.name AS granted_by, member_discount.note, member_discount.created_at,
+		COALESCE((SELECT SUM(amount) FROM discount_use WHERE discount_use.member_discount_id = member_discount.id), '$0.00') AS saved
+	FROM member_discount
+		JOIN discount ON discount.id = member_discount.discount_id
+		JOIN discount_kind ON discount_kind.id = discount.kind_id
+		LEFT JOIN member admin ON admin.id = member_discount.granted_by
+	WHERE member_discount.member_id = ? AND member_discount.ended_at IS NULL
+	ORDER BY member_discount.created_at, member_discount.id`)
+	discounts := []MemberDiscount{}
+	if err := dm.DB.Select(&discounts, q, memberID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve member discounts: %v", err)
+	}
+	return discounts, nil
+}
+
+//Grant gives a member a discount, such as a scholarship or a comped membership. A member whose earlier grant of
+//the same discount has ended is given it again with a fresh number of periods.
+func (dm *DiscountModel) Grant(memberID, discountID, grantedBy int, note string, now time.Time) error {
+	tx, err := dm.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	d := &Discount{}
+	if err := tx.Get(d, tx.Rebind(`SELECT `+discountColumns+discountFrom+` WHERE discount.id = ? FOR UPDATE OF discount`), discountID); err != nil {
+		return fmt.Errorf("Could not retrieve discount: %v", err)
+	}
+	if !d.Available(now) {
+		return ErrDiscountCode
+	}
+	var id int
+	err = tx.Get(&id, tx.Rebind(`
+		INSERT INTO member_discount (member_id, discount_id, periods_left, granted_by, note) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (member_id, discount_id) DO UPDATE SET
+			periods_left = EXCLUDED.periods_left, granted_by = EXCLUDED.granted_by, note = EXCLUDED.note,
+			created_at = now(), ended_at = NULL
+		WHERE member_discount.ended_at IS NOT NULL
+		RETURNING id`), memberID, discountID, d.Periods, grantedBy, note)
+	if err == sql.ErrNoRows {
+		return ErrDiscountGranted
+	}
+	if err != nil {
+		return fmt.Errorf("Could not grant discount: %v", err)
+	}
+	return tx.Commit()
+}
+
+//Redeem gives a member the discount with a code. Codes are not case sensitive, and each member can only redeem a code once.
+func (dm *DiscountModel) Redeem(memberID int, code string, now time.Time) (*Discount, error) {
+	tx, err := dm.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// locking the discount serializes redemptions, so a code can never be used more than max_uses times
+	d := &Discount{}
+	err = tx.Get(d, tx.Rebind(`SELECT `+discountColumns+discountFrom+` WHERE upper(discount.code) = upper(?) FOR UPDATE OF discount`), code)
+	if err == sql.ErrNoRows {
+		return nil, ErrDiscountCode
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve discount: %v", err)
+	}
+	if !d.Available(now) {
+		return nil, ErrDiscountCode
+	}
+	var id int
+	err = tx.Get(&id, tx.Rebind(`
+		INSERT INTO member_discount (member_id, discount_id, periods_left) VALUES (?, ?, ?)
+		ON CONFLICT (member_id, discount_id) DO NOTHING
+		RETURNING id`), memberID, d.ID, d.Periods)
+	if err == sql.ErrNoRows {
+		return nil, ErrDiscountGranted
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not redeem discount: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+//End stops applying one of a member's discounts to their invoices
+func (dm *DiscountModel) End(memberID, memberDiscountID int, now time.Time) error {
+	q := dm.DB.Rebind(`UPDATE member_discount SET ended_at = ? WHERE id = ? AND member_id = ? AND ended_at IS NULL`)
+	if _, err := dm.DB.Exec(q, now, memberDiscountID, memberID); err != nil {
+		return fmt.Errorf("Could not end discount: %v", err)
+	}
+	return nil
+}
+
+// discountUse is a discount taken off an invoice, recorded once the invoice has been saved
+type discountUse struct {
+	memberDiscountID int
+	amount           Money
+}
+
+// applyDiscounts adds a line to the invoice for each of the member's current discounts that reduces its charges.
+// Each discount is worked out on what the discounts before it left to pay, so the charges never go below zero.
+// An invoice is only discounted once, however many times this is called.
+func applyDiscounts(tx *sqlx.Tx, inv *Invoice, now time.Time) error {
+	if inv.discounted || len(inv.Lines) == 0 {
+		return nil
+	}
+	inv.discounted = true
+
+	grants := []struct {
+		DiscountTerms
+		ID   int    `db:"id"`
+		Name string `db:"name"`
+	}{}
+	err := tx.Select(&grants, tx.Rebind(`
+		SELECT member_discount.id, discount.name, discount_kind.name AS kind, discount.percent_off, discount.amount_off,
+			discount.applies_to_dues, discount.applies_to_events
+		FROM member_discount
+			JOIN discount ON discount.id = member_discount.discount_id
+			JOIN discount_kind ON discount_kind.id = discount.kind_id
+		WHERE member_discount.member_id = ? AND member_discount.ended_at IS NULL
+			AND (member_discount.periods_left IS NULL OR member_discount.periods_left > 0)
+			AND discount.active AND (discount.expires_on IS NULL OR discount.expires_on >= ?)
+		ORDER BY member_discount.created_at, member_discount.id
+		FOR UPDATE OF member_discount`), inv.MemberID, now.Format("2006-01-02"))
+	if err != nil {
+		return fmt.Errorf("Could not retrieve member discounts: %v", err)
+	}
+
+	left := make([]Money, len(inv.Lines))
+	for i, l := range inv.Lines {
+		left[i] = l.Total()
+	}
+	for _, g := range grants {
+		var applicable Money
+		for i := range left {
+			if g.applies(inv.Lines[i].Category) && left[i] > 0 {
+				applicable += left[i]
+			}
+		}
+		off := g.off(applicable)
+		if off <= 0 {
+			continue
+		}
+		rest := off
+		for i := range left {
+			if !g.applies(inv.Lines[i].Category) || left[i] <= 0 {
+				continue
+			}
+			taken := left[i]
+			if taken > rest {
+				taken = rest
+			}
+			left[i] -= taken
+			rest -= taken
+		}
+		inv.Lines = append(inv.Lines, InvoiceLine{
+			Category:    "discount",
+			Description: fmt.Sprintf("%s (%s)", g.Name, g.Describe()),
+			Quantity:    1,
+			UnitAmount:  -off,
+		})
+		inv.discounts = append(inv.discounts, discountUse{memberDiscountID: g.ID, amount: off})
+	}
+	return nil
+}
+
+// recordDiscounts saves the discounts taken off a saved invoice, and counts down the periods left on them.
+// A discount is ended when it has no periods left.
+func recordDiscounts(tx *sqlx.Tx, inv *Invoice) error {
+	for _, u := range inv.discounts {
+		q := tx.Rebind(`INSERT INTO discount_use (member_discount_id, invoice_id, amount) VALUES (?, ?, ?)`)
+		if _, err := tx.Exec(q, u.memberDiscountID, inv.ID, u.amount); err != nil {
+			return fmt.Errorf("Could not record discount: %v", err)
+		}
+		q = tx.Rebind(`
+			UPDATE member_discount SET periods_left = periods_left - 1,
+				ended_at = CASE WHEN periods_left <= 1 THEN now() END
+			WHERE id = ? AND periods_left IS NOT NULL`)
+		if _, err := tx.Exec(q, u.memberDiscountID); err != nil {
+			return fmt.Errorf("Could not record discount: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DonationModel stores the database handle for recurring donations and donation statements
+type DonationModel struct {
+	DB *sqlx.DB
+}
+
+// Donation is one donation a member made, as a donation line on an invoice they paid
+type Donation struct {
+	Date        time.Time `db:"paid_at"`
+	PaymentID   int       `db:"payment_id"`
+	Description string    `db:"description"`
+	Amount      Money     `db:"amount"`
+}
+
+// Donor is a member who donated during a year, with the total
+type Donor struct {
+	MemberID int    `db:"member_id"`
+	Name     string `db:"name"`
+	Email    string `db:"email"`
+	Total    Money  `db:"total"`
+}
+
+// donationsPaid selects the donation lines on paid invoices, and their members, dated by the payment, for the given year
+const donationsPaid = `
+	FROM invoice_line_item
+		JOIN line_item_category ON line_item_category.id = invoice_line_item.category_id
+		JOIN invoice ON invoice.id = invoice_line_item.invoice_id
+		JOIN payment ON payment.id = invoice.payment_id
+		JOIN member ON member.id = invoice.member_id
+	WHERE line_item_category.name = 'donation'
+		AND invoice.status_id = (SELECT id FROM invoice_status WHERE name = 'paid')
+		AND payment.created_at >= make_date(?, 1, 1) AND payment.created_at < make_date(? + 1, 1, 1)`
+
+//Recurring returns the monthly amount a member donates, or 0 if they do not
+func (dm *DonationModel) Recurring(memberID int) (Money, error) {
+	var amount Money
+	err := dm.DB.Get(&amount, dm.DB.Rebind(`SELECT amount FROM member_recurring_donation WHERE member_id = ?`), memberID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("Could not retrieve recurring donation: %v", err)
+	}
+	return amount, nil
+}
+
+//SetRecurring sets or changes the monthly amount a member donates. An amount of 0 cancels the donation.
+//The new amount is invoiced from the member's next renewal.
+func (dm *DonationModel) SetRecurring(memberID int, amount Money) error {
+	var err error
+	if amount <= 0 {
+		_, err = dm.DB.Exec(dm.DB.Rebind(`DELETE FROM member_recurring_donation WHERE member_id = ?`), memberID)
+	} else {
+		_, err = dm.DB.Exec(dm.DB.Rebind(`
+			INSERT INTO member_recurring_donation (member_id, amount) VALUES (?, ?)
+			ON CONFLICT (member_id) DO UPDATE SET amount = EXCLUDED.amount, updated_at = now()`), memberID, amount)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not save recurring donation: %v", err)
+	}
+	return nil
+}
+
+//ForYear returns every donation a member paid during a year, oldest first. Dues and fees paid with the same
+//payment are not included.
+func (dm *DonationModel) ForYear(memberID, year int) ([]Donation, error) {
+	q := dm.DB.Rebind(`
+	SELECT payment.created_at AS paid_at, payment.id AS payment_id, invoice_line_item.description,
+		invoice_line_item.quantity * invoice_line_item.unit_amount AS amount` + donationsPaid + `
+		AND invoice.member_id = ?
+	ORDER BY payment.created_at, invoice_line_item.id`)
+	donations := []Donation{}
+	if err := dm.DB.Select(&donations, q, year, year, memberID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve donations: %v", err)
+	}
+	return donations, nil
+}
+
+//Donors returns the members who donated during a year with their totals, by name
+func (dm *DonationModel) Donors(year int) ([]Donor, error) {
+	q := dm.DB.Rebind(`
+	SELECT member.id AS member_id, member.name, member.username AS email,
+		SUM(invoice_line_item.quantity * invoice_line_item.unit_amount) AS total` + donationsPaid + `
+	GROUP BY member.id, member.name, member.username
+	ORDER BY member.name, member.id`)
+	donors := []Donor{}
+	if err := dm.DB.Select(&donors, q, year, year); err != nil {
+		return nil, fmt.Errorf("Could not retrieve donors: %v", err)
+	}
+	return donors, nil
+}
@@ -0,0 +1,236 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// EquipmentStatuses are the states a piece of equipment can be in, in the order they are shown
+var EquipmentStatuses = []string{"available", "out_of_service", "retired"}
+
+// EquipmentFileKinds are the kinds of file that can be attached to equipment
+var EquipmentFileKinds = []string{"photo", "manual"}
+
+// EquipmentModel stores the database handle for the equipment inventory
+type EquipmentModel struct {
+	DB *sqlx.DB
+}
+
+// Equipment is a tool or machine owned by the organization
+type Equipment struct {
+	ID            int        `db:"id"`
+	AreaID        int        `db:"area_id"`
+	Area          string     `db:"area"` // the name of the area the equipment is in
+	Name          string     `db:"name"`
+	Manufacturer  string     `db:"manufacturer"`
+	Model         string     `db:"model"`
+	SerialNumber  string     `db:"serial_number"`
+	AssetTag      *string    `db:"asset_tag"`
+	PurchasePrice *Money     `db:"purchase_price"`
+	PurchasedOn   *time.Time `db:"purchased_on"`
+	Status        string     `db:"status"`
+	Notes         string     `db:"notes"`
+	BroughtAt     *time.Time `db:"brought_at"`
+	CreatedAt     time.Time  `db:"created_at"`
+	ReservationLimits
+}
+
+// EquipmentFilter limits the equipment listed. Zero values match everything.
+type EquipmentFilter struct {
+	AreaID int
+	Status string
+}
+
+// EquipmentMove records a piece of equipment being moved from one area to another
+type EquipmentMove struct {
+	ID      int       `db:"id"`
+	From    string    `db:"from_area"`
+	To      string    `db:"to_area"`
+	MovedBy *string   `db:"moved_by"` // nil if the member who moved it has since been deleted
+	Note    string    `db:"note"`
+	MovedAt time.Time `db:"moved_at"`
+}
+
+// EquipmentFile is a photo or manual attached to a piece of equipment. The contents are only loaded by File.
+type EquipmentFile struct {
+	ID          int       `db:"id"`
+	EquipmentID int       `db:"equipment_id"`
+	Kind        string    `db:"kind"`
+	Filename    string    `db:"filename"`
+	ContentType string    `db:"content_type"`
+	Size        int       `db:"size"`
+	UploadedBy  *string   `db:"uploaded_by"`
+	CreatedAt   time.Time `db:"created_at"`
+	Data        []byte    `db:"data"`
+}
+
+const equipmentColumns = `equipment.id, equipment.area_id, area.name AS area, equipment.name, manufacturer, model,
+	serial_number, asset_tag, purchase_price, purchased_on, equipment_status.name AS status, notes, brought_at,
+	equipment.created_at, equipment.max_reservation_minutes, equipment.advance_days, equipment.member_quota`
+
+const equipmentFrom = ` FROM equipment
+	JOIN area ON area.id = equipment.area_id
+	JOIN equipment_status ON equipment_status.id = equipment.status_id`
+
+//List returns the equipment matching the filter, by area and then by name
+func (em *EquipmentModel) List(f EquipmentFilter) ([]Equipment, error) {
+	q := em.DB.Rebind(`SELECT ` + equipmentColumns + equipmentFrom + `
+	WHERE (? = 0 OR equipment.area_id = ?) AND (? = '' OR equipment_status.name = ?)
+	ORDER BY area.name, equipment.name`)
+	equipment := []Equipment{}
+	if err := em.DB.Select(&equipment, q, f.AreaID, f.AreaID, f.Status, f.Status); err != nil {
+		return nil, fmt.Errorf("Could not retrieve equipment: %v", err)
+	}
+	return equipment, nil
+}
+
+//Get one piece of equipment
+func (em *EquipmentModel) Get(id int) (*Equipment, error) {
+	q := em.DB.Rebind(`SELECT ` + equipmentColumns + equipmentFrom + ` WHERE equipment.id = ?`)
+	e := &Equipment{}
+	if err := em.DB.Get(e, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve equipment: %v", err)
+	}
+	return e, nil
+}
+
+//Create saves a new piece of equipment
+func (em *EquipmentModel) Create(e *Equipment) error {
+	q := em.DB.Rebind(`
+	INSERT INTO equipment
+		(area_id, name, manufacturer, model, serial_number, asset_tag, purchase_price, purchased_on, status_id, notes, brought_at,
+		max_reservation_minutes, advance_days, member_quota)
+	VALUES
+		(?, ?, ?, ?, ?, ?, ?, ?, (SELECT id FROM equipment_status WHERE name = ?), ?, ?, ?, ?, ?)
+	RETURNING id`)
+	if err := em.DB.Get(&e.ID, q, e.AreaID, e.Name, e.Manufacturer, e.Model, e.SerialNumber, e.AssetTag,
+		e.PurchasePrice, e.PurchasedOn, e.Status, e.Notes, e.BroughtAt, e.MaxMinutes, e.AdvanceDays, e.MemberQuota); err != nil {
+		return fmt.Errorf("Could not create equipment: %v", err)
+	}
+	return nil
+}
+
+//Update saves changes to a piece of equipment, except the area it is in (see Move)
+func (em *EquipmentModel) Update(e *Equipment) error {
+	q := em.DB.Rebind(`
+	UPDATE equipment
+	SET name = ?, manufacturer = ?, model = ?, serial_number = ?, asset_tag = ?, purchase_price = ?, purchased_on = ?,
+		status_id = (SELECT id FROM equipment_status WHERE name = ?), notes = ?, brought_at = ?,
+		max_reservation_minutes = ?, advance_days = ?, member_quota = ?
+	WHERE id = ?`)
+	if _, err := em.DB.Exec(q, e.Name, e.Manufacturer, e.Model, e.SerialNumber, e.AssetTag, e.PurchasePrice,
+		e.PurchasedOn, e.Status, e.Notes, e.BroughtAt, e.MaxMinutes, e.AdvanceDays, e.MemberQuota, e.ID); err != nil {
+		return fmt.Errorf("Could not update equipment: %v", err)
+	}
+	return nil
+}
+
+//Move puts a piece of equipment in another area and records the move. Moving it to the area it is already in does nothing.
+func (em *EquipmentModel) Move(id, areaID, movedBy int, note string, now time.Time) error {
+	tx, err := em.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var from int
+	if err := tx.Get(&from, tx.Rebind(`SELECT area_id FROM equipment WHERE id = ? FOR UPDATE`), id); err != nil {
+		return fmt.Errorf("Could not retrieve equipment: %v", err)
+	}
+	if from == areaID {
+		return nil
+	}
+
+	if _, err := tx.Exec(tx.Rebind(`UPDATE equipment SET area_id = ? WHERE id = ?`), areaID, id); err != nil {
+		return fmt.Errorf("Could not move equipment: %v", err)
+	}
+	q := tx.Rebind(`
+	INSERT INTO equipment_move
+		(equipment_id, from_area_id, to_area_id, moved_by, note, moved_at)
+	VALUES
+		(?, ?, ?, ?, ?, ?)`)
+	if _, err := tx.Exec(q, id, from, areaID, movedBy, note, now); err != nil {
+		return fmt.Errorf("Could not record equipment move: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+//Moves returns where a piece of equipment has been moved, most recent first
+func (em *EquipmentModel) Moves(id int) ([]EquipmentMove, error) {
+	q := em.DB.Rebind(`
+	SELECT equipment_move.id, from_area.name AS from_area, to_area.name AS to_area, member.name AS moved_by,
+		note, moved_at
+	FROM equipment_move
+		JOIN area from_area ON from_area.id = equipment_move.from_area_id
+		JOIN area to_area ON to_area.id = equipment_move.to_area_id
+		LEFT JOIN member ON member.id = equipment_move.moved_by
+	WHERE equipment_id = ?
+	ORDER BY moved_at DESC, equipment_move.id DESC`)
+	moves := []EquipmentMove{}
+	if err := em.DB.Select(&moves, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve equipment moves: %v", err)
+	}
+	return moves, nil
+}
+
+//Files returns the photos and manuals attached to a piece of equipment, without their contents
+func (em *EquipmentModel) Files(id int) ([]EquipmentFile, error) {
+	q := em.DB.Rebind(`
+	SELECT equipment_file.id, equipment_id, equipment_file_kind.name AS kind, filename, content_type,
+		octet_length(data) AS size, member.name AS uploaded_by, equipment_file.created_at
+	FROM equipment_file
+		JOIN equipment_file_kind ON equipment_file_kind.id = equipment_file.kind_id
+		LEFT JOIN member ON member.id = equipment_file.uploaded_by
+	WHERE equipment_id = ?
+	ORDER BY equipment_file_kind.id, equipment_file.created_at`)
+	files := []EquipmentFile{}
+	if err := em.DB.Select(&files, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve equipment files: %v", err)
+	}
+	return files, nil
+}
+
+//File returns one photo or manual attached to a piece of equipment, including its contents
+func (em *EquipmentModel) File(id, fileID int) (*EquipmentFile, error) {
+	q := em.DB.Rebind(`
+	SELECT equipment_file.id, equipment_id, equipment_file_kind.name AS kind, filename, content_type,
+		octet_length(data) AS size, NULL AS uploaded_by, equipment_file.created_at, data
+	FROM equipment_file
+		JOIN equipment_file_kind ON equipment_file_kind.id = equipment_file.kind_id
+	WHERE equipment_id = ? AND equipment_file.id = ?`)
+	f := &EquipmentFile{}
+	if err := em.DB.Get(f, q, id, fileID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve equipment file: %v", err)
+	}
+	return f, nil
+}
+
+//AddFile attaches a photo or manual to a piece of equipment
+func (em *EquipmentModel) AddFile(f *EquipmentFile, uploadedBy int) error {
+	q := em.DB.Rebind(`
+	INSERT INTO equipment_file
+		(equipment_id, kind_id, filename, content_type, data, uploaded_by)
+	VALUES
+		(?, (SELECT id FROM equipment_file_kind WHERE name = ?), ?, ?, ?, ?)
+	RETURNING id, created_at`)
+	if err := em.DB.QueryRowx(q, f.EquipmentID, f.Kind, f.Filename, f.ContentType, f.Data, uploadedBy).Scan(&f.ID, &f.CreatedAt); err != nil {
+		return fmt.Errorf("Could not save equipment file: %v", err)
+	}
+	f.Size = len(f.Data)
+	return nil
+}
+
+//DeleteFile removes a photo or manual from a piece of equipment
+func (em *EquipmentModel) DeleteFile(id, fileID int) error {
+	q := em.DB.Rebind(`DELETE FROM equipment_file WHERE equipment_id = ? AND id = ?`)
+	if _, err := em.DB.Exec(q, id, fileID); err != nil {
+		return fmt.Errorf("Could not delete equipment file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// HoursModel stores the database handle for the open hours and closures of each location
+type HoursModel struct {
+	DB *sqlx.DB
+}
+
+// OpenHours is a period a location is open every week
+type OpenHours struct {
+	ID         int    `db:"id" json:"-"`
+	LocationID int    `db:"location_id" json:"-"`
+	Weekday    int    `db:"weekday" json:"weekday"` // 0 is Sunday
+	Opens      string `db:"opens" json:"opens"`     // hh:mm
+	Closes     string `db:"closes" json:"closes"`   // hh:mm, 24:00 for midnight
+}
+
+// Day is the name of the day of the week
+func (h *OpenHours) Day() string {
+	return time.Weekday(h.Weekday).String()
+}
+
+// Closure is a holiday or other time a location is closed
+type Closure struct {
+	ID         int       `db:"id"`
+	LocationID int       `db:"location_id"`
+	Starts     time.Time `db:"starts"`
+	Ends       time.Time `db:"ends"`
+	Reason     string    `db:"reason"`
+	CreatedBy  *string   `db:"created_by"`
+}
+
+// ClosedError is returned when something is booked for a time its location is closed
+type ClosedError struct {
+	Reason string // why the location is closed, shown to members
+}
+
+func (e *ClosedError) Error() string {
+	return "It is closed then: " + e.Reason
+}
+
+// notOpenReason is given when a booking is outside the open hours rather than during a closure
+const notOpenReason = "outside the open hours"
+
+// closedReason returns why a location is closed for some or all of a period, or "" if it is open throughout
+func closedReason(q sqlx.Ext, locationID int, starts, ends time.Time) (string, error) {
+	var open bool
+	if err := sqlx.Get(q, &open, q.Rebind(`SELECT location_open(?, ?, ?)`), locationID, starts, ends); err != nil {
+		return "", fmt.Errorf("Could not check open hours: %v", err)
+	}
+	if open {
+		return "", nil
+	}
+
+	reasons := []string{}
+	rq := q.Rebind(`
+	SELECT reason FROM location_closure
+	WHERE location_id = ? AND during && tsrange(?, ?, CASE WHEN ? = ? THEN '[]' ELSE '[)' END)
+	ORDER BY lower(during)
+	LIMIT 1`)
+	if err := sqlx.Select(q, &reasons, rq, locationID, starts, ends, starts, ends); err != nil {
+		return "", fmt.Errorf("Could not retrieve closures: %v", err)
+	}
+	if len(reasons) == 0 {
+		return notOpenReason, nil
+	}
+	return reasons[0], nil
+}
+
+//Hours returns the weekly open hours of a location, from Sunday to Saturday
+func (hm *HoursModel) Hours(locationID int) ([]OpenHours, error) {
+	q := hm.DB.Rebind(`
+	SELECT id, location_id, weekday, to_char(opens, 'HH24:MI') AS opens, to_char(closes, 'HH24:MI') AS closes
+	FROM location_hours
+	WHERE location_id = ?
+	ORDER BY weekday, opens`)
+	hours := []OpenHours{}
+	if err := hm.DB.Select(&hours, q, locationID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve open hours: %v", err)
+	}
+	return hours, nil
+}
+
+//AddHours adds a period a location is open every week
+func (hm *HoursModel) AddHours(h *OpenHours) error {
+	q := hm.DB.Rebind(`
+	INSERT INTO location_hours
+		(location_id, weekday, opens, closes)
+	VALUES
+		(?, ?, ?, ?)
+	RETURNING id`)
+	if err := hm.DB.Get(&h.ID, q, h.LocationID, h.Weekday, h.Opens, h.Closes); err != nil {
+		return fmt.Errorf("Could not add open hours: %v", err)
+	}
+	return nil
+}
+
+//DeleteHours removes a period a location is open every week
+func (hm *HoursModel) DeleteHours(locationID, id int) error {
+	q := hm.DB.Rebind(`DELETE FROM location_hours WHERE location_id = ? AND id = ?`)
+	if _, err := hm.DB.Exec(q, locationID, id); err != nil {
+		return fmt.Errorf("Could not delete open hours: %v", err)
+	}
+	return nil
+}
+
+//Closures returns the closures of a location that end after a time, soonest first
+func (hm *HoursModel) Closures(locationID int, after time.Time) ([]Closure, error) {
+	q := hm.DB.Rebind(`
+	SELECT location_closure.id, location_id, lower(during) AS starts, upper(during) AS ends, reason,
+		member.name AS created_by
+	FROM location_closure
+		LEFT JOIN member ON member.id = location_closure.created_by
+	WHERE location_id = ? AND upper(during) > ?
+	ORDER BY lower(during)`)
+	closures := []Closure{}
+	if err := hm.DB.Select(&closures, q, locationID, after); err != nil {
+		return nil, fmt.Errorf("Could not retrieve closures: %v", err)
+	}
+	return closures, nil
+}
+
+//AddClosure closes a location for a holiday or other reason
+func (hm *HoursModel) AddClosure(c *Closure, createdBy int) error {
+	q := hm.DB.Rebind(`
+	INSERT INTO location_closure
+		(location_id, during, reason, created_by)
+	VALUES
+		(?, tsrange(?, ?), ?, ?)
+	RETURNING id`)
+	if err := hm.DB.Get(&c.ID, q, c.LocationID, c.Starts, c.Ends, c.Reason, createdBy); err != nil {
+		return fmt.Errorf("Could not add closure: %v", err)
+	}
+	return nil
+}
+
+//DeleteClosure removes a closure, opening the location again for that time
+func (hm *HoursModel) DeleteClosure(locationID, id int) error {
+	q := hm.DB.Rebind(`DELETE FROM location_closure WHERE location_id = ? AND id = ?`)
+	if _, err := hm.DB.Exec(q, locationID, id); err != nil {
+		return fmt.Errorf("Could not delete closure: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// InvoiceModel stores the database handle for all invoice related DB methods
+type InvoiceModel struct {
+	DB *sqlx.DB
+}
+
+// Invoice records an amount that a member owes
+type Invoice struct {
+	ID          int           `db:"id"`
+	Amount      Money         `db:"amount"`
+	Description string        `db:"description"`
+	MemberID    int           `db:"member_id"`
+	PaymentID   *int          `db:"payment_id"`  // the payment that settled it
+	AmountPaid  Money         `db:"amount_paid"` // by the payments made against it so far
+	Status      string        `db:"status"`
+	DueDate     time.Time     `db:"due_date"`
+	CreatedAt   time.Time     `db:"created_at"`
+	Lines       []InvoiceLine `db:"-"`
+
+	discounted bool          // the member's discounts have been added to the lines
+	discounts  []discountUse // to record when the invoice is saved
+	vouchers   []voucherUse  // gift vouchers spent on the invoice, to record when it is saved
+}
+
+// InvoiceLine is one charge on an invoice
+type InvoiceLine struct {
+	ID          int    `db:"id"`
+	Category    string `db:"category"`
+	Description string `db:"description"`
+	Quantity    int    `db:"quantity"`
+	UnitAmount  Money  `db:"unit_amount"`
+	OptionID    *int   `db:"membership_option_id"` // the membership a dues line is for
+	EventID     *int   `db:"event_id"`             // the event a fee line is for
+}
+
+// Total is the quantity times the unit amount
+func (l InvoiceLine) Total() Money {
+	return Money(l.Quantity) * l.UnitAmount
+}
+
+// Paid reports whether the invoice has been settled
+func (i *Invoice) Paid() bool {
+	return i.Status == "paid"
+}
+
+// Balance is what is left to pay
+func (i *Invoice) Balance() Money {
+	if i.Status != "unpaid" || i.AmountPaid >= i.Amount {
+		return 0
+	}
+	return i.Amount - i.AmountPaid
+}
+
+// Payable reports whether the invoice is waiting for a payment
+func (i *Invoice) Payable() bool {
+	return i.Balance() > 0
+}
+
+// invoiceBalance is the SQL for what is left to pay on an unpaid invoice
+const invoiceBalance = `(invoice.amount - COALESCE((SELECT SUM(payment.amount) FROM payment WHERE payment.invoice_id = invoice.id), '0'::money))`
+
+const invoiceColumns = `
+	invoice.id,
+	invoice.amount,
+	invoice.description,
+	invoice.member_id,
+	invoice.payment_id,
+	COALESCE((SELECT SUM(payment.amount) FROM payment WHERE payment.invoice_id = invoice.id), '0'::money) AS amount_paid,
+	COALESCE(invoice_status.name, 'unpaid') AS status,
+	invoice.due_date,
+	invoice.created_at`
+
+//Get one invoice
+func (im *InvoiceModel) Get(id int) (*Invoice, error) {
+	q := im.DB.Rebind(`SELECT ` + invoiceColumns + `
+		FROM invoice LEFT JOIN invoice_status ON invoice_status.id = invoice.status_id
+		WHERE invoice.id = ?`)
+	inv := &Invoice{}
+	if err := im.DB.Get(inv, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve invoice: %v", err)
+	}
+	return inv, nil
+}
+
+//GetForMember returns every invoice issued to a member, newest first
+func (im *InvoiceModel) GetForMember(memberID int) ([]Invoice, error) {
+	q := im.DB.Rebind(`SELECT ` + invoiceColumns + `
+		FROM invoice LEFT JOIN invoice_status ON invoice_status.id = invoice.status_id
+		WHERE invoice.member_id = ?
+		ORDER BY invoice.created_at DESC`)
+	invoices := []Invoice{}
+	if err := im.DB.Select(&invoices, q, memberID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve invoices: %v", err)
+	}
+	return invoices, nil
+}
+
+//GetForPayment returns the invoices a payment was made against, whether or not it settled them
+func (im *InvoiceModel) GetForPayment(paymentID int) ([]Invoice, error) {
+	q := im.DB.Rebind(`SELECT ` + invoiceColumns + `
+		FROM invoice LEFT JOIN invoice_status ON invoice_status.id = invoice.status_id
+		WHERE invoice.payment_id = ? OR invoice.id = (SELECT invoice_id FROM payment WHERE payment.id = ?)
+		ORDER BY invoice.id`)
+	invoices := []Invoice{}
+	if err := im.DB.Select(&invoices, q, paymentID, paymentID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve invoices: %v", err)
+	}
+	return invoices, nil
+}
+
+//GetLines fills in the line items of an invoice. Invoices created before line items existed, or without any,
+//get a single line made from their description and amount so that every invoice can be itemized the same way.
+func (im *InvoiceModel) GetLines(inv *Invoice) error {
+	q := im.DB.Rebind(`
+		SELECT invoice_line_item.id, line_item_category.name AS category, invoice_line_item.description,
+			invoice_line_item.quantity, invoice_line_item.unit_amount, invoice_line_item.membership_option_id,
+			invoice_line_item.event_id
+		FROM invoice_line_item JOIN line_item_category ON line_item_category.id = invoice_line_item.category_id
+		WHERE invoice_line_item.invoice_id = ?
+		ORDER BY invoice_line_item.id`)
+	inv.Lines = []InvoiceLine{}
+	if err := im.DB.Select(&inv.Lines, q, inv.ID); err != nil {
+		return fmt.Errorf("Could not retrieve invoice lines: %v", err)
+	}
+	if len(inv.Lines) == 0 {
+		inv.Lines = []InvoiceLine{{Category: "other", Description: inv.Description, Quantity: 1, UnitAmount: inv.Amount}}
+	}
+	return nil
+}
+
+//Create saves a new unpaid invoice. If it has line items they are saved too, with the member's discounts and gift
+//vouchers, and the amount is their total. An invoice that leaves nothing to pay is saved as paid.
+func (im *InvoiceModel) Create(inv *Invoice) error {
+	tx, err := im.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := createInvoice(tx, inv); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// createInvoice saves an invoice and its lines as part of a larger transaction. The member's discounts are
+// taken off the lines first, unless that has already been done, and then any gift vouchers they have redeemed.
+func createInvoice(tx *sqlx.Tx, inv *Invoice) error {
+	if err := applyDiscounts(tx, inv, time.Now()); err != nil {
+		return err
+	}
+	if err := applyVouchers(tx, inv, time.Now()); err != nil {
+		return err
+	}
+	if len(inv.Lines) > 0 {
+		inv.Amount = 0
+		for i := range inv.Lines {
+			inv.Amount += inv.Lines[i].Total()
+		}
+	}
+	if inv.DueDate.IsZero() {
+		inv.DueDate = time.Now()
+	}
+	// discounts, vouchers and credits can cover the whole invoice, and then there is nothing to wait for
+	inv.Status = "unpaid"
+	if inv.Amount <= 0 {
+		inv.Status = "paid"
+	}
+
+	q := tx.Rebind(`
+	INSERT INTO invoice
+		(amount, description, member_id, status_id, due_date)
+	VALUES
+		(?, ?, ?, (SELECT id FROM invoice_status WHERE name = ?), ?)
+	RETURNING id, created_at`)
+	if err := tx.QueryRowx(q, inv.Amount, inv.Description, inv.MemberID, inv.Status, inv.DueDate).Scan(&inv.ID, &inv.CreatedAt); err != nil {
+		return fmt.Errorf("Could not create invoice: %v", err)
+	}
+
+	for i := range inv.Lines {
+		l := &inv.Lines[i]
+		q := tx.Rebind(`
+		INSERT INTO invoice_line_item
+			(invoice_id, category_id, description, quantity, unit_amount, membership_option_id, event_id)
+		VALUES
+			(?, (SELECT id FROM line_item_category WHERE name = ?), ?, ?, ?, ?, ?)
+		RETURNING id`)
+		if err := tx.Get(&l.ID, q, inv.ID, l.Category, l.Description, l.Quantity, l.UnitAmount, l.OptionID, l.EventID); err != nil {
+			return fmt.Errorf("Could not create invoice line: %v", err)
+		}
+	}
+	if err := recordDiscounts(tx, inv); err != nil {
+		return err
+	}
+	if err := recordVouchers(tx, inv); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package models
+
+import "testing"
+
+func TestInvoiceBalance(t *testing.T) {
+	tests := []struct {
+		status  string
+		amount  Money
+		paid    Money
+		balance Money
+		payable bool
+	}{
+		{"unpaid", 5000, 0, 5000, true},
+		{"unpaid", 5000, 2000, 3000, true},
+		{"unpaid", 5000, 5000, 0, false},
+		{"unpaid", 5000, 6000, 0, false},
+		{"unpaid", 0, 0, 0, false},
+		{"unpaid", -500, 0, 0, false},
+		{"paid", 5000, 0, 0, false},
+		{"paid", 5000, 2000, 0, false},
+		{"cancelled", 5000, 0, 0, false},
+	}
+	for _, tt := range tests {
+		inv := &Invoice{Status: tt.status, Amount: tt.amount, AmountPaid: tt.paid}
+		if got := inv.Balance(); got != tt.balance {
+			t.Errorf("Balance() of %s invoice for %d with %d paid = %d; want %d", tt.status, tt.amount, tt.paid, got, tt.balance)
+		}
+		if got := inv.Payable(); got != tt.payable {
+			t.Errorf("Payable() of %s invoice for %d with %d paid = %v; want %v", tt.status, tt.amount, tt.paid, got, tt.payable)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// KioskModel stores the database handle for members checking in at the kiosk of a location
+type KioskModel struct {
+	DB *sqlx.DB
+}
+
+// CheckIn is a member arriving at a location
+type CheckIn struct {
+	ID           int       `db:"id"`
+	LocationID   int       `db:"location_id"`
+	MemberID     int       `db:"member_id"`
+	Name         string    `db:"name"` // the name of the member
+	CheckedInAt  time.Time `db:"checked_in_at"`
+	CheckedInBy  *int      `db:"checked_in_by"`
+	OutsideHours bool      `db:"outside_hours"`
+	Events       int       `db:"-"` // how many of the member's event registrations were checked in with it
+}
+
+// eventCheckInWindow is how long before an event starts members checking in at its location are checked in to it
+const eventCheckInWindow = time.Hour
+
+//CheckIn records a member arriving at a location, along with their registrations for events there that are on
+//now or starting soon. Unless override is set, it returns a ClosedError if the location is closed.
+func (km *KioskModel) CheckIn(c *CheckIn, override bool, now time.Time) error {
+	tx, err := km.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	reason, err := closedReason(tx, c.LocationID, now, now)
+	if err != nil {
+		return err
+	}
+	if reason != "" && !override {
+		return &ClosedError{Reason: reason}
+	}
+	c.OutsideHours = reason != ""
+	c.CheckedInAt = now
+
+	q := tx.Rebind(`
+	INSERT INTO location_checkin (location_id, member_id, checked_in_at, checked_in_by, outside_hours)
+	VALUES (?, ?, ?, ?, ?)
+	RETURNING id, (SELECT name FROM member WHERE id = location_checkin.member_id) AS name`)
+	if err := tx.QueryRowx(q, c.LocationID, c.MemberID, now, c.CheckedInBy, c.OutsideHours).Scan(&c.ID, &c.Name); err != nil {
+		if isForeignKeyViolation(err) {
+			return ErrNoSuchMember
+		}
+		return fmt.Errorf("Could not check in: %v", err)
+	}
+
+	rq := tx.Rebind(`
+	UPDATE member_event_registration SET
+		checked_in_status_id = (SELECT id FROM checked_in_status WHERE status = 'Checked In'),
+		updated_at = now()
+	WHERE member_id = ?
+	AND checked_in_status_id = (SELECT id FROM checked_in_status WHERE status = 'Not Checked In')
+	AND event_id IN (SELECT id FROM event WHERE location_id = ? AND during && tsrange(?, ?, '[]'))`)
+	res, err := tx.Exec(rq, c.MemberID, c.LocationID, now, now.Add(eventCheckInWindow))
+	if err != nil {
+		return fmt.Errorf("Could not check in to events: %v", err)
+	}
+	events, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Could not check in to events: %v", err)
+	}
+	c.Events = int(events)
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+//Since lists the members who checked in at a location from a time on, the latest first
+func (km *KioskModel) Since(locationID int, since time.Time) ([]CheckIn, error) {
+	q := km.DB.Rebind(`
+	SELECT location_checkin.id, location_id, member_id, member.name, checked_in_at, checked_in_by, outside_hours
+	FROM location_checkin
+	JOIN member ON member.id = location_checkin.member_id
+	WHERE location_id = ? AND checked_in_at >= ?
+	ORDER BY checked_in_at DESC`)
+	checkIns := []CheckIn{}
+	if err := km.DB.Select(&checkIns, q, locationID, since); err != nil {
+		return nil, fmt.Errorf("Could not retrieve check-ins: %v", err)
+	}
+	return checkIns, nil
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// LedgerModel stores the database handle for building member account statements.
+// The ledger is never stored, it is always derived from the invoice, payment and refund tables so that it cannot drift from them.
+type LedgerModel struct {
+	DB *sqlx.DB
+}
+
+// LedgerEntry is one line of an account statement. Charges (invoices, and refunds of money already paid)
+// increase the balance owed, credits (payments) reduce it.
+type LedgerEntry struct {
+	Date        time.Time `db:"date"`
+	Kind        string    `db:"kind"`
+	Ref         int       `db:"ref"`
+	Description string    `db:"description"`
+	Charge      Money     `db:"charge"`
+	Credit      Money     `db:"credit"`
+	Balance     Money     `db:"-"`
+}
+
+// Ledger is an account statement for one member over a date range
+type Ledger struct {
+	MemberID     int
+	From         time.Time
+	To           time.Time
+	Opening      Money
+	Entries      []LedgerEntry
+	TotalCharges Money
+	TotalCredits Money
+	Closing      Money
+}
+
+// invoices that count towards what a member owes. Cancelled invoices are left out of every balance.
+const ledgerInvoiceFilter = `invoice.status_id IS DISTINCT FROM (SELECT id FROM invoice_status WHERE name = 'cancelled')`
+
+//ForMember builds the statement for a member between two dates, inclusive
+func (lm *LedgerModel) ForMember(memberID int, from, to time.Time) (*Ledger, error) {
+	l := &Ledger{MemberID: memberID, From: from, To: to}
+	end := to.AddDate(0, 0, 1)
+
+	var charged, credited Money
+	q := lm.DB.Rebind(`SELECT SUM(amount) FROM invoice WHERE member_id = ? AND created_at < ? AND ` + ledgerInvoiceFilter)
+	if err := lm.DB.Get(&charged, q, memberID, from); err != nil {
+		return nil, fmt.Errorf("Could not calculate opening balance: %v", err)
+	}
+	q = lm.DB.Rebind(`SELECT SUM(amount) FROM payment WHERE member_id = ? AND created_at < ?`)
+	if err := lm.DB.Get(&credited, q, memberID, from); err != nil {
+		return nil, fmt.Errorf("Could not calculate opening balance: %v", err)
+	}
+	var refunded Money
+	q = lm.DB.Rebind(`SELECT SUM(refund.amount) FROM refund JOIN payment ON payment.id = refund.payment_id WHERE payment.member_id = ? AND refund.created_at < ?`)
+	if err := lm.DB.Get(&refunded, q, memberID, from); err != nil {
+		return nil, fmt.Errorf("Could not calculate opening balance: %v", err)
+	}
+	l.Opening = charged - credited + refunded
+
+	q = lm.DB.Rebind(`
+		SELECT invoice.created_at AS date, 'invoice' AS kind, invoice.id AS ref, invoice.description,
+			invoice.amount AS charge, '0'::money AS credit
+		FROM invoice
+		WHERE invoice.member_id = ? AND invoice.created_at >= ? AND invoice.created_at < ? AND ` + ledgerInvoiceFilter + `
+	UNION ALL
+		SELECT payment.created_at, 'payment', payment.id,
+			'Payment (' || payment_method.name || ')' ||
+				COALESCE(' for invoice #' || payment.invoice_id,
+					' for invoice #' || (SELECT string_agg(invoice.id::text, ', #') FROM invoice WHERE invoice.payment_id = payment.id), ''),
+			'0'::money, payment.amount
+		FROM payment JOIN payment_method ON payment_method.id = payment.payment_method_id
+		WHERE payment.member_id = ? AND payment.created_at >= ? AND payment.created_at < ?
+	UNION ALL
+		SELECT refund.created_at, 'refund', refund.id,
+			'Refund (' || payment_method.name || ') of payment #' || refund.payment_id,
+			refund.amount, '0'::money
+		FROM refund
+			JOIN payment ON payment.id = refund.payment_id
+			JOIN payment_method ON payment_method.id = refund.payment_method_id
+		WHERE payment.member_id = ? AND refund.created_at >= ? AND refund.created_at < ?
+	ORDER BY date, kind, ref`)
+	if err := lm.DB.Select(&l.Entries, q, memberID, from, end, memberID, from, end, memberID, from, end); err != nil {
+		return nil, fmt.Errorf("Could not retrieve ledger: %v", err)
+	}
+
+	balance := l.Opening
+	for i := range l.Entries {
+		e := &l.Entries[i]
+		balance += e.Charge - e.Credit
+		e.Balance = balance
+		l.TotalCharges += e.Charge
+		l.TotalCredits += e.Credit
+	}
+	l.Closing = balance
+
+	return l, nil
+}
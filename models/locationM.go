@@ -0,0 +1,104 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// ErrInUse is returned when deleting a location or area that something still refers to
+var ErrInUse = errors.New("It is still in use, so it cannot be deleted")
+
+// LocationModel stores the database handle for the locations the organization runs
+type LocationModel struct {
+	DB *sqlx.DB
+}
+
+// Location is a building or site. The rooms in it are areas.
+type Location struct {
+	ID       int    `db:"id"`
+	Name     string `db:"name"`
+	Address1 string `db:"address_1"`
+	Address2 string `db:"address_2"`
+	City     string `db:"city"`
+	State    string `db:"state"`
+	Zip      string `db:"zip"`
+	Areas    int    `db:"areas"` // the number of areas in the location
+}
+
+// Lines returns the address of the location as it would be written on an envelope
+func (l *Location) Lines() []string {
+	lines := []string{l.Address1}
+	if l.Address2 != "" {
+		lines = append(lines, l.Address2)
+	}
+	return append(lines, fmt.Sprintf("%s, %s %s", l.City, l.State, l.Zip))
+}
+
+const locationColumns = `location.id, location.name, address_1, address_2, city, state, zip,
+	(SELECT COUNT(*) FROM area WHERE area.location_id = location.id) AS areas`
+
+//All returns every location, by name
+func (lm *LocationModel) All() ([]Location, error) {
+	locations := []Location{}
+	if err := lm.DB.Select(&locations, `SELECT `+locationColumns+` FROM location ORDER BY name`); err != nil {
+		return nil, fmt.Errorf("Could not retrieve locations: %v", err)
+	}
+	return locations, nil
+}
+
+//Get one location
+func (lm *LocationModel) Get(id int) (*Location, error) {
+	q := lm.DB.Rebind(`SELECT ` + locationColumns + ` FROM location WHERE id = ?`)
+	l := &Location{}
+	if err := lm.DB.Get(l, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve location: %v", err)
+	}
+	return l, nil
+}
+
+//Create saves a new location
+func (lm *LocationModel) Create(l *Location) error {
+	q := lm.DB.Rebind(`
+	INSERT INTO location
+		(name, address_1, address_2, city, state, zip)
+	VALUES
+		(?, ?, ?, ?, ?, ?)
+	RETURNING id`)
+	if err := lm.DB.Get(&l.ID, q, l.Name, l.Address1, l.Address2, l.City, l.State, l.Zip); err != nil {
+		return fmt.Errorf("Could not create location: %v", err)
+	}
+	return nil
+}
+
+//Update saves changes to a location
+func (lm *LocationModel) Update(l *Location) error {
+	q := lm.DB.Rebind(`
+	UPDATE location
+	SET name = ?, address_1 = ?, address_2 = ?, city = ?, state = ?, zip = ?
+	WHERE id = ?`)
+	if _, err := lm.DB.Exec(q, l.Name, l.Address1, l.Address2, l.City, l.State, l.Zip, l.ID); err != nil {
+		return fmt.Errorf("Could not update location: %v", err)
+	}
+	return nil
+}
+
+//Delete removes a location. Returns ErrInUse if it still has areas.
+func (lm *LocationModel) Delete(id int) error {
+	q := lm.DB.Rebind(`DELETE FROM location WHERE id = ?`)
+	if _, err := lm.DB.Exec(q, id); err != nil {
+		if isForeignKeyViolation(err) {
+			return ErrInUse
+		}
+		return fmt.Errorf("Could not delete location: %v", err)
+	}
+	return nil
+}
+
+// isForeignKeyViolation reports whether a statement failed because a row it deleted is still referred to
+func isForeignKeyViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23503"
+}
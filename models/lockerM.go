@@ -0,0 +1,461 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// LockerModel stores the database handle for locker inventory, assignment and the locker waitlist
+type LockerModel struct {
+	DB *sqlx.DB
+}
+
+// LockerAddon is the name of the addon a member must have to be given a locker
+const LockerAddon = "Locker"
+
+var (
+	// ErrNoLockerAddon is returned when assigning a locker to a member who does not have the Locker addon
+	ErrNoLockerAddon = errors.New("The member needs the Locker addon before they can have a locker")
+	// ErrLockerUnavailable is returned when assigning a locker that is retired, taken, held for someone else, or needs clearing
+	ErrLockerUnavailable = errors.New("That locker is not available")
+	// ErrHasLocker is returned when assigning a locker to a member who already has one
+	ErrHasLocker = errors.New("The member already has a locker")
+	// ErrNoLockerOffer is returned when a member claims a locker but has no offer, or the offer has expired
+	ErrNoLockerOffer = errors.New("There is no locker offer to claim, or it has expired")
+)
+
+// Locker is a rentable locker and who has it
+type Locker struct {
+	ID            int        `db:"id"`
+	Label         string     `db:"locker_id"`
+	Size          string     `db:"size"`
+	AreaID        *int       `db:"area_id"`
+	AreaName      *string    `db:"area_name"`
+	Active        bool       `db:"active"`
+	NeedsClearing bool       `db:"needs_clearing"`
+	HolderID      *int       `db:"holder_id"`
+	HolderName    *string    `db:"holder_name"`
+	OfferedTo     *string    `db:"offered_to"`
+	OfferExpires  *time.Time `db:"offer_expires"`
+}
+
+// Status describes whether the locker can be assigned
+func (l *Locker) Status() string {
+	switch {
+	case !l.Active:
+		return "retired"
+	case l.HolderID != nil:
+		return "assigned"
+	case l.NeedsClearing:
+		return "needs clearing"
+	case l.OfferedTo != nil:
+		return "offered"
+	}
+	return "free"
+}
+
+// LockerWaiter is a member on the locker waitlist
+type LockerWaiter struct {
+	MemberID     int        `db:"member_id"`
+	Name         string     `db:"name"`
+	Since        time.Time  `db:"created_at"`
+	OfferedLabel *string    `db:"offered_label"`
+	OfferExpires *time.Time `db:"offer_expires"`
+}
+
+// MemberLocker is a member's locker, or their place on the waitlist
+type MemberLocker struct {
+	Locker       *Locker    // nil if the member has no locker
+	Position     int        // place on the waitlist, 0 if not waiting
+	OfferedLabel *string    // a locker being held for the member to claim
+	OfferExpires *time.Time // when the offer runs out
+	HasAddon     bool       // whether the member has the Locker addon
+}
+
+// LockerOffer is a freed locker offered to the next member on the waitlist
+type LockerOffer struct {
+	MemberID   int       `db:"member_id"`
+	MemberName string    `db:"member_name"`
+	Email      string    `db:"email"`
+	Label      string    `db:"locker_id"`
+	Expires    time.Time `db:"offer_expires"`
+}
+
+// ReleasedLocker is a locker taken back from a member automatically, which an admin needs to clear out
+type ReleasedLocker struct {
+	Label      string `db:"locker_id"`
+	MemberID   int    `db:"member_id"`
+	MemberName string `db:"member_name"`
+	Reason     string `db:"release_reason"`
+}
+
+const lockerColumns = `locker.id, locker.locker_id, locker_size.name AS size, locker.area_id, area.name AS area_name,
+	locker.active, locker.needs_clearing,
+	member.id AS holder_id, member.name AS holder_name,
+	offered.name AS offered_to, locker_waitlist.offer_expires`
+
+const lockerJoins = `
+	FROM locker
+		JOIN locker_size ON locker_size.id = locker.size_id
+		LEFT JOIN area ON area.id = locker.area_id
+		LEFT JOIN member_locker_rel ON member_locker_rel.locker_id = locker.id AND member_locker_rel.released_at IS NULL
+		LEFT JOIN member ON member.id = member_locker_rel.member_id
+		LEFT JOIN locker_waitlist ON locker_waitlist.offered_locker_id = locker.id
+		LEFT JOIN member offered ON offered.id = locker_waitlist.member_id`
+
+//All returns every locker, including retired ones, by label
+func (lm *LockerModel) All() ([]Locker, error) {
+	lockers := []Locker{}
+	if err := lm.DB.Select(&lockers, `SELECT `+lockerColumns+lockerJoins+` ORDER BY locker.active DESC, locker.locker_id`); err != nil {
+		return nil, fmt.Errorf("Could not retrieve lockers: %v", err)
+	}
+	return lockers, nil
+}
+
+//Get one locker
+func (lm *LockerModel) Get(id int) (*Locker, error) {
+	l := &Locker{}
+	if err := lm.DB.Get(l, lm.DB.Rebind(`SELECT `+lockerColumns+lockerJoins+` WHERE locker.id = ?`), id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve locker: %v", err)
+	}
+	return l, nil
+}
+
+//Sizes returns the locker sizes, smallest first
+func (lm *LockerModel) Sizes() ([]string, error) {
+	sizes := []string{}
+	if err := lm.DB.Select(&sizes, `SELECT name FROM locker_size ORDER BY id`); err != nil {
+		return nil, fmt.Errorf("Could not retrieve locker sizes: %v", err)
+	}
+	return sizes, nil
+}
+
+//Create adds a locker to the inventory
+func (lm *LockerModel) Create(l *Locker) error {
+	q := lm.DB.Rebind(`
+	INSERT INTO locker (locker_id, size_id, area_id)
+	VALUES (?, (SELECT id FROM locker_size WHERE name = ?), ?)
+	RETURNING id`)
+	if err := lm.DB.Get(&l.ID, q, l.Label, l.Size, l.AreaID); err != nil {
+		return fmt.Errorf("Could not create locker: %v", err)
+	}
+	l.Active = true
+	return nil
+}
+
+//Update saves changes to a locker's label, size and area
+func (lm *LockerModel) Update(l *Locker) error {
+	q := lm.DB.Rebind(`UPDATE locker SET locker_id = ?, size_id = (SELECT id FROM locker_size WHERE name = ?), area_id = ? WHERE id = ?`)
+	if _, err := lm.DB.Exec(q, l.Label, l.Size, l.AreaID, l.ID); err != nil {
+		return fmt.Errorf("Could not update locker: %v", err)
+	}
+	return nil
+}
+
+//SetActive retires a locker so that it is no longer assigned, or brings it back into use.
+//A locker can only be retired once it has been released.
+func (lm *LockerModel) SetActive(id int, active bool) error {
+	q := lm.DB.Rebind(`
+	UPDATE locker SET active = ?
+	WHERE id = ? AND NOT EXISTS (SELECT 1 FROM member_locker_rel WHERE locker_id = locker.id AND released_at IS NULL)`)
+	res, err := lm.DB.Exec(q, active, id)
+	if err != nil {
+		return fmt.Errorf("Could not update locker: %v", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrLockerUnavailable
+	}
+	if !active {
+		if _, err := lm.DB.Exec(lm.DB.Rebind(`UPDATE locker_waitlist SET offered_locker_id = NULL, offer_expires = NULL WHERE offered_locker_id = ?`), id); err != nil {
+			return fmt.Errorf("Could not withdraw locker offer: %v", err)
+		}
+	}
+	return nil
+}
+
+//Waitlist returns the members waiting for a locker, first in line first
+func (lm *LockerModel) Waitlist() ([]LockerWaiter, error) {
+	q := `
+	SELECT locker_waitlist.member_id, member.name, locker_waitlist.created_at,
+		locker.locker_id AS offered_label, locker_waitlist.offer_expires
+	FROM locker_waitlist
+		JOIN member ON member.id = locker_waitlist.member_id
+		LEFT JOIN locker ON locker.id = locker_waitlist.offered_locker_id
+	ORDER BY locker_waitlist.created_at, locker_waitlist.id`
+	waiters := []LockerWaiter{}
+	if err := lm.DB.Select(&waiters, q); err != nil {
+		return nil, fmt.Errorf("Could not retrieve locker waitlist: %v", err)
+	}
+	return waiters, nil
+}
+
+//ForMember returns a member's locker, or where they are on the waitlist
+func (lm *LockerModel) ForMember(memberID int) (*MemberLocker, error) {
+	ml := &MemberLocker{}
+
+	l := &Locker{}
+	err := lm.DB.Get(l, lm.DB.Rebind(`SELECT `+lockerColumns+lockerJoins+` WHERE member.id = ?`), memberID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("Could not retrieve locker: %v", err)
+	}
+	if err == nil {
+		ml.Locker = l
+	}
+
+	w := struct {
+		Position     int        `db:"position"`
+		OfferedLabel *string    `db:"offered_label"`
+		OfferExpires *time.Time `db:"offer_expires"`
+	}{}
+	err = lm.DB.Get(&w, lm.DB.Rebind(`
+		SELECT (SELECT COUNT(*) FROM locker_waitlist ahead
+				WHERE ahead.created_at < locker_waitlist.created_at
+					OR (ahead.created_at = locker_waitlist.created_at AND ahead.id <= locker_waitlist.id)) AS position,
+			locker.locker_id AS offered_label, locker_waitlist.offer_expires
+		FROM locker_waitlist LEFT JOIN locker ON locker.id = locker_waitlist.offered_locker_id
+		WHERE locker_waitlist.member_id = ?`), memberID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("Could not retrieve locker waitlist: %v", err)
+	}
+	if err == nil {
+		ml.Position, ml.OfferedLabel, ml.OfferExpires = w.Position, w.OfferedLabel, w.OfferExpires
+	}
+
+	if err := lm.DB.Get(&ml.HasAddon, lm.DB.Rebind(`SELECT `+hasLockerAddon), memberID, LockerAddon); err != nil {
+		return nil, fmt.Errorf("Could not check member addons: %v", err)
+	}
+	return ml, nil
+}
+
+const hasLockerAddon = `EXISTS (
+	SELECT 1 FROM member_addon_rel JOIN addon_types ON addon_types.id = member_addon_rel.addon_id
+	WHERE member_addon_rel.member_id = ? AND member_addon_rel.ended_at IS NULL AND addon_types.name = ?)`
+
+//Assign gives a locker to a member who has the Locker addon. A locker on offer can only be given to the member it is
+//offered to. The member leaves the waitlist if they were on it.
+func (lm *LockerModel) Assign(lockerID, memberID int, now time.Time) error {
+	tx, err := lm.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := assignLocker(tx, lockerID, memberID, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//JoinWaitlist puts a member at the back of the locker waitlist
+func (lm *LockerModel) JoinWaitlist(memberID int) error {
+	q := lm.DB.Rebind(`INSERT INTO locker_waitlist (member_id) VALUES (?) ON CONFLICT (member_id) DO NOTHING`)
+	if _, err := lm.DB.Exec(q, memberID); err != nil {
+		return fmt.Errorf("Could not join locker waitlist: %v", err)
+	}
+	return nil
+}
+
+//LeaveWaitlist takes a member off the locker waitlist, turning down any locker offered to them
+func (lm *LockerModel) LeaveWaitlist(memberID int) error {
+	if _, err := lm.DB.Exec(lm.DB.Rebind(`DELETE FROM locker_waitlist WHERE member_id = ?`), memberID); err != nil {
+		return fmt.Errorf("Could not leave locker waitlist: %v", err)
+	}
+	return nil
+}
+
+//Claim gives a member the locker offered to them, as long as the offer has not run out
+func (lm *LockerModel) Claim(memberID int, now time.Time) error {
+	tx, err := lm.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var lockerID int
+	err = tx.Get(&lockerID, tx.Rebind(`
+		SELECT offered_locker_id FROM locker_waitlist
+		WHERE member_id = ? AND offered_locker_id IS NOT NULL AND offer_expires > ?
+		FOR UPDATE`), memberID, now)
+	if err == sql.ErrNoRows {
+		return ErrNoLockerOffer
+	}
+	if err != nil {
+		return fmt.Errorf("Could not retrieve locker offer: %v", err)
+	}
+	if err := assignLocker(tx, lockerID, memberID, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//Release takes a locker back from its member. If the member did not empty it, it is flagged as needing clearing and is
+//not offered to anyone until an admin has cleared it.
+func (lm *LockerModel) Release(lockerID int, reason string, needsClearing bool, now time.Time) error {
+	tx, err := lm.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := tx.Rebind(`UPDATE member_locker_rel SET released_at = ?, release_reason = ? WHERE locker_id = ? AND released_at IS NULL`)
+	res, err := tx.Exec(q, now, reason, lockerID)
+	if err != nil {
+		return fmt.Errorf("Could not release locker: %v", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrLockerUnavailable
+	}
+	if needsClearing {
+		if _, err := tx.Exec(tx.Rebind(`UPDATE locker SET needs_clearing = 't' WHERE id = ?`), lockerID); err != nil {
+			return fmt.Errorf("Could not flag locker: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+//MarkCleared records that an admin has emptied a released locker, so that it can be offered again
+func (lm *LockerModel) MarkCleared(lockerID int) error {
+	if _, err := lm.DB.Exec(lm.DB.Rebind(`UPDATE locker SET needs_clearing = 'f' WHERE id = ?`), lockerID); err != nil {
+		return fmt.Errorf("Could not update locker: %v", err)
+	}
+	return nil
+}
+
+//ReleaseLapsed takes lockers back from members who have quit or who no longer have the Locker addon.
+//The lockers are flagged as needing clearing, because nobody has checked that they are empty.
+func (lm *LockerModel) ReleaseLapsed(now time.Time) ([]ReleasedLocker, error) {
+	q := lm.DB.Rebind(`
+	UPDATE member_locker_rel
+	SET released_at = ?,
+		release_reason = CASE WHEN member.membership_status_id = (SELECT id FROM membership_status WHERE name = 'quit')
+			THEN 'member quit' ELSE 'Locker addon removed' END
+	FROM member
+	WHERE member.id = member_locker_rel.member_id
+		AND member_locker_rel.released_at IS NULL
+		AND (member.membership_status_id = (SELECT id FROM membership_status WHERE name = 'quit')
+			OR NOT EXISTS (
+				SELECT 1 FROM member_addon_rel JOIN addon_types ON addon_types.id = member_addon_rel.addon_id
+				WHERE member_addon_rel.member_id = member.id AND member_addon_rel.ended_at IS NULL AND addon_types.name = ?))
+	RETURNING member_locker_rel.locker_id AS id, member.id AS member_id, member.name AS member_name, member_locker_rel.release_reason`)
+
+	tx, err := lm.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows := []struct {
+		ID int `db:"id"`
+		ReleasedLocker
+	}{}
+	if err := tx.Select(&rows, q, now, LockerAddon); err != nil {
+		return nil, fmt.Errorf("Could not release lockers: %v", err)
+	}
+	released := []ReleasedLocker{}
+	for _, r := range rows {
+		if err := tx.Get(&r.Label, tx.Rebind(`UPDATE locker SET needs_clearing = 't' WHERE id = ? RETURNING locker_id`), r.ID); err != nil {
+			return nil, fmt.Errorf("Could not flag locker: %v", err)
+		}
+		released = append(released, r.ReleasedLocker)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return released, nil
+}
+
+//OfferFree withdraws offers that have run out, taking those members off the waitlist, then offers every free locker
+//to the next member in line who does not already have an offer. Each offer lasts until expires.
+func (lm *LockerModel) OfferFree(now, expires time.Time) ([]LockerOffer, error) {
+	tx, err := lm.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// lock the waitlist so that two runs cannot offer the same locker twice
+	if _, err := tx.Exec(`LOCK TABLE locker_waitlist IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return nil, fmt.Errorf("Could not lock locker waitlist: %v", err)
+	}
+	if _, err := tx.Exec(tx.Rebind(`DELETE FROM locker_waitlist WHERE offered_locker_id IS NOT NULL AND offer_expires <= ?`), now); err != nil {
+		return nil, fmt.Errorf("Could not withdraw expired locker offers: %v", err)
+	}
+
+	free := []int{}
+	err = tx.Select(&free, `
+		SELECT locker.id FROM locker
+		WHERE locker.active AND NOT locker.needs_clearing
+			AND NOT EXISTS (SELECT 1 FROM member_locker_rel WHERE locker_id = locker.id AND released_at IS NULL)
+			AND NOT EXISTS (SELECT 1 FROM locker_waitlist WHERE offered_locker_id = locker.id)
+		ORDER BY locker.locker_id`)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve free lockers: %v", err)
+	}
+
+	offers := []LockerOffer{}
+	for _, id := range free {
+		o := LockerOffer{}
+		err := tx.Get(&o, tx.Rebind(`
+			UPDATE locker_waitlist SET offered_locker_id = ?, offer_expires = ?
+			FROM member, locker
+			WHERE locker_waitlist.id = (
+					SELECT id FROM locker_waitlist WHERE offered_locker_id IS NULL ORDER BY created_at, id LIMIT 1
+				)
+				AND member.id = locker_waitlist.member_id AND locker.id = ?
+			RETURNING member.id AS member_id, member.name AS member_name, member.username AS email,
+				locker.locker_id, locker_waitlist.offer_expires`), id, expires, id)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not offer locker: %v", err)
+		}
+		offers = append(offers, o)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return offers, nil
+}
+
+// assignLocker gives a locker to a member as part of a larger transaction
+func assignLocker(tx *sqlx.Tx, lockerID, memberID int, now time.Time) error {
+	var ok bool
+	err := tx.Get(&ok, tx.Rebind(`
+		SELECT locker.active AND NOT locker.needs_clearing
+			AND NOT EXISTS (SELECT 1 FROM member_locker_rel WHERE locker_id = locker.id AND released_at IS NULL)
+			AND NOT EXISTS (SELECT 1 FROM locker_waitlist WHERE offered_locker_id = locker.id AND member_id <> ?)
+		FROM locker WHERE id = ? FOR UPDATE`), memberID, lockerID)
+	if err == sql.ErrNoRows || (err == nil && !ok) {
+		return ErrLockerUnavailable
+	}
+	if err != nil {
+		return fmt.Errorf("Could not retrieve locker: %v", err)
+	}
+
+	if err := tx.Get(&ok, tx.Rebind(`SELECT `+hasLockerAddon), memberID, LockerAddon); err != nil {
+		return fmt.Errorf("Could not check member addons: %v", err)
+	}
+	if !ok {
+		return ErrNoLockerAddon
+	}
+	if err := tx.Get(&ok, tx.Rebind(`SELECT EXISTS (SELECT 1 FROM member_locker_rel WHERE member_id = ? AND released_at IS NULL)`), memberID); err != nil {
+		return fmt.Errorf("Could not check member lockers: %v", err)
+	}
+	if ok {
+		return ErrHasLocker
+	}
+
+	if _, err := tx.Exec(tx.Rebind(`INSERT INTO member_locker_rel (member_id, locker_id, assigned_at) VALUES (?, ?, ?)`), memberID, lockerID, now); err != nil {
+		return fmt.Errorf("Could not assign locker: %v", err)
+	}
+	if _, err := tx.Exec(tx.Rebind(`DELETE FROM locker_waitlist WHERE member_id = ?`), memberID); err != nil {
+		return fmt.Errorf("Could not update locker waitlist: %v", err)
+	}
+	return nil
+}
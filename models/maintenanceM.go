@@ -0,0 +1,360 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// TicketStatuses are the states a maintenance ticket can be in, in order
+var TicketStatuses = []string{"open", "in_progress", "resolved"}
+
+// MaintenanceModel stores the database handle for maintenance tickets and preventive maintenance schedules
+type MaintenanceModel struct {
+	DB *sqlx.DB
+}
+
+// Ticket is a problem with a piece of equipment that a member reported
+type Ticket struct {
+	ID           int        `db:"id"`
+	EquipmentID  int        `db:"equipment_id"`
+	Equipment    string     `db:"equipment"` // the name of the equipment
+	AreaID       int        `db:"area_id"`
+	Area         string     `db:"area"`
+	Title        string     `db:"title"`
+	Description  string     `db:"description"`
+	Status       string     `db:"status"`
+	OutOfService bool       `db:"out_of_service"`
+	ReportedByID *int       `db:"reported_by_id"`
+	ReportedBy   *string    `db:"reported_by"`
+	AssignedToID *int       `db:"assigned_to_id"`
+	AssignedTo   *string    `db:"assigned_to"`
+	CreatedAt    time.Time  `db:"created_at"`
+	ResolvedAt   *time.Time `db:"resolved_at"`
+}
+
+// TicketFilter limits the tickets listed. Zero values match everything.
+type TicketFilter struct {
+	Status      string // a ticket status, or "unresolved" for open and in progress tickets
+	EquipmentID int
+	MemberID    int // only tickets the member reported, is assigned, or that are in an area they look after
+}
+
+// TicketComment is a note added to a maintenance ticket
+type TicketComment struct {
+	ID        int       `db:"id"`
+	Member    *string   `db:"member"` // nil if the member has since been deleted
+	Body      string    `db:"body"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// AffectedEvent is an upcoming event that uses a piece of equipment, with one of the people running it
+type AffectedEvent struct {
+	EventID  int       `db:"event_id"`
+	Event    string    `db:"event"`
+	Starts   time.Time `db:"starts"`
+	HostName string    `db:"host_name"`
+	Email    string    `db:"email"`
+}
+
+// Schedule is preventive maintenance that needs to be done on a piece of equipment every so many days
+type Schedule struct {
+	ID           int        `db:"id"`
+	EquipmentID  int        `db:"equipment_id"`
+	Equipment    string     `db:"equipment"`
+	AreaID       int        `db:"area_id"`
+	Task         string     `db:"task"`
+	IntervalDays int        `db:"interval_days"`
+	LastDoneOn   *time.Time `db:"last_done_on"`
+	NextDueOn    time.Time  `db:"next_due_on"`
+}
+
+// Overdue reports whether the maintenance should already have been done
+func (s *Schedule) Overdue(now time.Time) bool {
+	return s.NextDueOn.Format("2006-01-02") < now.Format("2006-01-02")
+}
+
+const ticketColumns = `maintenance_ticket.id, maintenance_ticket.equipment_id, equipment.name AS equipment,
+	equipment.area_id, area.name AS area, title, description, maintenance_status.name AS status, out_of_service,
+	maintenance_ticket.reported_by AS reported_by_id, reporter.name AS reported_by,
+	maintenance_ticket.assigned_to AS assigned_to_id, assignee.name AS assigned_to,
+	maintenance_ticket.created_at, resolved_at`
+
+const ticketFrom = ` FROM maintenance_ticket
+	JOIN equipment ON equipment.id = maintenance_ticket.equipment_id
+	JOIN area ON area.id = equipment.area_id
+	JOIN maintenance_status ON maintenance_status.id = maintenance_ticket.status_id
+	LEFT JOIN member reporter ON reporter.id = maintenance_ticket.reported_by
+	LEFT JOIN member assignee ON assignee.id = maintenance_ticket.assigned_to`
+
+//Tickets returns the tickets matching the filter, newest first
+func (mm *MaintenanceModel) Tickets(f TicketFilter) ([]Ticket, error) {
+	q := mm.DB.Rebind(`SELECT ` + ticketColumns + ticketFrom + `
+	WHERE (? = '' OR maintenance_status.name = ? OR (? = 'unresolved' AND maintenance_status.name <> 'resolved'))
+	AND (? = 0 OR maintenance_ticket.equipment_id = ?)
+	AND (? = 0 OR maintenance_ticket.reported_by = ? OR maintenance_ticket.assigned_to = ?
+		OR equipment.area_id IN (SELECT area_id FROM area_steward WHERE member_id = ?))
+	ORDER BY maintenance_ticket.created_at DESC, maintenance_ticket.id DESC`)
+	tickets := []Ticket{}
+	err := mm.DB.Select(&tickets, q, f.Status, f.Status, f.Status, f.EquipmentID, f.EquipmentID,
+		f.MemberID, f.MemberID, f.MemberID, f.MemberID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve maintenance tickets: %v", err)
+	}
+	return tickets, nil
+}
+
+//Ticket returns one maintenance ticket
+func (mm *MaintenanceModel) Ticket(id int) (*Ticket, error) {
+	q := mm.DB.Rebind(`SELECT ` + ticketColumns + ticketFrom + ` WHERE maintenance_ticket.id = ?`)
+	t := &Ticket{}
+	if err := mm.DB.Get(t, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve maintenance ticket: %v", err)
+	}
+	return t, nil
+}
+
+//Report saves a new ticket, assigned to the area's first steward if it has any. If the ticket takes the equipment
+//out of service and it was available, the equipment is flagged out of service and Report returns true.
+func (mm *MaintenanceModel) Report(t *Ticket, now time.Time) (bool, error) {
+	tx, err := mm.DB.Beginx()
+	if err != nil {
+		return false, fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	q := tx.Rebind(`
+	INSERT INTO maintenance_ticket
+		(equipment_id, title, description, status_id, out_of_service, reported_by, assigned_to, created_at)
+	VALUES
+		(?, ?, ?, (SELECT id FROM maintenance_status WHERE name = 'open'), ?, ?,
+		(SELECT member_id FROM area_steward
+			WHERE area_id = (SELECT area_id FROM equipment WHERE id = ?)
+			ORDER BY area_steward.id LIMIT 1),
+		?)
+	RETURNING id`)
+	if err := tx.Get(&t.ID, q, t.EquipmentID, t.Title, t.Description, t.OutOfService, t.ReportedByID, t.EquipmentID, now); err != nil {
+		return false, fmt.Errorf("Could not create maintenance ticket: %v", err)
+	}
+
+	flagged := false
+	if t.OutOfService {
+		flagged, err = setEquipmentStatus(tx, t.EquipmentID, "available", "out_of_service")
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("Could not commit transaction: %v", err)
+	}
+	return flagged, nil
+}
+
+//Update changes the status of a ticket and who it is assigned to. When the last ticket keeping a piece of equipment
+//out of service is resolved, the equipment is made available again, and reopening such a ticket takes the equipment
+//out of service again. Returns the new status of the equipment, or "" if it did not change.
+func (mm *MaintenanceModel) Update(id int, status string, assignedTo *int, now time.Time) (string, error) {
+	tx, err := mm.DB.Beginx()
+	if err != nil {
+		return "", fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var ticket struct {
+		EquipmentID  int  `db:"equipment_id"`
+		OutOfService bool `db:"out_of_service"`
+		WasResolved  bool `db:"was_resolved"`
+	}
+	q := tx.Rebind(`
+	SELECT equipment_id, out_of_service, resolved_at IS NOT NULL AS was_resolved
+	FROM maintenance_ticket WHERE id = ? FOR UPDATE`)
+	if err := tx.Get(&ticket, q, id); err != nil {
+		return "", fmt.Errorf("Could not retrieve maintenance ticket: %v", err)
+	}
+
+	q = tx.Rebind(`
+	UPDATE maintenance_ticket
+	SET status_id = (SELECT id FROM maintenance_status WHERE name = ?), assigned_to = ?,
+		resolved_at = CASE WHEN ? = 'resolved' THEN COALESCE(resolved_at, ?) END
+	WHERE id = ?`)
+	if _, err := tx.Exec(q, status, assignedTo, status, now, id); err != nil {
+		return "", fmt.Errorf("Could not update maintenance ticket: %v", err)
+	}
+
+	changed := ""
+	switch {
+	case !ticket.OutOfService:
+	case status == "resolved" && !ticket.WasResolved:
+		var stillOut bool
+		q := tx.Rebind(`
+		SELECT EXISTS (SELECT 1 FROM maintenance_ticket
+			WHERE equipment_id = ? AND out_of_service AND resolved_at IS NULL)`)
+		if err := tx.Get(&stillOut, q, ticket.EquipmentID); err != nil {
+			return "", fmt.Errorf("Could not check maintenance tickets: %v", err)
+		}
+		if !stillOut {
+			ok, err := setEquipmentStatus(tx, ticket.EquipmentID, "out_of_service", "available")
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				changed = "available"
+			}
+		}
+	case status != "resolved" && ticket.WasResolved:
+		ok, err := setEquipmentStatus(tx, ticket.EquipmentID, "available", "out_of_service")
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			changed = "out_of_service"
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("Could not commit transaction: %v", err)
+	}
+	return changed, nil
+}
+
+// setEquipmentStatus changes the status of a piece of equipment, but only if it is in the expected status,
+// so that retired equipment is never brought back. Reports whether the status changed.
+func setEquipmentStatus(tx *sqlx.Tx, equipmentID int, from, to string) (bool, error) {
+	q := tx.Rebind(`
+	UPDATE equipment SET status_id = (SELECT id FROM equipment_status WHERE name = ?)
+	WHERE id = ? AND status_id = (SELECT id FROM equipment_status WHERE name = ?)`)
+	res, err := tx.Exec(q, to, equipmentID, from)
+	if err != nil {
+		return false, fmt.Errorf("Could not update equipment status: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Could not update equipment status: %v", err)
+	}
+	return n > 0, nil
+}
+
+//Comments returns the comments on a ticket, oldest first
+func (mm *MaintenanceModel) Comments(id int) ([]TicketComment, error) {
+	q := mm.DB.Rebind(`
+	SELECT maintenance_comment.id, member.name AS member, body, maintenance_comment.created_at
+	FROM maintenance_comment
+		LEFT JOIN member ON member.id = maintenance_comment.member_id
+	WHERE ticket_id = ?
+	ORDER BY maintenance_comment.created_at, maintenance_comment.id`)
+	comments := []TicketComment{}
+	if err := mm.DB.Select(&comments, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve ticket comments: %v", err)
+	}
+	return comments, nil
+}
+
+//Comment adds a comment to a ticket
+func (mm *MaintenanceModel) Comment(id, memberID int, body string, now time.Time) error {
+	q := mm.DB.Rebind(`INSERT INTO maintenance_comment (ticket_id, member_id, body, created_at) VALUES (?, ?, ?, ?)`)
+	if _, err := mm.DB.Exec(q, id, memberID, body, now); err != nil {
+		return fmt.Errorf("Could not save ticket comment: %v", err)
+	}
+	return nil
+}
+
+//AffectedEvents returns the upcoming events that use a piece of equipment, once for each person running them:
+//the member who created the event and its hosts
+func (mm *MaintenanceModel) AffectedEvents(equipmentID int, now time.Time) ([]AffectedEvent, error) {
+	q := mm.DB.Rebind(`
+	SELECT DISTINCT event.id AS event_id, event.name AS event, lower(event.during) AS starts,
+		member.name AS host_name, member.username AS email
+	FROM event
+		JOIN member ON member.id = event.created_by
+			OR member.id IN (SELECT member_id FROM event_host WHERE event_host.event_id = event.id)
+	WHERE upper(event.during) > ?
+	AND (event.id IN (SELECT event_id FROM event_equipment_rel WHERE equipment_id = ?)
+		OR event.id IN (SELECT event_id FROM equipment_reservation WHERE equipment_id = ?))
+	ORDER BY starts, event.id, email`)
+	events := []AffectedEvent{}
+	if err := mm.DB.Select(&events, q, now, equipmentID, equipmentID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve events using equipment: %v", err)
+	}
+	return events, nil
+}
+
+const scheduleColumns = `maintenance_schedule.id, equipment_id, equipment.name AS equipment, equipment.area_id, task,
+	interval_days, last_done_on, next_due_on`
+
+const scheduleFrom = ` FROM maintenance_schedule JOIN equipment ON equipment.id = maintenance_schedule.equipment_id`
+
+//Schedules returns the preventive maintenance for a piece of equipment, soonest due first
+func (mm *MaintenanceModel) Schedules(equipmentID int) ([]Schedule, error) {
+	q := mm.DB.Rebind(`SELECT ` + scheduleColumns + scheduleFrom + ` WHERE equipment_id = ? ORDER BY next_due_on, maintenance_schedule.id`)
+	schedules := []Schedule{}
+	if err := mm.DB.Select(&schedules, q, equipmentID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve maintenance schedules: %v", err)
+	}
+	return schedules, nil
+}
+
+//Schedule returns one preventive maintenance schedule
+func (mm *MaintenanceModel) Schedule(id int) (*Schedule, error) {
+	q := mm.DB.Rebind(`SELECT ` + scheduleColumns + scheduleFrom + ` WHERE maintenance_schedule.id = ?`)
+	s := &Schedule{}
+	if err := mm.DB.Get(s, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve maintenance schedule: %v", err)
+	}
+	return s, nil
+}
+
+//AddSchedule saves new preventive maintenance, first due on NextDueOn
+func (mm *MaintenanceModel) AddSchedule(s *Schedule) error {
+	q := mm.DB.Rebind(`
+	INSERT INTO maintenance_schedule
+		(equipment_id, task, interval_days, next_due_on)
+	VALUES
+		(?, ?, ?, ?)
+	RETURNING id`)
+	if err := mm.DB.Get(&s.ID, q, s.EquipmentID, s.Task, s.IntervalDays, s.NextDueOn); err != nil {
+		return fmt.Errorf("Could not create maintenance schedule: %v", err)
+	}
+	return nil
+}
+
+//Done records that preventive maintenance was done, and schedules it again IntervalDays later
+func (mm *MaintenanceModel) Done(id int, on time.Time) error {
+	q := mm.DB.Rebind(`
+	UPDATE maintenance_schedule
+	SET last_done_on = ?::date, next_due_on = ?::date + interval_days
+	WHERE id = ?`)
+	if _, err := mm.DB.Exec(q, on, on, id); err != nil {
+		return fmt.Errorf("Could not update maintenance schedule: %v", err)
+	}
+	return nil
+}
+
+//DeleteSchedule stops scheduling preventive maintenance
+func (mm *MaintenanceModel) DeleteSchedule(id int) error {
+	q := mm.DB.Rebind(`DELETE FROM maintenance_schedule WHERE id = ?`)
+	if _, err := mm.DB.Exec(q, id); err != nil {
+		return fmt.Errorf("Could not delete maintenance schedule: %v", err)
+	}
+	return nil
+}
+
+//DueForReminder returns the preventive maintenance that is due by the given date and has not been reminded
+//for its current due date, and marks it as reminded. Retired equipment is skipped.
+func (mm *MaintenanceModel) DueForReminder(by time.Time) ([]Schedule, error) {
+	q := mm.DB.Rebind(`
+	UPDATE maintenance_schedule
+	SET reminded_for = next_due_on
+	FROM equipment
+	WHERE equipment.id = maintenance_schedule.equipment_id
+	AND next_due_on <= ?::date
+	AND (reminded_for IS NULL OR reminded_for <> next_due_on)
+	AND equipment.status_id <> (SELECT id FROM equipment_status WHERE name = 'retired')
+	RETURNING ` + scheduleColumns)
+	schedules := []Schedule{}
+	if err := mm.DB.Select(&schedules, q, by); err != nil {
+		return nil, fmt.Errorf("Could not retrieve maintenance due: %v", err)
+	}
+	return schedules, nil
+}
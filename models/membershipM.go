@@ -0,0 +1,460 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MembershipModel stores the database handle for members pausing, resuming and changing their membership
+type MembershipModel struct {
+	DB *sqlx.DB
+}
+
+// ErrCannotPause is returned when a membership that is not active, or is already paused, is paused
+var ErrCannotPause = errors.New("Only active memberships can be paused")
+
+// ErrNotPaused is returned when a membership that is not paused is resumed
+var ErrNotPaused = errors.New("The membership is not paused")
+
+// ErrCannotChangePlan is returned when a member cannot switch to a membership option, because it is retired, it
+// is the one they have, or their membership is paused or has ended
+var ErrCannotChangePlan = errors.New("You cannot change to that membership option")
+
+// ErrDuesUnpaid is returned when a member with an unpaid dues invoice changes their membership option
+var ErrDuesUnpaid = errors.New("Please pay your outstanding dues invoice before changing your membership")
+
+// Membership is the state of a member's membership
+type Membership struct {
+	MemberID     int              `db:"member_id"`
+	Status       string           `db:"status"`
+	OptionID     *int             `db:"option_id"`
+	OptionName   *string          `db:"option_name"`
+	Price        Money            `db:"price"`
+	PeriodMonths int              `db:"period_months"`
+	Expires      *time.Time       `db:"membership_expires"`
+	Pause        *MembershipPause `db:"-"` // nil unless the membership is paused
+}
+
+// MembershipPause is a period when a membership is frozen
+type MembershipPause struct {
+	ID           int       `db:"id"`
+	MemberID     int       `db:"member_id"`
+	StartsOn     time.Time `db:"starts_on"`
+	EndsOn       time.Time `db:"ends_on"`
+	FeeInvoiceID *int      `db:"fee_invoice_id"`
+}
+
+// MembershipChange is an entry in the history of a membership
+type MembershipChange struct {
+	Kind          string     `db:"kind"` // pause, resume or plan_change
+	FromOption    *string    `db:"from_option"`
+	ToOption      *string    `db:"to_option"`
+	ExpiresBefore *time.Time `db:"expires_before"`
+	ExpiresAfter  *time.Time `db:"expires_after"`
+	Credit        Money      `db:"credit"`
+	InvoiceID     *int       `db:"invoice_id"`
+	ChangedBy     *string    `db:"changed_by"` // nil when the change was made automatically
+	CreatedAt     time.Time  `db:"created_at"`
+}
+
+// PlanChange is the result of switching to another membership option
+type PlanChange struct {
+	Credit  Money     // for the unused part of the old option and addons
+	Invoice *Invoice  // for the first period of the new option, with the credit taken off if it fits
+	Expires time.Time // when the first period ends; the membership runs until then once the invoice is paid
+}
+
+const membershipSelect = `SELECT member.id AS member_id, membership_status.name AS status, membership_options.id AS option_id,
+	membership_options.name AS option_name, membership_options.price,
+	COALESCE((EXTRACT(YEAR FROM membership_options.period) * 12 + EXTRACT(MONTH FROM membership_options.period))::integer, 0) AS period_months,
+	member.membership_expires
+	FROM member
+		JOIN membership_status ON membership_status.id = member.membership_status_id
+		LEFT JOIN membership_options ON membership_options.id = member.membership_option`
+
+// day is the date of a time, for comparing with DATE columns
+func day(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+//Get returns a member's membership, with the current pause if it is paused
+func (mm *MembershipModel) Get(memberID int) (*Membership, error) {
+	m := &Membership{}
+	if err := mm.DB.Get(m, mm.DB.Rebind(membershipSelect+` WHERE member.id = ?`), memberID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve membership: %v", err)
+	}
+	p := &MembershipPause{}
+	err := mm.DB.Get(p, mm.DB.Rebind(`
+		SELECT id, member_id, starts_on, ends_on, fee_invoice_id FROM membership_pause
+		WHERE member_id = ? AND resumed_at IS NULL`), memberID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("Could not retrieve membership pause: %v", err)
+	}
+	if err == nil {
+		m.Pause = p
+	}
+	return m, nil
+}
+
+//History returns the changes made to a member's membership, newest first
+func (mm *MembershipModel) History(memberID int) ([]MembershipChange, error) {
+	q := mm.DB.Rebind(`
+	SELECT membership_change_kind.name AS kind, from_option.name AS from_option, to_option.name AS to_option,
+		membership_change.expires_before, membership_change.expires_after, membership_change.credit,
+		membership_change.invoice_id, changer.name AS changed_by, membership_change.created_at
+	FROM membership_change
+		JOIN membership_change_kind ON membership_change_kind.id = membership_change.kind_id
+		LEFT JOIN membership_options from_option ON from_option.id = membership_change.from_option_id
+		LEFT JOIN membership_options to_option ON to_option.id = membership_change.to_option_id
+		LEFT JOIN member changer ON changer.id = membership_change.changed_by
+	WHERE membership_change.member_id = ?
+	ORDER BY membership_change.created_at DESC, membership_change.id DESC`)
+	changes := []MembershipChange{}
+	if err := mm.DB.Select(&changes, q, memberID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve membership history: %v", err)
+	}
+	return changes, nil
+}
+
+//Pause freezes an active membership until a date. Dues are not invoiced while it is paused, and the membership
+//expiry is pushed back by the length of the pause so that no paid time is lost. If there is a fee it is invoiced
+//straight away, and the invoice is returned.
+func (mm *MembershipModel) Pause(memberID int, until time.Time, fee Money, changedBy int, now time.Time) (*Invoice, error) {
+	tx, err := mm.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	m, err := lockMembership(tx, memberID)
+	if err != nil {
+		return nil, err
+	}
+	today := day(now)
+	until = day(until)
+	if m.Status != "active" || !until.After(today) {
+		return nil, ErrCannotPause
+	}
+
+	var pauseID int
+	err = tx.Get(&pauseID, tx.Rebind(`INSERT INTO membership_pause (member_id, starts_on, ends_on) VALUES (?, ?, ?) RETURNING id`),
+		memberID, today.Format("2006-01-02"), until.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not pause membership: %v", err)
+	}
+
+	var expires *time.Time
+	if m.Expires != nil {
+		e := m.Expires.AddDate(0, 0, int(until.Sub(today).Hours()/24))
+		expires = &e
+	}
+	if err := setMembership(tx, memberID, "paused", m.OptionID, expires); err != nil {
+		return nil, err
+	}
+
+	var inv *Invoice
+	if fee > 0 {
+		inv = &Invoice{
+			MemberID:    memberID,
+			Description: fmt.Sprintf("Membership pause until %s", until.Format("Jan 2, 2006")),
+			Lines: []InvoiceLine{{
+				Category:    "other",
+				Description: fmt.Sprintf("Membership pause fee, %s to %s", today.Format("Jan 2"), until.Format("Jan 2, 2006")),
+				Quantity:    1,
+				UnitAmount:  fee,
+			}},
+		}
+		if err := createInvoice(tx, inv); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(tx.Rebind(`UPDATE membership_pause SET fee_invoice_id = ? WHERE id = ?`), inv.ID, pauseID); err != nil {
+			return nil, fmt.Errorf("Could not pause membership: %v", err)
+		}
+	}
+
+	change := &membershipChangeRecord{kind: "pause", from: m.OptionID, to: m.OptionID, before: m.Expires, after: expires, changedBy: &changedBy}
+	if inv != nil {
+		change.invoiceID = &inv.ID
+	}
+	if err := recordMembershipChange(tx, memberID, change); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+//Resume ends a member's pause. A member who comes back before the pause was due to end has their membership
+//expiry brought forward by the days they did not use.
+func (mm *MembershipModel) Resume(memberID, changedBy int, now time.Time) error {
+	tx, err := mm.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := resumeMembership(tx, memberID, &changedBy, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//ResumeEnded resumes every membership whose pause has run its course and returns how many were resumed.
+//A failure to resume one membership does not stop the others.
+func (mm *MembershipModel) ResumeEnded(now time.Time) (int, error) {
+	members := []int{}
+	q := mm.DB.Rebind(`SELECT member_id FROM membership_pause WHERE resumed_at IS NULL AND ends_on <= ? ORDER BY ends_on, id`)
+	if err := mm.DB.Select(&members, q, day(now).Format("2006-01-02")); err != nil {
+		return 0, fmt.Errorf("Could not retrieve ended pauses: %v", err)
+	}
+
+	resumed := 0
+	var lastErr error
+	for _, memberID := range members {
+		err := func() error {
+			tx, err := mm.DB.Beginx()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			if err := resumeMembership(tx, memberID, nil, now); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}()
+		if err == ErrNotPaused {
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resumed++
+	}
+	return resumed, lastErr
+}
+
+//ChangePlan switches a member to another membership option. The unused part of the current period, and of their
+//addons, is credited, and a new period of the new option starts today. The first period is invoiced straight away,
+//with the member's addons for the same period and any credits that fit taken off, and like a renewal the membership
+//only runs to the end of it once the invoice is paid. Members with an unpaid dues invoice must pay it first.
+func (mm *MembershipModel) ChangePlan(memberID, optionID, changedBy int, now time.Time) (*PlanChange, error) {
+	tx, err := mm.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	m, err := lockMembership(tx, memberID)
+	if err != nil {
+		return nil, err
+	}
+	if m.Status != "active" && m.Status != "past_due" {
+		return nil, ErrCannotChangePlan
+	}
+	if m.OptionID != nil && *m.OptionID == optionID {
+		return nil, ErrCannotChangePlan
+	}
+	o := &MembershipOption{}
+	if err := tx.Get(o, tx.Rebind(`SELECT `+membershipOptionColumns+` FROM membership_options WHERE id = ?`), optionID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve membership option: %v", err)
+	}
+	if !o.Active || o.PeriodMonths <= 0 {
+		return nil, ErrCannotChangePlan
+	}
+
+	// the membership expiry only moves on when dues are paid, so as long as none are outstanding the credit
+	// below is only ever for time that was paid for
+	var unpaid bool
+	err = tx.Get(&unpaid, tx.Rebind(`
+		SELECT EXISTS (
+			SELECT 1 FROM membership_renewal JOIN invoice ON invoice.id = membership_renewal.invoice_id
+			WHERE membership_renewal.member_id = ? AND membership_renewal.settled_at IS NULL
+				AND invoice.status_id = (SELECT id FROM invoice_status WHERE name = 'unpaid'))`), memberID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve unpaid dues: %v", err)
+	}
+	if unpaid {
+		return nil, ErrDuesUnpaid
+	}
+
+	addons, err := currentAddons(tx, memberID)
+	if err != nil {
+		return nil, err
+	}
+
+	change := &PlanChange{}
+	if m.OptionID != nil && m.Expires != nil && m.PeriodMonths > 0 {
+		change.Credit = ProratePeriod(m.Price, m.PeriodMonths, *m.Expires, now)
+		for _, a := range addons {
+			change.Credit += Prorate(a.MonthlyCost, m.PeriodMonths, *m.Expires, now)
+		}
+	}
+	if change.Credit > 0 {
+		_, err := tx.Exec(tx.Rebind(`INSERT INTO member_credit (member_id, amount, description) VALUES (?, ?, ?)`),
+			memberID, change.Credit, fmt.Sprintf("Unused %s until %s", *m.OptionName, m.Expires.Format("Jan 2, 2006")))
+		if err != nil {
+			return nil, fmt.Errorf("Could not record credit: %v", err)
+		}
+	}
+
+	start := day(now)
+	change.Expires = start.AddDate(0, o.PeriodMonths, 0)
+	period := fmt.Sprintf("%s to %s", start.Format("Jan 2, 2006"), change.Expires.Format("Jan 2, 2006"))
+	inv := &Invoice{
+		MemberID:    memberID,
+		Description: fmt.Sprintf("Membership dues, %s", period),
+		DueDate:     start,
+		Lines: []InvoiceLine{{
+			Category:    "dues",
+			Description: fmt.Sprintf("%s membership, %s", o.Name, period),
+			Quantity:    1,
+			UnitAmount:  o.Price,
+			OptionID:    &o.ID,
+		}},
+	}
+	for _, a := range addons {
+		inv.Lines = append(inv.Lines, InvoiceLine{
+			Category:    "addon",
+			Description: fmt.Sprintf("%s, %s (per month)", a.Name, period),
+			Quantity:    o.PeriodMonths,
+			UnitAmount:  a.MonthlyCost,
+		})
+	}
+	if err := applyDiscounts(tx, inv, now); err != nil {
+		return nil, err
+	}
+	used, err := applyCredits(tx, inv)
+	if err != nil {
+		return nil, err
+	}
+	if err := createInvoice(tx, inv); err != nil {
+		return nil, err
+	}
+	if err := markCredits(tx, inv.ID, used); err != nil {
+		return nil, err
+	}
+	change.Invoice = inv
+
+	// the new period is recorded as a renewal, so that it is not invoiced again and paying for it extends the
+	// membership. A second change on the same day replaces the first one's period.
+	_, err = tx.Exec(tx.Rebind(`
+		INSERT INTO membership_renewal (member_id, period_start, period_end, invoice_id) VALUES (?, ?, ?, ?)
+		ON CONFLICT (member_id, period_start) DO UPDATE
+		SET period_end = EXCLUDED.period_end, invoice_id = EXCLUDED.invoice_id, settled_at = NULL`),
+		memberID, start.Format("2006-01-02"), change.Expires.Format("2006-01-02"), inv.ID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not record renewal: %v", err)
+	}
+	if err := setMembership(tx, memberID, m.Status, &o.ID, &start); err != nil {
+		return nil, err
+	}
+	expires := start
+	if inv.Paid() {
+		if err := settleRenewal(tx, inv.ID); err != nil {
+			return nil, err
+		}
+		expires = change.Expires
+	}
+	record := &membershipChangeRecord{
+		kind:      "plan_change",
+		from:      m.OptionID,
+		to:        &o.ID,
+		before:    m.Expires,
+		after:     &expires,
+		credit:    change.Credit,
+		invoiceID: &inv.ID,
+		changedBy: &changedBy,
+	}
+	if err := recordMembershipChange(tx, memberID, record); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// lockMembership returns a member's membership, locking the member so that changes to it are made one at a time
+func lockMembership(tx *sqlx.Tx, memberID int) (*Membership, error) {
+	m := &Membership{}
+	if err := tx.Get(m, tx.Rebind(membershipSelect+` WHERE member.id = ? FOR UPDATE OF member`), memberID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve membership: %v", err)
+	}
+	return m, nil
+}
+
+// setMembership saves a member's status, membership option and expiry
+func setMembership(tx *sqlx.Tx, memberID int, status string, optionID *int, expires *time.Time) error {
+	q := tx.Rebind(`
+		UPDATE member SET membership_status_id = (SELECT id FROM membership_status WHERE name = ?),
+			membership_option = ?, membership_expires = ?, updated_at = now()
+		WHERE id = ?`)
+	if _, err := tx.Exec(q, status, optionID, expires, memberID); err != nil {
+		return fmt.Errorf("Could not update membership: %v", err)
+	}
+	return nil
+}
+
+// resumeMembership ends a member's current pause as part of a larger transaction. changedBy is nil when the pause
+// has run its course.
+func resumeMembership(tx *sqlx.Tx, memberID int, changedBy *int, now time.Time) error {
+	m, err := lockMembership(tx, memberID)
+	if err != nil {
+		return err
+	}
+	p := &MembershipPause{}
+	err = tx.Get(p, tx.Rebind(`
+		SELECT id, member_id, starts_on, ends_on, fee_invoice_id FROM membership_pause
+		WHERE member_id = ? AND resumed_at IS NULL`), memberID)
+	if err == sql.ErrNoRows {
+		return ErrNotPaused
+	}
+	if err != nil {
+		return fmt.Errorf("Could not retrieve membership pause: %v", err)
+	}
+
+	if _, err := tx.Exec(tx.Rebind(`UPDATE membership_pause SET resumed_at = ? WHERE id = ?`), now, p.ID); err != nil {
+		return fmt.Errorf("Could not resume membership: %v", err)
+	}
+	expires := m.Expires
+	if unused := int(p.EndsOn.Sub(day(now)).Hours() / 24); unused > 0 && m.Expires != nil {
+		e := m.Expires.AddDate(0, 0, -unused)
+		expires = &e
+	}
+	if err := setMembership(tx, memberID, "active", m.OptionID, expires); err != nil {
+		return err
+	}
+	change := &membershipChangeRecord{kind: "resume", from: m.OptionID, to: m.OptionID, before: m.Expires, after: expires, changedBy: changedBy}
+	return recordMembershipChange(tx, memberID, change)
+}
+
+// membershipChangeRecord is an entry to add to the history of a membership
+type membershipChangeRecord struct {
+	kind          string
+	from, to      *int
+	before, after *time.Time
+	credit        Money
+	invoiceID     *int
+	changedBy     *int
+}
+
+// recordMembershipChange adds an entry to the history of a membership
+func recordMembershipChange(tx *sqlx.Tx, memberID int, c *membershipChangeRecord) error {
+	q := tx.Rebind(`
+	INSERT INTO membership_change
+		(member_id, kind_id, from_option_id, to_option_id, expires_before, expires_after, credit, invoice_id, changed_by)
+	VALUES
+		(?, (SELECT id FROM membership_change_kind WHERE name = ?), ?, ?, ?, ?, ?, ?, ?)`)
+	if _, err := tx.Exec(q, memberID, c.kind, c.from, c.to, c.before, c.after, c.credit, c.invoiceID, c.changedBy); err != nil {
+		return fmt.Errorf("Could not record membership change: %v", err)
+	}
+	return nil
+}
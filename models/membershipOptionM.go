@@ -0,0 +1,106 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MembershipOptionModel stores the database handle for the membership options offered at signup
+type MembershipOptionModel struct {
+	DB *sqlx.DB
+}
+
+// MembershipOption is a way of paying for membership. Options are retired rather than deleted,
+// because members who chose them keep them.
+type MembershipOption struct {
+	ID           int    `db:"id"`
+	Name         string `db:"name"`
+	Recurring    bool   `db:"is_recurring"`
+	PeriodMonths int    `db:"period_months"`
+	Price        Money  `db:"price"`
+	Active       bool   `db:"active"`
+}
+
+// Period describes how long the option lasts
+func (o *MembershipOption) Period() string {
+	switch {
+	case o.PeriodMonths == 1:
+		return "1 month"
+	case o.PeriodMonths%12 == 0:
+		if o.PeriodMonths == 12 {
+			return "1 year"
+		}
+		return fmt.Sprintf("%d years", o.PeriodMonths/12)
+	}
+	return fmt.Sprintf("%d months", o.PeriodMonths)
+}
+
+const membershipOptionColumns = `id, name, is_recurring,
+	(EXTRACT(YEAR FROM period) * 12 + EXTRACT(MONTH FROM period))::integer AS period_months,
+	price, active`
+
+//All returns every membership option, including retired ones, with the active ones first
+func (om *MembershipOptionModel) All() ([]MembershipOption, error) {
+	options := []MembershipOption{}
+	if err := om.DB.Select(&options, `SELECT `+membershipOptionColumns+` FROM membership_options ORDER BY active DESC, id`); err != nil {
+		return nil, fmt.Errorf("Could not retrieve membership options: %v", err)
+	}
+	return options, nil
+}
+
+//Active returns the membership options offered at signup
+func (om *MembershipOptionModel) Active() ([]MembershipOption, error) {
+	options := []MembershipOption{}
+	if err := om.DB.Select(&options, `SELECT `+membershipOptionColumns+` FROM membership_options WHERE active ORDER BY id`); err != nil {
+		return nil, fmt.Errorf("Could not retrieve membership options: %v", err)
+	}
+	return options, nil
+}
+
+//Get one membership option
+func (om *MembershipOptionModel) Get(id int) (*MembershipOption, error) {
+	q := om.DB.Rebind(`SELECT ` + membershipOptionColumns + ` FROM membership_options WHERE id = ?`)
+	o := &MembershipOption{}
+	if err := om.DB.Get(o, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve membership option: %v", err)
+	}
+	return o, nil
+}
+
+//Create saves a new membership option. New options are always offered.
+func (om *MembershipOptionModel) Create(o *MembershipOption) error {
+	q := om.DB.Rebind(`
+	INSERT INTO membership_options
+		(name, is_recurring, period, price, active)
+	VALUES
+		(?, ?, make_interval(months => ?), ?, ?)
+	RETURNING id`)
+	if err := om.DB.Get(&o.ID, q, o.Name, o.Recurring, o.PeriodMonths, o.Price, true); err != nil {
+		return fmt.Errorf("Could not create membership option: %v", err)
+	}
+	o.Active = true
+	return nil
+}
+
+//Update saves changes to a membership option, except whether it is active (see SetActive).
+//Members already on the option are charged the new price from their next renewal.
+func (om *MembershipOptionModel) Update(o *MembershipOption) error {
+	q := om.DB.Rebind(`
+	UPDATE membership_options
+	SET name = ?, is_recurring = ?, period = make_interval(months => ?), price = ?
+	WHERE id = ?`)
+	if _, err := om.DB.Exec(q, o.Name, o.Recurring, o.PeriodMonths, o.Price, o.ID); err != nil {
+		return fmt.Errorf("Could not update membership option: %v", err)
+	}
+	return nil
+}
+
+//SetActive retires an option, or offers it again
+func (om *MembershipOptionModel) SetActive(id int, active bool) error {
+	q := om.DB.Rebind(`UPDATE membership_options SET active = ? WHERE id = ?`)
+	if _, err := om.DB.Exec(q, active, id); err != nil {
+		return fmt.Errorf("Could not update membership option: %v", err)
+	}
+	return nil
+}
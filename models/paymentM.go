@@ -0,0 +1,305 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// PaymentModel stores the database handle for all payment related DB methods
+type PaymentModel struct {
+	DB *sqlx.DB
+}
+
+// ErrManualPayment is returned when a cash or check payment is not for a positive amount, or a check has no number
+var ErrManualPayment = errors.New("A cash or check payment needs an amount, and a check needs its number")
+
+// Payment is money received from a member
+type Payment struct {
+	ID           int        `db:"id"`
+	Amount       Money      `db:"amount"`
+	MemberID     int        `db:"member_id"`
+	Method       string     `db:"method"`
+	ProviderRef  *string    `db:"provider_ref"`
+	CheckNumber  *string    `db:"check_number"`
+	InvoiceID    *int       `db:"invoice_id"`
+	ReconciledAt *time.Time `db:"reconciled_at"` // when it was matched to a deposit on a bank statement
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+// OnlinePayment is a payment confirmed by the online payment provider, either through a webhook or a direct charge
+type OnlinePayment struct {
+	EventID    string // webhook event id, empty for a direct charge
+	EventType  string
+	SessionID  string
+	InvoiceID  int
+	ChargeRef  string
+	Amount     Money
+	CustomerID string
+	MethodID   string
+	Brand      string
+	Last4      string
+}
+
+// ManualPayment is a cash or check payment entered by the treasurer
+type ManualPayment struct {
+	InvoiceID   int
+	Method      string // cash or check
+	Amount      Money
+	CheckNumber string // for matching the deposit on a bank statement
+	ReceivedOn  time.Time
+	RecordedBy  int
+}
+
+// PaymentMethod is a reference to a card or account saved with the payment provider
+type PaymentMethod struct {
+	ID         int       `db:"id"`
+	MemberID   int       `db:"member_id"`
+	CustomerID string    `db:"provider_customer_id"`
+	MethodID   string    `db:"provider_method_id"`
+	Brand      string    `db:"brand"`
+	Last4      string    `db:"last4"`
+	IsDefault  bool      `db:"is_default"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+//Get one payment
+func (pm *PaymentModel) Get(id int) (*Payment, error) {
+	q := pm.DB.Rebind(`
+		SELECT payment.id, payment.amount, payment.member_id, payment_method.name AS method, payment.provider_ref,
+			payment.check_number, payment.invoice_id, payment.reconciled_at, payment.created_at
+		FROM payment JOIN payment_method ON payment_method.id = payment.payment_method_id
+		WHERE payment.id = ?`)
+	p := &Payment{}
+	if err := pm.DB.Get(p, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve payment: %v", err)
+	}
+	return p, nil
+}
+
+//StartCheckout records that a checkout session was created for an invoice
+func (pm *PaymentModel) StartCheckout(invoiceID int, sessionID string) error {
+	q := pm.DB.Rebind(`INSERT INTO payment_checkout (invoice_id, session_id) VALUES (?, ?)`)
+	if _, err := pm.DB.Exec(q, invoiceID, sessionID); err != nil {
+		return fmt.Errorf("Could not record checkout session: %v", err)
+	}
+	return nil
+}
+
+//RecordOnlinePayment saves a payment confirmed by the provider against its invoice, and marks the invoice paid once
+//its payments cover it. Anything paid beyond that is credited to the member, see payInvoice. It is safe to call any number of times for the same event or charge: the id of the new payment is returned,
+//or 0 when the payment had already been recorded and nothing was changed.
+func (pm *PaymentModel) RecordOnlinePayment(op *OnlinePayment) (int, error) {
+	tx, err := pm.DB.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if op.EventID != "" {
+		var eventID int
+		err := tx.Get(&eventID, tx.Rebind(`
+			INSERT INTO payment_webhook_event (event_id, event_type) VALUES (?, ?)
+			ON CONFLICT (event_id) DO NOTHING
+			RETURNING id`), op.EventID, op.EventType)
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Could not record webhook event: %v", err)
+		}
+	}
+
+	var memberID int
+	if err := tx.Get(&memberID, tx.Rebind(`SELECT member_id FROM invoice WHERE id = ? FOR UPDATE`), op.InvoiceID); err != nil {
+		return 0, fmt.Errorf("Could not find invoice %d: %v", op.InvoiceID, err)
+	}
+
+	var paymentID int
+	err = tx.Get(&paymentID, tx.Rebind(`
+		INSERT INTO payment (amount, member_id, payment_method_id, provider_ref, invoice_id)
+		VALUES (?, ?, (SELECT id FROM payment_method WHERE name = 'online'), ?, ?)
+		ON CONFLICT (provider_ref) DO NOTHING
+		RETURNING id`), op.Amount, memberID, op.ChargeRef, op.InvoiceID)
+	if err == sql.ErrNoRows {
+		// the charge was already recorded, e.g. by a direct charge before its webhook arrived
+		return 0, tx.Commit()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Could not record payment: %v", err)
+	}
+
+	if err := payInvoice(tx, op.InvoiceID, paymentID, op.Amount); err != nil {
+		return 0, err
+	}
+
+	if op.SessionID != "" {
+		if _, err := tx.Exec(tx.Rebind(`UPDATE payment_checkout SET completed_at = now() WHERE session_id = ?`), op.SessionID); err != nil {
+			return 0, fmt.Errorf("Could not complete checkout session: %v", err)
+		}
+	}
+
+	if op.MethodID != "" && op.CustomerID != "" {
+		_, err := tx.Exec(tx.Rebind(`
+			INSERT INTO member_payment_method (member_id, provider_customer_id, provider_method_id, brand, last4, is_default)
+			VALUES (?, ?, ?, ?, ?, NOT EXISTS (SELECT 1 FROM member_payment_method WHERE member_id = ?))
+			ON CONFLICT (provider_method_id) DO NOTHING`),
+			memberID, op.CustomerID, op.MethodID, op.Brand, op.Last4, memberID)
+		if err != nil {
+			return 0, fmt.Errorf("Could not save payment method: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return paymentID, nil
+}
+
+//RecordManualPayment saves a cash or check payment against its invoice, and marks the invoice paid once its payments
+//cover it, in the same way as an online payment. Returns the id of the new payment.
+func (pm *PaymentModel) RecordManualPayment(mp *ManualPayment) (int, error) {
+	if (mp.Method != "cash" && mp.Method != "check") || mp.Amount <= 0 || (mp.Method == "check" && mp.CheckNumber == "") {
+		return 0, ErrManualPayment
+	}
+	var checkNumber *string
+	if mp.Method == "check" {
+		checkNumber = &mp.CheckNumber
+	}
+
+	tx, err := pm.DB.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var memberID int
+	if err := tx.Get(&memberID, tx.Rebind(`SELECT member_id FROM invoice WHERE id = ? FOR UPDATE`), mp.InvoiceID); err != nil {
+		return 0, fmt.Errorf("Could not find invoice %d: %v", mp.InvoiceID, err)
+	}
+
+	var paymentID int
+	err = tx.Get(&paymentID, tx.Rebind(`
+		INSERT INTO payment (amount, member_id, payment_method_id, check_number, invoice_id, recorded_by, created_at)
+		VALUES (?, ?, (SELECT id FROM payment_method WHERE name = ?), ?, ?, ?, ?)
+		RETURNING id`), mp.Amount, memberID, mp.Method, checkNumber, mp.InvoiceID, mp.RecordedBy, mp.ReceivedOn)
+	if err != nil {
+		return 0, fmt.Errorf("Could not record payment: %v", err)
+	}
+	if err := payInvoice(tx, mp.InvoiceID, paymentID, mp.Amount); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return paymentID, nil
+}
+
+// payInvoice applies a payment that has just been recorded to its invoice, as part of the same transaction. The
+// invoice is marked paid once its payments cover it, which also extends a membership it renews or settles the event
+// registration it is for. Whatever is paid beyond that, such as all of a second payment on an invoice that was
+// already paid, is credited to the member so that it comes off their next dues invoice and shows on it.
+func payInvoice(tx *sqlx.Tx, invoiceID, paymentID int, amount Money) error {
+	var inv struct {
+		MemberID int    `db:"member_id"`
+		Amount   Money  `db:"amount"`
+		Status   string `db:"status"`
+		Received Money  `db:"received"` // by the invoice's earlier payments
+	}
+	err := tx.Get(&inv, tx.Rebind(`
+		SELECT invoice.member_id, invoice.amount, COALESCE(invoice_status.name, 'unpaid') AS status,
+			COALESCE((SELECT SUM(payment.amount) FROM payment WHERE payment.invoice_id = invoice.id AND payment.id <> ?), '0'::money) AS received
+		FROM invoice LEFT JOIN invoice_status ON invoice_status.id = invoice.status_id
+		WHERE invoice.id = ?`), paymentID, invoiceID)
+	if err != nil {
+		return fmt.Errorf("Could not find invoice %d: %v", invoiceID, err)
+	}
+
+	over := amount
+	if inv.Status == "unpaid" {
+		balance := inv.Amount - inv.Received
+		if amount < balance {
+			return nil
+		}
+		over = amount - balance
+		_, err := tx.Exec(tx.Rebind(`
+			UPDATE invoice SET payment_id = ?, status_id = (SELECT id FROM invoice_status WHERE name = 'paid') WHERE id = ?`),
+			paymentID, invoiceID)
+		if err != nil {
+			return fmt.Errorf("Could not mark invoice paid: %v", err)
+		}
+		if err := settleRenewal(tx, invoiceID); err != nil {
+			return err
+		}
+		if err := settleRegistration(tx, invoiceID); err != nil {
+			return err
+		}
+	}
+
+	if over > 0 {
+		_, err := tx.Exec(tx.Rebind(`INSERT INTO member_credit (member_id, amount, description) VALUES (?, ?, ?)`),
+			inv.MemberID, over, fmt.Sprintf("Overpayment of invoice #%d by payment #%d", invoiceID, paymentID))
+		if err != nil {
+			return fmt.Errorf("Could not record overpayment: %v", err)
+		}
+	}
+	return nil
+}
+
+//SavedMethods lists the payment methods a member has on file
+func (pm *PaymentModel) SavedMethods(memberID int) ([]PaymentMethod, error) {
+	q := pm.DB.Rebind(`SELECT * FROM member_payment_method WHERE member_id = ? ORDER BY is_default DESC, created_at`)
+	methods := []PaymentMethod{}
+	if err := pm.DB.Select(&methods, q, memberID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve payment methods: %v", err)
+	}
+	return methods, nil
+}
+
+//DefaultMethod returns the payment method used for recurring dues, or nil if the member has none
+func (pm *PaymentModel) DefaultMethod(memberID int) (*PaymentMethod, error) {
+	q := pm.DB.Rebind(`SELECT * FROM member_payment_method WHERE member_id = ? AND is_default`)
+	m := &PaymentMethod{}
+	err := pm.DB.Get(m, q, memberID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve default payment method: %v", err)
+	}
+	return m, nil
+}
+
+//SetDefaultMethod makes one of the member's saved methods the one charged for recurring dues
+func (pm *PaymentModel) SetDefaultMethod(memberID, id int) error {
+	q := pm.DB.Rebind(`UPDATE member_payment_method SET is_default = (id = ?) WHERE member_id = ?`)
+	if _, err := pm.DB.Exec(q, id, memberID); err != nil {
+		return fmt.Errorf("Could not update default payment method: %v", err)
+	}
+	return nil
+}
+
+//DeleteMethod removes a saved payment method. If it was the default, the oldest remaining method becomes the default.
+func (pm *PaymentModel) DeleteMethod(memberID, id int) error {
+	tx, err := pm.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(tx.Rebind(`DELETE FROM member_payment_method WHERE id = ? AND member_id = ?`), id, memberID); err != nil {
+		return fmt.Errorf("Could not delete payment method: %v", err)
+	}
+	_, err = tx.Exec(tx.Rebind(`
+		UPDATE member_payment_method SET is_default = 't'
+		WHERE id = (SELECT id FROM member_payment_method WHERE member_id = ? ORDER BY created_at LIMIT 1)
+		AND NOT EXISTS (SELECT 1 FROM member_payment_method WHERE member_id = ? AND is_default)`), memberID, memberID)
+	if err != nil {
+		return fmt.Errorf("Could not update default payment method: %v", err)
+	}
+	return tx.Commit()
+}
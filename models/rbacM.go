@@ -0,0 +1,39 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// RBACModel stores the database handle for looking up roles and permissions
+type RBACModel struct {
+	DB *sqlx.DB
+}
+
+//HasPermission reports whether a member's role grants a permission, either directly or through one of the role's groups
+func (rm *RBACModel) HasPermission(memberID int, permission string) (bool, error) {
+	if memberID == 0 {
+		return false, nil
+	}
+	q := rm.DB.Rebind(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM member
+				JOIN rbac_role_permission_rel rp ON rp.rbac_role_id = member.rbac_role_id
+				JOIN rbac_permission ON rbac_permission.id = rp.rbac_permission_id
+			WHERE member.id = ? AND rbac_permission.name = ?
+		UNION ALL
+			SELECT 1
+			FROM member
+				JOIN rbac_role_group_rel rg ON rg.rbac_role_id = member.rbac_role_id
+				JOIN rbac_group_permission_rel gp ON gp.rbac_group_id = rg.rbac_group_id
+				JOIN rbac_permission ON rbac_permission.id = gp.rbac_permission_id
+			WHERE member.id = ? AND rbac_permission.name = ?
+		)`)
+	var ok bool
+	if err := rm.DB.Get(&ok, q, memberID, permission, memberID, permission); err != nil {
+		return false, fmt.Errorf("Could not check permission: %v", err)
+	}
+	return ok, nil
+}
@@ -0,0 +1,389 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Errors returned when a refund request cannot be made or decided
+var (
+	ErrDuplicateRefund  = errors.New("A refund has already been requested for this registration")
+	ErrRefundNotPending = errors.New("The refund request is no longer pending")
+)
+
+// RefundModel stores the database handle for refund policies, requests and refunds
+type RefundModel struct {
+	DB *sqlx.DB
+}
+
+// RefundPolicy holds the rules used to calculate how much of an event fee is returned
+type RefundPolicy struct {
+	ID             int    `db:"id"`
+	Name           string `db:"name"`
+	Description    string `db:"description"`
+	FullRefundDays *int   `db:"full_refund_days"`
+	PartialPercent int    `db:"partial_refund_percent"`
+}
+
+// RefundFor calculates the refund due on an amount paid for an event starting at start, if requested at now.
+// The whole amount is refunded until FullRefundDays before the start (never, if it is nil),
+// PartialPercent of it until the start, and nothing after.
+func (p *RefundPolicy) RefundFor(paid Money, start, now time.Time) Money {
+	if !now.Before(start) {
+		return 0
+	}
+	if p.FullRefundDays != nil && !now.After(start.AddDate(0, 0, -*p.FullRefundDays)) {
+		return paid
+	}
+	return Money(int64(paid) * int64(p.PartialPercent) / 100)
+}
+
+// RefundableRegistration is an event registration with everything needed to work out its refund
+type RefundableRegistration struct {
+	ID            int       `db:"id"`
+	MemberID      int       `db:"member_id"`
+	MemberName    string    `db:"member_name"`
+	EventID       int       `db:"event_id"`
+	EventName     string    `db:"event_name"`
+	EventStart    time.Time `db:"event_start"`
+	PaymentID     *int      `db:"payment_id"`
+	PaymentAmount Money     `db:"payment_amount"`
+	EventAmount   Money     `db:"event_amount"` // the part of the payment that was for this event
+	Refunded      Money     `db:"refunded"`     // already refunded from the payment
+	PaymentMethod string    `db:"payment_method"`
+	ProviderRef   *string   `db:"provider_ref"`
+	Policy        RefundPolicy
+}
+
+// Refund calculates the refund due if requested at now. The policy is applied to what was paid for the event, not
+// the whole payment, and the refund never takes more than is left of the payment after earlier refunds.
+func (r *RefundableRegistration) Refund(now time.Time) Money {
+	due := r.Policy.RefundFor(r.EventAmount, r.EventStart, now)
+	if left := r.PaymentAmount - r.Refunded; due > left {
+		due = left
+	}
+	if due < 0 {
+		return 0
+	}
+	return due
+}
+
+// RefundRequest is a member's request for a refund and the admin's decision on it
+type RefundRequest struct {
+	ID             int        `db:"id"`
+	RegistrationID int        `db:"member_event_registration_id"`
+	PaymentID      int        `db:"payment_id"`
+	Amount         Money      `db:"amount"`
+	Reason         string     `db:"reason"`
+	Status         string     `db:"status"`
+	RequestedBy    int        `db:"requested_by"`
+	DecidedBy      *int       `db:"decided_by"`
+	DecisionNote   string     `db:"decision_note"`
+	CreatedAt      time.Time  `db:"created_at"`
+	DecidedAt      *time.Time `db:"decided_at"`
+	MemberID       int        `db:"member_id"`
+	MemberName     string     `db:"member_name"`
+	EventName      string     `db:"event_name"`
+	PaymentMethod  string     `db:"payment_method"`
+	PaymentAmount  Money      `db:"payment_amount"`
+	ProviderRef    *string    `db:"provider_ref"`
+}
+
+// Refund is money returned to a member
+type Refund struct {
+	ID          int       `db:"id"`
+	PaymentID   int       `db:"payment_id"`
+	RequestID   *int      `db:"refund_request_id"`
+	Amount      Money     `db:"amount"`
+	Method      string    `db:"method"`
+	ProviderRef *string   `db:"provider_ref"`
+	Note        string    `db:"note"`
+	CreatedBy   int       `db:"created_by"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+//Policies lists all refund policies
+func (rm *RefundModel) Policies() ([]RefundPolicy, error) {
+	policies := []RefundPolicy{}
+	if err := rm.DB.Select(&policies, `SELECT * FROM refund_policy ORDER BY name`); err != nil {
+		return nil, fmt.Errorf("Could not retrieve refund policies: %v", err)
+	}
+	return policies, nil
+}
+
+//GetPolicy returns one refund policy
+func (rm *RefundModel) GetPolicy(id int) (*RefundPolicy, error) {
+	p := &RefundPolicy{}
+	if err := rm.DB.Get(p, rm.DB.Rebind(`SELECT * FROM refund_policy WHERE id = ?`), id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve refund policy: %v", err)
+	}
+	return p, nil
+}
+
+//CreatePolicy saves a new refund policy
+func (rm *RefundModel) CreatePolicy(p *RefundPolicy) error {
+	q := rm.DB.Rebind(`
+	INSERT INTO refund_policy
+		(name, description, full_refund_days, partial_refund_percent)
+	VALUES
+		(?, ?, ?, ?)
+	RETURNING id`)
+	if err := rm.DB.Get(&p.ID, q, p.Name, p.Description, p.FullRefundDays, p.PartialPercent); err != nil {
+		return fmt.Errorf("Could not save refund policy: %v", err)
+	}
+	return nil
+}
+
+//UpdatePolicy saves changes to a refund policy. Requests already made keep the amount calculated at the time.
+func (rm *RefundModel) UpdatePolicy(p *RefundPolicy) error {
+	q := rm.DB.Rebind(`
+	UPDATE refund_policy SET
+		name = ?, description = ?, full_refund_days = ?, partial_refund_percent = ?
+	WHERE id = ?`)
+	if _, err := rm.DB.Exec(q, p.Name, p.Description, p.FullRefundDays, p.PartialPercent, p.ID); err != nil {
+		return fmt.Errorf("Could not save refund policy: %v", err)
+	}
+	return nil
+}
+
+//Registration looks up an event registration along with its payment and the refund policy of the event
+func (rm *RefundModel) Registration(id int) (*RefundableRegistration, error) {
+	q := rm.DB.Rebind(`
+		SELECT
+			reg.id,
+			reg.member_id,
+			member.name AS member_name,
+			event.id AS event_id,
+			event.name AS event_name,
+			lower(event.during) AS event_start,
+			reg.payment_id,
+			COALESCE(payment.amount, '0'::money) AS payment_amount,
+			LEAST(COALESCE(payment.amount, '0'::money), COALESCE(
+				(SELECT SUM(invoice_line_item.unit_amount * invoice_line_item.quantity)
+				FROM invoice_line_item JOIN invoice ON invoice.id = invoice_line_item.invoice_id
+				WHERE invoice_line_item.event_id = event.id
+					AND (invoice.id = payment.invoice_id OR invoice.payment_id = payment.id)),
+				payment.amount, '0'::money)) AS event_amount,
+			COALESCE((SELECT SUM(refund.amount) FROM refund WHERE refund.payment_id = payment.id), '0'::money) AS refunded,
+			COALESCE(payment_method.name, '') AS payment_method,
+			payment.provider_ref,
+			COALESCE(refund_policy.id, 0) AS "policy.id",
+			COALESCE(refund_policy.name, '') AS "policy.name",
+			COALESCE(refund_policy.description, '') AS "policy.description",
+			refund_policy.full_refund_days AS "policy.full_refund_days",
+			COALESCE(refund_policy.partial_refund_percent, 0) AS "policy.partial_refund_percent"
+		FROM member_event_registration reg
+			JOIN member ON member.id = reg.member_id
+			JOIN event ON event.id = reg.event_id
+			LEFT JOIN payment ON payment.id = reg.payment_id
+			LEFT JOIN payment_method ON payment_method.id = payment.payment_method_id
+			LEFT JOIN event_fees ON event_fees.event_id = event.id
+			LEFT JOIN refund_policy ON refund_policy.id = event_fees.refund_policy_id
+		WHERE reg.id = ?`)
+	r := &RefundableRegistration{}
+	if err := rm.DB.Get(r, q, id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve registration: %v", err)
+	}
+	return r, nil
+}
+
+//RequestRefund saves a pending refund request, unless the registration already has one that is pending or refunded
+func (rm *RefundModel) RequestRefund(rr *RefundRequest) error {
+	tx, err := rm.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock the registration so that two requests for it can't both pass the check below
+	if _, err := tx.Exec(tx.Rebind(`SELECT id FROM member_event_registration WHERE id = ? FOR UPDATE`), rr.RegistrationID); err != nil {
+		return fmt.Errorf("Could not lock registration: %v", err)
+	}
+
+	var exists bool
+	err = tx.Get(&exists, tx.Rebind(`
+		SELECT EXISTS (
+			SELECT 1 FROM refund_request JOIN refund_status ON refund_status.id = refund_request.status_id
+			WHERE member_event_registration_id = ? AND refund_status.name IN ('pending', 'processing', 'refunded')
+		)`), rr.RegistrationID)
+	if err != nil {
+		return fmt.Errorf("Could not check for existing refunds: %v", err)
+	}
+	if exists {
+		return ErrDuplicateRefund
+	}
+
+	err = tx.QueryRowx(tx.Rebind(`
+		INSERT INTO refund_request
+			(member_event_registration_id, payment_id, amount, reason, status_id, requested_by)
+		VALUES
+			(?, ?, ?, ?, (SELECT id FROM refund_status WHERE name = 'pending'), ?)
+		RETURNING id, created_at`),
+		rr.RegistrationID, rr.PaymentID, rr.Amount, rr.Reason, rr.RequestedBy).Scan(&rr.ID, &rr.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("Could not save refund request: %v", err)
+	}
+	rr.Status = "pending"
+
+	return tx.Commit()
+}
+
+const refundRequestQuery = `
+	SELECT
+		rr.id, rr.member_event_registration_id, rr.payment_id, rr.amount, rr.reason,
+		refund_status.name AS status,
+		rr.requested_by, rr.decided_by, rr.decision_note, rr.created_at, rr.decided_at,
+		member.id AS member_id,
+		member.name AS member_name,
+		event.name AS event_name,
+		payment_method.name AS payment_method,
+		payment.amount AS payment_amount,
+		payment.provider_ref
+	FROM refund_request rr
+		JOIN refund_status ON refund_status.id = rr.status_id
+		JOIN member_event_registration reg ON reg.id = rr.member_event_registration_id
+		JOIN member ON member.id = reg.member_id
+		JOIN event ON event.id = reg.event_id
+		JOIN payment ON payment.id = rr.payment_id
+		JOIN payment_method ON payment_method.id = payment.payment_method_id`
+
+//GetRequest returns one refund request
+func (rm *RefundModel) GetRequest(id int) (*RefundRequest, error) {
+	rr := &RefundRequest{}
+	if err := rm.DB.Get(rr, rm.DB.Rebind(refundRequestQuery+` WHERE rr.id = ?`), id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve refund request: %v", err)
+	}
+	return rr, nil
+}
+
+//Requests lists refund requests with a status, oldest first so the queue is worked in order
+func (rm *RefundModel) Requests(status string) ([]RefundRequest, error) {
+	requests := []RefundRequest{}
+	if err := rm.DB.Select(&requests, rm.DB.Rebind(refundRequestQuery+` WHERE refund_status.name = ? ORDER BY rr.created_at`), status); err != nil {
+		return nil, fmt.Errorf("Could not retrieve refund requests: %v", err)
+	}
+	return requests, nil
+}
+
+//Reject closes a pending request without refunding anything
+func (rm *RefundModel) Reject(id, deciderID int, note string) error {
+	q := rm.DB.Rebind(`
+		UPDATE refund_request SET
+			status_id = (SELECT id FROM refund_status WHERE name = 'rejected'),
+			decided_by = ?, decision_note = ?, decided_at = now()
+		WHERE id = ? AND status_id = (SELECT id FROM refund_status WHERE name = 'pending')`)
+	res, err := rm.DB.Exec(q, deciderID, note, id)
+	if err != nil {
+		return fmt.Errorf("Could not reject refund request: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrRefundNotPending
+	}
+	return nil
+}
+
+//Claim moves a pending request to processing before its money is returned, so that only one admin can approve it.
+//Returns ErrRefundNotPending if it was already claimed or decided.
+func (rm *RefundModel) Claim(id, deciderID int) error {
+	q := rm.DB.Rebind(`
+		UPDATE refund_request SET
+			status_id = (SELECT id FROM refund_status WHERE name = 'processing'),
+			decided_by = ?
+		WHERE id = ? AND status_id = (SELECT id FROM refund_status WHERE name = 'pending')`)
+	res, err := rm.DB.Exec(q, deciderID, id)
+	if err != nil {
+		return fmt.Errorf("Could not claim refund request: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrRefundNotPending
+	}
+	return nil
+}
+
+//Release puts a processing request back to pending, when its money could not be returned
+func (rm *RefundModel) Release(id int) error {
+	q := rm.DB.Rebind(`
+		UPDATE refund_request SET
+			status_id = (SELECT id FROM refund_status WHERE name = 'pending'),
+			decided_by = NULL
+		WHERE id = ? AND status_id = (SELECT id FROM refund_status WHERE name = 'processing')`)
+	if _, err := rm.DB.Exec(q, id); err != nil {
+		return fmt.Errorf("Could not release refund request: %v", err)
+	}
+	return nil
+}
+
+//Approve records the refund for a request claimed with Claim, closes the request and cancels the registration
+func (rm *RefundModel) Approve(id, deciderID int, note string, refund *Refund) error {
+	tx, err := rm.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var regID int
+	err = tx.Get(&regID, tx.Rebind(`
+		UPDATE refund_request SET
+			status_id = (SELECT id FROM refund_status WHERE name = 'refunded'),
+			decided_by = ?, decision_note = ?, decided_at = now()
+		WHERE id = ? AND status_id = (SELECT id FROM refund_status WHERE name = 'processing')
+		RETURNING member_event_registration_id`), deciderID, note, id)
+	if err == sql.ErrNoRows {
+		return ErrRefundNotPending
+	}
+	if err != nil {
+		return fmt.Errorf("Could not approve refund request: %v", err)
+	}
+
+	refund.RequestID = &id
+	refund.CreatedBy = deciderID
+	if err := insertRefund(tx, refund); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(tx.Rebind(`
+		UPDATE member_event_registration SET
+			payment_status = 'refunded',
+			checked_in_status_id = (SELECT id FROM checked_in_status WHERE status = 'Cancelled'),
+			updated_at = now()
+		WHERE id = ?`), regID)
+	if err != nil {
+		return fmt.Errorf("Could not cancel registration: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+//RefundsForPayment lists the refunds already made against a payment
+func (rm *RefundModel) RefundsForPayment(paymentID int) ([]Refund, error) {
+	q := rm.DB.Rebind(`
+		SELECT refund.id, refund.payment_id, refund.refund_request_id, refund.amount, payment_method.name AS method,
+			refund.provider_ref, refund.note, refund.created_by, refund.created_at
+		FROM refund JOIN payment_method ON payment_method.id = refund.payment_method_id
+		WHERE refund.payment_id = ?
+		ORDER BY refund.created_at`)
+	refunds := []Refund{}
+	if err := rm.DB.Select(&refunds, q, paymentID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve refunds: %v", err)
+	}
+	return refunds, nil
+}
+
+// insertRefund saves a refund record inside a transaction
+func insertRefund(tx *sqlx.Tx, r *Refund) error {
+	err := tx.QueryRowx(tx.Rebind(`
+		INSERT INTO refund
+			(payment_id, refund_request_id, amount, payment_method_id, provider_ref, note, created_by)
+		VALUES
+			(?, ?, ?, (SELECT id FROM payment_method WHERE name = ?), ?, ?, ?)
+		RETURNING id, created_at`),
+		r.PaymentID, r.RequestID, r.Amount, r.Method, r.ProviderRef, r.Note, r.CreatedBy).Scan(&r.ID, &r.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("Could not record refund: %v", err)
+	}
+	return nil
+}
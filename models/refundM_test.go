@@ -0,0 +1,69 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefundFor(t *testing.T) {
+	week := 7
+	start := time.Date(2026, time.March, 10, 18, 0, 0, 0, time.UTC)
+	cutoff := start.AddDate(0, 0, -week)
+	tests := []struct {
+		name   string
+		policy RefundPolicy
+		now    time.Time
+		want   Money
+	}{
+		{"well before", RefundPolicy{FullRefundDays: &week, PartialPercent: 50}, start.AddDate(0, -1, 0), 4000},
+		{"at the full refund cutoff", RefundPolicy{FullRefundDays: &week, PartialPercent: 50}, cutoff, 4000},
+		{"just after the cutoff", RefundPolicy{FullRefundDays: &week, PartialPercent: 50}, cutoff.Add(time.Second), 2000},
+		{"just before the start", RefundPolicy{FullRefundDays: &week, PartialPercent: 50}, start.Add(-time.Second), 2000},
+		{"at the start", RefundPolicy{FullRefundDays: &week, PartialPercent: 50}, start, 0},
+		{"after the start", RefundPolicy{FullRefundDays: &week, PartialPercent: 50}, start.Add(time.Hour), 0},
+		{"never a full refund", RefundPolicy{PartialPercent: 75}, start.AddDate(0, -1, 0), 3000},
+		{"no partial refund", RefundPolicy{FullRefundDays: &week}, cutoff.Add(time.Second), 0},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.RefundFor(4000, start, tt.now); got != tt.want {
+			t.Errorf("%s: RefundFor() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRefundForRoundsDown(t *testing.T) {
+	p := RefundPolicy{PartialPercent: 50}
+	start := time.Date(2026, time.March, 10, 18, 0, 0, 0, time.UTC)
+	if got := p.RefundFor(1999, start, start.AddDate(0, 0, -1)); got != 999 {
+		t.Errorf("RefundFor() = %d, want 999", got)
+	}
+}
+
+func TestRegistrationRefund(t *testing.T) {
+	week := 7
+	start := time.Date(2026, time.March, 10, 18, 0, 0, 0, time.UTC)
+	early := start.AddDate(0, -1, 0)
+	late := start.AddDate(0, 0, -1)
+	full := RefundPolicy{FullRefundDays: &week, PartialPercent: 50}
+	tests := []struct {
+		name     string
+		payment  Money
+		event    Money
+		refunded Money
+		now      time.Time
+		want     Money
+	}{
+		{"only the event's share of the payment", 10000, 4000, 0, early, 4000},
+		{"partial share of the event", 10000, 4000, 0, late, 2000},
+		{"less earlier refunds from the payment", 10000, 4000, 7000, early, 3000},
+		{"payment already refunded", 10000, 4000, 10000, early, 0},
+		{"payment over-refunded by hand", 10000, 4000, 12000, early, 0},
+		{"payment for the event alone", 4000, 4000, 0, early, 4000},
+	}
+	for _, tt := range tests {
+		r := &RefundableRegistration{EventStart: start, PaymentAmount: tt.payment, EventAmount: tt.event, Refunded: tt.refunded, Policy: full}
+		if got := r.Refund(tt.now); got != tt.want {
+			t.Errorf("%s: Refund() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
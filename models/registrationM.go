@@ -0,0 +1,194 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Errors returned when a member cannot register for an event
+var (
+	ErrNoRegistration       = errors.New("This event does not take registrations")
+	ErrEventStarted         = errors.New("The event has already started")
+	ErrAlreadyRegistered    = errors.New("You are already registered for this event")
+	ErrMissingPrerequisites = errors.New("You need the certifications this event requires before you can register")
+)
+
+// RegistrationModel stores the database handle for members registering for events
+type RegistrationModel struct {
+	DB *sqlx.DB
+}
+
+// RegistrationEvent is an event with the fees a member registering for it pays
+type RegistrationEvent struct {
+	ID                   int       `db:"id"`
+	Name                 string    `db:"name"`
+	Description          string    `db:"description"`
+	Starts               time.Time `db:"starts"`
+	Ends                 time.Time `db:"ends"`
+	LocationID           int       `db:"location_id"`
+	RequiresRegistration bool      `db:"requires_registration"`
+	RequiresFees         bool      `db:"requires_fees"`
+	MaterialFee          Money     `db:"class_material_fee"`
+	FacilitiesFee        Money     `db:"facilities_fee"`
+	AuthorizationFee     Money     `db:"authorization_fee"`
+	MemberPrice          bool      `db:"member_price"` // active members only pay the class and material fee
+	Registered           bool      `db:"registered"`   // the member already has a registration for it
+}
+
+// Lines are the invoice lines for the fees the member pays. Each one records the event, so that an event voucher
+// bought for it can be spent on them.
+func (e *RegistrationEvent) Lines() []InvoiceLine {
+	if !e.RequiresFees {
+		return nil
+	}
+	lines := []InvoiceLine{}
+	add := func(category, description string, amount Money) {
+		if amount > 0 {
+			lines = append(lines, InvoiceLine{
+				Category:    category,
+				Description: fmt.Sprintf("%s, %s", description, e.Name),
+				Quantity:    1,
+				UnitAmount:  amount,
+				EventID:     &e.ID,
+			})
+		}
+	}
+	add("material_fee", "Class and material fee", e.MaterialFee)
+	if !e.MemberPrice {
+		add("event_fee", "Facilities fee", e.FacilitiesFee)
+		add("event_fee", "Authorization fee", e.AuthorizationFee)
+	}
+	return lines
+}
+
+// Price is the total of the fees the member pays, before discounts and vouchers
+func (e *RegistrationEvent) Price() Money {
+	var total Money
+	for _, l := range e.Lines() {
+		total += l.Total()
+	}
+	return total
+}
+
+const registrationEventSelect = `
+	SELECT event.id, event.name, event.description, lower(event.during) AS starts, upper(event.during) AS ends,
+		event.location_id, event.requires_registration, event.requires_fees,
+		COALESCE(event_fees.class_material_fee, '0'::money) AS class_material_fee,
+		COALESCE(fee_structures.facilities_fee, '0'::money) AS facilities_fee,
+		COALESCE(fee_structures.authorization_fee, '0'::money) AS authorization_fee,
+		EXISTS (
+			SELECT 1 FROM member JOIN membership_status ON membership_status.id = member.membership_status_id
+			WHERE member.id = ? AND membership_status.name = 'active') AS member_price,
+		EXISTS (SELECT 1 FROM member_event_registration WHERE member_id = ? AND event_id = event.id) AS registered
+	FROM event
+		LEFT JOIN event_fees ON event_fees.event_id = event.id
+		LEFT JOIN fee_structures ON fee_structures.id = event_fees.fee_structure_id
+	WHERE event.id = ?`
+
+//Event returns an event with the fees a member would pay to register for it
+func (rm *RegistrationModel) Event(eventID, memberID int) (*RegistrationEvent, error) {
+	e := &RegistrationEvent{}
+	if err := rm.DB.Get(e, rm.DB.Rebind(registrationEventSelect), memberID, memberID, eventID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve event: %v", err)
+	}
+	return e, nil
+}
+
+//Register signs a member up for an event and invoices them for its fees. Discounts, gift vouchers and credits are
+//taken off the invoice as for dues, so an event voucher bought for the event pays for it. The invoice is nil if
+//the event is free.
+func (rm *RegistrationModel) Register(memberID, eventID int, now time.Time) (*Invoice, error) {
+	tx, err := rm.DB.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	e := &RegistrationEvent{}
+	if err := tx.Get(e, tx.Rebind(registrationEventSelect+` FOR UPDATE OF event`), memberID, memberID, eventID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve event: %v", err)
+	}
+	if !e.RequiresRegistration {
+		return nil, ErrNoRegistration
+	}
+	if !e.Starts.After(now) {
+		return nil, ErrEventStarted
+	}
+
+	var registrationID int
+	err = tx.Get(&registrationID, tx.Rebind(`
+		INSERT INTO member_event_registration (member_id, event_id, checked_in_status_id)
+		VALUES (?, ?, (SELECT id FROM checked_in_status WHERE status = 'Not Checked In'))
+		ON CONFLICT (member_id, event_id) DO NOTHING
+		RETURNING id`), memberID, eventID)
+	if err == sql.ErrNoRows {
+		return nil, ErrAlreadyRegistered
+	}
+	if err != nil {
+		if isCheckViolation(err) {
+			return nil, ErrMissingPrerequisites
+		}
+		return nil, fmt.Errorf("Could not register: %v", err)
+	}
+
+	lines := e.Lines()
+	if len(lines) == 0 {
+		_, err := tx.Exec(tx.Rebind(`UPDATE member_event_registration SET payment_status = 'paid' WHERE id = ?`), registrationID)
+		if err != nil {
+			return nil, fmt.Errorf("Could not record registration: %v", err)
+		}
+		return nil, tx.Commit()
+	}
+
+	inv := &Invoice{
+		MemberID:    memberID,
+		Description: fmt.Sprintf("Registration for %s, %s", e.Name, e.Starts.Format("Jan 2, 2006")),
+		DueDate:     now,
+		Lines:       lines,
+	}
+	// discounts come off before credits, so that credits are only used while they fit what is left to pay
+	if err := applyDiscounts(tx, inv, now); err != nil {
+		return nil, err
+	}
+	used, err := applyCredits(tx, inv)
+	if err != nil {
+		return nil, err
+	}
+	if err := createInvoice(tx, inv); err != nil {
+		return nil, err
+	}
+	if err := markCredits(tx, inv.ID, used); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(tx.Rebind(`UPDATE member_event_registration SET invoice_id = ? WHERE id = ?`), inv.ID, registrationID); err != nil {
+		return nil, fmt.Errorf("Could not record registration: %v", err)
+	}
+	if inv.Paid() {
+		if err := settleRegistration(tx, inv.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// settleRegistration marks the registration invoiced on an invoice as paid, as part of the transaction that marks
+// the invoice paid. Invoices that are not for a registration are ignored.
+func settleRegistration(tx *sqlx.Tx, invoiceID int) error {
+	_, err := tx.Exec(tx.Rebind(`
+		UPDATE member_event_registration SET payment_status = 'paid', payment_id = invoice.payment_id, updated_at = now()
+		FROM invoice
+		WHERE invoice.id = ? AND member_event_registration.invoice_id = invoice.id
+			AND member_event_registration.payment_status = 'unpaid'`), invoiceID)
+	if err != nil {
+		return fmt.Errorf("Could not record registration payment: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package models
+
+import "testing"
+
+func TestRegistrationLines(t *testing.T) {
+	e := &RegistrationEvent{ID: 4, Name: "Intro to welding", RequiresFees: true,
+		MaterialFee: 2500, FacilitiesFee: 500, AuthorizationFee: 0}
+
+	if got := e.Price(); got != 3000 {
+		t.Errorf("non-member Price() = %d; want 3000", got)
+	}
+	e.MemberPrice = true
+	if got := e.Price(); got != 2500 {
+		t.Errorf("member Price() = %d; want 2500", got)
+	}
+	e.RequiresFees = false
+	if got := e.Lines(); len(got) != 0 {
+		t.Errorf("Lines() of an event without fees = %v; want none", got)
+	}
+}
+
+func TestEventVoucherPaysForRegistration(t *testing.T) {
+	event, other := 4, 5
+	e := &RegistrationEvent{ID: event, Name: "Intro to welding", RequiresFees: true, MaterialFee: 2500, FacilitiesFee: 500}
+	lines := e.Lines()
+	if len(lines) != 2 {
+		t.Fatalf("Lines() = %v; want the material and facilities fees", lines)
+	}
+
+	for _, tt := range []struct {
+		voucher *Voucher
+		want    bool
+	}{
+		{&Voucher{Kind: "event", EventID: &event}, true},
+		{&Voucher{Kind: "event", EventID: &other}, false},
+		{&Voucher{Kind: "value"}, true},
+		{&Voucher{Kind: "membership"}, false},
+	} {
+		for _, l := range lines {
+			if got := tt.voucher.applies(l); got != tt.want {
+				t.Errorf("%s voucher applies to %q = %v; want %v", tt.voucher.Kind, l.Description, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ReminderModel stores the database handle for payment reminders
+type ReminderModel struct {
+	DB *sqlx.DB
+}
+
+// ReminderInvoice is an unpaid invoice with the contact details needed to remind the member about it
+type ReminderInvoice struct {
+	InvoiceID   int       `db:"invoice_id"`
+	Description string    `db:"description"`
+	Amount      Money     `db:"amount"` // left to pay
+	DueDate     time.Time `db:"due_date"`
+	MemberID    int       `db:"member_id"`
+	MemberName  string    `db:"member_name"`
+	Email       string    `db:"email"`
+	Phone       string    `db:"phone"`
+	TextOK      bool      `db:"text_ok"`
+}
+
+//Unpaid returns the invoices that are still unpaid and due on or before a date, oldest first.
+//Paid and cancelled invoices are never returned, which is what stops their reminders, and neither are invoices with
+//nothing to pay.
+func (rm *ReminderModel) Unpaid(dueBy time.Time) ([]ReminderInvoice, error) {
+	q := rm.DB.Rebind(`
+	SELECT invoice.id AS invoice_id, invoice.description, ` + invoiceBalance + ` AS amount, invoice.due_date,
+		member.id AS member_id, member.name AS member_name, member.username AS email, member.phone, member.text_ok
+	FROM invoice JOIN member ON member.id = invoice.member_id
+	WHERE invoice.status_id = (SELECT id FROM invoice_status WHERE name = 'unpaid')
+		AND ` + invoiceBalance + ` > '0'::money
+		AND invoice.due_date <= ?
+	ORDER BY invoice.due_date, invoice.id`)
+	invoices := []ReminderInvoice{}
+	if err := rm.DB.Select(&invoices, q, dueBy.Format("2006-01-02")); err != nil {
+		return nil, fmt.Errorf("Could not retrieve unpaid invoices: %v", err)
+	}
+	return invoices, nil
+}
+
+//Claim records that a reminder is being sent for an invoice. It returns false if that reminder was already sent,
+//so that two runs at the same time can never send the same reminder twice.
+func (rm *ReminderModel) Claim(invoiceID int, step, channel string) (bool, error) {
+	var id int
+	err := rm.DB.Get(&id, rm.DB.Rebind(`
+		INSERT INTO invoice_reminder (invoice_id, step, channel) VALUES (?, ?, ?)
+		ON CONFLICT (invoice_id, step, channel) DO NOTHING
+		RETURNING id`), invoiceID, step, channel)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Could not record reminder: %v", err)
+	}
+	return true, nil
+}
+
+//Release forgets a claimed reminder that could not be sent, so that it is tried again next time
+func (rm *ReminderModel) Release(invoiceID int, step, channel string) error {
+	q := rm.DB.Rebind(`DELETE FROM invoice_reminder WHERE invoice_id = ? AND step = ? AND channel = ?`)
+	if _, err := rm.DB.Exec(q, invoiceID, step, channel); err != nil {
+		return fmt.Errorf("Could not release reminder: %v", err)
+	}
+	return nil
+}
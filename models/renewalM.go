@@ -0,0 +1,234 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// RenewalModel stores the database handle for invoicing recurring dues
+type RenewalModel struct {
+	DB *sqlx.DB
+}
+
+// Renewal is a member whose recurring membership is due to be invoiced for another period
+type Renewal struct {
+	MemberID     int       `db:"member_id"`
+	OptionID     int       `db:"option_id"`
+	OptionName   string    `db:"option_name"`
+	Price        Money     `db:"price"`
+	PeriodMonths int       `db:"period_months"`
+	PeriodStart  time.Time `db:"membership_expires"` // the new period starts when the current one ends
+}
+
+// PeriodEnd is when the new period ends
+func (r *Renewal) PeriodEnd() time.Time {
+	return r.PeriodStart.AddDate(0, r.PeriodMonths, 0)
+}
+
+//Due returns the members on a recurring membership option whose current period ends on or before a date
+func (rm *RenewalModel) Due(before time.Time) ([]Renewal, error) {
+	q := rm.DB.Rebind(`
+	SELECT member.id AS member_id, membership_options.id AS option_id, membership_options.name AS option_name, membership_options.price,
+		(EXTRACT(YEAR FROM membership_options.period) * 12 + EXTRACT(MONTH FROM membership_options.period))::integer AS period_months,
+		member.membership_expires
+	FROM member
+		JOIN membership_options ON membership_options.id = member.membership_option
+		JOIN membership_status ON membership_status.id = member.membership_status_id
+	WHERE membership_options.is_recurring
+		AND membership_status.name IN ('active', 'past_due')
+		AND member.membership_expires <= ?
+	ORDER BY member.membership_expires, member.id`)
+	due := []Renewal{}
+	if err := rm.DB.Select(&due, q, before.Format("2006-01-02")); err != nil {
+		return nil, fmt.Errorf("Could not retrieve renewals: %v", err)
+	}
+	return due, nil
+}
+
+//Renew invoices a member for their next dues period, with their addons and recurring donation for the same period and
+//their discounts and any credits they are owed taken off. The invoice is due when the current period ends, and the
+//membership expiry moves to the end of the new period once it is paid. Returns nil if the period has already been invoiced.
+func (rm *RenewalModel) Renew(due *Renewal) (*Invoice, error) {
+	tx, err := rm.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var renewalID int
+	err = tx.Get(&renewalID, tx.Rebind(`
+		INSERT INTO membership_renewal (member_id, period_start, period_end) VALUES (?, ?, ?)
+		ON CONFLICT (member_id, period_start) DO NOTHING
+		RETURNING id`), due.MemberID, due.PeriodStart.Format("2006-01-02"), due.PeriodEnd().Format("2006-01-02"))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not record renewal: %v", err)
+	}
+
+	period := fmt.Sprintf("%s to %s", due.PeriodStart.Format("Jan 2, 2006"), due.PeriodEnd().Format("Jan 2, 2006"))
+	inv := &Invoice{
+		MemberID:    due.MemberID,
+		Description: fmt.Sprintf("Membership dues, %s", period),
+		DueDate:     due.PeriodStart,
+		Lines: []InvoiceLine{{
+			Category:    "dues",
+			Description: fmt.Sprintf("%s membership, %s", due.OptionName, period),
+			Quantity:    1,
+			UnitAmount:  due.Price,
+			OptionID:    &due.OptionID,
+		}},
+	}
+
+	addons, err := currentAddons(tx, due.MemberID)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addons {
+		inv.Lines = append(inv.Lines, InvoiceLine{
+			Category:    "addon",
+			Description: fmt.Sprintf("%s, %s (per month)", a.Name, period),
+			Quantity:    due.PeriodMonths,
+			UnitAmount:  a.MonthlyCost,
+		})
+	}
+
+	var donation Money
+	err = tx.Get(&donation, tx.Rebind(`SELECT amount FROM member_recurring_donation WHERE member_id = ?`), due.MemberID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("Could not retrieve recurring donation: %v", err)
+	}
+	if donation > 0 {
+		// donations are kept on their own line so that they can be acknowledged separately from dues
+		inv.Lines = append(inv.Lines, InvoiceLine{
+			Category:    "donation",
+			Description: fmt.Sprintf("Monthly donation, %s (per month)", period),
+			Quantity:    due.PeriodMonths,
+			UnitAmount:  donation,
+		})
+	}
+
+	// discounts come off before credits, so that credits are only used while they fit what is left to pay
+	if err := applyDiscounts(tx, inv, time.Now()); err != nil {
+		return nil, err
+	}
+
+	used, err := applyCredits(tx, inv)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := createInvoice(tx, inv); err != nil {
+		return nil, err
+	}
+	if err := markCredits(tx, inv.ID, used); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(tx.Rebind(`UPDATE membership_renewal SET invoice_id = ? WHERE id = ?`), inv.ID, renewalID); err != nil {
+		return nil, fmt.Errorf("Could not record renewal: %v", err)
+	}
+	if inv.Paid() {
+		if err := settleRenewal(tx, inv.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+//Lapse moves active members to past_due when their membership has expired and the invoice for the next period is
+//still unpaid, and returns how many were moved. Paying the invoice makes them active again.
+func (rm *RenewalModel) Lapse(today time.Time) (int, error) {
+	q := rm.DB.Rebind(`
+	UPDATE member SET membership_status_id = (SELECT id FROM membership_status WHERE name = 'past_due'), updated_at = now()
+	WHERE member.membership_status_id = (SELECT id FROM membership_status WHERE name = 'active')
+		AND member.membership_expires < ?
+		AND EXISTS (
+			SELECT 1 FROM membership_renewal JOIN invoice ON invoice.id = membership_renewal.invoice_id
+			WHERE membership_renewal.member_id = member.id
+				AND membership_renewal.settled_at IS NULL
+				AND invoice.status_id = (SELECT id FROM invoice_status WHERE name = 'unpaid'))`)
+	res, err := rm.DB.Exec(q, today.Format("2006-01-02"))
+	if err != nil {
+		return 0, fmt.Errorf("Could not mark lapsed memberships past due: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// settleRenewal extends the membership paid for by a renewal invoice, as part of the transaction that marks it paid.
+// The expiry moves on by the length of the period rather than to its end, so that a pause taken while the invoice
+// was unpaid still counts, and a member who had fallen past due is active again. Invoices that are not for a renewal,
+// or whose renewal has already been settled, are ignored.
+func settleRenewal(tx *sqlx.Tx, invoiceID int) error {
+	_, err := tx.Exec(tx.Rebind(`
+		UPDATE member SET membership_expires = member.membership_expires + (membership_renewal.period_end - membership_renewal.period_start),
+			membership_status_id = CASE
+				WHEN member.membership_status_id = (SELECT id FROM membership_status WHERE name = 'past_due')
+				THEN (SELECT id FROM membership_status WHERE name = 'active')
+				ELSE member.membership_status_id END,
+			updated_at = now()
+		FROM membership_renewal
+		WHERE membership_renewal.invoice_id = ? AND membership_renewal.settled_at IS NULL
+			AND member.id = membership_renewal.member_id`), invoiceID)
+	if err != nil {
+		return fmt.Errorf("Could not update membership expiry: %v", err)
+	}
+	if _, err := tx.Exec(tx.Rebind(`UPDATE membership_renewal SET settled_at = now() WHERE invoice_id = ? AND settled_at IS NULL`), invoiceID); err != nil {
+		return fmt.Errorf("Could not record renewal: %v", err)
+	}
+	return nil
+}
+
+// applyCredits adds a line to the invoice for each of the member's unused credits, oldest first, while they fit
+// what is left to pay. The rest wait for a later invoice. Returns the credits used, to be marked with markCredits
+// once the invoice has been saved.
+func applyCredits(tx *sqlx.Tx, inv *Invoice) ([]int, error) {
+	credits := []struct {
+		ID          int    `db:"id"`
+		Amount      Money  `db:"amount"`
+		Description string `db:"description"`
+	}{}
+	err := tx.Select(&credits, tx.Rebind(`
+		SELECT id, amount, description FROM member_credit
+		WHERE member_id = ? AND invoice_id IS NULL
+		ORDER BY created_at, id
+		FOR UPDATE`), inv.MemberID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve member credits: %v", err)
+	}
+	var total Money
+	for _, l := range inv.Lines {
+		total += l.Total()
+	}
+	used := []int{}
+	for _, c := range credits {
+		if c.Amount > total {
+			continue
+		}
+		total -= c.Amount
+		used = append(used, c.ID)
+		inv.Lines = append(inv.Lines, InvoiceLine{Category: "other", Description: "Credit: " + c.Description, Quantity: 1, UnitAmount: -c.Amount})
+	}
+	return used, nil
+}
+
+// markCredits records the invoice that used the credits
+func markCredits(tx *sqlx.Tx, invoiceID int, ids []int) error {
+	for _, id := range ids {
+		if _, err := tx.Exec(tx.Rebind(`UPDATE member_credit SET invoice_id = ? WHERE id = ?`), invoiceID, id); err != nil {
+			return fmt.Errorf("Could not apply member credit: %v", err)
+		}
+	}
+	return nil
+}
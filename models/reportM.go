@@ -0,0 +1,238 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ReportModel stores the database handle for the treasurer's financial reports.
+// Date ranges are inclusive of both days, like the member ledger.
+type ReportModel struct {
+	DB *sqlx.DB
+}
+
+// RevenueRow is the amount invoiced for one category. Dues are broken out by the member's membership option.
+type RevenueRow struct {
+	Category string `db:"category"`
+	Lines    int    `db:"lines"`
+	Amount   Money  `db:"amount"`
+}
+
+// AgingInvoice is an unpaid invoice and how many days old it is
+type AgingInvoice struct {
+	ID          int       `db:"id"`
+	MemberID    int       `db:"member_id"`
+	MemberName  string    `db:"member_name"`
+	Description string    `db:"description"`
+	Amount      Money     `db:"amount"` // left to pay
+	CreatedAt   time.Time `db:"created_at"`
+	Days        int       `db:"days"`
+}
+
+// AgingBuckets are the usual receivables aging periods, in days
+var AgingBuckets = []struct {
+	Name     string
+	From, To int
+}{
+	{"0-30 days", 0, 30},
+	{"31-60 days", 31, 60},
+	{"61-90 days", 61, 90},
+	{"Over 90 days", 91, 1 << 30},
+}
+
+// Bucket returns the index in AgingBuckets that the invoice falls in
+func (a *AgingInvoice) Bucket() int {
+	for i, b := range AgingBuckets {
+		if a.Days <= b.To {
+			return i
+		}
+	}
+	return len(AgingBuckets) - 1
+}
+
+// MethodTotal is the money received and refunded through one payment method
+type MethodTotal struct {
+	Method   string `db:"method"`
+	Payments int    `db:"payments"`
+	Received Money  `db:"received"`
+	Refunds  int    `db:"refunds"`
+	Refunded Money  `db:"refunded"`
+}
+
+// Net is what was kept after refunds
+func (m MethodTotal) Net() Money {
+	return m.Received - m.Refunded
+}
+
+// MemberCount is the number of members in good standing during a month
+type MemberCount struct {
+	Month       time.Time `db:"month"`
+	Active      int       `db:"active"`
+	New         int       `db:"new"`
+	WithAddons  int       `db:"with_addons"`
+	AddonsTotal int       `db:"addons"`
+}
+
+// DiscountTotal is how often a discount was given and used during a period, and how much it took off invoices
+type DiscountTotal struct {
+	Name    string  `db:"name"`
+	Code    *string `db:"code"`
+	Granted int     `db:"granted"`
+	Uses    int     `db:"uses"`
+	Amount  Money   `db:"amount"`
+}
+
+// DiscountGrant is a discount given to a member
+type DiscountGrant struct {
+	CreatedAt  time.Time `db:"created_at"`
+	MemberName string    `db:"member_name"`
+	Discount   string    `db:"discount"`
+	GrantedBy  *string   `db:"granted_by"` // nil if the member redeemed a code
+	Note       string    `db:"note"`
+}
+
+//Revenue totals invoiced amounts by category for invoices issued between two dates. Cancelled invoices are left out.
+//Dues are split by the membership option each line was for, not the one the member has now. Invoices without line
+//items are counted as "other".
+func (rm *ReportModel) Revenue(from, to time.Time) ([]RevenueRow, error) {
+	end := to.AddDate(0, 0, 1)
+	q := rm.DB.Rebind(`
+	SELECT category, COUNT(*) AS lines, SUM(amount) AS amount FROM (
+			SELECT CASE WHEN line_item_category.name = 'dues'
+					THEN 'dues: ' || COALESCE(membership_options.name, 'no option')
+					ELSE line_item_category.name END AS category,
+				invoice_line_item.unit_amount * invoice_line_item.quantity AS amount
+			FROM invoice_line_item
+				JOIN invoice ON invoice.id = invoice_line_item.invoice_id
+				JOIN line_item_category ON line_item_category.id = invoice_line_item.category_id
+				LEFT JOIN membership_options ON membership_options.id = invoice_line_item.membership_option_id
+			WHERE invoice.created_at >= ? AND invoice.created_at < ? AND ` + ledgerInvoiceFilter + `
+		UNION ALL
+			SELECT 'other', invoice.amount
+			FROM invoice
+			WHERE invoice.created_at >= ? AND invoice.created_at < ? AND ` + ledgerInvoiceFilter + `
+				AND NOT EXISTS (SELECT 1 FROM invoice_line_item WHERE invoice_line_item.invoice_id = invoice.id)
+		) revenue_line
+	GROUP BY category
+	ORDER BY category`)
+	rows := []RevenueRow{}
+	if err := rm.DB.Select(&rows, q, from, end, from, end); err != nil {
+		return nil, fmt.Errorf("Could not calculate revenue: %v", err)
+	}
+	return rows, nil
+}
+
+//Aging lists the invoices that were unpaid on a date, oldest first, with their age in days on that date
+func (rm *ReportModel) Aging(asOf time.Time) ([]AgingInvoice, error) {
+	end := asOf.AddDate(0, 0, 1)
+	q := rm.DB.Rebind(`
+	SELECT invoice.id, invoice.member_id, member.name AS member_name, invoice.description, ` + invoiceBalance + ` AS amount, invoice.created_at,
+		(?::date - invoice.created_at::date) AS days
+	FROM invoice JOIN member ON member.id = invoice.member_id
+	WHERE invoice.created_at < ?
+		AND invoice.status_id = (SELECT id FROM invoice_status WHERE name = 'unpaid')
+		AND ` + invoiceBalance + ` > '0'::money
+	ORDER BY invoice.created_at, invoice.id`)
+	invoices := []AgingInvoice{}
+	if err := rm.DB.Select(&invoices, q, asOf, end); err != nil {
+		return nil, fmt.Errorf("Could not retrieve unpaid invoices: %v", err)
+	}
+	return invoices, nil
+}
+
+//PaymentsByMethod totals payments received and refunds paid out between two dates for each payment method
+func (rm *ReportModel) PaymentsByMethod(from, to time.Time) ([]MethodTotal, error) {
+	end := to.AddDate(0, 0, 1)
+	q := rm.DB.Rebind(`
+	SELECT payment_method.name AS method,
+		(SELECT COUNT(*) FROM payment WHERE payment.payment_method_id = payment_method.id AND payment.created_at >= ? AND payment.created_at < ?) AS payments,
+		(SELECT SUM(amount) FROM payment WHERE payment.payment_method_id = payment_method.id AND payment.created_at >= ? AND payment.created_at < ?) AS received,
+		(SELECT COUNT(*) FROM refund WHERE refund.payment_method_id = payment_method.id AND refund.created_at >= ? AND refund.created_at < ?) AS refunds,
+		(SELECT SUM(amount) FROM refund WHERE refund.payment_method_id = payment_method.id AND refund.created_at >= ? AND refund.created_at < ?) AS refunded
+	FROM payment_method
+	ORDER BY payment_method.name`)
+	totals := []MethodTotal{}
+	if err := rm.DB.Select(&totals, q, from, end, from, end, from, end, from, end); err != nil {
+		return nil, fmt.Errorf("Could not total payments: %v", err)
+	}
+	return totals, nil
+}
+
+//ActiveMembers counts, for each month between two dates, the members in good standing during the month,
+//how many of them joined that month, and how many addons they held.
+//Membership history is not stored, so a member counts as active from the day they joined until their membership
+//expires, unless they are a guest or have quit.
+func (rm *ReportModel) ActiveMembers(from, to time.Time) ([]MemberCount, error) {
+	q := rm.DB.Rebind(`
+	WITH months AS (
+		SELECT generate_series(date_trunc('month', ?::timestamp), date_trunc('month', ?::timestamp), '1 month') AS month
+	), active AS (
+		SELECT months.month, member.id, member.created_at,
+			(SELECT COUNT(*) FROM member_addon_rel
+				WHERE member_addon_rel.member_id = member.id AND member_addon_rel.created_at < months.month + INTERVAL '1 month'
+					AND (member_addon_rel.ended_at IS NULL OR member_addon_rel.ended_at >= months.month)) AS addons
+		FROM months JOIN member
+			ON member.created_at < months.month + INTERVAL '1 month'
+			AND (member.membership_expires IS NULL OR member.membership_expires >= months.month)
+			AND member.membership_status_id NOT IN (SELECT id FROM membership_status WHERE name IN ('guest', 'quit'))
+	)
+	SELECT months.month,
+		COUNT(active.id) AS active,
+		COUNT(active.id) FILTER (WHERE active.created_at >= months.month) AS new,
+		COUNT(active.id) FILTER (WHERE active.addons > 0) AS with_addons,
+		COALESCE(SUM(active.addons), 0) AS addons
+	FROM months LEFT JOIN active ON active.month = months.month
+	GROUP BY months.month
+	ORDER BY months.month`)
+	counts := []MemberCount{}
+	if err := rm.DB.Select(&counts, q, from, to); err != nil {
+		return nil, fmt.Errorf("Could not count members: %v", err)
+	}
+	return counts, nil
+}
+
+// discountUses selects the uses of a discount on invoices issued in a period
+const discountUses = `
+			FROM discount_use
+				JOIN member_discount ON member_discount.id = discount_use.member_discount_id
+				JOIN invoice ON invoice.id = discount_use.invoice_id
+			WHERE member_discount.discount_id = discount.id
+				AND invoice.created_at >= ? AND invoice.created_at < ? AND ` + ledgerInvoiceFilter
+
+//Discounts totals, for every discount, the members given it between two dates and the amounts it took off invoices
+//issued between them. Cancelled invoices are left out.
+func (rm *ReportModel) Discounts(from, to time.Time) ([]DiscountTotal, error) {
+	end := to.AddDate(0, 0, 1)
+	q := rm.DB.Rebind(`
+	SELECT discount.name, discount.code,
+		(SELECT COUNT(*) FROM member_discount
+			WHERE member_discount.discount_id = discount.id AND member_discount.created_at >= ? AND member_discount.created_at < ?) AS granted,
+		(SELECT COUNT(*)` + discountUses + `) AS uses,
+		(SELECT SUM(discount_use.amount)` + discountUses + `) AS amount
+	FROM discount
+	ORDER BY discount.name`)
+	totals := []DiscountTotal{}
+	if err := rm.DB.Select(&totals, q, from, end, from, end, from, end); err != nil {
+		return nil, fmt.Errorf("Could not total discounts: %v", err)
+	}
+	return totals, nil
+}
+
+//DiscountGrants lists the discounts given to members between two dates, oldest first
+func (rm *ReportModel) DiscountGrants(from, to time.Time) ([]DiscountGrant, error) {
+	q := rm.DB.Rebind(`
+	SELECT member_discount.created_at, member.name AS member_name, discount.name AS discount, admin.name AS granted_by, member_discount.note
+	FROM member_discount
+		JOIN member ON member.id = member_discount.member_id
+		JOIN discount ON discount.id = member_discount.discount_id
+		LEFT JOIN member admin ON admin.id = member_discount.granted_by
+	WHERE member_discount.created_at >= ? AND member_discount.created_at < ?
+	ORDER BY member_discount.created_at, member_discount.id`)
+	grants := []DiscountGrant{}
+	if err := rm.DB.Select(&grants, q, from, to.AddDate(0, 0, 1)); err != nil {
+		return nil, fmt.Errorf("Could not retrieve discount grants: %v", err)
+	}
+	return grants, nil
+}
@@ -0,0 +1,401 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// ResourceKinds are the kinds of resource members can reserve
+var ResourceKinds = []string{"area", "equipment"}
+
+// Errors returned when a member's reservation breaks the rules for the resource
+var (
+	ErrNotCertified     = errors.New("You do not hold all the certifications needed to reserve it")
+	ErrNotReservable    = errors.New("It is out of service and cannot be reserved")
+	ErrReservationPast  = errors.New("Reservations have to start in the future")
+	ErrTooFarAhead      = errors.New("That is further ahead than it can be reserved")
+	ErrTooLong          = errors.New("That is longer than it can be reserved for at once")
+	ErrQuotaReached     = errors.New("You already hold as many upcoming reservations for it as you are allowed")
+	ErrNoSuchResource   = errors.New("There is no such area or equipment")
+	ErrNotMemberBooking = errors.New("Only reservations members made for themselves can be cancelled here")
+)
+
+// ReservationModel stores the database handle for reservations of areas and equipment
+type ReservationModel struct {
+	DB *sqlx.DB
+}
+
+// ReservationLimits are the rules for members reserving an area or piece of equipment for themselves.
+// Each is nil if there is no limit.
+type ReservationLimits struct {
+	MaxMinutes  *int `db:"max_reservation_minutes"` // longest a single reservation can be
+	AdvanceDays *int `db:"advance_days"`            // how many days ahead it can be reserved
+	MemberQuota *int `db:"member_quota"`            // how many upcoming reservations one member can hold at once
+}
+
+// Resource is an area or a piece of equipment that members can reserve
+type Resource struct {
+	Kind       string `db:"kind"` // "area" or "equipment"
+	ID         int    `db:"id"`
+	Name       string `db:"name"`
+	AreaID     int    `db:"area_id"`
+	Area       string `db:"area"`
+	LocationID int    `db:"location_id"`
+	Status     string `db:"status"` // areas are always "available"
+	ReservationLimits
+}
+
+// Reservation books an area or a piece of equipment, for an event or for a member
+type Reservation struct {
+	ID         int       `db:"id"`
+	Kind       string    `db:"kind"` // "area" or "equipment"
+	ResourceID int       `db:"resource_id"`
+	Resource   string    `db:"resource"` // the name of the area or equipment
+	MemberID   *int      `db:"member_id"`
+	Member     *string   `db:"member"`
+	EventID    *int      `db:"event_id"`
+	Event      *string   `db:"event"`
+	Starts     time.Time `db:"starts"`
+	Ends       time.Time `db:"ends"`
+}
+
+// Minutes is how long the reservation is for
+func (r *Reservation) Minutes() int {
+	return int(r.Ends.Sub(r.Starts).Minutes())
+}
+
+// Slot is a period of time a resource is free
+type Slot struct {
+	Starts time.Time
+	Ends   time.Time
+}
+
+// Availability is when a resource is booked and when it is free over a period
+type Availability struct {
+	From   time.Time
+	To     time.Time
+	Booked []Reservation // soonest first, including bookings that started before From or end after To
+	Free   []Slot        // the time between the bookings, within From and To
+}
+
+// ConflictError is returned by Reserve when the time asked for overlaps bookings that have already been made
+type ConflictError struct {
+	Conflicts   []Reservation // the bookings in the way
+	Suggestions []Slot        // free times of the same length, nearest to the time asked for first
+}
+
+func (e *ConflictError) Error() string {
+	return "It is already reserved for some of that time"
+}
+
+// maxSuggestions is how many free times are suggested when a reservation conflicts with another
+const maxSuggestions = 3
+
+// resourceQueries selects a resource of each kind by id
+var resourceQueries = map[string]string{
+	"area": `
+	SELECT 'area' AS kind, area.id, area.name, area.id AS area_id, area.name AS area, area.location_id,
+		'available' AS status, max_reservation_minutes, advance_days, member_quota
+	FROM area
+	WHERE area.id = ?`,
+	"equipment": `
+	SELECT 'equipment' AS kind, equipment.id, equipment.name, area.id AS area_id, area.name AS area, area.location_id,
+		equipment_status.name AS status, equipment.max_reservation_minutes, equipment.advance_days, equipment.member_quota
+	FROM equipment
+		JOIN area ON area.id = equipment.area_id
+		JOIN equipment_status ON equipment_status.id = equipment.status_id
+	WHERE equipment.id = ?`,
+}
+
+// reservationSelects lists the reservations of each kind, with the same columns so they can be combined
+var reservationSelects = map[string]string{
+	"area": `
+	SELECT area_reservation.id, 'area' AS kind, area_id AS resource_id, area.name AS resource,
+		member_id, member.name AS member, event_id, event.name AS event, lower(area_reservation.during) AS starts,
+		upper(area_reservation.during) AS ends
+	FROM area_reservation
+		JOIN area ON area.id = area_reservation.area_id
+		LEFT JOIN member ON member.id = area_reservation.member_id
+		LEFT JOIN event ON event.id = area_reservation.event_id`,
+	"equipment": `
+	SELECT equipment_reservation.id, 'equipment' AS kind, equipment_id AS resource_id, equipment.name AS resource,
+		member_id, member.name AS member, event_id, event.name AS event, lower(equipment_reservation.during) AS starts,
+		upper(equipment_reservation.during) AS ends
+	FROM equipment_reservation
+		JOIN equipment ON equipment.id = equipment_reservation.equipment_id
+		LEFT JOIN member ON member.id = equipment_reservation.member_id
+		LEFT JOIN event ON event.id = equipment_reservation.event_id`,
+}
+
+//Resource returns an area or piece of equipment with its reservation limits. Returns ErrNoSuchResource for an unknown kind.
+func (rm *ReservationModel) Resource(kind string, id int) (*Resource, error) {
+	q, ok := resourceQueries[kind]
+	if !ok {
+		return nil, ErrNoSuchResource
+	}
+	res := &Resource{}
+	if err := rm.DB.Get(res, rm.DB.Rebind(q), id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve %s: %v", kind, err)
+	}
+	return res, nil
+}
+
+//Missing returns the names of the certifications needed to reserve a resource that the member does not hold
+func (rm *ReservationModel) Missing(kind string, id, memberID int) ([]string, error) {
+	return (&ApprovalModel{DB: rm.DB}).Missing(memberID, kind, id)
+}
+
+//Reserve books a resource for the member on the reservation, after checking the member holds the certifications it
+//needs, that the booking is within its limits, and that its location is open then unless override is set.
+//The reservation's ID is set on success.
+func (rm *ReservationModel) Reserve(r *Reservation, override bool, now time.Time) error {
+	q, ok := resourceQueries[r.Kind]
+	if !ok || r.MemberID == nil {
+		return ErrNoSuchResource
+	}
+	if !r.Starts.After(now) {
+		return ErrReservationPast
+	}
+
+	certified, err := (&ApprovalModel{DB: rm.DB}).IsCertified(*r.MemberID, r.Kind, r.ResourceID)
+	if err != nil {
+		return err
+	}
+	if !certified {
+		return ErrNotCertified
+	}
+
+	tx, err := rm.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// locking the resource makes members reserving it at the same time take turns, so the quota holds
+	res := &Resource{}
+	if err := tx.Get(res, tx.Rebind(q+` FOR UPDATE OF `+r.Kind), r.ResourceID); err != nil {
+		return fmt.Errorf("Could not retrieve %s: %v", r.Kind, err)
+	}
+	if res.Status != "available" {
+		return ErrNotReservable
+	}
+	if res.MaxMinutes != nil && r.Minutes() > *res.MaxMinutes {
+		return ErrTooLong
+	}
+	if res.AdvanceDays != nil && r.Starts.After(now.AddDate(0, 0, *res.AdvanceDays)) {
+		return ErrTooFarAhead
+	}
+	if res.MemberQuota != nil {
+		var held int
+		cq := tx.Rebind(`SELECT COUNT(*) FROM ` + r.Kind + `_reservation WHERE ` + r.Kind + `_id = ? AND member_id = ? AND upper(during) > ?`)
+		if err := tx.Get(&held, cq, r.ResourceID, *r.MemberID, now); err != nil {
+			return fmt.Errorf("Could not count reservations: %v", err)
+		}
+		if held >= *res.MemberQuota {
+			return ErrQuotaReached
+		}
+	}
+	if !override {
+		reason, err := closedReason(tx, res.LocationID, r.Starts, r.Ends)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			return &ClosedError{Reason: reason}
+		}
+	}
+
+	iq := tx.Rebind(`
+	INSERT INTO ` + r.Kind + `_reservation
+		(` + r.Kind + `_id, during, member_id, created_at)
+	VALUES
+		(?, tsrange(?, ?), ?, ?)
+	RETURNING id`)
+	if err := tx.Get(&r.ID, iq, r.ResourceID, r.Starts, r.Ends, *r.MemberID, now); err != nil {
+		if isCheckViolation(err) {
+			return ErrNotReservable
+		}
+		if isExclusionViolation(err) {
+			tx.Rollback()
+			return rm.conflict(r, res, override, now)
+		}
+		return fmt.Errorf("Could not save reservation: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+// conflict builds the error for a reservation that overlaps other bookings, suggesting free times of the same
+// length within a day either side that the member would be allowed to book
+func (rm *ReservationModel) conflict(r *Reservation, res *Resource, override bool, now time.Time) error {
+	length := r.Ends.Sub(r.Starts)
+	from, to := r.Starts.AddDate(0, 0, -1), r.Ends.AddDate(0, 0, 1)
+	if from.Before(now) {
+		from = now
+	}
+	if res.AdvanceDays != nil {
+		if last := now.AddDate(0, 0, *res.AdvanceDays).Add(length); to.After(last) {
+			to = last
+		}
+	}
+	if !to.After(from) {
+		to = from
+	}
+
+	a, err := rm.Availability(r.Kind, r.ResourceID, from, to)
+	if err != nil {
+		return err
+	}
+	conflicts := []Reservation{}
+	for _, b := range a.Booked {
+		if b.Starts.Before(r.Ends) && b.Ends.After(r.Starts) {
+			conflicts = append(conflicts, b)
+		}
+	}
+
+	suggestions := []Slot{}
+	for _, s := range suggest(a.Free, r.Starts, length) {
+		if len(suggestions) == maxSuggestions {
+			break
+		}
+		if !override {
+			reason, err := closedReason(rm.DB, res.LocationID, s.Starts, s.Ends)
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				continue
+			}
+		}
+		suggestions = append(suggestions, s)
+	}
+	return &ConflictError{Conflicts: conflicts, Suggestions: suggestions}
+}
+
+// suggest finds the free times of the given length that start nearest to the time asked for. Times are rounded
+// to the quarter hour, and times that run past midnight are left out because members book part of one day.
+func suggest(free []Slot, want time.Time, length time.Duration) []Slot {
+	suggestions := []Slot{}
+	for _, f := range free {
+		starts := want
+		if starts.Before(f.Starts) {
+			starts = f.Starts
+		}
+		if latest := f.Ends.Add(-length); starts.After(latest) {
+			starts = latest
+		}
+		if rounded := starts.Truncate(15 * time.Minute); rounded.Before(starts) {
+			starts = rounded.Add(15 * time.Minute)
+		}
+		ends := starts.Add(length)
+		if starts.Before(f.Starts) || ends.After(f.Ends) {
+			continue
+		}
+		if y, m, d := starts.Date(); ends.After(time.Date(y, m, d+1, 0, 0, 0, 0, starts.Location())) {
+			continue
+		}
+		suggestions = append(suggestions, Slot{Starts: starts, Ends: ends})
+	}
+
+	distance := func(s Slot) time.Duration {
+		if d := s.Starts.Sub(want); d > 0 {
+			return d
+		}
+		return want.Sub(s.Starts)
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool { return distance(suggestions[i]) < distance(suggestions[j]) })
+	return suggestions
+}
+
+//Availability returns the bookings of an area or piece of equipment that overlap a period, for events and members
+//alike, and the free time between them
+func (rm *ReservationModel) Availability(kind string, id int, from, to time.Time) (*Availability, error) {
+	s, ok := reservationSelects[kind]
+	if !ok {
+		return nil, ErrNoSuchResource
+	}
+	q := rm.DB.Rebind(s + `
+	WHERE ` + kind + `_reservation.` + kind + `_id = ? AND ` + kind + `_reservation.during && tsrange(?, ?)
+	ORDER BY starts`)
+	a := &Availability{From: from, To: to, Booked: []Reservation{}, Free: []Slot{}}
+	if err := rm.DB.Select(&a.Booked, q, id, from, to); err != nil {
+		return nil, fmt.Errorf("Could not retrieve availability: %v", err)
+	}
+
+	free := from
+	for _, b := range a.Booked {
+		if b.Starts.After(free) {
+			a.Free = append(a.Free, Slot{Starts: free, Ends: b.Starts})
+		}
+		if b.Ends.After(free) {
+			free = b.Ends
+		}
+	}
+	if to.After(free) {
+		a.Free = append(a.Free, Slot{Starts: free, Ends: to})
+	}
+	return a, nil
+}
+
+//ForMember returns a member's reservations that have not ended yet, soonest first
+func (rm *ReservationModel) ForMember(memberID int, now time.Time) ([]Reservation, error) {
+	q := rm.DB.Rebind(`SELECT * FROM (` + reservationSelects["area"] + `
+	UNION ALL` + reservationSelects["equipment"] + `) AS reservation
+	WHERE member_id = ? AND ends > ?
+	ORDER BY starts, kind, id`)
+	reservations := []Reservation{}
+	if err := rm.DB.Select(&reservations, q, memberID, now); err != nil {
+		return nil, fmt.Errorf("Could not retrieve reservations: %v", err)
+	}
+	return reservations, nil
+}
+
+//Get returns one reservation of an area or piece of equipment
+func (rm *ReservationModel) Get(kind string, id int) (*Reservation, error) {
+	s, ok := reservationSelects[kind]
+	if !ok {
+		return nil, ErrNoSuchResource
+	}
+	r := &Reservation{}
+	if err := rm.DB.Get(r, rm.DB.Rebind(s+` WHERE `+kind+`_reservation.id = ?`), id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve reservation: %v", err)
+	}
+	return r, nil
+}
+
+//Cancel removes a reservation a member made for themselves. Returns ErrNotMemberBooking for event reservations,
+//which are managed with the event.
+func (rm *ReservationModel) Cancel(kind string, id int) error {
+	if _, ok := reservationSelects[kind]; !ok {
+		return ErrNoSuchResource
+	}
+	q := rm.DB.Rebind(`DELETE FROM ` + kind + `_reservation WHERE id = ? AND member_id IS NOT NULL`)
+	result, err := rm.DB.Exec(q, id)
+	if err != nil {
+		return fmt.Errorf("Could not cancel reservation: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotMemberBooking
+	}
+	return nil
+}
+
+// isExclusionViolation reports whether a statement failed an EXCLUDE constraint, such as overlapping reservations
+func isExclusionViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23P01"
+}
+
+// isCheckViolation reports whether a statement failed a CHECK constraint, or a trigger that raised a check violation
+func isCheckViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23514"
+}
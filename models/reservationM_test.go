@@ -0,0 +1,36 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSuggest(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2026, time.May, 4, h, m, 0, 0, time.UTC) }
+	slot := func(sh, sm, eh, em int) Slot { return Slot{Starts: at(sh, sm), Ends: at(eh, em)} }
+	tests := []struct {
+		name   string
+		free   []Slot
+		want   time.Time
+		length time.Duration
+		expect []Slot
+	}{
+		{"time asked for is free", []Slot{slot(9, 0, 12, 0)}, at(10, 0), time.Hour, []Slot{slot(10, 0, 11, 0)}},
+		{"moved later to fit", []Slot{slot(10, 30, 12, 0)}, at(10, 0), time.Hour, []Slot{slot(10, 30, 11, 30)}},
+		{"moved earlier to fit", []Slot{slot(8, 0, 10, 30)}, at(10, 0), time.Hour, []Slot{slot(9, 30, 10, 30)}},
+		{"rounded up to the quarter hour", []Slot{slot(10, 10, 12, 0)}, at(10, 0), time.Hour, []Slot{slot(10, 15, 11, 15)}},
+		{"too short once rounded", []Slot{slot(8, 0, 9, 20)}, at(10, 0), time.Hour, []Slot{}},
+		{"too short", []Slot{slot(10, 0, 10, 45)}, at(10, 0), time.Hour, []Slot{}},
+		{"nearest first", []Slot{slot(6, 0, 7, 0), slot(11, 30, 13, 0)}, at(10, 0), time.Hour,
+			[]Slot{slot(11, 30, 12, 30), slot(6, 0, 7, 0)}},
+		{"past midnight", []Slot{{Starts: at(23, 0), Ends: at(23, 0).Add(3 * time.Hour)}}, at(23, 45), time.Hour, []Slot{}},
+		{"nothing free", nil, at(10, 0), time.Hour, []Slot{}},
+	}
+	for _, tt := range tests {
+		got := suggest(tt.free, tt.want, tt.length)
+		if !reflect.DeepEqual(got, tt.expect) {
+			t.Errorf("%s: suggest() = %v, want %v", tt.name, got, tt.expect)
+		}
+	}
+}
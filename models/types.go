@@ -0,0 +1,108 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money holds an amount of US currency as a whole number of cents.
+// Postgres returns MONEY columns as formatted text (e.g. "$1,234.56"), so Money implements
+// Scanner and Valuer to convert to and from the database.
+type Money int64
+
+// ParseMoney converts a string such as "12", "12.5", "$1,234.56" or "-$3.00" into Money
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	neg := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		neg = true
+		s = strings.TrimSuffix(strings.TrimPrefix(s, "("), ")")
+	}
+	if strings.HasPrefix(s, "-") {
+		neg = true
+		s = strings.TrimPrefix(s, "-")
+	}
+	s = strings.TrimPrefix(s, "$")
+	s = strings.Replace(s, ",", "", -1)
+	if s == "" {
+		return 0, fmt.Errorf("Could not recognize amount")
+	}
+
+	parts := strings.SplitN(s, ".", 2)
+	dollars, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Could not recognize amount: %v", err)
+	}
+	var cents int64
+	if len(parts) == 2 {
+		c := parts[1]
+		if len(c) == 0 || len(c) > 2 {
+			return 0, fmt.Errorf("Could not recognize amount %q", s)
+		}
+		if len(c) == 1 {
+			c += "0"
+		}
+		cents, err = strconv.ParseInt(c, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Could not recognize amount: %v", err)
+		}
+	}
+
+	m := Money(dollars*100 + cents)
+	if neg {
+		m = -m
+	}
+	return m, nil
+}
+
+// String formats the amount the way it should be shown to members, e.g. $1234.56
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign = "-"
+		m = -m
+	}
+	return fmt.Sprintf("%s$%d.%02d", sign, int64(m)/100, int64(m)%100)
+}
+
+// Decimal formats the amount without a currency symbol, e.g. 1234.56. Useful for form values and exports.
+func (m Money) Decimal() string {
+	return strings.Replace(m.String(), "$", "", 1)
+}
+
+// Scan implements sql.Scanner for MONEY and NUMERIC columns
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+		return nil
+	case int64:
+		*m = Money(v * 100)
+		return nil
+	case float64:
+		*m = Money(math.Round(v * 100))
+		return nil
+	case []byte:
+		return m.scanString(string(v))
+	case string:
+		return m.scanString(v)
+	}
+	return fmt.Errorf("Cannot scan %T into Money", src)
+}
+
+func (m *Money) scanString(s string) error {
+	p, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = p
+	return nil
+}
+
+// Value implements driver.Valuer so that Money can be used directly as a bindvar
+func (m Money) Value() (driver.Value, error) {
+	return m.Decimal(), nil
+}
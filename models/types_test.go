@@ -0,0 +1,34 @@
+package models
+
+import "testing"
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+		ok   bool
+	}{
+		{"12", 1200, true},
+		{"12.5", 1250, true},
+		{"12.05", 1205, true},
+		{"$1,234.56", 123456, true},
+		{" 7.00 ", 700, true},
+		{"0.99", 99, true},
+		{"-$3.00", -300, true},
+		{"($4.25)", -425, true},
+		{"", 0, false},
+		{"$", 0, false},
+		{"-", 0, false},
+		{"abc", 0, false},
+		{"1.", 0, false},
+		{"1.234", 0, false},
+		{"1.2x", 0, false},
+		{"$1.00 off", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseMoney(%q) = %v, %v; want %v, ok %v", tt.in, int64(got), err, int64(tt.want), tt.ok)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"database/sql"
 	"fmt"
 	"time"
 
@@ -32,7 +33,7 @@ func (um *UserModel) Get(id int) (*User, error) {
 	if !(id > 0) {
 		return nil, fmt.Errorf("Did not recognize user id")
 	}
-	q := um.DB.Rebind("SELECT id, name, username, dob, phone FROM member WHERE id = ?")
+	q := um.DB.Rebind("SELECT id, name, username, dob, phone, text_ok FROM member WHERE id = ?")
 	user := &User{}
 	err := um.DB.Get(user, q, id)
 	if err != nil {
@@ -82,9 +83,9 @@ func (um *UserModel) Create(u *User) error {
 	//TODO calculate membership_expires
 	q := um.DB.Rebind(`
 	INSERT INTO member 
-		(name, username, password, dob, phone, membership_status_id, rbac_role_id, created_at, updated_at)
+		(name, username, password, dob, phone, text_ok, membership_status_id, membership_option, rbac_role_id, created_at, updated_at)
 	VALUES
-		(?, ?, ?, ?, ?, ?, ?, ?, ?)
+		(?, ?, ?, ?, ?, ?, ?, NULLIF(?, 0), ?, ?, ?)
 	RETURNING id`)
 	var id int
 	fmt.Printf("%+v\n", u)
@@ -96,7 +97,9 @@ func (um *UserModel) Create(u *User) error {
 		u.Password,
 		u.DOB,
 		u.Phone,
+		u.TextOK,
 		u.MembershipStatus,
+		u.MembershipOption,
 		1,
 		time.Now(),
 		time.Now(),
@@ -121,3 +124,40 @@ func (um *UserModel) Delete(*User) error {
 //define database helper functions here
 
 //define Valuers and Scanners for any user related custom types here.
+
+// Address is a member's postal address
+type Address struct {
+	Type  string  `db:"addr_type"`
+	Addr1 string  `db:"addr1"`
+	Addr2 *string `db:"addr2"`
+	City  string  `db:"city"`
+	State string  `db:"state"`
+	Zip   string  `db:"zip"`
+}
+
+// Lines returns the address as it would be written on an envelope
+func (a *Address) Lines() []string {
+	lines := []string{a.Addr1}
+	if a.Addr2 != nil && *a.Addr2 != "" {
+		lines = append(lines, *a.Addr2)
+	}
+	return append(lines, fmt.Sprintf("%s, %s %s", a.City, a.State, a.Zip))
+}
+
+//BillingAddress returns the member's billing address, or their home address if no billing address was given.
+//Returns nil if the member has no address at all.
+func (um *UserModel) BillingAddress(memberID int) (*Address, error) {
+	q := um.DB.Rebind(`SELECT addr_type, addr1, addr2, city, state, zip FROM member_address
+		WHERE member_id = ? AND addr_type IN ('billing', 'home')
+		ORDER BY addr_type = 'billing' DESC
+		LIMIT 1`)
+	addr := &Address{}
+	err := um.DB.Get(addr, q, memberID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve address: %v", err)
+	}
+	return addr, nil
+}
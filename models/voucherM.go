@@ -0,0 +1,428 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// VoucherModel stores the database handle for gift memberships and prepaid vouchers
+type VoucherModel struct {
+	DB *sqlx.DB
+}
+
+// ErrVoucherCode is returned when a voucher code does not exist, has expired, has not been paid for, or is used up
+var ErrVoucherCode = errors.New("That gift voucher code is not valid")
+
+// ErrVoucherRedeemed is returned when a voucher has already been redeemed by another member
+var ErrVoucherRedeemed = errors.New("That gift voucher has already been redeemed")
+
+// Voucher is a gift voucher bought by a member for someone else
+type Voucher struct {
+	ID             int        `db:"id"`
+	Code           string     `db:"code"`
+	Kind           string     `db:"kind"` // value, membership or event
+	Amount         Money      `db:"amount"`
+	Balance        Money      `db:"balance"`
+	OptionID       *int       `db:"membership_option_id"`
+	Option         *string    `db:"option"` // the name of the membership option, for membership vouchers
+	EventID        *int       `db:"event_id"`
+	Event          *string    `db:"event"` // the name of the event, for event vouchers
+	PurchaserID    int        `db:"purchaser_id"`
+	Purchaser      string     `db:"purchaser"`
+	InvoiceID      int        `db:"invoice_id"`
+	Paid           bool       `db:"paid"`
+	RecipientName  string     `db:"recipient_name"`
+	RecipientEmail string     `db:"recipient_email"`
+	Message        string     `db:"message"`
+	ExpiresOn      *time.Time `db:"expires_on"`
+	RedeemedByID   *int       `db:"redeemed_by_id"`
+	RedeemedBy     *string    `db:"redeemed_by"`
+	RedeemedAt     *time.Time `db:"redeemed_at"`
+	EmailedAt      *time.Time `db:"emailed_at"`
+	CreatedAt      time.Time  `db:"created_at"`
+}
+
+// VoucherEvent is an upcoming event that a voucher can be bought for
+type VoucherEvent struct {
+	ID     int       `db:"id"`
+	Name   string    `db:"name"`
+	Starts time.Time `db:"starts"`
+	Price  Money     `db:"price"`
+}
+
+// voucherUse is a voucher taken off an invoice, recorded once the invoice has been saved
+type voucherUse struct {
+	voucherID int
+	amount    Money
+}
+
+// Describe says what the voucher is for, e.g. "Gift membership: 3 Month"
+func (v *Voucher) Describe() string {
+	switch {
+	case v.Kind == "membership" && v.Option != nil:
+		return "Gift membership: " + *v.Option
+	case v.Kind == "event" && v.Event != nil:
+		return "Gift voucher for " + *v.Event
+	}
+	return fmt.Sprintf("Gift voucher for %s", v.Amount)
+}
+
+// SpentOn says which charges the voucher can be spent on
+func (v *Voucher) SpentOn() string {
+	switch {
+	case v.Kind == "membership" && v.Option != nil:
+		return "dues for the " + *v.Option + " membership"
+	case v.Kind == "event" && v.Event != nil:
+		return "the fees for " + *v.Event
+	}
+	return "dues, addons, and class and event fees"
+}
+
+// Expired reports whether the voucher can no longer be used
+func (v *Voucher) Expired(now time.Time) bool {
+	return v.ExpiresOn != nil && v.ExpiresOn.Format("2006-01-02") < now.Format("2006-01-02")
+}
+
+// Usable reports whether the voucher can be redeemed or spent
+func (v *Voucher) Usable(now time.Time) bool {
+	return v.Paid && v.Balance > 0 && !v.Expired(now)
+}
+
+// applies reports whether the voucher can be spent on an invoice line. Value vouchers pay for any dues, addon or
+// event line; a membership or event voucher only pays for the membership option or event it was bought for.
+func (v *Voucher) applies(l InvoiceLine) bool {
+	switch l.Category {
+	case "dues":
+		if v.Kind == "membership" {
+			return sameID(v.OptionID, l.OptionID)
+		}
+		return v.Kind == "value"
+	case "addon":
+		return v.Kind == "value"
+	case "event_fee", "material_fee":
+		if v.Kind == "event" {
+			return sameID(v.EventID, l.EventID)
+		}
+		return v.Kind == "value"
+	}
+	return false
+}
+
+// sameID reports whether two optional IDs are both set and equal
+func sameID(a, b *int) bool {
+	return a != nil && b != nil && *a == *b
+}
+
+// voucherCodeChars leaves out letters and digits that are easily confused, like O and 0
+const voucherCodeChars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newVoucherCode makes a random code like ABCD-EFGH-JKLM
+func newVoucherCode() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Could not generate voucher code: %v", err)
+	}
+	var code strings.Builder
+	for i, c := range b {
+		if i > 0 && i%4 == 0 {
+			code.WriteByte('-')
+		}
+		code.WriteByte(voucherCodeChars[int(c)%len(voucherCodeChars)])
+	}
+	return code.String(), nil
+}
+
+// normalizeVoucherCode lets members type a code in lower case, or without the dashes
+func normalizeVoucherCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 12 {
+		return code
+	}
+	return code[:4] + "-" + code[4:8] + "-" + code[8:]
+}
+
+const voucherColumns = `
+	gift_voucher.id, gift_voucher.code, gift_voucher_kind.name AS kind, gift_voucher.amount, gift_voucher.balance,
+	gift_voucher.membership_option_id, membership_options.name AS option, gift_voucher.event_id, event.name AS event,
+	gift_voucher.purchaser_id, purchaser.name AS purchaser, gift_voucher.invoice_id,
+	COALESCE(invoice_status.name = 'paid', false) AS paid,
+	gift_voucher.recipient_name, gift_voucher.recipient_email, gift_voucher.message, gift_voucher.expires_on,
+	gift_voucher.redeemed_by AS redeemed_by_id, redeemer.name AS redeemed_by, gift_voucher.redeemed_at,
+	gift_voucher.emailed_at, gift_voucher.created_at`
+
+const voucherFrom = `
+	FROM gift_voucher
+		JOIN gift_voucher_kind ON gift_voucher_kind.id = gift_voucher.kind_id
+		JOIN member purchaser ON purchaser.id = gift_voucher.purchaser_id
+		JOIN invoice ON invoice.id = gift_voucher.invoice_id
+		LEFT JOIN invoice_status ON invoice_status.id = invoice.status_id
+		LEFT JOIN membership_options ON membership_options.id = gift_voucher.membership_option_id
+		LEFT JOIN event ON event.id = gift_voucher.event_id
+		LEFT JOIN member redeemer ON redeemer.id = gift_voucher.redeemed_by`
+
+//All returns every voucher, newest first
+func (vm *VoucherModel) All() ([]Voucher, error) {
+	vouchers := []Voucher{}
+	if err := vm.DB.Select(&vouchers, `SELECT `+voucherColumns+voucherFrom+` ORDER BY gift_voucher.created_at DESC, gift_voucher.id DESC`); err != nil {
+		return nil, fmt.Errorf("Could not retrieve vouchers: %v", err)
+	}
+	return vouchers, nil
+}
+
+//Get one voucher
+func (vm *VoucherModel) Get(id int) (*Voucher, error) {
+	v := &Voucher{}
+	if err := vm.DB.Get(v, vm.DB.Rebind(`SELECT `+voucherColumns+voucherFrom+` WHERE gift_voucher.id = ?`), id); err != nil {
+		return nil, fmt.Errorf("Could not retrieve voucher: %v", err)
+	}
+	return v, nil
+}
+
+//Find looks up a voucher by its code, which is not case sensitive and can be typed without the dashes
+func (vm *VoucherModel) Find(code string) (*Voucher, error) {
+	v := &Voucher{}
+	err := vm.DB.Get(v, vm.DB.Rebind(`SELECT `+voucherColumns+voucherFrom+` WHERE gift_voucher.code = ?`), normalizeVoucherCode(code))
+	if err == sql.ErrNoRows {
+		return nil, ErrVoucherCode
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve voucher: %v", err)
+	}
+	return v, nil
+}
+
+//ForMember returns the vouchers a member has bought or redeemed, newest first
+func (vm *VoucherModel) ForMember(memberID int) ([]Voucher, error) {
+	vouchers := []Voucher{}
+	q := vm.DB.Rebind(`SELECT ` + voucherColumns + voucherFrom + `
+		WHERE gift_voucher.purchaser_id = ? OR gift_voucher.redeemed_by = ?
+		ORDER BY gift_voucher.created_at DESC, gift_voucher.id DESC`)
+	if err := vm.DB.Select(&vouchers, q, memberID, memberID); err != nil {
+		return nil, fmt.Errorf("Could not retrieve vouchers: %v", err)
+	}
+	return vouchers, nil
+}
+
+const voucherEventSelect = `
+	SELECT event.id, event.name, lower(event.during) AS starts,
+		event_fees.class_material_fee + fee_structures.facilities_fee + fee_structures.authorization_fee AS price
+	FROM event
+		JOIN event_fees ON event_fees.event_id = event.id
+		JOIN fee_structures ON fee_structures.id = event_fees.fee_structure_id`
+
+//Events returns the upcoming events with fees that a voucher can be bought for. The price is what a non-member
+//pays, so that the voucher covers the event whoever it is given to.
+func (vm *VoucherModel) Events(now time.Time) ([]VoucherEvent, error) {
+	events := []VoucherEvent{}
+	q := vm.DB.Rebind(`` + voucherEventSelect + `
+		WHERE event.requires_fees AND lower(event.during) > ?
+			AND event_fees.class_material_fee + fee_structures.facilities_fee + fee_structures.authorization_fee > '$0.00'
+		ORDER BY lower(event.during), event.id`)
+	if err := vm.DB.Select(&events, q, now); err != nil {
+		return nil, fmt.Errorf("Could not retrieve events: %v", err)
+	}
+	return events, nil
+}
+
+//Buy invoices the purchaser for a new voucher and saves it with a new code. The price of a membership or event
+//voucher is looked up, and a value voucher costs its amount. The voucher can be redeemed once the invoice is paid.
+func (vm *VoucherModel) Buy(v *Voucher, now time.Time) (*Invoice, error) {
+	tx, err := vm.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	description := fmt.Sprintf("Gift voucher for %s", v.RecipientName)
+	switch v.Kind {
+	case "membership":
+		o := &MembershipOption{}
+		if err := tx.Get(o, tx.Rebind(`SELECT `+membershipOptionColumns+` FROM membership_options WHERE id = ? AND active`), *v.OptionID); err != nil {
+			return nil, fmt.Errorf("Could not retrieve membership option: %v", err)
+		}
+		v.Amount = o.Price
+		v.Option = &o.Name
+		description = fmt.Sprintf("Gift membership (%s) for %s", o.Name, v.RecipientName)
+	case "event":
+		e := &VoucherEvent{}
+		q := tx.Rebind(voucherEventSelect + ` WHERE event.id = ?`)
+		if err := tx.Get(e, q, *v.EventID); err != nil {
+			return nil, fmt.Errorf("Could not retrieve event: %v", err)
+		}
+		v.Amount = e.Price
+		v.Event = &e.Name
+		description = fmt.Sprintf("Gift voucher for %s, for %s", e.Name, v.RecipientName)
+	}
+	v.Balance = v.Amount
+
+	inv := &Invoice{
+		MemberID:    v.PurchaserID,
+		Description: description,
+		DueDate:     now,
+		Lines:       []InvoiceLine{{Category: "gift_voucher", Description: description, Quantity: 1, UnitAmount: v.Amount}},
+	}
+	if err := createInvoice(tx, inv); err != nil {
+		return nil, err
+	}
+	v.InvoiceID = inv.ID
+
+	if v.Code, err = newVoucherCode(); err != nil {
+		return nil, err
+	}
+	q := tx.Rebind(`
+		INSERT INTO gift_voucher
+			(code, kind_id, amount, balance, membership_option_id, event_id, purchaser_id, invoice_id,
+			recipient_name, recipient_email, message, expires_on)
+		VALUES
+			(?, (SELECT id FROM gift_voucher_kind WHERE name = ?), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id, created_at`)
+	err = tx.QueryRowx(q, v.Code, v.Kind, v.Amount, v.Balance, v.OptionID, v.EventID, v.PurchaserID, v.InvoiceID,
+		v.RecipientName, v.RecipientEmail, v.Message, v.ExpiresOn).Scan(&v.ID, &v.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("Could not save voucher: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+//Redeem gives a member a voucher with its code. Its balance is then taken off the member's invoices for the
+//charges it can be spent on, until it runs out.
+func (vm *VoucherModel) Redeem(memberID int, code string, now time.Time) (*Voucher, error) {
+	tx, err := vm.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	v := &Voucher{}
+	q := tx.Rebind(`SELECT ` + voucherColumns + voucherFrom + ` WHERE gift_voucher.code = ? FOR UPDATE OF gift_voucher`)
+	err = tx.Get(v, q, normalizeVoucherCode(code))
+	if err == sql.ErrNoRows {
+		return nil, ErrVoucherCode
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve voucher: %v", err)
+	}
+	if v.RedeemedByID != nil {
+		if *v.RedeemedByID == memberID {
+			return v, nil
+		}
+		return nil, ErrVoucherRedeemed
+	}
+	if !v.Usable(now) {
+		return nil, ErrVoucherCode
+	}
+	if _, err := tx.Exec(tx.Rebind(`UPDATE gift_voucher SET redeemed_by = ?, redeemed_at = ? WHERE id = ?`), memberID, now, v.ID); err != nil {
+		return nil, fmt.Errorf("Could not redeem voucher: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	v.RedeemedByID = &memberID
+	v.RedeemedAt = &now
+	return v, nil
+}
+
+//MarkEmailed records when the gift certificate was emailed to the recipient
+func (vm *VoucherModel) MarkEmailed(id int, now time.Time) error {
+	if _, err := vm.DB.Exec(vm.DB.Rebind(`UPDATE gift_voucher SET emailed_at = ? WHERE id = ?`), now, id); err != nil {
+		return fmt.Errorf("Could not update voucher: %v", err)
+	}
+	return nil
+}
+
+// applyVouchers adds a line to the invoice for each voucher the member has redeemed that can be spent on its
+// charges, oldest first. Vouchers only pay for what is left after discounts and credits, and never for charges
+// they cannot be spent on; whatever is not needed stays on the voucher for later invoices.
+func applyVouchers(tx *sqlx.Tx, inv *Invoice, now time.Time) error {
+	if len(inv.Lines) == 0 {
+		return nil
+	}
+
+	vouchers := []Voucher{}
+	q := tx.Rebind(`SELECT ` + voucherColumns + voucherFrom + `
+		WHERE gift_voucher.redeemed_by = ? AND gift_voucher.balance > '$0.00'
+		ORDER BY gift_voucher.redeemed_at, gift_voucher.id
+		FOR UPDATE OF gift_voucher`)
+	if err := tx.Select(&vouchers, q, inv.MemberID); err != nil {
+		return fmt.Errorf("Could not retrieve vouchers: %v", err)
+	}
+
+	var total Money
+	left := make([]Money, len(inv.Lines))
+	for i, l := range inv.Lines {
+		total += l.Total()
+		if l.Total() > 0 {
+			left[i] = l.Total()
+		}
+	}
+	for i := range vouchers {
+		v := &vouchers[i]
+		if !v.Usable(now) {
+			continue
+		}
+		var applicable, other Money
+		for i := range left {
+			if v.applies(inv.Lines[i]) {
+				applicable += left[i]
+			} else {
+				other += left[i]
+			}
+		}
+		// discounts and credits are taken off what the voucher can pay for, not off the other charges
+		if applicable > total-other {
+			applicable = total - other
+		}
+		off := v.Balance
+		if off > applicable {
+			off = applicable
+		}
+		if off <= 0 {
+			continue
+		}
+		rest := off
+		for i := range left {
+			if !v.applies(inv.Lines[i]) || left[i] <= 0 {
+				continue
+			}
+			taken := left[i]
+			if taken > rest {
+				taken = rest
+			}
+			left[i] -= taken
+			rest -= taken
+		}
+		total -= off
+		inv.Lines = append(inv.Lines, InvoiceLine{
+			Category:    "gift_voucher",
+			Description: fmt.Sprintf("Gift voucher %s", v.Code),
+			Quantity:    1,
+			UnitAmount:  -off,
+		})
+		inv.vouchers = append(inv.vouchers, voucherUse{voucherID: v.ID, amount: off})
+	}
+	return nil
+}
+
+// recordVouchers saves the vouchers spent on a saved invoice, and takes the amounts off their balances
+func recordVouchers(tx *sqlx.Tx, inv *Invoice) error {
+	for _, u := range inv.vouchers {
+		q := tx.Rebind(`INSERT INTO gift_voucher_use (voucher_id, invoice_id, amount) VALUES (?, ?, ?)`)
+		if _, err := tx.Exec(q, u.voucherID, inv.ID, u.amount); err != nil {
+			return fmt.Errorf("Could not record voucher: %v", err)
+		}
+		q = tx.Rebind(`UPDATE gift_voucher SET balance = balance - ? WHERE id = ?`)
+		if _, err := tx.Exec(q, u.amount, u.voucherID); err != nil {
+			return fmt.Errorf("Could not record voucher: %v", err)
+		}
+	}
+	return nil
+}
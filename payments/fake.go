@@ -0,0 +1,165 @@
+package payments
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Fake is an in-process payment provider for development and tests. Checkout sessions are held in memory and
+// completed by calling Complete, which produces a webhook payload signed the same way as a real provider would.
+type Fake struct {
+	WebhookSecret string
+	BaseURL       string // root of the application, used to build the fake checkout page URL
+
+	mu       sync.Mutex
+	next     int
+	sessions map[string]*fakeSession
+	charges  map[string]int64
+	refunds  []Refund
+	keys     map[string]*Refund // refunds by idempotency key
+}
+
+type fakeSession struct {
+	request   CheckoutRequest
+	completed bool
+}
+
+// NewFake returns a fake provider. The checkout URLs it hands out point at baseURL/payments/fake/checkout/<id>
+func NewFake(webhookSecret, baseURL string) *Fake {
+	return &Fake{
+		WebhookSecret: webhookSecret,
+		BaseURL:       baseURL,
+		sessions:      map[string]*fakeSession{},
+		charges:       map[string]int64{},
+		keys:          map[string]*Refund{},
+	}
+}
+
+func (f *Fake) id(prefix string) string {
+	f.next++
+	return fmt.Sprintf("%s_%d_%d", prefix, time.Now().Unix(), f.next)
+}
+
+// CreateCheckoutSession records the request and returns a URL to the application's fake checkout page
+func (f *Fake) CreateCheckoutSession(cr *CheckoutRequest) (*CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.id("fake_cs")
+	f.sessions[id] = &fakeSession{request: *cr}
+	return &CheckoutSession{ID: id, URL: fmt.Sprintf("%spayments/fake/checkout/%s", f.BaseURL, id)}, nil
+}
+
+// Session returns the request that started a checkout session, for display on the fake checkout page
+func (f *Fake) Session(id string) (*CheckoutRequest, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	cr := s.request
+	return &cr, true
+}
+
+// Complete marks a session as paid and returns a webhook payload and signature header for it,
+// exactly as they would be posted to the webhook endpoint by a real provider.
+func (f *Fake) Complete(sessionID string) ([]byte, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.sessions[sessionID]
+	if !ok {
+		return nil, "", fmt.Errorf("no checkout session %s", sessionID)
+	}
+	s.completed = true
+
+	charge := f.id("fake_ch")
+	f.charges[charge] = s.request.Amount
+
+	e := Event{
+		ID:        f.id("fake_evt"),
+		Type:      EventCheckoutCompleted,
+		SessionID: sessionID,
+		InvoiceID: s.request.InvoiceID,
+		ChargeRef: charge,
+		Amount:    s.request.Amount,
+	}
+	if s.request.SaveMethod {
+		e.CustomerID = s.request.CustomerID
+		if e.CustomerID == "" {
+			e.CustomerID = f.id("fake_cus")
+		}
+		e.MethodID = f.id("fake_pm")
+		e.Brand = "visa"
+		e.Last4 = "4242"
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, "", err
+	}
+	return payload, signatureHeader(f.WebhookSecret, time.Now().Unix(), payload), nil
+}
+
+// VerifyWebhook checks the signature and decodes a payload produced by Complete
+func (f *Fake) VerifyWebhook(payload []byte, signature string) (*Event, error) {
+	if err := checkSignature(f.WebhookSecret, payload, signature, time.Now()); err != nil {
+		return nil, err
+	}
+	e := &Event{}
+	if err := json.Unmarshal(payload, e); err != nil {
+		return nil, fmt.Errorf("could not decode webhook: %v", err)
+	}
+	return e, nil
+}
+
+// Charge always succeeds
+func (f *Fake) Charge(cr *ChargeRequest) (*Charge, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if cr.MethodID == "" {
+		return nil, fmt.Errorf("no payment method")
+	}
+	ref := f.id("fake_ch")
+	f.charges[ref] = cr.Amount
+	return &Charge{Ref: ref, Amount: cr.Amount}, nil
+}
+
+// Refund succeeds for any charge made through the fake, as long as the amount does not exceed the charge. A repeated
+// idempotency key returns the first refund again, as the real provider does.
+func (f *Fake) Refund(chargeRef string, amount int64, idempotencyKey string) (*Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r, ok := f.keys[idempotencyKey]; ok && idempotencyKey != "" {
+		return r, nil
+	}
+
+	charged, ok := f.charges[chargeRef]
+	if !ok {
+		return nil, fmt.Errorf("no charge %s", chargeRef)
+	}
+	if amount > charged {
+		return nil, fmt.Errorf("refund of %d exceeds remaining charge of %d", amount, charged)
+	}
+	f.charges[chargeRef] = charged - amount
+
+	r := Refund{Ref: f.id("fake_re"), ChargeRef: chargeRef, Amount: amount}
+	f.refunds = append(f.refunds, r)
+	if idempotencyKey != "" {
+		f.keys[idempotencyKey] = &r
+	}
+	return &r, nil
+}
+
+// Refunds lists every refund made through the fake
+func (f *Fake) Refunds() []Refund {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Refund(nil), f.refunds...)
+}
@@ -0,0 +1,102 @@
+package payments
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckSignature(t *testing.T) {
+	secret := "whsec_test"
+	payload := []byte(`{"id":"evt_1","type":"checkout.session.completed"}`)
+	now := time.Unix(1700000000, 0)
+	valid := signatureHeader(secret, now.Unix(), payload)
+
+	tests := []struct {
+		name    string
+		secret  string
+		payload []byte
+		header  string
+		ok      bool
+	}{
+		{"valid", secret, payload, valid, true},
+		{"valid among several signatures", secret, payload, valid + ",v1=00ff", true},
+		{"slightly in the future", secret, payload, signatureHeader(secret, now.Add(time.Minute).Unix(), payload), true},
+		{"expired", secret, payload, signatureHeader(secret, now.Add(-signatureTolerance-time.Second).Unix(), payload), false},
+		{"too far in the future", secret, payload, signatureHeader(secret, now.Add(signatureTolerance+time.Second).Unix(), payload), false},
+		{"tampered payload", secret, []byte(`{"id":"evt_1","type":"checkout.session.completed","amount":1}`), valid, false},
+		{"wrong secret", "whsec_other", payload, valid, false},
+		{"no timestamp", secret, payload, "v1=" + sign(secret, now.Unix(), payload), false},
+		{"no signature", secret, payload, "t=1700000000", false},
+		{"bad timestamp", secret, payload, "t=soon,v1=" + sign(secret, now.Unix(), payload), false},
+		{"empty", secret, payload, "", false},
+	}
+	for _, tt := range tests {
+		err := checkSignature(tt.secret, tt.payload, tt.header, now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: checkSignature() error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err != nil && err != ErrBadSignature {
+			t.Errorf("%s: checkSignature() error = %v, want ErrBadSignature", tt.name, err)
+		}
+	}
+}
+
+func TestFakeCompleteVerifies(t *testing.T) {
+	f := NewFake("whsec_test", "http://localhost/")
+	cs, err := f.CreateCheckoutSession(&CheckoutRequest{InvoiceID: 7, Amount: 2500, SaveMethod: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, err := f.Complete(cs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := f.VerifyWebhook(payload, sig)
+	if err != nil {
+		t.Fatalf("VerifyWebhook() error = %v", err)
+	}
+	if e.Type != EventCheckoutCompleted || e.InvoiceID != 7 || e.Amount != 2500 || e.SessionID != cs.ID {
+		t.Errorf("VerifyWebhook() = %+v, want a completed checkout of 2500 for invoice 7", e)
+	}
+	if e.MethodID == "" || e.CustomerID == "" {
+		t.Errorf("VerifyWebhook() = %+v, want the saved payment method", e)
+	}
+
+	if _, err := f.VerifyWebhook(append(payload, ' '), sig); err == nil {
+		t.Error("VerifyWebhook() accepted a tampered payload")
+	}
+	if _, err := NewFake("whsec_other", "").VerifyWebhook(payload, sig); err == nil {
+		t.Error("VerifyWebhook() accepted a payload signed with another secret")
+	}
+}
+
+func TestFakeRefund(t *testing.T) {
+	f := NewFake("whsec_test", "")
+	c, err := f.Charge(&ChargeRequest{MethodID: "fake_pm_1", Amount: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := f.Refund(c.Ref, 3000, "refund-request-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := f.Refund(c.Ref, 3000, "refund-request-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Ref != first.Ref || len(f.Refunds()) != 1 {
+		t.Errorf("repeated idempotency key refunded again: %s then %s, %d refunds", first.Ref, again.Ref, len(f.Refunds()))
+	}
+
+	if _, err := f.Refund(c.Ref, 3000, "refund-request-2"); err == nil {
+		t.Error("Refund() returned more than what is left of the charge")
+	}
+	if _, err := f.Refund(c.Ref, 2000, "refund-request-2"); err != nil {
+		t.Errorf("Refund() of the rest of the charge error = %v", err)
+	}
+	if _, err := f.Refund("fake_ch_none", 100, ""); err == nil {
+		t.Error("Refund() of an unknown charge succeeded")
+	}
+}
@@ -0,0 +1,221 @@
+package payments
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const stripeAPI = "https://api.stripe.com/v1/"
+
+// Stripe talks to the Stripe REST API directly. Only the handful of endpoints needed for checkout,
+// off-session charges and refunds are used, so there is no dependency on the Stripe SDK.
+type Stripe struct {
+	SecretKey     string
+	WebhookSecret string
+	Currency      string
+	Client        *http.Client
+}
+
+// NewStripe returns a Stripe provider using the given API key and webhook signing secret
+func NewStripe(secretKey, webhookSecret, currency string) *Stripe {
+	if currency == "" {
+		currency = "usd"
+	}
+	return &Stripe{
+		SecretKey:     secretKey,
+		WebhookSecret: webhookSecret,
+		Currency:      currency,
+		Client:        &http.Client{Timeout: 20 * time.Second},
+	}
+}
+
+// CreateCheckoutSession creates a hosted checkout page for a single invoice
+func (s *Stripe) CreateCheckoutSession(cr *CheckoutRequest) (*CheckoutSession, error) {
+	v := url.Values{}
+	v.Set("mode", "payment")
+	v.Set("success_url", cr.SuccessURL)
+	v.Set("cancel_url", cr.CancelURL)
+	v.Set("client_reference_id", strconv.Itoa(cr.InvoiceID))
+	v.Set("metadata[invoice_id]", strconv.Itoa(cr.InvoiceID))
+	v.Set("payment_intent_data[metadata][invoice_id]", strconv.Itoa(cr.InvoiceID))
+	v.Set("line_items[0][quantity]", "1")
+	v.Set("line_items[0][price_data][currency]", s.Currency)
+	v.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(cr.Amount, 10))
+	v.Set("line_items[0][price_data][product_data][name]", cr.Description)
+	if cr.CustomerID != "" {
+		v.Set("customer", cr.CustomerID)
+	} else {
+		v.Set("customer_email", cr.MemberEmail)
+		if cr.SaveMethod {
+			v.Set("customer_creation", "always")
+		}
+	}
+	if cr.SaveMethod {
+		v.Set("payment_intent_data[setup_future_usage]", "off_session")
+	}
+
+	var resp struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err := s.post("checkout/sessions", v, "", &resp); err != nil {
+		return nil, err
+	}
+	return &CheckoutSession{ID: resp.ID, URL: resp.URL}, nil
+}
+
+// VerifyWebhook checks the Stripe-Signature header and decodes the event.
+// For completed checkouts the payment intent is looked up so that the saved card details are included.
+func (s *Stripe) VerifyWebhook(payload []byte, signature string) (*Event, error) {
+	if err := checkSignature(s.WebhookSecret, payload, signature, time.Now()); err != nil {
+		return nil, err
+	}
+
+	var raw struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object json.RawMessage `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, fmt.Errorf("could not decode webhook: %v", err)
+	}
+
+	e := &Event{ID: raw.ID, Type: raw.Type}
+	if raw.Type != EventCheckoutCompleted {
+		return e, nil
+	}
+
+	var session struct {
+		ID                string            `json:"id"`
+		ClientReferenceID string            `json:"client_reference_id"`
+		AmountTotal       int64             `json:"amount_total"`
+		Customer          string            `json:"customer"`
+		PaymentIntent     string            `json:"payment_intent"`
+		Metadata          map[string]string `json:"metadata"`
+	}
+	if err := json.Unmarshal(raw.Data.Object, &session); err != nil {
+		return nil, fmt.Errorf("could not decode checkout session: %v", err)
+	}
+	e.SessionID = session.ID
+	e.Amount = session.AmountTotal
+	e.CustomerID = session.Customer
+	e.ChargeRef = session.PaymentIntent
+	e.InvoiceID, _ = strconv.Atoi(session.ClientReferenceID)
+
+	if session.PaymentIntent != "" {
+		var pi struct {
+			PaymentMethod struct {
+				ID   string `json:"id"`
+				Card struct {
+					Brand string `json:"brand"`
+					Last4 string `json:"last4"`
+				} `json:"card"`
+			} `json:"payment_method"`
+		}
+		if err := s.get("payment_intents/"+url.PathEscape(session.PaymentIntent)+"?expand[]=payment_method", &pi); err != nil {
+			return nil, err
+		}
+		e.MethodID = pi.PaymentMethod.ID
+		e.Brand = pi.PaymentMethod.Card.Brand
+		e.Last4 = pi.PaymentMethod.Card.Last4
+	}
+
+	return e, nil
+}
+
+// Charge confirms an off-session payment intent against a saved payment method
+func (s *Stripe) Charge(cr *ChargeRequest) (*Charge, error) {
+	v := url.Values{}
+	v.Set("amount", strconv.FormatInt(cr.Amount, 10))
+	v.Set("currency", s.Currency)
+	v.Set("customer", cr.CustomerID)
+	v.Set("payment_method", cr.MethodID)
+	v.Set("off_session", "true")
+	v.Set("confirm", "true")
+	v.Set("description", cr.Description)
+	v.Set("metadata[invoice_id]", strconv.Itoa(cr.InvoiceID))
+
+	var resp struct {
+		ID     string `json:"id"`
+		Amount int64  `json:"amount"`
+		Status string `json:"status"`
+	}
+	if err := s.post("payment_intents", v, cr.IdempotencyKey, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != "succeeded" {
+		return nil, fmt.Errorf("charge was not completed, status %s", resp.Status)
+	}
+	return &Charge{Ref: resp.ID, Amount: resp.Amount}, nil
+}
+
+// Refund returns some or all of a payment to the original payment method. Stripe returns the first refund again for
+// a repeated idempotency key, rather than refunding twice.
+func (s *Stripe) Refund(chargeRef string, amount int64, idempotencyKey string) (*Refund, error) {
+	v := url.Values{}
+	v.Set("payment_intent", chargeRef)
+	v.Set("amount", strconv.FormatInt(amount, 10))
+
+	var resp struct {
+		ID     string `json:"id"`
+		Amount int64  `json:"amount"`
+	}
+	if err := s.post("refunds", v, idempotencyKey, &resp); err != nil {
+		return nil, err
+	}
+	return &Refund{Ref: resp.ID, ChargeRef: chargeRef, Amount: resp.Amount}, nil
+}
+
+func (s *Stripe) post(path string, v url.Values, idempotencyKey string, dst interface{}) error {
+	req, err := http.NewRequest("POST", stripeAPI+path, strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	return s.do(req, dst)
+}
+
+func (s *Stripe) get(path string, dst interface{}) error {
+	req, err := http.NewRequest("GET", stripeAPI+path, nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req, dst)
+}
+
+func (s *Stripe) do(req *http.Request, dst interface{}) error {
+	req.SetBasicAuth(s.SecretKey, "")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach stripe: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read stripe response: %v", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		var se struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(body, &se)
+		return fmt.Errorf("stripe returned %d: %s", resp.StatusCode, se.Error.Message)
+	}
+
+	return json.Unmarshal(body, dst)
+}
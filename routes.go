@@ -7,6 +7,8 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
+
+	"github.com/makeict/MESSforMakers/payments"
 )
 
 func (a *application) appRouter() {
@@ -42,6 +44,188 @@ func (a *application) appRouter() {
 	router.HandleFunc("/user/{id:[0-9]+}/waiver", noRoute("show waiver")).Methods("GET")
 	router.HandleFunc("/user/{id:[0-9]+}/waiver", noRoute("delete waiver")).Methods("POST").MatcherFunc(makeMatcher("delete"))
 
+	router.HandleFunc("/invoice/{id:[0-9]+}", a.PaymentC.ShowInvoice()).Methods("GET")
+	router.HandleFunc("/invoice/{id:[0-9]+}/pay", a.PaymentC.Pay()).Methods("POST")
+	router.HandleFunc("/invoice/{id:[0-9]+}/autopay", a.PaymentC.AutoPay()).Methods("POST")
+	router.HandleFunc("/invoice/{id:[0-9]+}/payment", a.PaymentC.RecordPayment()).Methods("POST")
+	router.HandleFunc("/invoice/{id:[0-9]+}.pdf", a.DocumentC.InvoicePDF()).Methods("GET")
+	router.HandleFunc("/invoice/{id:[0-9]+}/email", a.DocumentC.EmailInvoice()).Methods("POST")
+	router.HandleFunc("/payment/{id:[0-9]+}/receipt.pdf", a.DocumentC.ReceiptPDF()).Methods("GET")
+	router.HandleFunc("/payment/{id:[0-9]+}/acknowledgement.pdf", a.DocumentC.AcknowledgementPDF()).Methods("GET")
+	router.HandleFunc("/user/{id:[0-9]+}/donations/{year:[0-9]{4}}.pdf", a.DocumentC.StatementPDF()).Methods("GET")
+	router.HandleFunc("/payments/webhook", a.PaymentC.Webhook()).Methods("POST")
+	router.HandleFunc("/payments/success", a.PaymentC.CheckoutResult(true)).Methods("GET")
+	router.HandleFunc("/payments/cancel", a.PaymentC.CheckoutResult(false)).Methods("GET")
+	router.HandleFunc("/user/{id:[0-9]+}/paymentmethods", a.PaymentC.Methods()).Methods("GET")
+	router.HandleFunc("/user/{id:[0-9]+}/paymentmethods/{mid:[0-9]+}/default", a.PaymentC.DefaultMethod()).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/paymentmethods/{mid:[0-9]+}", a.PaymentC.DeleteMethod()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/user/{id:[0-9]+}/ledger", a.LedgerC.Show()).Methods("GET")
+	router.HandleFunc("/user/{id:[0-9]+}/ledger.csv", a.LedgerC.CSV()).Methods("GET")
+	router.HandleFunc("/user/{id:[0-9]+}/ledger.pdf", a.LedgerC.PDF()).Methods("GET")
+	router.HandleFunc("/refundpolicies", a.RefundC.Policies()).Methods("GET")
+	router.HandleFunc("/refundpolicies", a.RefundC.SavePolicy()).Methods("POST")
+	router.HandleFunc("/refundpolicy/new", a.RefundC.PolicyForm()).Methods("GET")
+	router.HandleFunc("/refundpolicy/{id:[0-9]+}/edit", a.RefundC.PolicyForm()).Methods("GET")
+	router.HandleFunc("/refundpolicy/{id:[0-9]+}", a.RefundC.SavePolicy()).Methods("POST").MatcherFunc(makeMatcher("patch"))
+	router.HandleFunc("/registration/{id:[0-9]+}/refund", a.RefundC.RequestForm()).Methods("GET")
+	router.HandleFunc("/registration/{id:[0-9]+}/refund", a.RefundC.Request()).Methods("POST")
+	router.HandleFunc("/refunds", a.RefundC.Queue()).Methods("GET")
+	router.HandleFunc("/refund/{id:[0-9]+}/approve", a.RefundC.Approve()).Methods("POST")
+	router.HandleFunc("/refund/{id:[0-9]+}/reject", a.RefundC.Reject()).Methods("POST")
+
+	router.HandleFunc("/reports", a.ReportC.Index()).Methods("GET")
+	router.HandleFunc("/reports/{name:[a-z]+}", a.ReportC.Show(false)).Methods("GET")
+	router.HandleFunc("/reports/{name:[a-z]+}.csv", a.ReportC.Show(true)).Methods("GET")
+	router.HandleFunc("/reminders/run", a.ReminderC.RunNow()).Methods("POST")
+
+	router.HandleFunc("/membershipoptions", a.OptionC.List()).Methods("GET")
+	router.HandleFunc("/membershipoptions", a.OptionC.Save()).Methods("POST")
+	router.HandleFunc("/membershipoption/new", a.OptionC.Form()).Methods("GET")
+	router.HandleFunc("/membershipoption/{id:[0-9]+}/edit", a.OptionC.Form()).Methods("GET")
+	router.HandleFunc("/membershipoption/{id:[0-9]+}", a.OptionC.Save()).Methods("POST").MatcherFunc(makeMatcher("patch"))
+	router.HandleFunc("/membershipoption/{id:[0-9]+}/retire", a.OptionC.SetActive(false)).Methods("POST")
+	router.HandleFunc("/membershipoption/{id:[0-9]+}/restore", a.OptionC.SetActive(true)).Methods("POST")
+	router.HandleFunc("/addons", a.AddonC.List()).Methods("GET")
+	router.HandleFunc("/addons", a.AddonC.Save()).Methods("POST")
+	router.HandleFunc("/addon/new", a.AddonC.Form()).Methods("GET")
+	router.HandleFunc("/addon/{id:[0-9]+}/edit", a.AddonC.Form()).Methods("GET")
+	router.HandleFunc("/addon/{id:[0-9]+}", a.AddonC.Save()).Methods("POST").MatcherFunc(makeMatcher("patch"))
+	router.HandleFunc("/addon/{id:[0-9]+}/retire", a.AddonC.SetActive(false)).Methods("POST")
+	router.HandleFunc("/addon/{id:[0-9]+}/restore", a.AddonC.SetActive(true)).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/addons", a.AddonC.ForMember()).Methods("GET")
+	router.HandleFunc("/user/{id:[0-9]+}/addons", a.AddonC.Add()).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/addons/{aid:[0-9]+}", a.AddonC.Remove()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/user/{id:[0-9]+}/waitlist/{aid:[0-9]+}", a.AddonC.LeaveWaitlist()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/renewals/run", a.RenewalC.RunNow()).Methods("POST")
+	router.HandleFunc("/lockers", a.LockerC.List()).Methods("GET")
+	router.HandleFunc("/lockers", a.LockerC.Save()).Methods("POST")
+	router.HandleFunc("/locker/new", a.LockerC.Form()).Methods("GET")
+	router.HandleFunc("/locker/{id:[0-9]+}/edit", a.LockerC.Form()).Methods("GET")
+	router.HandleFunc("/locker/{id:[0-9]+}", a.LockerC.Save()).Methods("POST").MatcherFunc(makeMatcher("patch"))
+	router.HandleFunc("/locker/{id:[0-9]+}/retire", a.LockerC.SetActive(false)).Methods("POST")
+	router.HandleFunc("/locker/{id:[0-9]+}/restore", a.LockerC.SetActive(true)).Methods("POST")
+	router.HandleFunc("/locker/{id:[0-9]+}/assign", a.LockerC.Assign()).Methods("POST")
+	router.HandleFunc("/locker/{id:[0-9]+}/assignment", a.LockerC.Release()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/locker/{id:[0-9]+}/cleared", a.LockerC.Cleared()).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/locker", a.LockerC.ForMember()).Methods("GET")
+	router.HandleFunc("/user/{id:[0-9]+}/locker/claim", a.LockerC.Claim()).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/lockerwaitlist", a.LockerC.JoinWaitlist()).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/lockerwaitlist", a.LockerC.LeaveWaitlist()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/user/{id:[0-9]+}/donation", a.DonationC.ForMember()).Methods("GET")
+	router.HandleFunc("/user/{id:[0-9]+}/donation", a.DonationC.SetRecurring()).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/donation", a.DonationC.CancelRecurring()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/donations/statements", a.DonationC.Statements()).Methods("GET")
+	router.HandleFunc("/donations/statements/{year:[0-9]{4}}/send", a.DonationC.SendStatements()).Methods("POST")
+	router.HandleFunc("/discounts", a.DiscountC.List()).Methods("GET")
+	router.HandleFunc("/discounts", a.DiscountC.Save()).Methods("POST")
+	router.HandleFunc("/discount/new", a.DiscountC.Form()).Methods("GET")
+	router.HandleFunc("/discount/{id:[0-9]+}/edit", a.DiscountC.Form()).Methods("GET")
+	router.HandleFunc("/discount/{id:[0-9]+}", a.DiscountC.Save()).Methods("POST").MatcherFunc(makeMatcher("patch"))
+	router.HandleFunc("/discount/{id:[0-9]+}/retire", a.DiscountC.SetActive(false)).Methods("POST")
+	router.HandleFunc("/discount/{id:[0-9]+}/restore", a.DiscountC.SetActive(true)).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/discounts", a.DiscountC.ForMember()).Methods("GET")
+	router.HandleFunc("/user/{id:[0-9]+}/discounts", a.DiscountC.Redeem()).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/discounts/grant", a.DiscountC.Grant()).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/discounts/{did:[0-9]+}", a.DiscountC.End()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/user/{id:[0-9]+}/membership", a.MembershipC.Show()).Methods("GET")
+	router.HandleFunc("/user/{id:[0-9]+}/membership/pause", a.MembershipC.Pause()).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/membership/resume", a.MembershipC.Resume()).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/membership/plan", a.MembershipC.ChangePlan()).Methods("POST")
+	router.HandleFunc("/accounting/export", a.AccountingC.Export()).Methods("GET")
+	router.HandleFunc("/accounting/export.csv", a.AccountingC.Download("csv")).Methods("GET")
+	router.HandleFunc("/accounting/export.iif", a.AccountingC.Download("iif")).Methods("GET")
+	router.HandleFunc("/bank/statements", a.BankC.Statements()).Methods("GET")
+	router.HandleFunc("/bank/statements", a.BankC.Import()).Methods("POST")
+	router.HandleFunc("/bank/statement/{id:[0-9]+}", a.BankC.Statement()).Methods("GET")
+	router.HandleFunc("/bank/reconcile", a.BankC.Reconcile()).Methods("GET")
+	router.HandleFunc("/bank/reconcile/confirm", a.BankC.ConfirmSuggested()).Methods("POST")
+	router.HandleFunc("/bank/deposit/{id:[0-9]+}/match", a.BankC.Unmatch()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/bank/deposit/{id:[0-9]+}/match", a.BankC.Match()).Methods("POST")
+	router.HandleFunc("/vouchers", a.VoucherC.List()).Methods("GET")
+	router.HandleFunc("/vouchers/buy", a.VoucherC.BuyForm()).Methods("GET")
+	router.HandleFunc("/vouchers/buy", a.VoucherC.Buy()).Methods("POST")
+	router.HandleFunc("/voucher/{id:[0-9]+}/certificate.pdf", a.VoucherC.Certificate()).Methods("GET")
+	router.HandleFunc("/voucher/{id:[0-9]+}/email", a.VoucherC.Email()).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/vouchers", a.VoucherC.ForMember()).Methods("GET")
+	router.HandleFunc("/user/{id:[0-9]+}/vouchers", a.VoucherC.Redeem()).Methods("POST")
+	router.HandleFunc("/locations", a.LocationC.List()).Methods("GET")
+	router.HandleFunc("/locations", a.LocationC.Save()).Methods("POST")
+	router.HandleFunc("/location/new", a.LocationC.Form()).Methods("GET")
+	router.HandleFunc("/location/{id:[0-9]+}/edit", a.LocationC.Form()).Methods("GET")
+	router.HandleFunc("/location/{id:[0-9]+}", a.LocationC.Save()).Methods("POST").MatcherFunc(makeMatcher("patch"))
+	router.HandleFunc("/location/{id:[0-9]+}", a.LocationC.Delete()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/areas", a.AreaC.List()).Methods("GET")
+	router.HandleFunc("/areas", a.AreaC.Save()).Methods("POST")
+	router.HandleFunc("/area/new", a.AreaC.Form()).Methods("GET")
+	router.HandleFunc("/area/{id:[0-9]+}", a.AreaC.Show()).Methods("GET")
+	router.HandleFunc("/area/{id:[0-9]+}/edit", a.AreaC.Form()).Methods("GET")
+	router.HandleFunc("/area/{id:[0-9]+}", a.AreaC.Save()).Methods("POST").MatcherFunc(makeMatcher("patch"))
+	router.HandleFunc("/area/{id:[0-9]+}", a.AreaC.Delete()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/equipment", a.EquipmentC.List()).Methods("GET")
+	router.HandleFunc("/equipment", a.EquipmentC.Save()).Methods("POST")
+	router.HandleFunc("/equipment.csv", a.EquipmentC.Export()).Methods("GET")
+	router.HandleFunc("/equipment/new", a.EquipmentC.Form()).Methods("GET")
+	router.HandleFunc("/equipment/{id:[0-9]+}", a.EquipmentC.Show()).Methods("GET")
+	router.HandleFunc("/equipment/{id:[0-9]+}/edit", a.EquipmentC.Form()).Methods("GET")
+	router.HandleFunc("/equipment/{id:[0-9]+}", a.EquipmentC.Save()).Methods("POST").MatcherFunc(makeMatcher("patch"))
+	router.HandleFunc("/equipment/{id:[0-9]+}/move", a.EquipmentC.Move()).Methods("POST")
+	router.HandleFunc("/equipment/{id:[0-9]+}/files", a.EquipmentC.Upload()).Methods("POST")
+	router.HandleFunc("/equipment/{id:[0-9]+}/file/{fid:[0-9]+}", a.EquipmentC.File()).Methods("GET")
+	router.HandleFunc("/equipment/{id:[0-9]+}/file/{fid:[0-9]+}", a.EquipmentC.DeleteFile()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/area/{id:[0-9]+}/stewards", a.AreaC.AddSteward()).Methods("POST")
+	router.HandleFunc("/area/{id:[0-9]+}/stewards/{mid:[0-9]+}", a.AreaC.RemoveSteward()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/equipment/{id:[0-9]+}/report", a.MaintenanceC.ReportForm()).Methods("GET")
+	router.HandleFunc("/equipment/{id:[0-9]+}/tickets", a.MaintenanceC.Report()).Methods("POST")
+	router.HandleFunc("/equipment/{id:[0-9]+}/maintenance", a.MaintenanceC.Schedules()).Methods("GET")
+	router.HandleFunc("/equipment/{id:[0-9]+}/maintenance", a.MaintenanceC.AddSchedule()).Methods("POST")
+	router.HandleFunc("/maintenance/{id:[0-9]+}/done", a.MaintenanceC.Done()).Methods("POST")
+	router.HandleFunc("/maintenance/{id:[0-9]+}", a.MaintenanceC.DeleteSchedule()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/tickets", a.MaintenanceC.List()).Methods("GET")
+	router.HandleFunc("/ticket/{id:[0-9]+}", a.MaintenanceC.Show()).Methods("GET")
+	router.HandleFunc("/ticket/{id:[0-9]+}", a.MaintenanceC.Update()).Methods("POST").MatcherFunc(makeMatcher("patch"))
+	router.HandleFunc("/ticket/{id:[0-9]+}/comments", a.MaintenanceC.Comment()).Methods("POST")
+	router.HandleFunc("/area/{id:[0-9]+}/reserve", a.ReservationC.Form("area")).Methods("GET")
+	router.HandleFunc("/area/{id:[0-9]+}/reservations", a.ReservationC.Reserve("area")).Methods("POST")
+	router.HandleFunc("/equipment/{id:[0-9]+}/reserve", a.ReservationC.Form("equipment")).Methods("GET")
+	router.HandleFunc("/equipment/{id:[0-9]+}/reservations", a.ReservationC.Reserve("equipment")).Methods("POST")
+	router.HandleFunc("/reservation/area/{id:[0-9]+}", a.ReservationC.Cancel("area")).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/reservation/equipment/{id:[0-9]+}", a.ReservationC.Cancel("equipment")).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/user/{id:[0-9]+}/reservations", a.ReservationC.ForMember()).Methods("GET")
+	router.HandleFunc("/location/{id:[0-9]+}/calendar", a.CalendarC.Show()).Methods("GET")
+	router.HandleFunc("/location/{id:[0-9]+}/calendar.json", a.CalendarC.JSON()).Methods("GET")
+	router.HandleFunc("/location/{id:[0-9]+}/hours", a.HoursC.Show()).Methods("GET")
+	router.HandleFunc("/location/{id:[0-9]+}/hours", a.HoursC.AddHours()).Methods("POST")
+	router.HandleFunc("/location/{id:[0-9]+}/hours/{hid:[0-9]+}", a.HoursC.DeleteHours()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/location/{id:[0-9]+}/closures", a.HoursC.AddClosure()).Methods("POST")
+	router.HandleFunc("/location/{id:[0-9]+}/closures/{cid:[0-9]+}", a.HoursC.DeleteClosure()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/location/{id:[0-9]+}/kiosk", a.KioskC.Show()).Methods("GET")
+	router.HandleFunc("/location/{id:[0-9]+}/checkins", a.KioskC.CheckIn()).Methods("POST")
+	router.HandleFunc("/event/{id:[0-9]+}/register", a.RegistrationC.Form()).Methods("GET")
+	router.HandleFunc("/event/{id:[0-9]+}/registrations", a.RegistrationC.Register()).Methods("POST")
+	router.HandleFunc("/certifications", a.CertificationC.List()).Methods("GET")
+	router.HandleFunc("/certifications", a.CertificationC.Save()).Methods("POST")
+	router.HandleFunc("/certification/new", a.CertificationC.Form()).Methods("GET")
+	router.HandleFunc("/certification/{id:[0-9]+}", a.CertificationC.Show()).Methods("GET")
+	router.HandleFunc("/certification/{id:[0-9]+}/edit", a.CertificationC.Form()).Methods("GET")
+	router.HandleFunc("/certification/{id:[0-9]+}", a.CertificationC.Save()).Methods("POST").MatcherFunc(makeMatcher("patch"))
+	router.HandleFunc("/certification/{id:[0-9]+}", a.CertificationC.Delete()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/certification/{id:[0-9]+}/resources", a.CertificationC.Link()).Methods("POST")
+	router.HandleFunc("/certification/{id:[0-9]+}/resources/{lid:[0-9]+}", a.CertificationC.Unlink()).Methods("POST").MatcherFunc(makeMatcher("delete"))
+	router.HandleFunc("/certification/{id:[0-9]+}/requests", a.ApprovalC.Request()).Methods("POST")
+	router.HandleFunc("/approvals", a.ApprovalC.Pending()).Methods("GET")
+	router.HandleFunc("/approval/{id:[0-9]+}", a.ApprovalC.Show()).Methods("GET")
+	router.HandleFunc("/approval/{id:[0-9]+}/reviews", a.ApprovalC.Review()).Methods("POST")
+	router.HandleFunc("/approval/{id:[0-9]+}/renewals", a.ApprovalC.Renew()).Methods("POST")
+	router.HandleFunc("/approval/{id:[0-9]+}/revocations", a.ApprovalC.Revoke()).Methods("POST")
+	router.HandleFunc("/approval/{id:[0-9]+}/reinstatements", a.ApprovalC.Reinstate()).Methods("POST")
+	router.HandleFunc("/user/{id:[0-9]+}/certifications", a.ApprovalC.ForMember()).Methods("GET")
+	router.HandleFunc("/area/{id:[0-9]+}/access/{mid:[0-9]+}", a.ApprovalC.Access("area")).Methods("GET")
+	router.HandleFunc("/equipment/{id:[0-9]+}/access/{mid:[0-9]+}", a.ApprovalC.Access("equipment")).Methods("GET")
+	if _, ok := a.Provider.(*payments.Fake); ok {
+		router.HandleFunc("/payments/fake/checkout/{session}", a.PaymentC.FakeCheckoutForm()).Methods("GET")
+		router.HandleFunc("/payments/fake/checkout/{session}", a.PaymentC.FakeCheckoutComplete()).Methods("POST")
+	}
+
 	//TODO: need to implement handlers for 404 and 405, then implement router.NotFoundHandler and router.MethodNotAllowedHandler
 
 	//set the app router. Alice will pass all the requests through the middleware chain first,
@@ -62,6 +62,15 @@ CREATE TABLE rbac_group_permission_rel (
 );
 COMMENT ON TABLE rbac_group_permission_rel IS 'links a specific permission to a group';
 
+-- Permissions checked by the application. Names are <resource>.<access>
+INSERT INTO rbac_permission (rbac_permission_access_id, name) VALUES
+	((SELECT id FROM rbac_permission_access WHERE name = 'read'), 'finance.read'),
+	((SELECT id FROM rbac_permission_access WHERE name = 'write'), 'finance.write'),
+	((SELECT id FROM rbac_permission_access WHERE name = 'write'), 'membership.write'),
+	((SELECT id FROM rbac_permission_access WHERE name = 'write'), 'space.write'),
+	((SELECT id FROM rbac_permission_access WHERE name = 'write'), 'certification.write'),
+	((SELECT id FROM rbac_permission_access WHERE name = 'write'), 'certification.approve');
+
 --------------------------------------------------------------------------------------------------------------------------------
 -- Member
 --------------------------------------------------------------------------------------------------------------------------------
@@ -72,18 +81,19 @@ CREATE TABLE membership_status (
     , UNIQUE (name)
 );
 COMMENT ON TABLE membership_status IS 'Holds values to indicate whether a person is an active member of MakeICT or not';
-INSERT INTO membership_status (name) VALUES ('guest'), ('active'), ('past_due'), ('quit');
+INSERT INTO membership_status (name) VALUES ('guest'), ('active'), ('past_due'), ('quit'), ('paused');
 
 CREATE TABLE membership_options (
 	id SERIAL PRIMARY KEY
 	, name TEXT NOT NULL
 	, is_recurring BOOLEAN NOT NULL DEFAULT 'f'
 	, period INTERVAL NOT NULL DEFAULT '1 month'
+	, price MONEY NOT NULL DEFAULT 0.00  -- charged each period
+	, active BOOLEAN NOT NULL DEFAULT 't'  -- retired options stay for existing members but are not offered at signup
 	, UNIQUE (name)
 );
 COMMENT ON TABLE membership_options IS 'for members only, not guests, defines when member will be charged for dues';
-INSERT INTO membership_options (name, is_recurring, period) VALUES ('One month', 'f', '0 months'), ('Recurring - monthly', 't', '1 month'), ('Recurring - 6 months', 't', '6 months'), ('Recurring - 12 months', 't', '12 months');
--- TODO implement some interface to allow admins to add or remove options
+INSERT INTO membership_options (name, is_recurring, period, price) VALUES ('One month', 'f', '1 month', '$45.00'), ('Recurring - monthly', 't', '1 month', '$40.00'), ('Recurring - 6 months', 't', '6 months', '$230.00'), ('Recurring - 12 months', 't', '12 months', '$450.00');
 
 CREATE TABLE member (
       id SERIAL PRIMARY KEY
@@ -92,6 +102,7 @@ CREATE TABLE member (
 	, password TEXT NOT NULL
     , dob DATE NOT NULL
     , phone TEXT NOT NULL
+	, text_ok BOOLEAN NOT NULL DEFAULT 'f'  -- member agreed to receive text messages
 	, membership_status_id INTEGER NOT NULL REFERENCES membership_status(id)
 	, membership_expires DATE 
 	, membership_option INTEGER REFERENCES membership_options(id)
@@ -164,20 +175,31 @@ CREATE TABLE addon_types (
 	id SERIAL PRIMARY KEY
 	, name TEXT NOT NULL
 	, monthly_cost MONEY NOT NULL
+	, capacity INTEGER CHECK (capacity > 0)  -- most members that can hold the addon at once, NULL for no limit
+	, active BOOLEAN NOT NULL DEFAULT 't'  -- retired addons stay with the members who have them but cannot be added
 	, UNIQUE (name)
 );
 COMMENT ON TABLE addon_types IS 'Types of additional services that can be purchased along with membership dues';
-INSERT INTO addon_types (name, monthly_cost) VALUES ('Locker', '$5.00'), ('Studio', '$75.00');
--- TODO add interface for admin to add and remove addons
+INSERT INTO addon_types (name, monthly_cost, capacity) VALUES ('Locker', '$5.00', NULL), ('Studio', '$75.00', 4);
 
 CREATE TABLE member_addon_rel (
 	id SERIAL PRIMARY KEY
 	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
 	, addon_id INTEGER NOT NULL REFERENCES addon_types(id) ON DELETE RESTRICT
 	, created_at TIMESTAMP NOT NULL DEFAULT now()
-	, UNIQUE (member_id, addon_id)
+	, ended_at TIMESTAMP  -- when the member removed the addon, NULL while they still have it
 );
 COMMENT ON TABLE member_addon_rel IS 'Links a member to the additional services they have purchased';
+CREATE UNIQUE INDEX member_addon_rel_current ON member_addon_rel (member_id, addon_id) WHERE ended_at IS NULL;
+
+CREATE TABLE addon_waitlist (
+	id SERIAL PRIMARY KEY
+	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
+	, addon_id INTEGER NOT NULL REFERENCES addon_types(id) ON DELETE CASCADE
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, UNIQUE (member_id, addon_id)
+);
+COMMENT ON TABLE addon_waitlist IS 'Members waiting for a place on an addon that is at capacity, first come first served';
 
 CREATE TABLE member_recurring_donation (
 	id SERIAL PRIMARY KEY
@@ -189,22 +211,6 @@ CREATE TABLE member_recurring_donation (
 );
 COMMENT ON TABLE member_recurring_donation IS 'If a member chooses to support with an additionaly monthly donations, it is stored here';
 
-CREATE TABLE locker (
-	id serial PRIMARY KEY
-	, locker_id TEXT NOT NULL
-	, UNIQUE (locker_id)
-);
-COMMENT ON TABLE locker IS 'list of lockers that can be rented';
--- TODO add interface so that admin can manage lockers
-
-CREATE TABLE member_locker_rel (
-	id SERIAL PRIMARY KEY
-	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
-	, locker_id INTEGER NOT NULL REFERENCES locker(id) ON DELETE RESTRICT
-	, UNIQUE (member_id, locker_id)
-);
-COMMENT ON TABLE member_locker_rel IS 'Records which member has which locker';
-
 --------------------------------------------------------------------------------------------------------------------------------
 -- Invoice and Payment
 --------------------------------------------------------------------------------------------------------------------------------
@@ -232,10 +238,42 @@ CREATE TABLE payment (
 	, amount MONEY NOT NULL DEFAULT 0.00
 	, member_id INTEGER NOT NULL REFERENCES member(id)
 	, payment_method_id INTEGER NOT NULL REFERENCES payment_method(id)
+	, provider_ref TEXT  -- id of the charge at the online payment provider, NULL for cash and check
+	, check_number TEXT  -- for matching check deposits on bank statements
+	, invoice_id INTEGER  -- the invoice the payment is for, which it may only pay part of
+	, recorded_by INTEGER REFERENCES member(id)  -- who entered a cash or check payment, NULL for online payments
+	, reconciled_at TIMESTAMP  -- when the payment was matched to a deposit on a bank statement, NULL until then
 	, created_at TIMESTAMP NOT NULL DEFAULT now()  -- TODO changes diagram
+	, UNIQUE (provider_ref)
 );
 COMMENT ON TABLE payment IS 'Holds payment history for members';
 
+CREATE TABLE bank_statement (
+	id SERIAL PRIMARY KEY
+	, filename TEXT NOT NULL
+	, format TEXT NOT NULL  -- ofx or csv
+	, imported_by INTEGER REFERENCES member(id) ON DELETE SET NULL
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+COMMENT ON TABLE bank_statement IS 'Bank statements imported for reconciling deposits with payments';
+
+CREATE TABLE bank_statement_line (
+	id SERIAL PRIMARY KEY
+	, statement_id INTEGER NOT NULL REFERENCES bank_statement(id) ON DELETE CASCADE
+	, posted_on DATE NOT NULL
+	, amount MONEY NOT NULL CHECK (amount > '$0.00')  -- only deposits are imported
+	, description TEXT NOT NULL DEFAULT ''
+	, check_number TEXT
+	, bank_ref TEXT NOT NULL  -- the bank's id for the transaction, or one made from its details, so that overlapping statements do not import it twice
+	, suggested_payment_id INTEGER REFERENCES payment(id) ON DELETE SET NULL  -- the likely match, waiting for the treasurer to confirm it
+	, payment_id INTEGER REFERENCES payment(id) ON DELETE SET NULL  -- the confirmed match
+	, matched_by INTEGER REFERENCES member(id) ON DELETE SET NULL
+	, matched_at TIMESTAMP
+	, UNIQUE (bank_ref)
+);
+CREATE UNIQUE INDEX bank_statement_line_payment ON bank_statement_line (payment_id) WHERE payment_id IS NOT NULL;
+COMMENT ON TABLE bank_statement_line IS 'Deposits on an imported bank statement, and the payments they were matched to';
+
 CREATE TABLE invoice (
 	id SERIAL PRIMARY KEY
 	, amount MONEY NOT NULL DEFAULT 0.00
@@ -243,9 +281,179 @@ CREATE TABLE invoice (
 	, member_id INTEGER NOT NULL REFERENCES member(id) 
 	, payment_id INTEGER REFERENCES payment(id)
 	, status_id INTEGER REFERENCES invoice_status(id)
+	, due_date DATE NOT NULL DEFAULT CURRENT_DATE
 	, created_at TIMESTAMP NOT NULL DEFAULT now()   
 );
 COMMENT ON TABLE invoice IS 'Records an amount that a member owes for dues, class fees, or other fees';
+ALTER TABLE payment ADD FOREIGN KEY (invoice_id) REFERENCES invoice(id);
+
+CREATE TABLE membership_renewal (
+	id SERIAL PRIMARY KEY
+	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
+	, period_start DATE NOT NULL
+	, period_end DATE NOT NULL
+	, invoice_id INTEGER REFERENCES invoice(id)
+	, settled_at TIMESTAMP  -- when the invoice was paid and the membership extended, NULL until then
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, UNIQUE (member_id, period_start)
+);
+COMMENT ON TABLE membership_renewal IS 'Dues periods that have been invoiced, so that a period is never billed twice';
+
+CREATE TABLE member_credit (
+	id SERIAL PRIMARY KEY
+	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
+	, amount MONEY NOT NULL
+	, description TEXT NOT NULL
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, invoice_id INTEGER REFERENCES invoice(id)  -- the invoice the credit was taken off, NULL until then
+);
+COMMENT ON TABLE member_credit IS 'Money owed back to a member, e.g. for the unused part of a removed addon or an overpaid invoice. Taken off their next renewal invoice';
+
+CREATE TABLE line_item_category (
+	id SERIAL PRIMARY KEY
+	, name TEXT NOT NULL
+	, UNIQUE (name)
+);
+COMMENT ON TABLE line_item_category IS 'What an invoice line is for. Donations are acknowledged separately for tax purposes';
+INSERT INTO line_item_category(name) VALUES ('dues'), ('addon'), ('event_fee'), ('material_fee'), ('donation'), ('discount'), ('other'), ('gift_voucher');
+
+CREATE TABLE invoice_line_item (
+	id SERIAL PRIMARY KEY
+	, invoice_id INTEGER NOT NULL REFERENCES invoice(id) ON DELETE CASCADE
+	, category_id INTEGER NOT NULL REFERENCES line_item_category(id)
+	, description TEXT NOT NULL
+	, quantity INTEGER NOT NULL DEFAULT 1 CHECK (quantity > 0)
+	, unit_amount MONEY NOT NULL
+	, membership_option_id INTEGER REFERENCES membership_options(id) ON DELETE SET NULL  -- the membership a dues line is for
+	, event_id INTEGER  -- the event a fee line is for, references event below
+);
+COMMENT ON TABLE invoice_line_item IS 'The individual charges that make up an invoice. Invoices without lines are shown as a single line';
+
+CREATE TABLE invoice_reminder (
+	id SERIAL PRIMARY KEY
+	, invoice_id INTEGER NOT NULL REFERENCES invoice(id) ON DELETE CASCADE
+	, step TEXT NOT NULL     -- name of the step in the reminder schedule
+	, channel TEXT NOT NULL  -- email or sms
+	, sent_at TIMESTAMP NOT NULL DEFAULT now()
+	, UNIQUE (invoice_id, step, channel)
+);
+COMMENT ON TABLE invoice_reminder IS 'Payment reminders sent for an invoice, so that each step of the schedule is only sent once';
+
+CREATE TABLE discount_kind (
+	id SERIAL PRIMARY KEY
+	, name TEXT NOT NULL
+	, UNIQUE (name)
+);
+COMMENT ON TABLE discount_kind IS 'How a discount reduces a charge: a percentage off, a fixed amount off, or free';
+INSERT INTO discount_kind (name) VALUES ('percent'), ('fixed'), ('free');
+
+CREATE TABLE discount (
+	id SERIAL PRIMARY KEY
+	, name TEXT NOT NULL  -- shown on invoices, e.g. 'Student discount'
+	, code TEXT  -- members can redeem the discount with this code. NULL for discounts that only an admin can grant, like comped memberships
+	, kind_id INTEGER NOT NULL REFERENCES discount_kind(id)
+	, percent_off SMALLINT NOT NULL DEFAULT 0 CHECK (percent_off BETWEEN 0 AND 100)  -- for percent discounts
+	, amount_off MONEY NOT NULL DEFAULT '$0.00'  -- for fixed discounts, taken off each invoice
+	, periods INTEGER CHECK (periods > 0)  -- how many invoices the discount is applied to for each member, NULL for no limit
+	, applies_to_dues BOOLEAN NOT NULL DEFAULT 't'
+	, applies_to_events BOOLEAN NOT NULL DEFAULT 'f'  -- event and material fees
+	, max_uses INTEGER CHECK (max_uses > 0)  -- how many members can be given the discount, NULL for no limit
+	, expires_on DATE  -- the code cannot be redeemed and the discount is no longer applied after this date
+	, active BOOLEAN NOT NULL DEFAULT 't'
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, UNIQUE (name)
+	, UNIQUE (code)
+);
+COMMENT ON TABLE discount IS 'Discount codes, scholarships and comped memberships that reduce dues or event fees';
+
+CREATE TABLE member_discount (
+	id SERIAL PRIMARY KEY
+	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
+	, discount_id INTEGER NOT NULL REFERENCES discount(id) ON DELETE RESTRICT
+	, periods_left INTEGER  -- counts down each time the discount is applied, NULL for no limit
+	, granted_by INTEGER REFERENCES member(id) ON DELETE SET NULL  -- the admin who granted it, NULL if the member redeemed a code
+	, note TEXT NOT NULL DEFAULT ''
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, ended_at TIMESTAMP
+	, UNIQUE (member_id, discount_id)
+);
+COMMENT ON TABLE member_discount IS 'Discounts given to a member. They are applied whenever an invoice is generated for the member until they run out or are ended';
+
+CREATE TABLE discount_use (
+	id SERIAL PRIMARY KEY
+	, member_discount_id INTEGER NOT NULL REFERENCES member_discount(id) ON DELETE CASCADE
+	, invoice_id INTEGER NOT NULL REFERENCES invoice(id) ON DELETE CASCADE
+	, amount MONEY NOT NULL
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+COMMENT ON TABLE discount_use IS 'Each time a discount was taken off an invoice, and by how much';
+
+CREATE TABLE membership_pause (
+	id SERIAL PRIMARY KEY
+	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
+	, starts_on DATE NOT NULL
+	, ends_on DATE NOT NULL CHECK (ends_on > starts_on)  -- when the member is resumed unless they come back sooner
+	, resumed_at TIMESTAMP
+	, fee_invoice_id INTEGER REFERENCES invoice(id)
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX membership_pause_current ON membership_pause (member_id) WHERE resumed_at IS NULL;
+COMMENT ON TABLE membership_pause IS 'Memberships frozen while the member is away. Dues are not invoiced and the membership expiry is pushed back by the length of the pause';
+
+CREATE TABLE membership_change_kind (
+	id SERIAL PRIMARY KEY
+	, name TEXT NOT NULL
+	, UNIQUE (name)
+);
+COMMENT ON TABLE membership_change_kind IS 'Kinds of change to a membership that are recorded in its history';
+INSERT INTO membership_change_kind (name) VALUES ('pause'), ('resume'), ('plan_change');
+
+CREATE TABLE membership_change (
+	id SERIAL PRIMARY KEY
+	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
+	, kind_id INTEGER NOT NULL REFERENCES membership_change_kind(id)
+	, from_option_id INTEGER REFERENCES membership_options(id)
+	, to_option_id INTEGER REFERENCES membership_options(id)
+	, expires_before DATE
+	, expires_after DATE
+	, credit MONEY NOT NULL DEFAULT '$0.00'  -- for the unused part of the old plan
+	, invoice_id INTEGER REFERENCES invoice(id)  -- the pause fee, or the new plan
+	, changed_by INTEGER REFERENCES member(id) ON DELETE SET NULL  -- NULL when the change was made automatically
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+COMMENT ON TABLE membership_change IS 'History of pauses, resumptions and plan changes for each membership';
+
+CREATE TABLE payment_checkout (
+	id SERIAL PRIMARY KEY
+	, invoice_id INTEGER NOT NULL REFERENCES invoice(id) ON DELETE CASCADE
+	, session_id TEXT NOT NULL  -- id of the checkout session at the payment provider
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, completed_at TIMESTAMP
+	, UNIQUE (session_id)
+);
+COMMENT ON TABLE payment_checkout IS 'Checkout sessions started with the online payment provider for an invoice';
+
+CREATE TABLE payment_webhook_event (
+	id SERIAL PRIMARY KEY
+	, event_id TEXT NOT NULL
+	, event_type TEXT NOT NULL
+	, received_at TIMESTAMP NOT NULL DEFAULT now()
+	, UNIQUE (event_id)
+);
+COMMENT ON TABLE payment_webhook_event IS 'Webhook events already processed, so that a redelivered event is never recorded twice';
+
+CREATE TABLE member_payment_method (
+	id SERIAL PRIMARY KEY
+	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
+	, provider_customer_id TEXT NOT NULL
+	, provider_method_id TEXT NOT NULL
+	, brand TEXT NOT NULL DEFAULT ''
+	, last4 TEXT NOT NULL DEFAULT ''
+	, is_default BOOLEAN NOT NULL DEFAULT 'f'
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, UNIQUE (provider_method_id)
+);
+COMMENT ON TABLE member_payment_method IS 'Cards or accounts a member has saved with the payment provider for recurring dues. Only references are stored, never card numbers';
 
 --------------------------------------------------------------------------------------------------------------------------------
 -- Locations, Areas and Equipment
@@ -262,25 +470,218 @@ CREATE TABLE location (
 	, UNIQUE (name)
 );
 COMMENT ON TABLE location IS 'General locations, not specific rooms';
--- admin interface for creating/removing locations
+
+CREATE TABLE location_hours (
+	id SERIAL PRIMARY KEY
+	, location_id INTEGER NOT NULL REFERENCES location(id) ON DELETE CASCADE
+	, weekday INTEGER NOT NULL CHECK (weekday BETWEEN 0 AND 6)  -- 0 is Sunday, as in EXTRACT(DOW ...)
+	, opens TIME NOT NULL
+	, closes TIME NOT NULL  -- 24:00 to stay open until midnight
+	, CHECK (closes > opens)
+);
+COMMENT ON TABLE location_hours IS 'The weekly open hours of a location. A location with no hours is always open';
+
+CREATE TABLE location_closure (
+	id SERIAL PRIMARY KEY
+	, location_id INTEGER NOT NULL REFERENCES location(id) ON DELETE CASCADE
+	, during TSRANGE NOT NULL
+	, reason TEXT NOT NULL  -- shown to members, like 'Thanksgiving' or 'Floor refinishing'
+	, created_by INTEGER REFERENCES member(id) ON DELETE SET NULL
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+COMMENT ON TABLE location_closure IS 'Holidays and other times a location is closed, whatever its open hours';
+
+CREATE FUNCTION location_open(loc INTEGER, starts TIMESTAMP, ends TIMESTAMP) RETURNS BOOLEAN AS $$
+	SELECT (
+		NOT EXISTS (SELECT 1 FROM location_hours WHERE location_id = loc)
+		OR EXISTS (
+			SELECT 1 FROM location_hours
+			WHERE location_id = loc
+			AND weekday = EXTRACT(DOW FROM starts)
+			AND starts >= starts::date + opens
+			AND ends <= starts::date + closes)
+	) AND NOT EXISTS (
+		SELECT 1 FROM location_closure
+		WHERE location_id = loc AND during && tsrange(starts, ends, CASE WHEN starts = ends THEN '[]' ELSE '[)' END))
+$$ LANGUAGE SQL STABLE;
+COMMENT ON FUNCTION location_open(INTEGER, TIMESTAMP, TIMESTAMP) IS 'Whether a location is open for the whole of a period within one day, or at a moment if starts and ends are the same';
+
+CREATE TABLE location_checkin (
+	id SERIAL PRIMARY KEY
+	, location_id INTEGER NOT NULL REFERENCES location(id) ON DELETE CASCADE
+	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
+	, checked_in_at TIMESTAMP NOT NULL DEFAULT now()
+	, checked_in_by INTEGER REFERENCES member(id) ON DELETE SET NULL  -- who was logged in at the kiosk
+	, outside_hours BOOLEAN NOT NULL DEFAULT 'f'  -- set when an admin let the member in while the location was closed
+);
+COMMENT ON TABLE location_checkin IS 'Members checking in at the kiosk of a location';
 
 CREATE TABLE area (
       id SERIAL PRIMARY KEY
+    , location_id INTEGER NOT NULL REFERENCES location(id) ON DELETE RESTRICT
     , name TEXT NOT NULL
+    , capacity INTEGER CHECK (capacity > 0)  -- how many people can use the area at once. NULL if there is no limit
+    , description TEXT NOT NULL DEFAULT ''
+    -- limits on members reserving it for themselves. NULL if there is no limit
+    , max_reservation_minutes INTEGER CHECK (max_reservation_minutes > 0)  -- longest a single reservation can be
+    , advance_days INTEGER CHECK (advance_days > 0)  -- how many days ahead it can be reserved
+    , member_quota INTEGER CHECK (member_quota > 0)  -- how many upcoming reservations one member can hold at once
     , UNIQUE (name)
 );
-COMMENT ON TABLE area IS 'Lists all the areas available for reservation or use. Needs to have a location';
--- TODO add area management to the wireframes
+COMMENT ON TABLE area IS 'Lists all the areas available for reservation or use, and the location they are in';
+
+CREATE TABLE locker_size (
+	id SERIAL PRIMARY KEY
+	, name TEXT NOT NULL
+	, UNIQUE (name)
+);
+COMMENT ON TABLE locker_size IS 'Sizes of locker';
+INSERT INTO locker_size (name) VALUES ('small'), ('medium'), ('large');
+
+CREATE TABLE locker (
+	id serial PRIMARY KEY
+	, locker_id TEXT NOT NULL  -- the number or name marked on the locker
+	, size_id INTEGER NOT NULL REFERENCES locker_size(id)
+	, area_id INTEGER REFERENCES area(id) ON DELETE RESTRICT
+	, active BOOLEAN NOT NULL DEFAULT 't'  -- retired lockers are kept for history but never assigned
+	, needs_clearing BOOLEAN NOT NULL DEFAULT 'f'  -- released without the member emptying it; not offered again until an admin has cleared it
+	, UNIQUE (locker_id)
+);
+COMMENT ON TABLE locker IS 'list of lockers that can be rented';
+
+CREATE TABLE member_locker_rel (
+	id SERIAL PRIMARY KEY
+	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
+	, locker_id INTEGER NOT NULL REFERENCES locker(id) ON DELETE RESTRICT
+	, assigned_at TIMESTAMP NOT NULL DEFAULT now()
+	, released_at TIMESTAMP  -- NULL while the member still has the locker
+	, release_reason TEXT
+);
+COMMENT ON TABLE member_locker_rel IS 'Records which member has which locker, and who had it before';
+CREATE UNIQUE INDEX member_locker_rel_current_locker ON member_locker_rel (locker_id) WHERE released_at IS NULL;
+CREATE UNIQUE INDEX member_locker_rel_current_member ON member_locker_rel (member_id) WHERE released_at IS NULL;
+
+CREATE TABLE locker_waitlist (
+	id SERIAL PRIMARY KEY
+	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, offered_locker_id INTEGER REFERENCES locker(id) ON DELETE SET NULL  -- a free locker held for this member to claim
+	, offer_expires TIMESTAMP
+	, UNIQUE (member_id)
+	, UNIQUE (offered_locker_id)
+);
+COMMENT ON TABLE locker_waitlist IS 'Members waiting for a locker, first come first served. A freed locker is offered to the first member for a limited time';
+
+CREATE TABLE equipment_status (
+	id SERIAL PRIMARY KEY
+	, name TEXT NOT NULL
+	, UNIQUE (name)
+);
+COMMENT ON TABLE equipment_status IS 'Whether equipment can be used. Retired equipment is kept for history but no longer listed for members';
+INSERT INTO equipment_status (name) VALUES ('available'), ('out_of_service'), ('retired');
 
 CREATE TABLE equipment (
       id SERIAL PRIMARY KEY
     , area_id INTEGER NOT NULL REFERENCES area(id) ON DELETE RESTRICT
     , name TEXT NOT NULL
+    , manufacturer TEXT NOT NULL DEFAULT ''
+    , model TEXT NOT NULL DEFAULT ''
+    , serial_number TEXT NOT NULL DEFAULT ''
+    , asset_tag TEXT  -- the organization's own inventory label, NULL if the equipment is not tagged
+    , purchase_price MONEY CHECK (purchase_price >= '$0.00')
+    , purchased_on DATE
+    , status_id INTEGER NOT NULL REFERENCES equipment_status(id) ON DELETE RESTRICT
+    , notes TEXT NOT NULL DEFAULT ''
     , brought_at TIMESTAMP
+    -- limits on members reserving it for themselves. NULL if there is no limit
+    , max_reservation_minutes INTEGER CHECK (max_reservation_minutes > 0)  -- longest a single reservation can be
+    , advance_days INTEGER CHECK (advance_days > 0)  -- how many days ahead it can be reserved
+    , member_quota INTEGER CHECK (member_quota > 0)  -- how many upcoming reservations one member can hold at once
     , created_at TIMESTAMP NOT NULL DEFAULT now()
+    , UNIQUE (asset_tag)
 );
 COMMENT ON TABLE equipment IS 'Lists all the equipment owned by the organization and what area it is in';
--- TODO add equipment management to the wireframes
+
+CREATE TABLE equipment_move (
+	id SERIAL PRIMARY KEY
+	, equipment_id INTEGER NOT NULL REFERENCES equipment(id) ON DELETE CASCADE
+	, from_area_id INTEGER NOT NULL REFERENCES area(id) ON DELETE RESTRICT
+	, to_area_id INTEGER NOT NULL REFERENCES area(id) ON DELETE RESTRICT
+	, moved_by INTEGER REFERENCES member(id) ON DELETE SET NULL
+	, note TEXT NOT NULL DEFAULT ''
+	, moved_at TIMESTAMP NOT NULL DEFAULT now()
+);
+COMMENT ON TABLE equipment_move IS 'History of equipment being moved from one area to another';
+
+CREATE TABLE equipment_file_kind (
+	id SERIAL PRIMARY KEY
+	, name TEXT NOT NULL
+	, UNIQUE (name)
+);
+COMMENT ON TABLE equipment_file_kind IS 'The kinds of file that can be attached to equipment';
+INSERT INTO equipment_file_kind (name) VALUES ('photo'), ('manual');
+
+CREATE TABLE equipment_file (
+	id SERIAL PRIMARY KEY
+	, equipment_id INTEGER NOT NULL REFERENCES equipment(id) ON DELETE CASCADE
+	, kind_id INTEGER NOT NULL REFERENCES equipment_file_kind(id) ON DELETE RESTRICT
+	, filename TEXT NOT NULL
+	, content_type TEXT NOT NULL
+	, data BYTEA NOT NULL
+	, uploaded_by INTEGER REFERENCES member(id) ON DELETE SET NULL
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+COMMENT ON TABLE equipment_file IS 'Photos and manuals uploaded for a piece of equipment';
+
+CREATE TABLE area_steward (
+	id SERIAL PRIMARY KEY
+	, area_id INTEGER NOT NULL REFERENCES area(id) ON DELETE CASCADE
+	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
+	, UNIQUE (area_id, member_id)
+);
+COMMENT ON TABLE area_steward IS 'Members who look after an area and its equipment, and are assigned its maintenance tickets';
+
+CREATE TABLE maintenance_status (
+	id SERIAL PRIMARY KEY
+	, name TEXT NOT NULL
+	, UNIQUE (name)
+);
+COMMENT ON TABLE maintenance_status IS 'Where a maintenance ticket is in being fixed';
+INSERT INTO maintenance_status (name) VALUES ('open'), ('in_progress'), ('resolved');
+
+CREATE TABLE maintenance_ticket (
+	id SERIAL PRIMARY KEY
+	, equipment_id INTEGER NOT NULL REFERENCES equipment(id) ON DELETE CASCADE
+	, title TEXT NOT NULL
+	, description TEXT NOT NULL DEFAULT ''
+	, status_id INTEGER NOT NULL REFERENCES maintenance_status(id) ON DELETE RESTRICT
+	, out_of_service BOOLEAN NOT NULL DEFAULT 'f'  -- the equipment cannot be used until the ticket is resolved
+	, reported_by INTEGER REFERENCES member(id) ON DELETE SET NULL
+	, assigned_to INTEGER REFERENCES member(id) ON DELETE SET NULL
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, resolved_at TIMESTAMP
+);
+COMMENT ON TABLE maintenance_ticket IS 'Problems with equipment reported by members, and the area steward fixing them';
+
+CREATE TABLE maintenance_comment (
+	id SERIAL PRIMARY KEY
+	, ticket_id INTEGER NOT NULL REFERENCES maintenance_ticket(id) ON DELETE CASCADE
+	, member_id INTEGER REFERENCES member(id) ON DELETE SET NULL
+	, body TEXT NOT NULL
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+COMMENT ON TABLE maintenance_comment IS 'Discussion of a maintenance ticket';
+
+CREATE TABLE maintenance_schedule (
+	id SERIAL PRIMARY KEY
+	, equipment_id INTEGER NOT NULL REFERENCES equipment(id) ON DELETE CASCADE
+	, task TEXT NOT NULL
+	, interval_days INTEGER NOT NULL CHECK (interval_days > 0)
+	, last_done_on DATE
+	, next_due_on DATE NOT NULL
+	, reminded_for DATE  -- the due date a reminder was last sent for, so each due date is only reminded once
+);
+COMMENT ON TABLE maintenance_schedule IS 'Preventive maintenance that needs to be done on equipment every so many days';
 
 --------------------------------------------------------------------------------------------------------------------------------
 -- Certifications
@@ -289,37 +690,77 @@ COMMENT ON TABLE equipment IS 'Lists all the equipment owned by the organization
 CREATE TABLE certification (
 	id SERIAL PRIMARY KEY
 	, name TEXT NOT NULL
+	, description TEXT NOT NULL DEFAULT ''
+	, valid_days INTEGER CHECK (valid_days > 0)  -- how long a member's certification lasts, NULL if it never expires
+	, approvals_required INTEGER NOT NULL DEFAULT 1 CHECK (approvals_required BETWEEN 1 AND 2)  -- 2 for dangerous tools
 	, created_at TIMESTAMP NOT NULL DEFAULT now()
 	, UNIQUE (name)
 );
 COMMENT ON TABLE certification IS 'Records the different kinds of certifications that a member can have';
--- Is certification management part of equipment management (e.g. you indicate that equipment needs cert from the equipment edit page), or separate?
+-- certifications are managed on their own pages and linked to equipment and areas from there
 
-CREATE TABLE member_certification (  -- does this need a status-active/status-revoked?
+CREATE TABLE certification_prerequisite (
+	id SERIAL PRIMARY KEY
+	, certification_id INTEGER NOT NULL REFERENCES certification(id) ON DELETE CASCADE
+	, prerequisite_id INTEGER NOT NULL REFERENCES certification(id) ON DELETE RESTRICT
+	, UNIQUE (certification_id, prerequisite_id)
+	, CHECK (certification_id <> prerequisite_id)
+);
+COMMENT ON TABLE certification_prerequisite IS 'The certifications a member must already hold before they can be certified on another';
+
+CREATE TABLE member_certification (
 	id SERIAL PRIMARY KEY
 	, member_id INTEGER NOT NULL REFERENCES member(id) ON DELETE CASCADE
 	, certification_id INTEGER NOT NULL REFERENCES certification(id) ON DELETE RESTRICT
+	, status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected', 'revoked'))
+	, requested_at TIMESTAMP NOT NULL DEFAULT now()  -- when it was last asked for, so earlier reviews do not count
+	, decided_at TIMESTAMP  -- when it was approved or rejected
+	, expires_on DATE  -- the last day it is valid, NULL if the certification never expires
+	, reminded_for DATE  -- the expiry the member was last reminded to renew for
 	, created_at TIMESTAMP NOT NULL DEFAULT now()
 	, UNIQUE (member_id, certification_id)
 );
-COMMENT ON TABLE member_certification IS 'Records the certifications that a member has';
+COMMENT ON TABLE member_certification IS 'Records the certifications that a member has or has asked to be signed off on';
 
 CREATE TABLE certification_approval (
 	id SERIAL PRIMARY KEY
 	, member_certification_id INTEGER NOT NULL REFERENCES member_certification(id) ON DELETE CASCADE
 	, approver_id INTEGER NOT NULL REFERENCES member(id) ON DELETE RESTRICT
+	, approved BOOLEAN NOT NULL DEFAULT 't'  -- false if the approver rejected it
+	, notes TEXT NOT NULL DEFAULT ''
 	, created_at TIMESTAMP NOT NULL DEFAULT now()
-	, UNIQUE (member_certification_id, approver_id)
 );
-COMMENT ON TABLE certification_approval IS 'Records the person that approved the certification. membver certification is not valid without an approval';
+COMMENT ON TABLE certification_approval IS 'Records each sign-off or rejection of a member certification. A member certification is not valid until it has as many sign-offs as the certification requires';
+
+CREATE TABLE member_certification_history (
+	id SERIAL PRIMARY KEY
+	, member_certification_id INTEGER NOT NULL REFERENCES member_certification(id) ON DELETE CASCADE
+	, action TEXT NOT NULL CHECK (action IN ('requested', 'approved', 'rejected', 'renewed', 'revoked', 'reinstated'))
+	, reason TEXT NOT NULL DEFAULT ''  -- such as the safety violation a certification was revoked for
+	, by_id INTEGER REFERENCES member(id) ON DELETE SET NULL
+	, expires_on DATE  -- when it expires after this, for approvals and renewals
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+COMMENT ON TABLE member_certification_history IS 'Everything that happened to a member certification, for its full history';
+
+CREATE FUNCTION member_certified(member INTEGER, cert INTEGER) RETURNS BOOLEAN AS $$
+	SELECT EXISTS (
+		SELECT 1 FROM member_certification
+		WHERE member_id = member AND certification_id = cert AND status = 'approved'
+		AND (expires_on IS NULL OR expires_on >= CURRENT_DATE))
+$$ LANGUAGE SQL STABLE;
+COMMENT ON FUNCTION member_certified(INTEGER, INTEGER) IS 'Whether a member holds a certification that has not expired or been revoked. Every access check goes through this';
 
 CREATE TABLE certification_resource_rel (
 	id SERIAL PRIMARY KEY
 	, certification_id INTEGER NOT NULL REFERENCES certification(id) ON DELETE CASCADE
-	, equipment_id INTEGER NOT NULL REFERENCES equipment(id) ON DELETE RESTRICT
-	, area_id INTEGER NOT NULL REFERENCES area(id)
+	, equipment_id INTEGER REFERENCES equipment(id) ON DELETE CASCADE
+	, area_id INTEGER REFERENCES area(id) ON DELETE CASCADE  -- covers the area and all the equipment in it
+	, CHECK ((equipment_id IS NULL) <> (area_id IS NULL))
+	, UNIQUE (certification_id, equipment_id)
+	, UNIQUE (certification_id, area_id)
 );
-COMMENT ON TABLE certification_resource_rel IS 'Links a certification to the resources to which it grants access';
+COMMENT ON TABLE certification_resource_rel IS 'Links a certification to the single piece of equipment or whole area to which it grants access';
 
 -- event checkin and certification approval need to be figured out in the wireframes
 
@@ -343,8 +784,23 @@ CREATE TABLE event (
 	, requires_fees BOOLEAN NOT NULL DEFAULT 'f'
 	, requires_prerequisites BOOLEAN NOT NULL DEFAULT 'f'
     , grants_certifications BOOLEAN NOT NULL DEFAULT 'f'
+    , outside_hours BOOLEAN NOT NULL DEFAULT 'f'  -- set by an admin to hold the event while the location is closed
 );
 COMMENT ON TABLE event IS 'Master Event List';
+ALTER TABLE invoice_line_item ADD FOREIGN KEY (event_id) REFERENCES event(id) ON DELETE SET NULL;
+
+CREATE FUNCTION event_in_open_hours() RETURNS trigger AS $$
+BEGIN
+	IF NOT NEW.outside_hours AND NOT location_open(NEW.location_id, lower(NEW.during), upper(NEW.during)) THEN
+		RAISE EXCEPTION 'location % is closed during %', NEW.location_id, NEW.during USING ERRCODE = 'check_violation';
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER event_open_hours BEFORE INSERT OR UPDATE OF during, location_id, outside_hours ON event
+	FOR EACH ROW EXECUTE PROCEDURE event_in_open_hours();
+COMMENT ON TRIGGER event_open_hours ON event IS 'Events can only be held while their location is open, unless an admin overrides it';
 
 CREATE TABLE event_materials (
 	id SERIAL PRIMARY KEY
@@ -380,10 +836,14 @@ CREATE TABLE refund_policy (
 	id SERIAL PRIMARY KEY
 	, name TEXT NOT NULL
 	, description TEXT NOT NULL
+	, full_refund_days INTEGER CHECK (full_refund_days >= 0)  -- full refund until this many days before the event starts. NULL if there is never a full refund
+	, partial_refund_percent SMALLINT NOT NULL DEFAULT 0 CHECK (partial_refund_percent BETWEEN 0 AND 100)  -- after that, until the event starts. Nothing once it has started
 	, UNIQUE (name)
 );
-COMMENT ON TABLE refund_policy IS 'Text description of how and when a member might get a refund if they do not attend a paid-for event';
--- TODO add refund policy management to the wireframes
+COMMENT ON TABLE refund_policy IS 'How and when a member might get a refund if they do not attend a paid-for event. The description is shown to members, the rules are used to calculate the refund';
+INSERT INTO refund_policy (name, description, full_refund_days, partial_refund_percent) VALUES
+	('Standard', 'Full refund up to 7 days before the event, 50% refund until the event starts, no refund after the event has started.', 7, 50),
+	('Non-refundable', 'Fees for this event cannot be refunded.', NULL, 0);
 
 CREATE TABLE event_fees (
 	id SERIAL PRIMARY KEY
@@ -395,6 +855,47 @@ CREATE TABLE event_fees (
 );
 COMMENT ON TABLE event_fees IS 'Sets up the fees for a specific event';
 
+CREATE TABLE gift_voucher_kind (
+	id SERIAL PRIMARY KEY
+	, name TEXT NOT NULL
+	, UNIQUE (name)
+);
+COMMENT ON TABLE gift_voucher_kind IS 'What a gift voucher can be spent on: anything (value), membership dues (membership), or event fees (event)';
+INSERT INTO gift_voucher_kind (name) VALUES ('value'), ('membership'), ('event');
+
+CREATE TABLE gift_voucher (
+	id SERIAL PRIMARY KEY
+	, code TEXT NOT NULL  -- given to the recipient to redeem the voucher
+	, kind_id INTEGER NOT NULL REFERENCES gift_voucher_kind(id)
+	, amount MONEY NOT NULL CHECK (amount > '$0.00')  -- what the purchaser paid, and what the voucher is worth
+	, balance MONEY NOT NULL  -- what is left to spend
+	, membership_option_id INTEGER REFERENCES membership_options(id) ON DELETE RESTRICT  -- the membership a membership voucher was bought for
+	, event_id INTEGER REFERENCES event(id) ON DELETE RESTRICT  -- the event an event voucher was bought for
+	, purchaser_id INTEGER NOT NULL REFERENCES member(id) ON DELETE RESTRICT
+	, invoice_id INTEGER NOT NULL REFERENCES invoice(id)  -- the purchase. The voucher cannot be redeemed until it is paid
+	, recipient_name TEXT NOT NULL
+	, recipient_email TEXT NOT NULL DEFAULT ''
+	, message TEXT NOT NULL DEFAULT ''  -- printed on the gift certificate
+	, expires_on DATE  -- NULL if it does not expire
+	, redeemed_by INTEGER REFERENCES member(id) ON DELETE SET NULL  -- the member whose invoices the balance is taken off
+	, redeemed_at TIMESTAMP
+	, emailed_at TIMESTAMP  -- when the gift certificate was last emailed to the recipient
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, UNIQUE (code)
+	, CHECK (balance >= '$0.00' AND balance <= amount)
+);
+COMMENT ON TABLE gift_voucher IS 'Prepaid vouchers bought for someone else, redeemed with a code and spent on their invoices until the balance runs out';
+
+CREATE TABLE gift_voucher_use (
+	id SERIAL PRIMARY KEY
+	, voucher_id INTEGER NOT NULL REFERENCES gift_voucher(id) ON DELETE CASCADE
+	, invoice_id INTEGER NOT NULL REFERENCES invoice(id) ON DELETE CASCADE
+	, amount MONEY NOT NULL
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, UNIQUE (voucher_id, invoice_id)
+);
+COMMENT ON TABLE gift_voucher_use IS 'How much of a gift voucher was taken off each invoice';
+
 CREATE TABLE event_prerequisites_rel (
 	id SERIAL PRIMARY KEY
 	, certification_id INTEGER NOT NULL REFERENCES certification(id) ON DELETE RESTRICT
@@ -426,12 +927,67 @@ CREATE TABLE member_event_registration (
 	, checked_in_status_id INTEGER NOT NULL REFERENCES checked_in_status(id) ON DELETE RESTRICT
 	, payment_status TEXT NOT NULL DEFAULT 'unpaid' -- paid or unpaid  TODO make a table to hold these strings
 	, payment_id INTEGER REFERENCES payment(id) ON DELETE RESTRICT
+	, invoice_id INTEGER REFERENCES invoice(id) ON DELETE RESTRICT  -- for the event fees. NULL if the event is free
 	, created_at TIMESTAMP NOT NULL DEFAULT now()
 	, updated_at TIMESTAMP 
 	, UNIQUE (member_id, event_id)
 );
 COMMENT ON TABLE event_registration IS 'Shows a users registration for event, whether they paid, and whether they attended';
 
+CREATE FUNCTION registration_has_prerequisites() RETURNS trigger AS $$
+BEGIN
+	IF EXISTS (
+		SELECT 1 FROM event_prerequisites_rel
+		WHERE event_id = NEW.event_id AND NOT member_certified(NEW.member_id, certification_id)
+	) THEN
+		RAISE EXCEPTION 'member % does not hold the certifications event % needs', NEW.member_id, NEW.event_id
+			USING ERRCODE = 'check_violation';
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER registration_prerequisites BEFORE INSERT ON member_event_registration
+	FOR EACH ROW EXECUTE PROCEDURE registration_has_prerequisites();
+COMMENT ON TRIGGER registration_prerequisites ON member_event_registration IS 'Members can only register for events once they hold the certifications the event needs';
+
+CREATE TABLE refund_status (
+	id SERIAL PRIMARY KEY
+	, name TEXT NOT NULL
+	, UNIQUE (name)
+);
+COMMENT ON TABLE refund_status IS 'Contains the status types for a refund request';
+INSERT INTO refund_status (name) VALUES ('pending'), ('processing'), ('refunded'), ('rejected');  -- processing while the provider is refunding it
+
+CREATE TABLE refund_request (
+	id SERIAL PRIMARY KEY
+	, member_event_registration_id INTEGER NOT NULL REFERENCES member_event_registration(id) ON DELETE RESTRICT
+	, payment_id INTEGER NOT NULL REFERENCES payment(id) ON DELETE RESTRICT
+	, amount MONEY NOT NULL  -- calculated from the refund policy when the request was made
+	, reason TEXT NOT NULL DEFAULT ''
+	, status_id INTEGER NOT NULL REFERENCES refund_status(id)
+	, requested_by INTEGER NOT NULL REFERENCES member(id) ON DELETE RESTRICT
+	, decided_by INTEGER REFERENCES member(id) ON DELETE RESTRICT
+	, decision_note TEXT NOT NULL DEFAULT ''
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, decided_at TIMESTAMP
+);
+COMMENT ON TABLE refund_request IS 'A request to refund an event registration, waiting for or decided by an admin';
+
+CREATE TABLE refund (
+	id SERIAL PRIMARY KEY
+	, payment_id INTEGER NOT NULL REFERENCES payment(id) ON DELETE RESTRICT
+	, refund_request_id INTEGER REFERENCES refund_request(id) ON DELETE RESTRICT
+	, amount MONEY NOT NULL
+	, payment_method_id INTEGER NOT NULL REFERENCES payment_method(id)  -- online refunds go back through the provider, otherwise cash or check
+	, provider_ref TEXT
+	, note TEXT NOT NULL DEFAULT ''  -- e.g. check number
+	, created_by INTEGER NOT NULL REFERENCES member(id) ON DELETE RESTRICT
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, UNIQUE (provider_ref)
+);
+COMMENT ON TABLE refund IS 'Money returned to a member, always linked back to the payment it came from';
+
 CREATE TABLE event_template (
 	id SERIAL PRIMARY KEY
 	, name TEXT NOT NULL -- name of the template, defaults to name of event 
@@ -479,17 +1035,36 @@ CREATE TABLE area_reservation (
 	id SERIAL PRIMARY KEY
 	, area_id INTEGER NOT NULL REFERENCES area(id) ON DELETE RESTRICT
 	, during TSRANGE NOT NULL  -- uses timestamp range to make overlap exclusion possible
-	, event_id INTEGER NOT NULL REFERENCES event(id) ON DELETE CASCADE
+	, event_id INTEGER REFERENCES event(id) ON DELETE CASCADE  -- NULL if a member reserved it for themselves
+	, member_id INTEGER REFERENCES member(id) ON DELETE CASCADE  -- NULL if it is reserved for an event
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, CHECK ((event_id IS NULL) <> (member_id IS NULL))
 	, EXCLUDE USING gist (area_id WITH =, during WITH &&)
 );
-COMMENT ON TABLE area_reservation IS 'Reserves a room for an event during a specific time period';
--- TODO future feature: add calendars and reservations for users to reserve equipment or areas during specific times
+COMMENT ON TABLE area_reservation IS 'Reserves a room for an event, or for a member, during a specific time period';
 
 CREATE TABLE equipment_reservation (
 	id SERIAL PRIMARY KEY
 	, equipment_id INTEGER NOT NULL REFERENCES equipment(id) ON DELETE RESTRICT
 	, during TSRANGE NOT NULL    -- uses timestamp range to make overlap exclusion possible
-	, event_id INTEGER NOT NULL REFERENCES event(id) ON DELETE CASCADE
+	, event_id INTEGER REFERENCES event(id) ON DELETE CASCADE  -- NULL if a member reserved it for themselves
+	, member_id INTEGER REFERENCES member(id) ON DELETE CASCADE  -- NULL if it is reserved for an event
+	, created_at TIMESTAMP NOT NULL DEFAULT now()
+	, CHECK ((event_id IS NULL) <> (member_id IS NULL))
 	, EXCLUDE USING gist (equipment_id WITH =, during WITH &&)
 );
-COMMENT ON TABLE equipment_reservation IS 'Reserves a piece of equipment for an event during a specific time period';
+COMMENT ON TABLE equipment_reservation IS 'Reserves a piece of equipment for an event, or for a member, during a specific time period';
+
+CREATE FUNCTION equipment_in_service() RETURNS trigger AS $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM equipment JOIN equipment_status ON equipment_status.id = equipment.status_id
+		WHERE equipment.id = NEW.equipment_id AND equipment_status.name = 'available') THEN
+		RAISE EXCEPTION 'equipment % is not available to reserve', NEW.equipment_id USING ERRCODE = 'check_violation';
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER equipment_reservation_in_service BEFORE INSERT ON equipment_reservation
+	FOR EACH ROW EXECUTE PROCEDURE equipment_in_service();
+COMMENT ON TRIGGER equipment_reservation_in_service ON equipment_reservation IS 'Out of service and retired equipment cannot be reserved';
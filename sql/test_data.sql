@@ -4,11 +4,143 @@
 -- add this to the database with the following:
 -- psql <connection string> -f test_tables.sql
 
-INSERT INTO rbac_role (name) VALUES ('DEFAULT');
+INSERT INTO rbac_role (name) VALUES ('DEFAULT'), ('Treasurer'), ('Facilities');
+
+INSERT INTO rbac_role_permission_rel (rbac_role_id, rbac_permission_id)
+	SELECT rbac_role.id, rbac_permission.id FROM rbac_role, rbac_permission
+	WHERE rbac_role.name = 'Treasurer' AND (rbac_permission.name LIKE 'finance.%' OR rbac_permission.name = 'membership.write');
+
+INSERT INTO rbac_role_permission_rel (rbac_role_id, rbac_permission_id)
+	SELECT rbac_role.id, rbac_permission.id FROM rbac_role, rbac_permission
+	WHERE rbac_role.name = 'Facilities' AND (rbac_permission.name = 'space.write' OR rbac_permission.name LIKE 'certification.%');
 
 INSERT INTO member (name, username, password, dob, phone, membership_status_id, rbac_role_id) VALUES 
 ('Name One', 'email1@address.com', 'aaaaaaaa', '1970-1-1', '316-555-1234', 1, 1),
 ('Name Two', 'email2@address.com', 'aaaaaaaa', '1970-1-1', '316-555-1234', 1, 1),
 ('John Doe', 'email3@address.com', 'aaaaaaaa', '1970-1-1', '316-555-1234', 1, 1),
-('Jane Doe', 'email4@address.com', 'aaaaaaaa', '1970-1-1', '316-555-1234', 1, 1);
+('Jane Doe', 'email4@address.com', 'aaaaaaaa', '1970-1-1', '316-555-1234', 1, 1),
+('Tres Urer', 'email5@address.com', 'aaaaaaaa', '1970-1-1', '316-555-1234', 2, 2);
+
+-- Name One is on the monthly recurring option with a locker
+UPDATE member SET membership_status_id = (SELECT id FROM membership_status WHERE name = 'active'),
+	membership_option = (SELECT id FROM membership_options WHERE name = 'Recurring - monthly'),
+	membership_expires = CURRENT_DATE + 10
+WHERE id = 1;
+
+INSERT INTO member_addon_rel (member_id, addon_id, created_at) VALUES
+(1, (SELECT id FROM addon_types WHERE name = 'Locker'), now() - INTERVAL '15 days');
+
+INSERT INTO member_recurring_donation (member_id, amount) VALUES
+(1, '$10.00');
+
+INSERT INTO location (name, address_1, address_2, city, state, zip) VALUES
+('Main Space', '1873 S Bluff St', '', 'Wichita', 'KS', '67218');
+
+INSERT INTO location_hours (location_id, weekday, opens, closes) VALUES
+(1, 0, '12:00', '18:00'),
+(1, 1, '10:00', '22:00'),
+(1, 2, '10:00', '22:00'),
+(1, 3, '10:00', '22:00'),
+(1, 4, '10:00', '22:00'),
+(1, 5, '10:00', '22:00'),
+(1, 6, '10:00', '18:00');
+
+INSERT INTO location_closure (location_id, during, reason) VALUES
+(1, tsrange((CURRENT_DATE + 30)::timestamp, (CURRENT_DATE + 31)::timestamp), 'Closed for the holiday');
+
+INSERT INTO area (location_id, name, capacity, description) VALUES
+(1, 'Wood Shop', 6, 'Table saw, bandsaw, jointer and hand tools'),
+(1, 'Electronics Lab', 8, 'Soldering stations and test equipment'),
+(1, 'Classroom', 20, 'Tables, chairs and a projector for classes and meetings');
+
+INSERT INTO equipment (area_id, name, manufacturer, model, serial_number, asset_tag, purchase_price, purchased_on, status_id, brought_at) VALUES
+(1, 'SawStop Table Saw', 'SawStop', 'PCS31230-TGP236', 'PCS-0012345', 'MI-0001', '$3,199.00', CURRENT_DATE - 730, (SELECT id FROM equipment_status WHERE name = 'available'), now() - INTERVAL '2 years'),
+(1, 'Bandsaw', 'Jet', 'JWBS-14SFX', '', 'MI-0002', NULL, NULL, (SELECT id FROM equipment_status WHERE name = 'available'), NULL),
+(2, 'Rigol Oscilloscope', 'Rigol', 'DS1054Z', 'DS1ZA000000001', 'MI-0003', '$399.00', CURRENT_DATE - 365, (SELECT id FROM equipment_status WHERE name = 'out_of_service'), now() - INTERVAL '1 year');
+
+UPDATE equipment SET max_reservation_minutes = 120, advance_days = 14, member_quota = 2 WHERE id = 1;
+UPDATE area SET max_reservation_minutes = 240, advance_days = 30 WHERE id = 3;
+
+INSERT INTO equipment_move (equipment_id, from_area_id, to_area_id, note, moved_at) VALUES
+(3, 3, 2, 'Moved out of the classroom once the lab was set up', now() - INTERVAL '6 months');
+
+INSERT INTO area_steward (area_id, member_id) VALUES
+(1, 1),
+(2, 2);
+
+INSERT INTO maintenance_ticket (equipment_id, title, description, status_id, out_of_service, reported_by, assigned_to, created_at) VALUES
+(3, 'Channel 2 reads zero', 'No signal on channel 2 with a known good probe', (SELECT id FROM maintenance_status WHERE name = 'open'), 't', 1, 2, now() - INTERVAL '3 days');
+
+INSERT INTO maintenance_comment (ticket_id, member_id, body, created_at) VALUES
+(1, 2, 'Ordered a replacement input board', now() - INTERVAL '2 days');
+
+INSERT INTO maintenance_schedule (equipment_id, task, interval_days, last_done_on, next_due_on) VALUES
+(1, 'Clean and wax the table, check the blade brake cartridge', 90, CURRENT_DATE - 85, CURRENT_DATE + 5),
+(2, 'Check blade tension and tracking', 30, CURRENT_DATE - 10, CURRENT_DATE + 20);
+
+INSERT INTO certification (name, description, valid_days, approvals_required) VALUES
+('Table Saw', 'Safe use of the SawStop, including changing blades and testing the brake', 730, 2),
+('Wood Shop Safety', 'Shop rules, dust collection and hearing and eye protection', NULL, 1);
+
+INSERT INTO certification_prerequisite (certification_id, prerequisite_id) VALUES
+(1, 2);
+
+INSERT INTO certification_resource_rel (certification_id, equipment_id, area_id) VALUES
+(1, 1, NULL),
+(2, NULL, 1);
+
+INSERT INTO member_certification (member_id, certification_id, status, decided_at, expires_on) VALUES
+(1, 2, 'approved', now() - INTERVAL '710 days', NULL),
+(1, 1, 'approved', now() - INTERVAL '710 days', CURRENT_DATE + 20),
+(3, 2, 'pending', NULL, NULL);
+
+INSERT INTO certification_approval (member_certification_id, approver_id, notes) VALUES
+(1, 2, ''),
+(2, 2, 'Good blade changes'),
+(2, 3, '');
+
+INSERT INTO member_certification_history (member_certification_id, action, reason, by_id, expires_on, created_at) VALUES
+(1, 'requested', '', 1, NULL, now() - INTERVAL '711 days'),
+(1, 'approved', '', 2, NULL, now() - INTERVAL '710 days'),
+(2, 'requested', '', 1, NULL, now() - INTERVAL '711 days'),
+(2, 'approved', '', 3, CURRENT_DATE + 20, now() - INTERVAL '710 days'),
+(3, 'requested', '', 3, NULL, now());
+
+INSERT INTO equipment_reservation (equipment_id, during, member_id) VALUES
+(1, tsrange(date_trunc('day', now()) + INTERVAL '1 day 18 hours', date_trunc('day', now()) + INTERVAL '1 day 19 hours'), 1);
+
+INSERT INTO locker (locker_id, size_id) VALUES
+('1', (SELECT id FROM locker_size WHERE name = 'small')),
+('2', (SELECT id FROM locker_size WHERE name = 'small')),
+('3', (SELECT id FROM locker_size WHERE name = 'large'));
+
+INSERT INTO member_locker_rel (member_id, locker_id, assigned_at) VALUES
+(1, 1, now() - INTERVAL '15 days');
+
+INSERT INTO payment (amount, member_id, payment_method_id, check_number, created_at) VALUES
+('$40.00', 1, 1, NULL, now() - INTERVAL '40 days'),
+('$45.00', 1, 2, '1042', now() - INTERVAL '10 days'),
+('$50.00', 1, 1, NULL, now() - INTERVAL '5 days');
+
+INSERT INTO invoice (amount, description, member_id, payment_id, status_id, due_date, created_at) VALUES
+('$40.00', 'Membership dues', 1, 1, 1, CURRENT_DATE - 45, now() - INTERVAL '45 days'),
+('$45.00', 'Membership dues', 1, 2, 1, CURRENT_DATE - 15, now() - INTERVAL '15 days'),
+('$5.00', 'Locker', 1, NULL, 2, CURRENT_DATE - 8, now() - INTERVAL '15 days'),
+('$50.00', 'Gift voucher for Pat Smith', 1, 3, 1, CURRENT_DATE - 5, now() - INTERVAL '5 days');
+
+INSERT INTO invoice_line_item (invoice_id, category_id, description, quantity, unit_amount) VALUES
+(2, (SELECT id FROM line_item_category WHERE name = 'dues'), 'Membership dues', 1, '$40.00'),
+(2, (SELECT id FROM line_item_category WHERE name = 'donation'), 'Donation', 1, '$5.00'),
+(4, (SELECT id FROM line_item_category WHERE name = 'gift_voucher'), 'Gift voucher for Pat Smith', 1, '$50.00');
+
+INSERT INTO member_address (member_id, addr_type, addr1, addr2, city, state, zip) VALUES
+(1, 'home', '123 Main St', NULL, 'Wichita', 'KS', '67202'),
+(1, 'billing', 'PO Box 100', NULL, 'Wichita', 'KS', '67201');
+
+INSERT INTO discount (name, code, kind_id, percent_off, amount_off, periods, applies_to_dues, applies_to_events, max_uses, expires_on) VALUES
+('Student discount', 'STUDENT', (SELECT id FROM discount_kind WHERE name = 'percent'), 50, '$0.00', NULL, 't', 't', NULL, NULL),
+('First month $10 off', 'WELCOME10', (SELECT id FROM discount_kind WHERE name = 'fixed'), 0, '$10.00', 1, 't', 'f', 100, CURRENT_DATE + 90),
+('Volunteer comp', NULL, (SELECT id FROM discount_kind WHERE name = 'free'), 0, '$0.00', 3, 't', 'f', NULL, NULL);
 
+INSERT INTO gift_voucher (code, kind_id, amount, balance, purchaser_id, invoice_id, recipient_name, recipient_email, message, expires_on) VALUES
+('GIFT-TEST-2345', (SELECT id FROM gift_voucher_kind WHERE name = 'value'), '$50.00', '$50.00', 1, 4, 'Pat Smith', 'pat@example.com', 'Happy birthday! Make something cool.', CURRENT_DATE + 365);
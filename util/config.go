@@ -22,6 +22,70 @@ type Config struct {
 		Host string `json:"host"`
 		Port int    `json:"port"`
 	} `json:"app_settings"`
+	Payments struct {
+		Provider      string `json:"provider"` // "stripe", or "fake" for development. Anything else is an error
+		SecretKey     string `json:"secret_key"`
+		WebhookSecret string `json:"webhook_secret"`
+		Currency      string `json:"currency"`
+	} `json:"payment_settings"`
+	Org struct {
+		Name    string   `json:"name"`
+		Address []string `json:"address"` // one entry per printed line
+		Email   string   `json:"email"`
+		TaxID   string   `json:"tax_id"` // shown on donation acknowledgements
+	} `json:"org_settings"`
+	Mail struct {
+		Host     string `json:"host"` // leave empty to write messages to the log instead of sending them
+		Port     int    `json:"port"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		From     string `json:"from"`
+	} `json:"mail_settings"`
+	SMS struct {
+		Provider    string `json:"provider"` // "twilio", or empty to write messages to the log instead of sending them
+		AccountSID  string `json:"account_sid"`
+		AuthToken   string `json:"auth_token"`
+		From        string `json:"from"`
+		CountryCode string `json:"country_code"` // calling code for phone numbers stored without one, "1" if empty
+	} `json:"sms_settings"`
+	Reminders struct {
+		// Steps of the reminder schedule. Days are counted from the invoice due date, negative for before it.
+		// Each step has a template in templates/reminder named after it.
+		Steps []struct {
+			Name string `json:"name"`
+			Days int    `json:"days"`
+			SMS  bool   `json:"sms"` // also send a text to members who allow it
+		} `json:"steps"`
+		IntervalMinutes int `json:"interval_minutes"` // how often to check for reminders to send, 0 to only send them by hand
+	} `json:"reminder_settings"`
+	Billing struct {
+		RenewalDays     int    `json:"renewal_days"`     // how many days before a recurring membership ends to invoice the next period
+		IntervalMinutes int    `json:"interval_minutes"` // how often to check for renewals to invoice, 0 to only invoice them by hand
+		PauseMinDays    int    `json:"pause_min_days"`   // shortest and longest time a member can pause their membership for
+		PauseMaxDays    int    `json:"pause_max_days"`
+		PauseFee        string `json:"pause_fee"`      // charged each time a member pauses, like "10.00". Empty or 0 for no fee
+		VoucherMonths   int    `json:"voucher_months"` // how long a gift voucher can be used for after it is bought, 0 if they do not expire
+	} `json:"billing_settings"`
+	Lockers struct {
+		ClaimHours      int `json:"claim_hours"`      // how long a freed locker is held for the next member on the waitlist
+		IntervalMinutes int `json:"interval_minutes"` // how often to release lapsed lockers and offer free ones, 0 to only do it when lockers change
+	} `json:"locker_settings"`
+	Maintenance struct {
+		ReminderDays    int `json:"reminder_days"`    // how many days before preventive maintenance is due to remind the area stewards
+		IntervalMinutes int `json:"interval_minutes"` // how often to check for preventive maintenance coming due, 0 to never remind
+	} `json:"maintenance_settings"`
+	Certifications struct {
+		ReminderDays    int `json:"reminder_days"`    // how many days before a certification expires to remind the member to renew it
+		IntervalMinutes int `json:"interval_minutes"` // how often to check for certifications about to expire, 0 to never remind
+	} `json:"certification_settings"`
+	Accounting struct {
+		// Chart of accounts codes for each line item category, like "dues":"4000 Membership Dues".
+		// Categories that are not listed use the "other" account.
+		Income     map[string]string `json:"income"`
+		Receivable string            `json:"receivable"`
+		Deposit    map[string]string `json:"deposit"`    // where money is received for each payment method, like "check":"1010 Undeposited Funds"
+		MatchDays  int               `json:"match_days"` // how many days apart a payment and a bank deposit of the same amount can be and still be suggested as a match
+	} `json:"accounting_settings"`
 }
 
 // InitConfig parse configuration file and setup settings
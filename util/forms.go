@@ -6,6 +6,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -142,3 +143,22 @@ func IntOK(val string, min, max int) (int, bool) {
 	}
 	return n, true
 }
+
+//DateOK returns a date and an OK flag if the string is a date in the yyyy-mm-dd format used by date inputs
+func DateOK(val string) (time.Time, bool) {
+	t, err := time.ParseInLocation("2006-01-02", val, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+//DateTimeOK returns a time and an OK flag if the strings are a date in the yyyy-mm-dd format used by date inputs
+//and a time of day in the hh:mm format used by time inputs
+func DateTimeOK(date, clock string) (time.Time, bool) {
+	t, err := time.ParseInLocation("2006-01-02 15:04", date+" "+clock, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
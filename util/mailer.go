@@ -0,0 +1,139 @@
+package util
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Mailer sends email. Use NewMailer to get the one matching the configuration.
+type Mailer interface {
+	Send(*Message) error
+}
+
+// Message is a plain text email with optional attachments
+type Message struct {
+	To          []string
+	Subject     string
+	Body        string
+	Attachments []Attachment
+}
+
+// Attachment is a file attached to a Message
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// NewMailer returns a mailer that sends through the configured SMTP server, or one that only logs
+// messages if no server is configured, which is convenient for development.
+func NewMailer(cfg *Config, l *Logger) Mailer {
+	if cfg.Mail.Host == "" {
+		return &LogMailer{Logger: l}
+	}
+	return &SMTPMailer{
+		Addr: fmt.Sprintf("%s:%d", cfg.Mail.Host, cfg.Mail.Port),
+		Host: cfg.Mail.Host,
+		User: cfg.Mail.Username,
+		Pass: cfg.Mail.Password,
+		From: cfg.Mail.From,
+	}
+}
+
+// SMTPMailer sends email through an SMTP server, authenticating if a username is set
+type SMTPMailer struct {
+	Addr string
+	Host string
+	User string
+	Pass string
+	From string
+}
+
+// Send delivers the message
+func (sm *SMTPMailer) Send(m *Message) error {
+	from, err := mail.ParseAddress(sm.From)
+	if err != nil {
+		return fmt.Errorf("Invalid from address: %v", err)
+	}
+	body, err := m.bytes(sm.From)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if sm.User != "" {
+		auth = smtp.PlainAuth("", sm.User, sm.Pass, sm.Host)
+	}
+	if err := smtp.SendMail(sm.Addr, auth, from.Address, m.To, body); err != nil {
+		return fmt.Errorf("Could not send email: %v", err)
+	}
+	return nil
+}
+
+// LogMailer writes a summary of each message to the log instead of sending it
+type LogMailer struct {
+	Logger *Logger
+}
+
+// Send logs the message
+func (lm *LogMailer) Send(m *Message) error {
+	names := make([]string, len(m.Attachments))
+	for i, a := range m.Attachments {
+		names[i] = fmt.Sprintf("%s (%d bytes)", a.Filename, len(a.Data))
+	}
+	lm.Logger.Printf("email not sent, no mail server configured. To: %s Subject: %q Attachments: %s\n%s",
+		strings.Join(m.To, ", "), m.Subject, strings.Join(names, ", "), m.Body)
+	return nil
+}
+
+// bytes builds the MIME encoded message
+func (m *Message) bytes(from string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	pw.Write([]byte(strings.Replace(m.Body, "\n", "\r\n", -1)))
+
+	for _, a := range m.Attachments {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		enc := base64.StdEncoding.EncodeToString(a.Data)
+		// base64 bodies must be wrapped at 76 characters
+		for len(enc) > 76 {
+			fmt.Fprintf(pw, "%s\r\n", enc[:76])
+			enc = enc[76:]
+		}
+		fmt.Fprintf(pw, "%s\r\n", enc)
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,497 @@
+package util
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PDF page size (US Letter) and margins, in points
+const (
+	pdfWidth  = 612.0
+	pdfHeight = 792.0
+	pdfMargin = 54.0
+)
+
+// PDF builds simple flowing documents (headings, wrapped text, rules and tables) using the standard
+// Helvetica fonts, so that no font files or third party libraries are needed.
+// Content is added top to bottom and new pages are started automatically.
+type PDF struct {
+	pages  []*bytes.Buffer
+	page   *bytes.Buffer
+	y      float64 // distance from the top of the page to the next line
+	images []pdfImage
+}
+
+// pdfImage is an image converted to compressed RGB, ready to embed
+type pdfImage struct {
+	width, height int
+	data          []byte
+}
+
+// PDFColumn describes one column of a table. Width is a fraction of the printable width.
+type PDFColumn struct {
+	Title string
+	Width float64
+	Right bool
+}
+
+// NewPDF returns a document with one empty page
+func NewPDF() *PDF {
+	p := &PDF{}
+	p.AddPage()
+	return p
+}
+
+// AddPage starts a new page
+func (p *PDF) AddPage() {
+	p.page = &bytes.Buffer{}
+	p.pages = append(p.pages, p.page)
+	p.y = pdfMargin
+}
+
+// ensure starts a new page if there is less than h points left on the current one
+func (p *PDF) ensure(h float64) bool {
+	if p.y+h > pdfHeight-pdfMargin {
+		p.AddPage()
+		return true
+	}
+	return false
+}
+
+// Space moves down the page
+func (p *PDF) Space(h float64) {
+	p.y += h
+}
+
+// Heading writes a line of large bold text
+func (p *PDF) Heading(s string) {
+	p.ensure(24)
+	p.y += 18
+	p.textAt(pdfMargin, p.y, 16, true, s)
+	p.y += 8
+}
+
+// Subheading writes a line of medium bold text
+func (p *PDF) Subheading(s string) {
+	p.ensure(18)
+	p.y += 13
+	p.textAt(pdfMargin, p.y, 12, true, s)
+	p.y += 5
+}
+
+// Text writes a paragraph, wrapping it to the width of the page. Newlines start a new line.
+func (p *PDF) Text(s string) {
+	p.paragraph(s, 10, false)
+}
+
+// BoldText writes a paragraph in bold
+func (p *PDF) BoldText(s string) {
+	p.paragraph(s, 10, true)
+}
+
+func (p *PDF) paragraph(s string, size float64, bold bool) {
+	for _, line := range strings.Split(s, "\n") {
+		for _, l := range wrapText(line, pdfWidth-2*pdfMargin, size, bold) {
+			p.ensure(size + 4)
+			p.y += size + 2
+			p.textAt(pdfMargin, p.y, size, bold, l)
+		}
+	}
+	p.y += 4
+}
+
+// Rule draws a horizontal line across the page
+func (p *PDF) Rule() {
+	p.ensure(8)
+	p.y += 4
+	p.lineAt(pdfMargin, p.y, pdfWidth-pdfMargin, p.y)
+	p.y += 4
+}
+
+// Table writes a header row and data rows. The header is repeated at the top of every page the table spans.
+// Rows whose first cell starts with "*" are written in bold, without the asterisk, which is useful for totals.
+func (p *PDF) Table(cols []PDFColumn, rows [][]string) {
+	const size = 9.0
+	const rowHeight = size + 5
+
+	header := func() {
+		p.y += rowHeight
+		p.cells(cols, nil, size, true)
+		p.lineAt(pdfMargin, p.y+3, pdfWidth-pdfMargin, p.y+3)
+		p.y += 2
+	}
+
+	p.ensure(2 * rowHeight)
+	header()
+	for _, row := range rows {
+		if p.ensure(rowHeight) {
+			header()
+		}
+		p.y += rowHeight
+		bold := false
+		if len(row) > 0 && strings.HasPrefix(row[0], "*") {
+			bold = true
+			row = append([]string{strings.TrimPrefix(row[0], "*")}, row[1:]...)
+		}
+		p.cells(cols, row, size, bold)
+	}
+	p.y += 6
+}
+
+// cells writes one table row at the current line. A nil row writes the column titles.
+func (p *PDF) cells(cols []PDFColumn, row []string, size float64, bold bool) {
+	width := pdfWidth - 2*pdfMargin
+	x := pdfMargin
+	for i, c := range cols {
+		w := c.Width * width
+		s := c.Title
+		if row != nil {
+			s = ""
+			if i < len(row) {
+				s = row[i]
+			}
+		}
+		s = truncateText(s, w-4, size, bold)
+		if c.Right {
+			p.textAt(x+w-textWidth(s, size, bold)-2, p.y, size, bold, s)
+		} else {
+			p.textAt(x+2, p.y, size, bold, s)
+		}
+		x += w
+	}
+}
+
+// Image draws an image at the left margin, scaled to width points wide. Transparent areas are drawn white.
+func (p *PDF) Image(img image.Image, width float64) {
+	b := img.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return
+	}
+	height := width * float64(b.Dy()) / float64(b.Dx())
+
+	raw := &bytes.Buffer{}
+	zw := zlib.NewWriter(raw)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			// colors are premultiplied by alpha, so adding the missing white gives the color over a white page
+			white := 0xffff - a
+			zw.Write([]byte{byte((r + white) >> 8), byte((g + white) >> 8), byte((bl + white) >> 8)})
+		}
+	}
+	zw.Close()
+
+	p.images = append(p.images, pdfImage{width: b.Dx(), height: b.Dy(), data: raw.Bytes()})
+
+	p.ensure(height)
+	fmt.Fprintf(p.page, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", width, height, pdfMargin, pdfHeight-p.y-height, len(p.images))
+	p.y += height + 4
+}
+
+// textAt writes a string with its baseline y points from the top of the page
+func (p *PDF) textAt(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(p.page, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, pdfHeight-y, pdfEscape(s))
+}
+
+// lineAt draws a thin line between two points measured from the top of the page
+func (p *PDF) lineAt(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(p.page, "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, pdfHeight-y1, x2, pdfHeight-y2)
+}
+
+// WriteTo writes the finished document
+func (p *PDF) WriteTo(w io.Writer) (int64, error) {
+	out := &bytes.Buffer{}
+	var offsets []int
+
+	obj := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+
+	// objects 1-4 are the catalog, page tree and fonts, followed by one object per image.
+	// Each page then takes two objects: the page and its content.
+	firstPage := 5 + len(p.images)
+	kids := make([]string, len(p.pages))
+	for i := range p.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	xobjects := make([]string, len(p.images))
+	for i := range p.images {
+		xobjects[i] = fmt.Sprintf("/Im%d %d 0 R", i+1, 5+i)
+	}
+
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for _, img := range p.images {
+		obj(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream",
+			img.width, img.height, len(img.data), img.data))
+	}
+	for i, pg := range p.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> /XObject << %s >> >> /Contents %d 0 R >>",
+			pdfWidth, pdfHeight, strings.Join(xobjects, " "), firstPage+2*i+1))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", pg.Len(), pg.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(out, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return out.WriteTo(w)
+}
+
+// Markup adds content described by a small line based markup language, so that documents can be laid out
+// with text templates instead of code. Each line is one of:
+//
+//	# Heading
+//	## Subheading
+//	! bold paragraph
+//	---                      a horizontal rule
+//	[image name 120]         an image from images, 120 points wide
+//	[space 12]               12 points of empty space
+//	[table 55 10:r 15:r 20:r] starts a table with column widths in percent, :r aligns right.
+//	| a | b | c | d |        a table row. The first row is the header. Ends at a line that is not a row.
+//	anything else            a paragraph. Blank lines add a little space.
+//
+// A backslash makes the character after it plain text, so \[x] is a paragraph reading [x]. Use EscapeMarkup on
+// anything members type, so that it can never be read as markup.
+func (p *PDF) Markup(src string, images map[string]image.Image) error {
+	var cols []PDFColumn
+	var rows [][]string
+
+	flush := func() {
+		if cols != nil && len(rows) > 0 {
+			for i := range cols {
+				if i < len(rows[0]) {
+					cols[i].Title = rows[0][i]
+				}
+			}
+			p.Table(cols, rows[1:])
+		}
+		cols, rows = nil, nil
+	}
+
+	for n, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+
+		if cols != nil {
+			if strings.HasPrefix(line, "|") {
+				cells := strings.Split(strings.Trim(line, "|"), "|")
+				for i := range cells {
+					cells[i] = strings.TrimSpace(cells[i])
+					// a leading * is kept for Table to find, the rest is plain text
+					if i == 0 && strings.HasPrefix(cells[i], "*") {
+						cells[i] = "*" + unescapeMarkup(cells[i][1:])
+					} else {
+						cells[i] = unescapeMarkup(cells[i])
+					}
+				}
+				rows = append(rows, cells)
+				continue
+			}
+			flush()
+		}
+
+		switch {
+		case line == "":
+			p.Space(4)
+		case line == "---":
+			p.Rule()
+		case strings.HasPrefix(line, "## "):
+			p.Subheading(unescapeMarkup(strings.TrimPrefix(line, "## ")))
+		case strings.HasPrefix(line, "# "):
+			p.Heading(unescapeMarkup(strings.TrimPrefix(line, "# ")))
+		case strings.HasPrefix(line, "! "):
+			p.BoldText(unescapeMarkup(strings.TrimPrefix(line, "! ")))
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			args := strings.Fields(strings.Trim(line, "[]"))
+			if err := p.directive(args, images, &cols); err != nil {
+				return fmt.Errorf("line %d: %v", n+1, err)
+			}
+		default:
+			p.Text(unescapeMarkup(line))
+		}
+	}
+	flush()
+	return nil
+}
+
+// markupSpecial are the characters that mean something in markup, and the backslash that escapes them
+const markupSpecial = `\[]#!-|*`
+
+// EscapeMarkup makes text safe to put in markup, wherever it goes on a line: each character that means something
+// in markup gets a backslash in front, so a name like "[x]" or "# 1" is printed as it is
+func EscapeMarkup(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(markupSpecial, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// unescapeMarkup removes the backslashes added by EscapeMarkup
+func unescapeMarkup(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	escaped := false
+	for _, r := range s {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// directive handles the [bracketed] markup lines
+func (p *PDF) directive(args []string, images map[string]image.Image, cols *[]PDFColumn) error {
+	if len(args) == 0 {
+		return fmt.Errorf("empty directive")
+	}
+	switch args[0] {
+	case "image":
+		if len(args) != 3 {
+			return fmt.Errorf("image needs a name and a width")
+		}
+		w, err := strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			return fmt.Errorf("bad image width %q", args[2])
+		}
+		img, ok := images[args[1]]
+		if !ok {
+			return fmt.Errorf("no image named %q", args[1])
+		}
+		p.Image(img, w)
+	case "space":
+		if len(args) != 2 {
+			return fmt.Errorf("space needs a height")
+		}
+		h, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return fmt.Errorf("bad space height %q", args[1])
+		}
+		p.Space(h)
+	case "table":
+		*cols = []PDFColumn{}
+		for _, c := range args[1:] {
+			parts := strings.SplitN(c, ":", 2)
+			pct, err := strconv.ParseFloat(parts[0], 64)
+			if err != nil {
+				return fmt.Errorf("bad column width %q", c)
+			}
+			*cols = append(*cols, PDFColumn{Width: pct / 100, Right: len(parts) == 2 && parts[1] == "r"})
+		}
+	default:
+		return fmt.Errorf("unknown directive %q", args[0])
+	}
+	return nil
+}
+
+// pdfEscape makes a string safe to use inside a PDF literal string. Characters outside of Latin-1 are replaced.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteByte(' ')
+		case r < 32:
+		case r < 256:
+			b.WriteByte(byte(r))
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// wrapText splits a line into pieces no wider than width
+func wrapText(s string, width, size float64, bold bool) []string {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return []string{""}
+	}
+	var lines []string
+	line := words[0]
+	for _, w := range words[1:] {
+		if textWidth(line+" "+w, size, bold) > width {
+			lines = append(lines, line)
+			line = w
+			continue
+		}
+		line += " " + w
+	}
+	return append(lines, line)
+}
+
+// truncateText shortens a string with an ellipsis so that it fits in width
+func truncateText(s string, width, size float64, bold bool) string {
+	if textWidth(s, size, bold) <= width {
+		return s
+	}
+	r := []rune(s)
+	for len(r) > 0 && textWidth(string(r)+"...", size, bold) > width {
+		r = r[:len(r)-1]
+	}
+	return string(r) + "..."
+}
+
+// textWidth measures a string in points using the Helvetica font metrics
+func textWidth(s string, size float64, bold bool) float64 {
+	widths := helveticaWidths
+	if bold {
+		widths = helveticaBoldWidths
+	}
+	total := 0
+	for _, r := range s {
+		if r >= 32 && r <= 126 {
+			total += widths[r-32]
+		} else {
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// character widths for ASCII 32-126, from the Adobe font metrics for Helvetica and Helvetica-Bold
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+var helveticaBoldWidths = [95]int{
+	278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+	975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+	333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+	611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+}
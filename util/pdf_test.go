@@ -0,0 +1,49 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMarkupEmptyDirective(t *testing.T) {
+	for _, src := range []string{"[]", "[ ]", "[x]"} {
+		if err := NewPDF().Markup(src, nil); err == nil {
+			t.Errorf("Markup(%q) did not return an error", src)
+		}
+	}
+}
+
+func TestEscapeMarkupIsPlainText(t *testing.T) {
+	names := []string{
+		"[]",
+		"[x]",
+		"[image logo 80]",
+		"# Bob",
+		"## Bob",
+		"! Bob",
+		"---",
+		"| a | b |",
+		"*Total",
+		`back\slash`,
+		`trailing\`,
+		"Pat O'Brien (Treasurer)",
+	}
+	for _, name := range names {
+		if got := unescapeMarkup(EscapeMarkup(name)); got != name {
+			t.Errorf("unescapeMarkup(EscapeMarkup(%q)) = %q", name, got)
+		}
+
+		doc := NewPDF()
+		if err := doc.Markup(EscapeMarkup(name), nil); err != nil {
+			t.Errorf("Markup(EscapeMarkup(%q)) returned %v", name, err)
+			continue
+		}
+		out := &bytes.Buffer{}
+		if _, err := doc.WriteTo(out); err != nil {
+			t.Fatal(err)
+		}
+		if want := "(" + pdfEscape(name) + ") Tj"; !bytes.Contains(out.Bytes(), []byte(want)) {
+			t.Errorf("Markup(EscapeMarkup(%q)) did not print %s", name, want)
+		}
+	}
+}
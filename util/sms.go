@@ -0,0 +1,125 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Texter sends text messages. Use NewTexter to get the one matching the configuration.
+type Texter interface {
+	SendText(to, body string) error
+}
+
+// NormalizePhone turns a phone number as members type it, like "316-555-1234" or "(316) 555 1234", into the
+// E.164 form text providers need, like "+13165551234". Numbers without a leading + or 00 are taken to be in the
+// country with the calling code given, "1" if it is empty. Returns false if it is not a phone number.
+func NormalizePhone(phone, countryCode string) (string, bool) {
+	if countryCode == "" {
+		countryCode = "1"
+	}
+	phone = strings.TrimSpace(phone)
+	international := strings.HasPrefix(phone, "+")
+
+	var digits strings.Builder
+	for _, r := range phone {
+		switch {
+		case unicode.IsDigit(r):
+			digits.WriteRune(r)
+		case strings.ContainsRune(" -.()/+", r):
+		default:
+			return "", false
+		}
+	}
+	d := digits.String()
+
+	switch {
+	case international:
+	case strings.HasPrefix(d, "00"):
+		d = d[2:]
+	case countryCode == "1" && len(d) == 11 && d[0] == '1':
+	case countryCode == "1":
+		if len(d) != 10 {
+			return "", false
+		}
+		d = "1" + d
+	default:
+		// numbers dialled within the country often start with a trunk 0 that is left out internationally
+		d = countryCode + strings.TrimPrefix(d, "0")
+	}
+
+	if len(d) < 8 || len(d) > 15 || d[0] == '0' {
+		return "", false
+	}
+	return "+" + d, true
+}
+
+// NewTexter returns a texter that sends through the configured provider, or one that only logs
+// messages if no provider is configured.
+func NewTexter(cfg *Config, l *Logger) Texter {
+	if cfg.SMS.Provider == "twilio" {
+		return &TwilioTexter{
+			AccountSID:  cfg.SMS.AccountSID,
+			AuthToken:   cfg.SMS.AuthToken,
+			From:        cfg.SMS.From,
+			CountryCode: cfg.SMS.CountryCode,
+			client:      &http.Client{Timeout: 20 * time.Second},
+		}
+	}
+	return &LogTexter{Logger: l}
+}
+
+// TwilioTexter sends text messages through the Twilio REST API
+type TwilioTexter struct {
+	AccountSID  string
+	AuthToken   string
+	From        string
+	CountryCode string // for numbers without one, see NormalizePhone
+	client      *http.Client
+}
+
+// SendText delivers the message. Twilio only accepts numbers in E.164 form, so the number is normalized first.
+func (tt *TwilioTexter) SendText(to, body string) error {
+	number, ok := NormalizePhone(to, tt.CountryCode)
+	if !ok {
+		return fmt.Errorf("Could not send text: %q is not a phone number", to)
+	}
+	form := url.Values{}
+	form.Set("To", number)
+	form.Set("From", tt.From)
+	form.Set("Body", body)
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", tt.AccountSID), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(tt.AccountSID, tt.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := tt.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not send text: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Could not send text: %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+// LogTexter writes each message to the log instead of sending it
+type LogTexter struct {
+	Logger *Logger
+}
+
+// SendText logs the message
+func (lt *LogTexter) SendText(to, body string) error {
+	lt.Logger.Printf("text not sent, no sms provider configured. To: %s\n%s", to, body)
+	return nil
+}
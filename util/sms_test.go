@@ -0,0 +1,33 @@
+package util
+
+import "testing"
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		phone       string
+		countryCode string
+		want        string
+		ok          bool
+	}{
+		{"316-555-1234", "", "+13165551234", true},
+		{"(316) 555 1234", "1", "+13165551234", true},
+		{"316.555.1234", "1", "+13165551234", true},
+		{"1-316-555-1234", "1", "+13165551234", true},
+		{"+1 316 555 1234", "1", "+13165551234", true},
+		{"+44 20 7946 0958", "1", "+442079460958", true},
+		{"0044 20 7946 0958", "1", "+442079460958", true},
+		{"020 7946 0958", "44", "+442079460958", true},
+		{"555-1234", "1", "", false},
+		{"316-555-12345", "1", "", false},
+		{"call me", "1", "", false},
+		{"316-555-1234 x2", "1", "", false},
+		{"", "1", "", false},
+		{"+0 316 555 1234", "1", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := NormalizePhone(tt.phone, tt.countryCode)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("NormalizePhone(%q, %q) = %q, %v; want %q, %v", tt.phone, tt.countryCode, got, ok, tt.want, tt.ok)
+		}
+	}
+}
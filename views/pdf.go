@@ -0,0 +1,97 @@
+package views
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/makeict/MESSforMakers/util"
+)
+
+// PDFView renders printable documents. Templates are text templates in templates/pdf/*.gotmpl that
+// produce the markup understood by util.PDF.Markup, so documents can be changed without touching code.
+type PDFView struct {
+	TemplateCache map[string]*template.Template
+	Images        map[string]image.Image
+}
+
+// pdfFuncs are available in every PDF template. Use them on anything members type, so it is always printed as
+// plain text and never read as markup.
+var pdfFuncs = template.FuncMap{
+	// cell makes a value safe to put in a table row. Rows are split on every |, so those become /.
+	"cell": func(v interface{}) string {
+		return util.EscapeMarkup(strings.Replace(oneLine.Replace(fmt.Sprint(v)), "|", "/", -1))
+	},
+	// line makes a value safe to put anywhere on a line
+	"line": func(v interface{}) string {
+		return util.EscapeMarkup(oneLine.Replace(fmt.Sprint(v)))
+	},
+}
+
+// oneLine keeps a value on the line it is put on
+var oneLine = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+// LoadTemplates loads the PDF templates and the images they can use. The logo is available as "logo".
+func (v *PDFView) LoadTemplates() error {
+	tc := map[string]*template.Template{}
+
+	pages, err := filepath.Glob("templates/pdf/*.gotmpl")
+	if err != nil {
+		return fmt.Errorf("could not find pdf templates: %v", err)
+	}
+	for _, p := range pages {
+		n := filepath.Base(p)
+		t, err := template.New(n).Funcs(pdfFuncs).ParseFiles(p)
+		if err != nil {
+			return fmt.Errorf("could not create pdf template: %v", err)
+		}
+		t, err = t.ParseGlob("templates/pdf/include/*.gotmpl")
+		if err != nil {
+			return fmt.Errorf("could not create pdf include templates: %v", err)
+		}
+		tc[n] = t
+	}
+	v.TemplateCache = tc
+
+	f, err := os.Open("assets/images/logo-primary.png")
+	if err != nil {
+		return fmt.Errorf("could not open logo: %v", err)
+	}
+	defer f.Close()
+	logo, err := png.Decode(f)
+	if err != nil {
+		return fmt.Errorf("could not decode logo: %v", err)
+	}
+	v.Images = map[string]image.Image{"logo": logo}
+
+	return nil
+}
+
+// Render executes a template and returns the finished PDF
+func (v *PDFView) Render(page string, data interface{}) ([]byte, error) {
+	t, ok := v.TemplateCache[page]
+	if !ok {
+		return nil, fmt.Errorf("no pdf template named %s", page)
+	}
+
+	src := &bytes.Buffer{}
+	if err := t.ExecuteTemplate(src, page, data); err != nil {
+		return nil, err
+	}
+
+	doc := util.NewPDF()
+	if err := doc.Markup(src.String(), v.Images); err != nil {
+		return nil, fmt.Errorf("could not lay out %s: %v", page, err)
+	}
+
+	out := &bytes.Buffer{}
+	if _, err := doc.WriteTo(out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
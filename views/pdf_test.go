@@ -0,0 +1,94 @@
+package views
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/makeict/MESSforMakers/models"
+)
+
+func TestPDFHostileNames(t *testing.T) {
+	// templates are loaded relative to the repository root
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir("views")
+
+	v := &PDFView{}
+	if err := v.LoadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	org := struct {
+		Name    string
+		Address []string
+		Email   string
+	}{"MakeICT", []string{"1349 S Sylvan"}, "info@example.com"}
+
+	names := []string{"[]", "[x]", "[image logo 80]", "# Bob", "---", "| a | b |", "*Total", "Bob\n[x]"}
+	for _, name := range names {
+		data := map[string]interface{}{
+			"Root":   "https://example.com/",
+			"Org":    org,
+			"Member": &models.User{Name: name},
+			"Invoice": &models.Invoice{
+				ID:        1,
+				Status:    "unpaid",
+				CreatedAt: time.Now(),
+				DueDate:   time.Now(),
+				Lines:     []models.InvoiceLine{{Description: name, Quantity: 1}},
+			},
+		}
+		out, err := v.Render("invoice.gotmpl", data)
+		if err != nil {
+			t.Errorf("invoice for %q: %v", name, err)
+			continue
+		}
+		// the name is billed to on a line of its own, exactly as typed
+		if want := "(" + oneLine.Replace(name) + ") Tj"; !bytes.Contains(out, []byte(want)) {
+			t.Errorf("invoice for %q did not print %s", name, want)
+		}
+	}
+}
+
+func TestVoucherPDFHostileText(t *testing.T) {
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir("views")
+
+	v := &PDFView{}
+	if err := v.LoadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	event := "[]"
+	for _, text := range []string{"[]", "[x]", "# Happy birthday", "---", "| a |", "*hugs*", "Love,\n[image logo 80]"} {
+		data := map[string]interface{}{
+			"Root": "https://example.com/",
+			"Org": struct {
+				Name, Email string
+				Address     []string
+			}{Name: "MakeICT"},
+			"Voucher": &models.Voucher{
+				Code:          "ABCD-1234",
+				Kind:          "event",
+				Event:         &event,
+				Paid:          true,
+				RecipientName: text,
+				Purchaser:     text,
+				Message:       text,
+			},
+		}
+		out, err := v.Render("voucher.gotmpl", data)
+		if err != nil {
+			t.Errorf("voucher for %q: %v", text, err)
+			continue
+		}
+		if want := "(\"" + oneLine.Replace(text) + "\") Tj"; !bytes.Contains(out, []byte(want)) {
+			t.Errorf("voucher for %q did not print %s", text, want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package views
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// TextView renders plain text such as email and text message bodies. Templates are text templates in
+// templates/<folder>/*.gotmpl, and each one defines the blocks it needs, e.g. "subject" and "body".
+type TextView struct {
+	TemplateCache map[string]*template.Template
+}
+
+// LoadTemplates loads the text templates in a folder
+func (v *TextView) LoadTemplates(f string) error {
+	tc := map[string]*template.Template{}
+
+	pages, err := filepath.Glob(fmt.Sprintf("templates/%s/*.gotmpl", f))
+	if err != nil {
+		return fmt.Errorf("could not find text templates: %v", err)
+	}
+	for _, p := range pages {
+		n := filepath.Base(p)
+		t, err := template.New(n).ParseFiles(p)
+		if err != nil {
+			return fmt.Errorf("could not create text template: %v", err)
+		}
+		tc[n] = t
+	}
+	v.TemplateCache = tc
+
+	return nil
+}
+
+// Has reports whether a template was loaded
+func (v *TextView) Has(page string) bool {
+	_, ok := v.TemplateCache[page]
+	return ok
+}
+
+// Render executes one block of a template, trimming surrounding whitespace
+func (v *TextView) Render(page, block string, data interface{}) (string, error) {
+	t, ok := v.TemplateCache[page]
+	if !ok {
+		return "", fmt.Errorf("no text template named %s", page)
+	}
+	buf := &bytes.Buffer{}
+	if err := t.ExecuteTemplate(buf, block, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}